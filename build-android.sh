@@ -17,7 +17,7 @@ export CC=$PWD/arm-linux-musleabihf-cross/bin/arm-linux-musleabihf-gcc
 export CXX=$PWD/arm-linux-musleabihf-cross/bin/arm-linux-musleabihf-g++
 
 # Build static binary for Android
-go build -ldflags="-s -w -extldflags=-static" -o tun-android tun-optimized.go
+go build -ldflags="-s -w -extldflags=-static" -o tun-android ./cmd/l3tunnel
 
 # Verify it's static ARM
 file tun-android
@@ -2,7 +2,7 @@
 
 set -e
 
-echo "Building tun-optimized for Huawei E3372H..."
+echo "Building l3tunnel for Huawei E3372H..."
 
 # Use buildx for proper ARM cross-compilation
 docker buildx build --platform linux/arm/v7 -t tun-builder . -f - <<EOF
@@ -12,7 +12,7 @@ WORKDIR /app
 COPY . .
 RUN CGO_ENABLED=1 GOOS=linux GOARCH=arm GOARM=7 \
     go build -ldflags="-s -w -extldflags=-static" \
-    -gcflags="-l=4" -o tun-e3372h tun-optimized.go
+    -gcflags="-l=4" -o tun-e3372h ./cmd/l3tunnel
 EOF
 
 # Extract binary from container
@@ -31,4 +31,4 @@ echo "  ✅ Memory optimized for 41MB RAM"
 echo ""
 echo "Deploy to E3372H:"
 echo "  scp tun-e3372h root@192.168.24.1:/tmp/"
-echo "  ssh root@192.168.24.1 '/tmp/tun-e3372h vps.domain.com:443'"
\ No newline at end of file
+echo "  ssh root@192.168.24.1 '/tmp/tun-e3372h -uuid <uuid> -profile e3372h vps.domain.com:443'"
\ No newline at end of file
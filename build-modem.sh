@@ -2,7 +2,7 @@
 
 set -e
 
-echo "Building tun-modem (ARMv7 with embedded TUN module)..."
+echo "Building l3tunnel (ARMv7 with embedded TUN module)..."
 
 # Build ARMv7 static binary with embedded tun.ko
 export CGO_ENABLED=1
@@ -10,7 +10,7 @@ export GOOS=linux
 export GOARCH=arm
 export GOARM=7
 
-go build -ldflags="-s -w" -o tun-modem tun-modem.go
+go build -ldflags="-s -w" -o tun-modem ./cmd/l3tunnel
 
 SIZE=$(du -h tun-modem | cut -f1)
 echo "Modem-ready binary created: tun-modem ($SIZE)"
@@ -25,4 +25,4 @@ echo ""
 echo "Deploy to modem:"
 echo "  scp tun-modem root@192.168.24.1:/tmp/"
 echo "  ssh root@192.168.24.1 'chmod +x /tmp/tun-modem'"
-echo "  ssh root@192.168.24.1 '/tmp/tun-modem vps.domain.com:443'"
\ No newline at end of file
+echo "  ssh root@192.168.24.1 '/tmp/tun-modem -uuid <uuid> -profile e3372h vps.domain.com:443'"
\ No newline at end of file
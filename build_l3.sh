@@ -10,14 +10,16 @@ export CGO_ENABLED=1
 go mod tidy
 
 # Build with minimal size
-go build -ldflags "-s -w" -trimpath -o tun-l3 tun-l3.go
+go build -ldflags "-s -w" -trimpath -o tun-l3 ./cmd/l3tunnel
+go build -ldflags "-s -w" -trimpath -o l3gateway ./cmd/l3gateway
 
 SIZE=$(du -h tun-l3 | cut -f1)
 echo "tun-l3 binary created: tun-l3 ($SIZE)"
+echo "Gateway server for the VPS: l3gateway (see vps-config.md)"
 
 echo ""
 echo "Full L3 tunnel with VLESS+WS/TLS ready!"
-echo "Usage: sudo ./tun-l3 <vps.domain.com:443>"
+echo "Usage: sudo ./tun-l3 [-config l3tunnel.json] [-uuid <uuid>] [-profile generic] <vps.domain.com:443>"
 echo ""
 echo "Features:"
 echo "✅ Raw IP packet forwarding (QUIC/HTTP3 preserved)"
@@ -10,7 +10,7 @@ export CGO_ENABLED=1
 
 # Build the simplified binary
 echo "Compiling tun-simpl..."
-go build -ldflags "-s -w" -trimpath -o tun-simpl tun-simpl.go
+go build -ldflags "-s -w" -trimpath -o tun-simpl ./cmd/tun-simpl
 
 # Get binary size
 SIZE=$(du -h tun-simpl | cut -f1)
@@ -18,5 +18,5 @@ echo "tun-simpl binary created: tun-simpl ($SIZE)"
 
 echo "Build completed successfully!"
 echo ""
-echo "Usage: sudo ./tun-simpl <vps_address:port>"
+echo "Usage: sudo ./tun-simpl <vps_address:port> <uuid>"
 echo "Example: sudo ./tun-simpl 1.2.3.4:443"
\ No newline at end of file
@@ -0,0 +1,83 @@
+// Command l3gateway runs the gateway server of the L3 tunnel: packets of the clients are written to the TUN device
+// and leave the server with NAT, replies are sent back to the clients.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/goxray/tun/pkg/l3tunnel"
+)
+
+var usage = `usage: %s [flags]
+
+flags:
+`
+
+var (
+	configFile = flag.String("config", "", "JSON config file of the gateway")
+	listen     = flag.String("listen", "", "listen address, overrides \"listen\" of the config file")
+	stream     = flag.String("stream-listen", "", "stream listener address, overrides \"stream_listen\" of the config file")
+	users      = flag.String("uuid", "", "comma separated VLESS user IDs of the clients, added to \"users\" of the config file")
+	wan        = flag.String("wan", "", "WAN interface for NAT, overrides \"wan_interface\" of the config file")
+	verbose    = flag.Bool("verbose", false, "debug logging")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), usage, os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	level := slog.LevelInfo
+	if *verbose {
+		level = slog.LevelDebug
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+
+	cfg := &l3tunnel.GatewayConfig{}
+	if *configFile != "" {
+		var err error
+		if cfg, err = l3tunnel.LoadGatewayConfig(*configFile); err != nil {
+			logger.Error("config load failed", "err", err)
+			os.Exit(1)
+		}
+	}
+	if *listen != "" {
+		cfg.Listen = *listen
+	}
+	if *stream != "" {
+		cfg.StreamListen = *stream
+	}
+	if *users != "" {
+		cfg.Users = append(cfg.Users, strings.Split(*users, ",")...)
+	}
+	if *wan != "" {
+		cfg.WANInterface = *wan
+	}
+	if len(cfg.Users) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	cfg.Logger = logger
+
+	gw, err := l3tunnel.NewGateway(*cfg)
+	if err != nil {
+		logger.Error("gateway setup failed", "err", err)
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err = gw.Run(ctx); err != nil {
+		logger.Error("gateway failed", "err", err)
+		os.Exit(1)
+	}
+}
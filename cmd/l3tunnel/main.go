@@ -0,0 +1,104 @@
+// Command l3tunnel runs the L3 tunnel: all IPv4 traffic of the device is carried to the gateway server as raw IP packets.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/goxray/tun/pkg/l3tunnel"
+)
+
+var usage = `usage: %s [flags] [server]
+  - server - gateway server address (host:port) or vless:// link with WebSocket transport,
+    overrides "server" of the config file (the link overrides the UUID and WebSocket settings too)
+
+Device profiles: %s.
+Send SIGUSR1 to the running process to log round-trip time of the link to the server.
+
+flags:
+`
+
+var (
+	configFile = flag.String("config", "", "JSON config file with the server, device profile and custom profiles")
+	uuid       = flag.String("uuid", "", "VLESS user ID, overrides \"uuid\" of the config file")
+	profile    = flag.String("profile", "", "device profile, overrides \"profile\" of the config file")
+	verbose    = flag.Bool("verbose", false, "debug logging")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), usage, os.Args[0], strings.Join(l3tunnel.BuiltinProfiles(), ", "))
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	level := slog.LevelInfo
+	if *verbose {
+		level = slog.LevelDebug
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+
+	cfg := &l3tunnel.Config{}
+	if *configFile != "" {
+		var err error
+		if cfg, err = l3tunnel.LoadConfig(*configFile); err != nil {
+			logger.Error("config load failed", "err", err)
+			os.Exit(1)
+		}
+	}
+	if arg := flag.Arg(0); strings.HasPrefix(arg, "vless://") {
+		if err := cfg.ApplyLink(arg); err != nil {
+			logger.Error("config load failed", "err", err)
+			os.Exit(1)
+		}
+	} else if arg != "" {
+		cfg.Server = arg
+	}
+	if *uuid != "" {
+		cfg.UUID = *uuid
+	}
+	if *profile != "" {
+		cfg.Profile = *profile
+	}
+	if cfg.Server == "" || cfg.UUID == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	cfg.Logger = logger
+
+	tunnel, err := l3tunnel.New(*cfg)
+	if err != nil {
+		logger.Error("tunnel setup failed", "err", err)
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go logLinkStats(ctx, tunnel, logger)
+	if err = tunnel.Run(ctx); err != nil {
+		logger.Error("tunnel failed", "err", err)
+		os.Exit(1)
+	}
+}
+
+// logLinkStats logs the link stats of the tunnel on SIGUSR1 until ctx is done.
+func logLinkStats(ctx context.Context, tunnel *l3tunnel.Tunnel, logger *slog.Logger) {
+	sigusr := make(chan os.Signal, 1)
+	signal.Notify(sigusr, syscall.SIGUSR1)
+	defer signal.Stop(sigusr)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigusr:
+			s := tunnel.LinkStats()
+			logger.Info("link stats", "rtt", s.RTT, "smoothed_rtt", s.SmoothedRTT, "samples", s.Samples)
+		}
+	}
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -14,49 +17,53 @@ import (
 	"time"
 
 	"github.com/goxray/core/network/tun"
+
+	"github.com/goxray/tun/pkg/l3tunnel/frame"
+	"github.com/goxray/tun/pkg/l3tunnel/vless"
 )
 
 const (
-	tunAddr    = "10.50.0.2/24"
-	modemAddr  = "192.168.24.1:80"
-	proxyPort  = ":8080"
-	vpsAddr    = "YOUR_VPS_IP:PORT" // Zastąp swoim adresem VPS
+	tunAddr   = "10.50.0.2/24"
+	modemAddr = "192.168.24.1:80"
+	proxyPort = ":8080"
+	vpsAddr   = "YOUR_VPS_IP:PORT" // Zastąp swoim adresem VPS
+	keepalive = 15 * time.Second
 )
 
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Printf("Usage: %s <vps_address:port>\n", os.Args[0])
+	if len(os.Args) < 3 {
+		fmt.Printf("Usage: %s <vps_address:port> <uuid>\n", os.Args[0])
 		os.Exit(1)
 	}
-	
-	vpsTarget := os.Args[1]
-	
+
+	vpsTarget, uuid := os.Args[1], os.Args[2]
+
 	// Setup signal handling
 	sigterm := make(chan os.Signal, 1)
 	signal.Notify(sigterm, os.Interrupt, syscall.SIGTERM)
-	
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	
+
 	log.Println("Starting tun-simpl...")
-	
+
 	// Create TUN interface
 	tunIface, err := setupTUN()
 	if err != nil {
 		log.Fatal("Failed to setup TUN:", err)
 	}
 	defer tunIface.Close()
-	
+
 	// Start services
 	go startRawSocketListener(ctx, vpsTarget)
 	go startHTTPProxy(ctx)
-	go handleTUNTraffic(ctx, tunIface, vpsTarget)
-	
+	go handleTUNTraffic(ctx, tunIface, vpsTarget, uuid)
+
 	log.Println("tun-simpl started successfully")
 	log.Printf("TUN interface: %s", tunAddr)
 	log.Printf("HTTP proxy: http://10.50.0.2%s", proxyPort)
 	log.Printf("VPS target: %s", vpsTarget)
-	
+
 	<-sigterm
 	log.Println("Shutting down...")
 	cancel()
@@ -69,17 +76,17 @@ func setupTUN() (*tun.Interface, error) {
 	if err != nil {
 		return nil, fmt.Errorf("create TUN: %w", err)
 	}
-	
+
 	// Parse TUN address
 	ip, ipnet, err := net.ParseCIDR(tunAddr)
 	if err != nil {
 		return nil, fmt.Errorf("parse TUN address: %w", err)
 	}
-	
+
 	if err := iface.Up(&net.IPNet{IP: ip, Mask: ipnet.Mask}, ip); err != nil {
 		return nil, fmt.Errorf("bring TUN up: %w", err)
 	}
-	
+
 	log.Printf("TUN interface %s created with address %s", iface.Name(), tunAddr)
 	return iface, nil
 }
@@ -92,9 +99,9 @@ func startRawSocketListener(ctx context.Context, vpsAddr string) {
 		return
 	}
 	defer conn.Close()
-	
+
 	log.Println("Raw socket listener started")
-	
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -110,7 +117,7 @@ func startRawSocketListener(ctx context.Context, vpsAddr string) {
 				log.Printf("Raw socket read error: %v", err)
 				continue
 			}
-			
+
 			log.Printf("Received %d bytes from %s", n, addr)
 			// Forward to WAN interface (simplified)
 			go sendToWAN(buf[:n])
@@ -132,17 +139,17 @@ func startHTTPProxy(ctx context.Context) {
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		proxyRequest(w, r, modemAddr)
 	})
-	
+
 	server := &http.Server{
 		Addr:    "10.50.0.2" + proxyPort,
 		Handler: mux,
 	}
-	
+
 	go func() {
 		<-ctx.Done()
 		server.Shutdown(context.Background())
 	}()
-	
+
 	log.Printf("HTTP proxy started on http://10.50.0.2%s", proxyPort)
 	if err := server.ListenAndServe(); err != http.ErrServerClosed {
 		log.Printf("HTTP proxy error: %v", err)
@@ -153,26 +160,26 @@ func startHTTPProxy(ctx context.Context) {
 func proxyRequest(w http.ResponseWriter, r *http.Request, target string) {
 	// Create target URL
 	targetURL := &url.URL{
-		Scheme: "http",
-		Host:   target,
-		Path:   r.URL.Path,
+		Scheme:   "http",
+		Host:     target,
+		Path:     r.URL.Path,
 		RawQuery: r.URL.RawQuery,
 	}
-	
+
 	// Create new request
 	proxyReq, err := http.NewRequest(r.Method, targetURL.String(), r.Body)
 	if err != nil {
 		http.Error(w, "Failed to create proxy request", http.StatusInternalServerError)
 		return
 	}
-	
+
 	// Copy headers
 	for key, values := range r.Header {
 		for _, value := range values {
 			proxyReq.Header.Add(key, value)
 		}
 	}
-	
+
 	// Make request
 	client := &http.Client{Timeout: 30 * time.Second}
 	resp, err := client.Do(proxyReq)
@@ -181,32 +188,32 @@ func proxyRequest(w http.ResponseWriter, r *http.Request, target string) {
 		return
 	}
 	defer resp.Body.Close()
-	
+
 	// Copy response headers
 	for key, values := range resp.Header {
 		for _, value := range values {
 			w.Header().Add(key, value)
 		}
 	}
-	
+
 	w.WriteHeader(resp.StatusCode)
 	io.Copy(w, resp.Body)
 }
 
-// handleTUNTraffic processes raw IP packets from TUN and forwards via VLESS+WS
-func handleTUNTraffic(ctx context.Context, tunIface *tun.Interface, vpsAddr string) {
+// handleTUNTraffic processes raw IP packets from TUN and forwards them to the stream listener of l3gateway
+func handleTUNTraffic(ctx context.Context, tunIface *tun.Interface, vpsAddr, uuid string) {
 	log.Println("TUN L3 handler started")
-	
-	// WebSocket connection to VPS with VLESS protocol
-	conn, err := dialVLESS(vpsAddr)
+
+	// Framed VLESS connection to VPS, packet boundaries are kept however TCP splits or coalesces the stream
+	conn, err := dialVLESS(vpsAddr, uuid)
 	if err != nil {
 		log.Printf("Failed to connect VLESS to %s: %v", vpsAddr, err)
 		return
 	}
 	defer conn.Close()
-	
-	log.Printf("VLESS+WS connected: %s", vpsAddr)
-	
+
+	log.Printf("VLESS connected: %s", vpsAddr)
+
 	// Forward raw IP packets TUN → VLESS
 	go func() {
 		buf := make([]byte, 1500)
@@ -222,7 +229,7 @@ func handleTUNTraffic(ctx context.Context, tunIface *tun.Interface, vpsAddr stri
 					}
 					continue
 				}
-				
+
 				// Send raw IP packet through VLESS tunnel
 				if _, err := conn.Write(buf[:n]); err != nil {
 					log.Printf("VLESS write error: %v", err)
@@ -231,39 +238,122 @@ func handleTUNTraffic(ctx context.Context, tunIface *tun.Interface, vpsAddr stri
 			}
 		}
 	}()
-	
+
+	// Empty frames are pings, they keep NAT mappings and the session at the gateway alive
+	go func() {
+		ticker := time.NewTicker(keepalive)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if _, err := conn.Write(nil); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
 	// Forward VLESS → TUN (preserve original packets)
-	buf := make([]byte, 1500)
-	for {
+	// Closing unblocks Read, a read deadline would break framing in the middle of a frame.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
 		select {
 		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	buf := make([]byte, 1500)
+	for {
+		n, err := conn.Read(buf)
+		if errors.Is(err, frame.ErrTooLarge) {
+			log.Printf("VLESS packet dropped: %v", err)
+			continue
+		}
+		if err != nil {
+			return
+		}
+		if n == 0 {
+			continue // Pong
+		}
+
+		// Write raw IP packet back to TUN
+		if _, err := tunIface.Write(buf[:n]); err != nil {
+			log.Printf("TUN write error: %v", err)
 			return
-		default:
-			conn.SetReadDeadline(time.Now().Add(1 * time.Second))
-			n, err := conn.Read(buf)
-			if err != nil {
-				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-					continue
-				}
-				if ctx.Err() != nil {
-					return
-				}
-				return
-			}
-			
-			// Write raw IP packet back to TUN
-			if _, err := tunIface.Write(buf[:n]); err != nil {
-				log.Printf("TUN write error: %v", err)
-				return
-			}
 		}
 	}
 }
 
-// dialVLESS creates VLESS+WebSocket connection (simplified)
-func dialVLESS(addr string) (net.Conn, error) {
-	// TODO: Implement proper VLESS+WS handshake
-	// For now, use plain TCP (should be WebSocket with VLESS protocol)
-	return net.Dial("tcp", addr)
+// dialVLESS connects to the stream listener of l3gateway (transport tcp) and makes the session handshake
+func dialVLESS(addr, uuid string) (*frame.Conn, error) {
+	c, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	conn := frame.NewConn(c)
+	if err := handshake(conn, uuid); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// handshake sends VLESS request header and hello asking for tunAddr, then reads VLESS response header
+// and the reply of the gateway, each message in its own frame
+func handshake(conn *frame.Conn, uuid string) error {
+	id, err := vless.ParseUUID(uuid)
+	if err != nil {
+		return err
+	}
+	// The gateway accepts requests to this destination only
+	req, err := (&vless.Request{UUID: id, Command: vless.CommandTCP, Address: "l3tunnel.invalid", Port: 1}).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	hello, _ := json.Marshal(map[string]any{"version": 1, "address": tunAddr})
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+	for _, msg := range [][]byte{req, hello} {
+		if _, err := conn.Write(msg); err != nil {
+			return fmt.Errorf("send handshake: %w", err)
+		}
+	}
+
+	buf := make([]byte, frame.MaxSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return fmt.Errorf("read VLESS response: %w", err)
+	}
+	if _, err := vless.ReadResponse(bytes.NewReader(buf[:n])); err != nil {
+		return err
+	}
+	if n, err = conn.Read(buf); err != nil {
+		return fmt.Errorf("read hello: %w", err)
+	}
+	var reply struct {
+		Error  string `json:"error"`
+		Config *struct {
+			Address string `json:"address"`
+		} `json:"config"`
+	}
+	if err := json.Unmarshal(buf[:n], &reply); err != nil {
+		return fmt.Errorf("invalid hello: %w", err)
+	}
+	if reply.Error != "" {
+		return fmt.Errorf("refused by gateway: %s", reply.Error)
+	}
+	if reply.Config == nil {
+		return errors.New("no tunnel config in hello")
+	}
+	if reply.Config.Address != tunAddr {
+		log.Printf("Gateway assigned %s, TUN address is %s", reply.Config.Address, tunAddr)
+	}
+
+	return nil
 }
-}
\ No newline at end of file
@@ -16,7 +16,7 @@ export GOARM=7
 export CC=arm-linux-gnueabihf-gcc
 
 # Build ARMv7 binary
-go build -ldflags="-s -w" -o tun-e3372h-arm tun-optimized.go
+go build -ldflags="-s -w" -o tun-e3372h-arm ./cmd/l3tunnel
 
 # Verify it's ARM
 file tun-e3372h-arm
@@ -2,52 +2,118 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"log/slog"
+	"net"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/goxray/tun/pkg/client"
+	"github.com/goxray/tun/pkg/sdnotify"
 )
 
 var cmdArgsErr = `ERROR: no config_link provided
-usage: %s <config_url>
-  - config_url - xray connection link, like "vless://example..."
+usage: %s [flags] <config_url> [hop_url...]
+  - config_url - xray connection link, like "vless://example...", "wireguard://..." or path to wg-quick .conf file
+  - hop_url - optional links of the next servers of multi-hop chain, the last one is the exit server
+
+Send SIGUSR1 to the running process to print active connections.
+Send SIGUSR2 to the running process to start/stop packet capture.
+Send SIGHUP to the running process to reload blocklists.
+
+flags:
 `
 
+var (
+	captureFile     = flag.String("capture", "tun.pcapng", "pcapng file packet capture is written to (SIGUSR2 starts/stops capture)")
+	captureFilter   = flag.String("capture-filter", "", `capture filter, e.g. "udp port 443" or "net 10.0.0.0/8"`)
+	captureMaxBytes = flag.Int64("capture-max-bytes", 0, "stop capture after this many bytes (0 - no limit)")
+	captureDuration = flag.Duration("capture-duration", 0, "stop capture after this time (0 - no limit)")
+	captureOnStart  = flag.Bool("capture-on-start", false, "start packet capture right after connecting")
+	directRules     = flag.String("direct", "", `comma separated destinations bypassing the VPN, e.g. "geoip:ru,geosite:category-ru,example.com,10.0.0.0/8"`)
+	blocklists      = flag.String("blocklist", "", "comma separated blocklist files (hosts, AdGuard or CIDR lists)")
+	tunFd           = flag.Int("tun-fd", -1, "use already open TUN device file descriptor inherited from the parent process (no root required)")
+	tunSocket       = flag.String("tun-socket", "", "receive TUN device file descriptor from a privileged helper over this Unix socket (no root required)")
+	netnsName       = flag.String("netns", "", "run the VPN in this network namespace (created if missing) instead of changing host routes")
+	netnsPID        = flag.Int("netns-pid", 0, "run the VPN in the network namespace of this process (e.g. a container)")
+	assetDir        = flag.String("asset-dir", "", "directory with geoip.dat and geosite.dat (default: executable directory)")
+	healthTarget    = flag.String("health-target", client.DefaultHealthTarget, "URL or host:port reached through the server by systemd watchdog health checks")
+)
+
 func main() {
-	// Get connection link from first cmd argument
-	if len(os.Args[1:]) != 1 {
+	flag.Usage = func() {
 		fmt.Printf(cmdArgsErr, os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	// Get connection link from first cmd argument, the rest are chain hops.
+	if flag.NArg() < 1 {
+		flag.Usage()
 		os.Exit(0)
 	}
-	clientLink := os.Args[1]
+	clientLink := flag.Arg(0)
+	hopLinks := flag.Args()[1:]
 
 	sigterm := make(chan os.Signal, 1)
 	signal.Notify(sigterm, os.Interrupt, syscall.SIGTERM)
+	sigusr := make(chan os.Signal, 1)
+	signal.Notify(sigusr, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGHUP)
 
 	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
 		Level: slog.LevelError,
 	}))
 
+	var namespace *client.Namespace
+	if *netnsName != "" || *netnsPID != 0 {
+		namespace = &client.Namespace{Name: *netnsName, PID: *netnsPID}
+	}
+
+	tunDevice, err := openTUN()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	vpn, err := client.NewClientWithOpts(client.Config{
 		TLSAllowInsecure: false,
 		Logger:           logger,
+		DirectRules:      splitList(*directRules),
+		AssetDir:         *assetDir,
+		Blocklists:       splitList(*blocklists),
+		TUN:              tunDevice,
+		Namespace:        namespace,
+		OnStateChange:    notifyState,
+		HealthTarget:     *healthTarget,
 	})
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	slog.Info("Connecting to VPN server")
-	err = vpn.Connect(clientLink)
+	err = vpn.Connect(clientLink, hopLinks...)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	slog.Info("Connected to VPN server")
-	<-sigterm
+	watchdogCtx, stopWatchdog := context.WithCancel(context.Background())
+	go watchdog(watchdogCtx, vpn)
+	capture := &captureToggle{vpn: vpn}
+	if *captureOnStart {
+		capture.toggle()
+	}
+	waitForTerm(vpn, capture, sigterm, sigusr)
+	stopWatchdog()
+	capture.stop()
 	slog.Info("Received term signal, disconnecting...")
 	if err = vpn.Disconnect(context.Background()); err != nil {
 		slog.Warn("Disconnecting VPN failed", "error", err)
@@ -57,3 +123,203 @@ func main() {
 	slog.Info("VPN disconnected successfully")
 	os.Exit(0)
 }
+
+// openTUN returns TUN device set by -tun-fd or -tun-socket flags, nil means the client creates the device.
+func openTUN() (io.ReadWriteCloser, error) {
+	switch {
+	case *tunFd >= 0:
+		return client.TUNFromFd(uintptr(*tunFd))
+	case *tunSocket != "":
+		conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: *tunSocket, Net: "unix"})
+		if err != nil {
+			return nil, fmt.Errorf("connect to tun socket: %w", err)
+		}
+		defer conn.Close()
+
+		return client.ReceiveTUN(conn)
+	}
+
+	return nil, nil
+}
+
+// notifyState reports client state to systemd, it is a no-op if not run as a systemd service.
+func notifyState(state client.State) {
+	states := []string{sdnotify.Status("VPN " + state.String())}
+	switch state {
+	case client.StateConnected:
+		states = append(states, sdnotify.Ready)
+	case client.StateDisconnecting:
+		states = append(states, sdnotify.Stopping)
+	}
+	if _, err := sdnotify.Notify(states...); err != nil {
+		slog.Warn("Notifying systemd failed", "error", err)
+	}
+}
+
+// watchdog sends systemd watchdog pings while the tunnel is healthy, so that systemd restarts
+// the service if the tunnel stops working. It is a no-op if WatchdogSec is not set for the service.
+func watchdog(ctx context.Context, vpn *client.Client) {
+	interval, err := sdnotify.WatchdogInterval()
+	if err != nil {
+		slog.Warn("Reading systemd watchdog interval failed", "error", err)
+	}
+	if interval == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval / 3)
+	defer ticker.Stop()
+	healthy := true
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// Pings are not sent while the tunnel is broken, systemd restarts the service on watchdog timeout.
+		states := []string{sdnotify.Watchdog}
+		if err = vpn.Health(); err != nil {
+			slog.Error("Tunnel health check failed", "error", err)
+			healthy, states = false, []string{sdnotify.Status("VPN unhealthy: " + err.Error())}
+		} else if !healthy {
+			healthy, states = true, append(states, sdnotify.Status("VPN "+client.StateConnected.String()))
+		}
+		if _, err = sdnotify.Notify(states...); err != nil {
+			slog.Warn("Notifying systemd failed", "error", err)
+		}
+	}
+}
+
+// waitForTerm blocks till sigterm is received, printing active connections on SIGUSR1,
+// toggling packet capture on SIGUSR2 and reloading blocklists on SIGHUP.
+func waitForTerm(vpn *client.Client, capture *captureToggle, sigterm, sigusr <-chan os.Signal) {
+	for {
+		select {
+		case <-sigterm:
+			return
+		case sig := <-sigusr:
+			switch sig {
+			case syscall.SIGUSR1:
+				printConnections(vpn.Connections())
+				printBlocklists(vpn.Blocklists())
+			case syscall.SIGUSR2:
+				capture.toggle()
+			case syscall.SIGHUP:
+				if err := vpn.ReloadBlocklists(); err != nil {
+					slog.Error("Reloading blocklists failed", "error", err)
+					continue
+				}
+				printBlocklists(vpn.Blocklists())
+			}
+		}
+	}
+}
+
+// captureToggle starts and stops packet capture into the file set by -capture flag.
+type captureToggle struct {
+	vpn     *client.Client
+	mu      sync.Mutex
+	file    *os.File
+	capture *client.Capture
+}
+
+func (c *captureToggle) toggle() {
+	c.mu.Lock()
+	running := c.capture != nil
+	c.mu.Unlock()
+	if running {
+		c.stop()
+		return
+	}
+
+	f, err := os.Create(*captureFile)
+	if err != nil {
+		slog.Error("Creating capture file failed", "error", err)
+		return
+	}
+	capture, err := c.vpn.StartCapture(f, client.CaptureOptions{
+		Filter:   *captureFilter,
+		MaxBytes: *captureMaxBytes,
+		Duration: *captureDuration,
+	})
+	if err != nil {
+		_ = f.Close()
+		slog.Error("Starting capture failed", "error", err)
+		return
+	}
+	slog.Info("Capture started", "file", *captureFile)
+
+	c.mu.Lock()
+	c.file, c.capture = f, capture
+	c.mu.Unlock()
+
+	// Capture may also be stopped by reaching one of the limits.
+	go func() {
+		<-capture.Done()
+		c.stopCapture(capture)
+	}()
+}
+
+// stop stops the running capture if any.
+func (c *captureToggle) stop() {
+	c.stopCapture(nil)
+}
+
+// stopCapture stops the given capture if it is still the running one (nil means any running capture).
+func (c *captureToggle) stopCapture(capture *client.Capture) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.capture == nil || (capture != nil && c.capture != capture) {
+		return
+	}
+
+	if err := errors.Join(c.capture.Stop(), c.file.Close()); err != nil {
+		slog.Error("Stopping capture failed", "error", err)
+	}
+	slog.Info("Capture stopped", "file", *captureFile, "packets", c.capture.Packets())
+	c.file, c.capture = nil, nil
+}
+
+// printConnections prints connections table to stdout.
+func printConnections(conns []client.Connection) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PROTO\tSOURCE\tDESTINATION\tSENT\tRECEIVED\tPACKETS\tAGE\tIDLE\tPID\tPROCESS")
+	now := time.Now()
+	for _, c := range conns {
+		pid := "-"
+		if c.PID != 0 {
+			pid = fmt.Sprint(c.PID)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d/%d\t%s\t%s\t%s\t%s\n",
+			c.Protocol, c.Source, c.Destination, c.BytesSent, c.BytesReceived, c.PacketsSent, c.PacketsReceived,
+			now.Sub(c.Started).Truncate(time.Second), now.Sub(c.LastActivity).Truncate(time.Second), pid, c.Executable)
+	}
+	_ = w.Flush()
+}
+
+// printBlocklists prints blocklists table to stdout.
+func printBlocklists(lists []client.BlocklistStats) {
+	if len(lists) == 0 {
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "BLOCKLIST\tDOMAINS\tCIDRS\tHITS")
+	for _, l := range lists {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\n", l.Path, l.Domains, l.CIDRs, l.Hits)
+	}
+	_ = w.Flush()
+}
+
+// splitList splits comma separated flag value, empty items are skipped.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
@@ -0,0 +1,312 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/xtls/xray-core/common/serial"
+	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/features/outbound"
+	"github.com/xtls/xray-core/features/routing"
+	"github.com/xtls/xray-core/infra/conf"
+	"github.com/xtls/xray-core/transport"
+)
+
+// hostsIgnored are the host names found in regular hosts files that must never be blocked.
+var hostsIgnored = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+	"0.0.0.0":               true,
+}
+
+// BlocklistStats describes loaded blocklist.
+type BlocklistStats struct {
+	Path    string
+	Domains int    // Number of domain rules loaded.
+	CIDRs   int    // Number of IP and CIDR rules loaded.
+	Hits    uint64 // Number of connections blocked by the list since connect.
+}
+
+// blocklist is a parsed blocklist file.
+type blocklist struct {
+	domains []string // XRay domain matchers.
+	ips     []string // IPs and CIDRs.
+}
+
+// loadBlocklist reads blocklist from file.
+func loadBlocklist(path string) (*blocklist, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open blocklist: %w", err)
+	}
+	defer f.Close()
+
+	list, err := parseBlocklist(f)
+	if err != nil {
+		return nil, fmt.Errorf("read blocklist %s: %w", path, err)
+	}
+
+	return list, nil
+}
+
+// parseBlocklist parses blocklist in hosts format ("0.0.0.0 ads.example.com"),
+// AdGuard domain format ("||ads.example.com^"), plain domain or CIDR list format.
+// Formats can be mixed, lines that can't be expressed as domain or IP rules are skipped.
+func parseBlocklist(r io.Reader) (*blocklist, error) {
+	list := &blocklist{}
+	seen := make(map[string]bool)
+	add := func(rules *[]string, rule string) {
+		if !seen[rule] {
+			seen[rule] = true
+			*rules = append(*rules, rule)
+		}
+	}
+
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if i := strings.Index(line, " #"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		if line == "" || line[0] == '#' || line[0] == '!' || line[0] == '[' {
+			continue
+		}
+
+		// AdGuard domain rule, the domain and all of its subdomains are blocked.
+		if strings.HasPrefix(line, "||") {
+			domain, ok := strings.CutSuffix(line[2:], "^")
+			if ok && isDomain(domain) {
+				add(&list.domains, "domain:"+strings.ToLower(domain))
+			}
+			continue
+		}
+
+		// Hosts file entry, only the listed hosts are blocked.
+		if fields := strings.Fields(line); len(fields) > 1 {
+			if _, err := netip.ParseAddr(fields[0]); err == nil {
+				for _, host := range fields[1:] {
+					host = strings.ToLower(host)
+					if !hostsIgnored[host] && isDomain(host) {
+						add(&list.domains, "full:"+host)
+					}
+				}
+			}
+			continue
+		}
+
+		if p, err := netip.ParsePrefix(line); err == nil {
+			add(&list.ips, p.Masked().String())
+		} else if _, err := netip.ParseAddr(line); err == nil {
+			add(&list.ips, line)
+		} else if isDomain(line) {
+			add(&list.domains, "domain:"+strings.ToLower(line))
+		}
+	}
+
+	return list, sc.Err()
+}
+
+func isDomain(s string) bool {
+	return s != "" && !strings.ContainsAny(s, " */|^$@:[]") && !strings.HasPrefix(s, ".") && !strings.HasSuffix(s, ".")
+}
+
+// blocker sends destinations from blocklists to blackhole outbounds, one outbound per list.
+type blocker struct {
+	paths []string
+	hits  []atomic.Uint64
+
+	mu     sync.Mutex
+	lists  []*blocklist
+	router routing.Router
+}
+
+// newBlocker loads blocklists from files.
+func newBlocker(paths []string) (*blocker, error) {
+	b := &blocker{paths: paths, hits: make([]atomic.Uint64, len(paths))}
+	lists, err := b.load()
+	if err != nil {
+		return nil, err
+	}
+	b.lists = lists
+
+	return b, nil
+}
+
+func (b *blocker) load() ([]*blocklist, error) {
+	lists := make([]*blocklist, 0, len(b.paths))
+	for _, path := range b.paths {
+		list, err := loadBlocklist(path)
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, list)
+	}
+
+	return lists, nil
+}
+
+// current returns loaded lists.
+func (b *blocker) current() []*blocklist {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.lists
+}
+
+// outbounds returns blackhole outbound configs for the lists.
+func (b *blocker) outbounds() ([]*core.OutboundHandlerConfig, error) {
+	var obs []*core.OutboundHandlerConfig
+	for i := range b.paths {
+		ob, err := (&conf.OutboundDetourConfig{Protocol: "blackhole", Tag: blockOutboundTag(i)}).Build()
+		if err != nil {
+			return nil, fmt.Errorf("build blackhole outbound: %w", err)
+		}
+		obs = append(obs, ob)
+	}
+
+	return obs, nil
+}
+
+// attach starts counting hits of the lists and keeps router of the instance for reloads.
+// Must be called before the instance is started.
+func (b *blocker) attach(inst *core.Instance) error {
+	om, ok := inst.GetFeature(outbound.ManagerType()).(outbound.Manager)
+	if !ok {
+		return fmt.Errorf("outbound manager not found")
+	}
+	for i := range b.paths {
+		tag := blockOutboundTag(i)
+		h := om.GetHandler(tag)
+		if h == nil {
+			return fmt.Errorf("outbound %s not found", tag)
+		}
+		if err := om.RemoveHandler(context.Background(), tag); err != nil {
+			return fmt.Errorf("remove outbound %s: %w", tag, err)
+		}
+		if err := om.AddHandler(context.Background(), &countingHandler{Handler: h, hits: &b.hits[i]}); err != nil {
+			return fmt.Errorf("add outbound %s: %w", tag, err)
+		}
+	}
+
+	router, ok := inst.GetFeature(routing.RouterType()).(routing.Router)
+	if !ok {
+		return fmt.Errorf("router not found")
+	}
+	b.mu.Lock()
+	b.router = router
+	b.mu.Unlock()
+
+	return nil
+}
+
+// reload reads blocklists again and replaces routing rules of the running instance.
+// Rules are left unchanged if any of the lists fails to load.
+func (b *blocker) reload(direct directRules, assetDir string) error {
+	lists, err := b.load()
+	if err != nil {
+		return err
+	}
+	routerCfg, err := buildRouterConfig(direct, lists, assetDir)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.router == nil {
+		return ErrNotConnected
+	}
+	if err = b.router.AddRule(serial.ToTypedMessage(routerCfg), false); err != nil {
+		return fmt.Errorf("replace routing rules: %w", err)
+	}
+	b.lists = lists
+
+	return nil
+}
+
+func (b *blocker) stats() []BlocklistStats {
+	lists := b.current()
+	stats := make([]BlocklistStats, len(b.paths))
+	for i, path := range b.paths {
+		stats[i] = BlocklistStats{
+			Path:    path,
+			Domains: len(lists[i].domains),
+			CIDRs:   len(lists[i].ips),
+			Hits:    b.hits[i].Load(),
+		}
+	}
+
+	return stats
+}
+
+func blockOutboundTag(i int) string {
+	return fmt.Sprintf("block-%d", i)
+}
+
+// blockRules returns routing rules sending blocklists matches to their blackhole outbounds.
+func blockRules(lists []*blocklist) []fieldRule {
+	var rules []fieldRule
+	for i, list := range lists {
+		if len(list.domains) > 0 {
+			rules = append(rules, fieldRule{Type: "field", OutboundTag: blockOutboundTag(i), Domain: list.domains})
+		}
+		if len(list.ips) > 0 {
+			rules = append(rules, fieldRule{Type: "field", OutboundTag: blockOutboundTag(i), IP: list.ips})
+		}
+	}
+
+	return rules
+}
+
+// countingHandler counts connections dispatched to the outbound handler.
+type countingHandler struct {
+	outbound.Handler
+	hits *atomic.Uint64
+}
+
+func (h *countingHandler) Dispatch(ctx context.Context, link *transport.Link) {
+	h.hits.Add(1)
+	h.Handler.Dispatch(ctx, link)
+}
+
+// Blocklists returns loaded blocklists with their hit counters.
+func (c *Client) Blocklists() []BlocklistStats {
+	if c.blocker == nil {
+		return nil
+	}
+
+	return c.blocker.stats()
+}
+
+// ReloadBlocklists reads blocklist files (Config.Blocklists) again and applies them to the connected client.
+// Established connections are not affected. Hit counters are preserved.
+func (c *Client) ReloadBlocklists() error {
+	if c.stopTunnel == nil {
+		return ErrNotConnected
+	}
+	if c.blocker == nil {
+		return nil
+	}
+	direct, err := parseDirectRules(c.cfg.DirectRules)
+	if err != nil {
+		return err
+	}
+
+	return c.blocker.reload(direct, c.cfg.AssetDir)
+}
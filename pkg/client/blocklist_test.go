@@ -0,0 +1,88 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBlocklist(t *testing.T) {
+	list, err := parseBlocklist(strings.NewReader(`
+# hosts format
+127.0.0.1 localhost
+0.0.0.0 ads.example.com tracker.example.com # inline comment
+::1 ip6-localhost
+0.0.0.0 ADS.example.com
+
+! AdGuard format
+[Adblock Plus 2.0]
+||doubleclick.example^
+||analytics.example.org^$third-party
+@@||allowed.example^
+/banner/*/img^
+
+# plain lists
+metrics.example.net
+10.1.0.0/16
+192.0.2.10
+2001:db8::/32
+not a rule
+`))
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"full:ads.example.com", "full:tracker.example.com", "domain:doubleclick.example", "domain:metrics.example.net",
+	}, list.domains)
+	require.Equal(t, []string{"10.1.0.0/16", "192.0.2.10", "2001:db8::/32"}, list.ips)
+}
+
+func TestBlocker(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer target.Close()
+
+	dir := t.TempDir()
+	blockPath, otherPath := filepath.Join(dir, "block.txt"), filepath.Join(dir, "other.txt")
+	require.NoError(t, os.WriteFile(blockPath, []byte("127.0.0.1/32\n"), 0o600))
+	require.NoError(t, os.WriteFile(otherPath, []byte("||example.com^\n"), 0o600))
+
+	_, err := newBlocker([]string{filepath.Join(dir, "missing.txt")})
+	require.Error(t, err)
+
+	b, err := newBlocker([]string{blockPath, otherPath})
+	require.NoError(t, err)
+
+	// Target is reachable directly only, the server is down.
+	cfg := &Config{Logger: slog.New(slog.NewTextHandler(io.Discard, nil)), DirectRules: []string{"127.0.0.0/8"}}
+	link := fmt.Sprintf("vless://%s@127.0.0.1:%d?type=tcp&security=none", testUUID, freeTCPPort(t))
+	inst, _, err := newXrayInstance(cfg, link, nil, b)
+	require.NoError(t, err)
+	require.NoError(t, inst.Start())
+	defer inst.Close()
+
+	require.Error(t, httpGetVia(inst, target.URL))
+	require.Equal(t, []BlocklistStats{
+		{Path: blockPath, CIDRs: 1, Hits: 1},
+		{Path: otherPath, Domains: 1},
+	}, b.stats())
+
+	// Failed reload keeps the current rules.
+	require.NoError(t, os.Remove(otherPath))
+	require.Error(t, b.reload(directRules{ips: []string{"127.0.0.0/8"}}, ""))
+	require.Error(t, httpGetVia(inst, target.URL))
+	require.EqualValues(t, 2, b.stats()[0].Hits)
+
+	require.NoError(t, os.WriteFile(blockPath, []byte("# nothing blocked\n"), 0o600))
+	require.NoError(t, os.WriteFile(otherPath, nil, 0o600))
+	require.NoError(t, b.reload(directRules{ips: []string{"127.0.0.0/8"}}, ""))
+	require.NoError(t, httpGetVia(inst, target.URL))
+	require.Equal(t, []BlocklistStats{{Path: blockPath, Hits: 2}, {Path: otherPath}}, b.stats())
+}
@@ -0,0 +1,347 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrNotConnected is returned by operations that require an active tunnel.
+	ErrNotConnected = errors.New("client is not connected")
+	// ErrCaptureRunning is returned by Client.StartCapture if another capture is in progress.
+	ErrCaptureRunning = errors.New("capture is already running")
+)
+
+// CaptureOptions configure packet capture started with Client.StartCapture.
+type CaptureOptions struct {
+	// Filter selects packets to capture, see ParseCaptureFilter for syntax (default: capture everything).
+	Filter string
+	// MaxBytes stops the capture after this many bytes were written (default: no limit).
+	MaxBytes int64
+	// Duration stops the capture after this time elapsed (default: no limit).
+	Duration time.Duration
+}
+
+// Capture is a running packet capture of the TUN traffic written in pcapng format.
+type Capture struct {
+	mu      sync.Mutex
+	w       *pcapngWriter
+	filter  CaptureFilter
+	max     int64
+	written int64
+	packets int64
+	err     error
+	stopped bool
+	timer   *time.Timer
+
+	done     chan struct{}
+	stopOnce sync.Once
+	onStop   func(*Capture)
+}
+
+// Stop stops the capture. It is safe to call Stop multiple times.
+// The writer passed to Client.StartCapture is not closed and is owned by the caller once Stop returns,
+// a packet being written when Stop is called is finished before.
+func (c *Capture) Stop() error {
+	c.stopOnce.Do(func() {
+		c.mu.Lock()
+		if c.timer != nil {
+			c.timer.Stop()
+		}
+		// Packets that got the capture before it is detached from the tap are not written after this.
+		c.stopped = true
+		c.mu.Unlock()
+		if c.onStop != nil {
+			c.onStop(c)
+		}
+		close(c.done)
+	})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.err
+}
+
+// Done is closed when the capture is stopped, either by Stop or by reaching one of the limits.
+func (c *Capture) Done() <-chan struct{} {
+	return c.done
+}
+
+// Packets returns number of captured packets.
+func (c *Capture) Packets() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.packets
+}
+
+// Bytes returns number of bytes written to the capture writer.
+func (c *Capture) Bytes() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.written
+}
+
+func (c *Capture) writePacket(packet []byte, outbound bool) {
+	if !c.filter.Match(packet) {
+		return
+	}
+
+	c.mu.Lock()
+	if c.stopped || c.err != nil || (c.max > 0 && c.written >= c.max) {
+		c.mu.Unlock()
+		return
+	}
+	n, err := c.w.WritePacket(time.Now(), packet, outbound)
+	c.written += int64(n)
+	c.packets++
+	c.err = err
+	limitReached := err != nil || (c.max > 0 && c.written >= c.max)
+	c.mu.Unlock()
+
+	if limitReached {
+		go c.Stop() //nolint:errcheck // Stop is called from the tunnel hot path, don't block it.
+	}
+}
+
+// packetTap wraps the TUN io.ReadWriteCloser and tees packets to the active Capture.
+type packetTap struct {
+	io.ReadWriteCloser
+
+	capture atomic.Pointer[Capture]
+}
+
+func newPacketTap(rw io.ReadWriteCloser) *packetTap {
+	return &packetTap{ReadWriteCloser: rw}
+}
+
+func (t *packetTap) Read(p []byte) (n int, err error) {
+	n, err = t.ReadWriteCloser.Read(p)
+	if c := t.capture.Load(); c != nil && err == nil && n > 0 {
+		c.writePacket(p[:n], true)
+	}
+
+	return n, err
+}
+
+func (t *packetTap) Write(p []byte) (n int, err error) {
+	n, err = t.ReadWriteCloser.Write(p)
+	if c := t.capture.Load(); c != nil && err == nil {
+		c.writePacket(p, false)
+	}
+
+	return n, err
+}
+
+// start attaches new capture writing to w.
+func (t *packetTap) start(w io.Writer, opts CaptureOptions) (*Capture, error) {
+	filter, err := ParseCaptureFilter(opts.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Capture{
+		filter: filter,
+		max:    opts.MaxBytes,
+		done:   make(chan struct{}),
+		onStop: func(c *Capture) { t.capture.CompareAndSwap(c, nil) },
+	}
+
+	// Hold the lock till the header is written, so that packets are not written before it.
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !t.capture.CompareAndSwap(nil, c) {
+		return nil, ErrCaptureRunning
+	}
+	if c.w, err = newPcapngWriter(w); err != nil {
+		t.capture.Store(nil)
+
+		return nil, fmt.Errorf("write pcapng header: %w", err)
+	}
+	if opts.Duration > 0 {
+		c.timer = time.AfterFunc(opts.Duration, func() { _ = c.Stop() })
+	}
+
+	return c, nil
+}
+
+// StartCapture starts capturing packets flowing through the TUN device into w in pcapng format.
+// Only one capture can be active at a time.
+func (c *Client) StartCapture(w io.Writer, opts CaptureOptions) (*Capture, error) {
+	if c.tap == nil {
+		return nil, ErrNotConnected
+	}
+
+	return c.tap.start(w, opts)
+}
+
+// StopCapture stops the active capture if any.
+func (c *Client) StopCapture() error {
+	if c.tap == nil {
+		return nil
+	}
+	if capture := c.tap.capture.Load(); capture != nil {
+		return capture.Stop()
+	}
+
+	return nil
+}
+
+// CaptureFilter selects packets by protocol, port and address.
+// It is a disjunction of conjunctions: packet matches if all terms of any group match.
+type CaptureFilter [][]captureTerm
+
+type captureTerm struct {
+	not   bool
+	match func(p packetInfo) bool
+}
+
+// Match reports whether the raw IP packet matches the filter. Empty filter matches everything.
+func (f CaptureFilter) Match(packet []byte) bool {
+	if len(f) == 0 {
+		return true
+	}
+
+	info, ok := parsePacket(packet)
+	if !ok {
+		return false
+	}
+
+	for _, group := range f {
+		matched := true
+		for _, term := range group {
+			if term.match(info) == term.not {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseCaptureFilter parses a simplified BPF-like filter expression, e.g.:
+//
+//	udp port 443
+//	tcp and dst net 10.0.0.0/8 or host 1.1.1.1
+//	not port 22
+//
+// Supported primitives: tcp, udp, icmp, [src|dst] port N, [src|dst] host IP, [src|dst] net CIDR.
+// Primitives can be negated with "not" and combined with "and"/"or" ("and" binds tighter),
+// primitives without an operator between them are joined with "and".
+func ParseCaptureFilter(expr string) (CaptureFilter, error) {
+	tokens := strings.Fields(strings.ToLower(expr))
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+
+	var (
+		filter CaptureFilter
+		group  []captureTerm
+	)
+	for i := 0; i < len(tokens); {
+		term, next, err := parseCaptureTerm(tokens, i)
+		if err != nil {
+			return nil, fmt.Errorf("invalid capture filter %q: %w", expr, err)
+		}
+		group = append(group, term)
+		i = next
+
+		if i == len(tokens) {
+			break
+		}
+		switch tokens[i] {
+		case "and", "&&":
+			i++
+		case "or", "||":
+			filter = append(filter, group)
+			group = nil
+			i++
+		default:
+			continue // Juxtaposed primitives are implicitly joined with "and", e.g. "udp port 53".
+		}
+		if i == len(tokens) {
+			return nil, fmt.Errorf("invalid capture filter %q: unexpected end of expression", expr)
+		}
+	}
+
+	return append(filter, group), nil
+}
+
+func parseCaptureTerm(tokens []string, i int) (captureTerm, int, error) {
+	var term captureTerm
+	if tokens[i] == "not" || tokens[i] == "!" {
+		term.not = true
+		i++
+	}
+	if i >= len(tokens) {
+		return term, i, errors.New("unexpected end of expression")
+	}
+
+	switch tokens[i] {
+	case "tcp", "udp", "icmp":
+		proto := map[string]uint8{"tcp": protoTCP, "udp": protoUDP, "icmp": protoICMP}[tokens[i]]
+		term.match = func(p packetInfo) bool {
+			return p.proto == proto || (proto == protoICMP && p.proto == protoICMPv6)
+		}
+
+		return term, i + 1, nil
+	}
+
+	src, dst := true, true
+	switch tokens[i] {
+	case "src":
+		dst = false
+		i++
+	case "dst":
+		src = false
+		i++
+	}
+	if i+1 >= len(tokens) {
+		return term, i, errors.New("unexpected end of expression")
+	}
+
+	kind, value := tokens[i], tokens[i+1]
+	switch kind {
+	case "port":
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return term, i, fmt.Errorf("invalid port %q", value)
+		}
+		term.match = func(p packetInfo) bool {
+			return (src && p.src.Port() == uint16(port)) || (dst && p.dst.Port() == uint16(port))
+		}
+	case "host":
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return term, i, fmt.Errorf("invalid host %q", value)
+		}
+		term.match = func(p packetInfo) bool {
+			return (src && p.src.Addr() == addr) || (dst && p.dst.Addr() == addr)
+		}
+	case "net":
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return term, i, fmt.Errorf("invalid net %q", value)
+		}
+		term.match = func(p packetInfo) bool {
+			return (src && prefix.Contains(p.src.Addr())) || (dst && prefix.Contains(p.dst.Addr()))
+		}
+	default:
+		return term, i, fmt.Errorf("unknown primitive %q", kind)
+	}
+
+	return term, i + 2, nil
+}
@@ -0,0 +1,233 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+
+	"github.com/goxray/tun/pkg/client/mocks"
+)
+
+func TestParseCaptureFilter(t *testing.T) {
+	tcp443 := testIPv4Packet(protoTCP, "10.0.0.2:40000", "1.1.1.1:443", 0)
+	udp443 := testIPv4Packet(protoUDP, "10.0.0.2:40000", "1.1.1.1:443", 0)
+	dns := testIPv4Packet(protoUDP, "10.0.0.2:5353", "8.8.8.8:53", 0)
+	dnsReply := testIPv4Packet(protoUDP, "8.8.8.8:53", "10.0.0.2:5353", 0)
+	ssh6 := testIPv6Packet(protoTCP, "[fd00::2]:50000", "[2001:db8::1]:22")
+
+	tests := []struct {
+		filter  string
+		match   [][]byte
+		noMatch [][]byte
+		err     bool
+	}{
+		{filter: "", match: [][]byte{tcp443, udp443, dns, ssh6}},
+		{filter: "udp", match: [][]byte{udp443, dns}, noMatch: [][]byte{tcp443, ssh6}},
+		{filter: "udp and port 443", match: [][]byte{udp443}, noMatch: [][]byte{tcp443, dns}},
+		{filter: "dst port 53", match: [][]byte{dns}, noMatch: [][]byte{dnsReply}},
+		{filter: "src host 8.8.8.8", match: [][]byte{dnsReply}, noMatch: [][]byte{dns}},
+		{filter: "net 2001:db8::/32", match: [][]byte{ssh6}, noMatch: [][]byte{dns}},
+		{filter: "not port 22", match: [][]byte{tcp443, dns}, noMatch: [][]byte{ssh6}},
+		{filter: "tcp and port 22 or port 53", match: [][]byte{ssh6, dns}, noMatch: [][]byte{tcp443}},
+		{filter: "port", err: true},
+		{filter: "port 70000", err: true},
+		{filter: "net 10.0.0.0", err: true},
+		{filter: "udp or", err: true},
+		{filter: "udp and", err: true},
+		{filter: "udp port 53", match: [][]byte{dns}, noMatch: [][]byte{udp443}},
+		{filter: "sctp", err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.filter, func(t *testing.T) {
+			f, err := ParseCaptureFilter(test.filter)
+			if test.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			for _, p := range test.match {
+				require.True(t, f.Match(p))
+			}
+			for _, p := range test.noMatch {
+				require.False(t, f.Match(p))
+			}
+		})
+	}
+}
+
+func TestPacketTap_Capture(t *testing.T) {
+	out := testIPv4Packet(protoUDP, "10.0.0.2:5353", "8.8.8.8:53", 0)
+	in := testIPv4Packet(protoUDP, "8.8.8.8:53", "10.0.0.2:5353", 0)
+	other := testIPv4Packet(protoTCP, "10.0.0.2:40000", "1.1.1.1:443", 0)
+
+	ioMock := mocks.NewMockioReadWriteCloser(gomock.NewController(t))
+	ioMock.EXPECT().Read(gomock.Any()).DoAndReturn(func(buf []byte) (int, error) {
+		return copy(buf, out), nil
+	}).AnyTimes()
+	ioMock.EXPECT().Write(gomock.Any()).DoAndReturn(func(buf []byte) (int, error) {
+		return len(buf), nil
+	}).AnyTimes()
+
+	tap := newPacketTap(ioMock)
+	buf := make([]byte, 1500)
+
+	var w bytes.Buffer
+	c, err := tap.start(&w, CaptureOptions{Filter: "udp port 53"})
+	require.NoError(t, err)
+
+	_, err = tap.start(&bytes.Buffer{}, CaptureOptions{})
+	require.ErrorIs(t, err, ErrCaptureRunning)
+
+	_, err = tap.Read(buf)
+	require.NoError(t, err)
+	_, err = tap.Write(in)
+	require.NoError(t, err)
+	_, err = tap.Write(other)
+	require.NoError(t, err)
+	require.NoError(t, c.Stop())
+	<-c.Done()
+
+	// Packets after Stop are not captured.
+	_, err = tap.Write(in)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, c.Packets())
+	require.EqualValues(t, w.Len()-60, c.Bytes()) // Minus section header and interface blocks.
+
+	blocks := readPcapngBlocks(t, w.Bytes())
+	require.Len(t, blocks, 4)
+	require.EqualValues(t, pcapngSectionHeader, blocks[0].typ)
+	require.EqualValues(t, pcapngInterfaceDesc, blocks[1].typ)
+	require.EqualValues(t, pcapngLinkTypeRaw, binary.LittleEndian.Uint16(blocks[1].body))
+
+	for i, exp := range []struct {
+		packet []byte
+		flags  uint32
+	}{{out, pcapngFlagOutbound}, {in, pcapngFlagInbound}} {
+		b := blocks[2+i]
+		require.EqualValues(t, pcapngEnhancedPacket, b.typ)
+		capLen := binary.LittleEndian.Uint32(b.body[12:])
+		require.EqualValues(t, len(exp.packet), capLen)
+		require.Equal(t, exp.packet, b.body[20:20+capLen])
+		opt := b.body[20+(capLen+3)&^3:]
+		require.EqualValues(t, pcapngOptEPBFlags, binary.LittleEndian.Uint16(opt))
+		require.Equal(t, exp.flags, binary.LittleEndian.Uint32(opt[4:]))
+	}
+
+	// New capture can be started after the previous one stopped.
+	c, err = tap.start(&bytes.Buffer{}, CaptureOptions{})
+	require.NoError(t, err)
+	require.NoError(t, c.Stop())
+}
+
+func TestPacketTap_Limits(t *testing.T) {
+	packet := testIPv4Packet(protoUDP, "10.0.0.2:5353", "8.8.8.8:53", 0)
+	ioMock := mocks.NewMockioReadWriteCloser(gomock.NewController(t))
+	ioMock.EXPECT().Write(gomock.Any()).DoAndReturn(func(buf []byte) (int, error) {
+		return len(buf), nil
+	}).AnyTimes()
+	tap := newPacketTap(ioMock)
+
+	c, err := tap.start(&bytes.Buffer{}, CaptureOptions{MaxBytes: 1})
+	require.NoError(t, err)
+	for range 3 {
+		_, _ = tap.Write(packet)
+	}
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Fatal("capture is not stopped after reaching size limit")
+	}
+	require.EqualValues(t, 1, c.Packets())
+
+	c, err = tap.start(&bytes.Buffer{}, CaptureOptions{Duration: 10 * time.Millisecond})
+	require.NoError(t, err)
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Fatal("capture is not stopped after reaching time limit")
+	}
+}
+
+func TestPacketTap_StopWhileWriting(t *testing.T) {
+	packet := testIPv4Packet(protoUDP, "10.0.0.2:5353", "8.8.8.8:53", 0)
+	ioMock := mocks.NewMockioReadWriteCloser(gomock.NewController(t))
+	ioMock.EXPECT().Write(gomock.Any()).DoAndReturn(func(buf []byte) (int, error) {
+		return len(buf), nil
+	}).AnyTimes()
+	tap := newPacketTap(ioMock)
+
+	w := &ownedWriter{}
+	c, err := tap.start(w, CaptureOptions{})
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					_, _ = tap.Write(packet)
+				}
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, c.Stop())
+	w.release()
+
+	// A packet which got the capture from the tap before Stop is not written either.
+	c.writePacket(packet, false)
+	time.Sleep(10 * time.Millisecond)
+	close(done)
+	wg.Wait()
+	require.False(t, w.writtenAfterRelease.Load(), "packet written after Stop returned")
+	require.Positive(t, c.Packets())
+}
+
+// ownedWriter records writes made after the capture handed it back to the caller.
+type ownedWriter struct {
+	released            atomic.Bool
+	writtenAfterRelease atomic.Bool
+}
+
+func (w *ownedWriter) Write(p []byte) (int, error) {
+	if w.released.Load() {
+		w.writtenAfterRelease.Store(true)
+	}
+
+	return len(p), nil
+}
+
+func (w *ownedWriter) release() { w.released.Store(true) }
+
+type pcapngBlock struct {
+	typ  uint32
+	body []byte
+}
+
+func readPcapngBlocks(t *testing.T, b []byte) []pcapngBlock {
+	var blocks []pcapngBlock
+	for len(b) > 0 {
+		require.GreaterOrEqual(t, len(b), 12)
+		typ, l := binary.LittleEndian.Uint32(b), binary.LittleEndian.Uint32(b[4:])
+		require.Zero(t, l%4)
+		require.GreaterOrEqual(t, len(b), int(l))
+		require.Equal(t, l, binary.LittleEndian.Uint32(b[l-4:]))
+		blocks = append(blocks, pcapngBlock{typ: typ, body: b[8 : l-4]})
+		b = b[l:]
+	}
+
+	return blocks
+}
@@ -0,0 +1,301 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/lilendian0x00/xray-knife/v3/pkg/xray"
+	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/features/dns"
+	"github.com/xtls/xray-core/features/outbound"
+	"github.com/xtls/xray-core/infra/conf"
+	"github.com/xtls/xray-core/transport/internet"
+)
+
+// ErrHopNotChainable is returned on connect when a hop of the chain can't be dialed through the previous one.
+var ErrHopNotChainable = errors.New("hop can't be chained")
+
+// errNoOutboundManager is returned by dialerProxies when no instance is running.
+var errNoOutboundManager = errors.New("no running xray instance")
+
+// chainIDs makes hop outbound tags unique among instances of the process.
+var chainIDs atomic.Uint64
+
+// hop is a parsed link of the proxy chain.
+type hop struct {
+	link     string
+	info     *ServerInfo
+	protocol xray.Protocol
+}
+
+// validateChain checks that every hop can be dialed through the previous one.
+func validateChain(hops []hop) error {
+	seen := make(map[string]int, len(hops))
+	for i, h := range hops {
+		addr := h.info.HostPort()
+		if j, ok := seen[addr]; ok {
+			return fmt.Errorf("%w: hop %d: server %s is already hop %d", ErrHopNotChainable, i+1, addr, j+1)
+		}
+		seen[addr] = i
+
+		// Packet transports would be relayed as UDP over the previous hops, which they may not support.
+		if i > 0 && isPacketTransport(h.info) {
+			return fmt.Errorf("%w: hop %d: %s transport is only supported on the first hop", ErrHopNotChainable, i+1, h.info.Transport)
+		}
+	}
+
+	return nil
+}
+
+// isPacketTransport reports whether the server transport runs over UDP (WireGuard, mKCP or XHTTP over HTTP/3).
+func isPacketTransport(info *ServerInfo) bool {
+	switch info.Transport {
+	case "udp", "kcp", "mkcp":
+		return true
+	case "xhttp", "splithttp":
+		return len(info.ALPN) == 1 && info.ALPN[0] == "h3"
+	}
+
+	return false
+}
+
+// chainOutbounds is the built proxy chain.
+type chainOutbounds struct {
+	outbounds []*core.OutboundHandlerConfig // The exit hop first.
+	dialers   []outbound.Handler            // To be registered with dialerProxies.
+	streams   []StreamSettings              // The entry hop first.
+}
+
+// buildChainOutbounds builds outbounds of the chain, each hop is dialed through the previous one.
+// The last hop (exit) is the first outbound in the list and has proxyOutboundTag.
+//
+// Stream overrides and TLS settings of the config are applied to every hop.
+func buildChainOutbounds(cfg *Config, hops []hop) (*chainOutbounds, error) {
+	overrides, err := newStreamOverrides(cfg)
+	if err != nil {
+		return nil, err
+	}
+	trust, err := newTLSTrust(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	id := chainIDs.Add(1)
+	ch := &chainOutbounds{
+		outbounds: make([]*core.OutboundHandlerConfig, len(hops)),
+		streams:   make([]StreamSettings, len(hops)),
+	}
+	tlsHops, realityHops := 0, 0
+	prevTag := ""
+	for i, h := range hops {
+		ob, err := h.protocol.BuildOutboundDetourConfig(cfg.TLSAllowInsecure)
+		if err != nil {
+			return nil, fmt.Errorf("build outbound: %w", err)
+		}
+		ob.Tag = fmt.Sprintf("hop-%d-%d", id, i)
+		if i == len(hops)-1 {
+			ob.Tag = proxyOutboundTag
+		}
+		if prevTag != "" {
+			setDialerProxy(ob, prevTag)
+		}
+		if ob.StreamSetting != nil {
+			switch ob.StreamSetting.Security {
+			case "tls":
+				tlsHops++
+			case "reality":
+				realityHops++
+			}
+		}
+
+		overrides.apply(ob)
+		dialer, err := trust.apply(ob)
+		if err != nil {
+			return nil, fmt.Errorf("build outbound: hop %d: %w", i+1, err)
+		}
+		if dialer != nil {
+			dialer.tag = fmt.Sprintf("hop-%d-%d-tls", id, i)
+			dialer.prev = prevTag
+			setDialerProxy(ob, dialer.tag)
+			ch.dialers = append(ch.dialers, dialer)
+		}
+		prevTag = ob.Tag
+		ch.streams[i] = newStreamSettings(h, ob, dialer)
+
+		built, err := ob.Build()
+		if err != nil {
+			return nil, fmt.Errorf("build outbound: hop %d: %w", i+1, err)
+		}
+		ch.outbounds[len(hops)-1-i] = built
+	}
+	if trust.verifies() && tlsHops == 0 {
+		return nil, fmt.Errorf("tls: CA, pins and client certificate need a server with TLS security")
+	}
+	if overrides != nil {
+		if overrides.tls() && tlsHops+realityHops == 0 {
+			return nil, fmt.Errorf("tls: fingerprint and ALPN need a server with TLS or REALITY security")
+		}
+		if overrides.reality() && realityHops == 0 {
+			return nil, fmt.Errorf("reality: public key, short ID and spiderX need a server with REALITY security")
+		}
+	}
+
+	return ch, nil
+}
+
+// setDialerProxy makes the outbound dial its server through the outbound with the tag.
+func setDialerProxy(ob *conf.OutboundDetourConfig, tag string) {
+	if ob.StreamSetting == nil {
+		ob.StreamSetting = &conf.StreamConfig{}
+	}
+	if ob.StreamSetting.SocketSettings == nil {
+		ob.StreamSetting.SocketSettings = &conf.SocketConfig{}
+	}
+	ob.StreamSetting.SocketSettings.DialerProxy = tag
+}
+
+// dialerProxies is the outbound manager XRay system dialer uses to look up dialer proxies.
+//
+// XRay keeps the manager in a global variable, which is overwritten by every new instance, so dialer
+// proxies of other instances can't be found. It looks up hop outbounds in instances they belong to,
+// everything else goes to the most recently created instance as in XRay itself.
+var dialerProxies = &hopOutbounds{hops: make(map[string]hopHandler)}
+
+type hopOutbounds struct {
+	mu     sync.RWMutex
+	latest outbound.Manager // Manager of the most recently created instance, nil if it is closed.
+	hops   map[string]hopHandler
+}
+
+// hopHandler is the outbound of the instance a hop is dialed through.
+type hopHandler struct {
+	owner   outbound.Manager
+	handler outbound.Handler // Own handler not known to the instance, looked up in the owner if nil.
+}
+
+// register points XRay system dialer to dialerProxies and adds hop outbounds of the instance,
+// dialers are own handlers the instance outbounds are dialed through.
+// Must be called after the instance is created.
+func (o *hopOutbounds) register(inst *core.Instance, dialers ...outbound.Handler) error {
+	om, ok := inst.GetFeature(outbound.ManagerType()).(outbound.Manager)
+	if !ok {
+		return fmt.Errorf("outbound manager not found")
+	}
+	dc, ok := inst.GetFeature(dns.ClientType()).(dns.Client)
+	if !ok {
+		return fmt.Errorf("dns client not found")
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, h := range om.ListHandlers(context.Background()) {
+		if strings.HasPrefix(h.Tag(), "hop-") {
+			o.hops[h.Tag()] = hopHandler{owner: om}
+		}
+	}
+	for _, d := range dialers {
+		o.hops[d.Tag()] = hopHandler{owner: om, handler: d}
+	}
+	o.latest = om
+	internet.InitSystemDialer(dc, o)
+
+	return nil
+}
+
+// forget removes hop outbounds of the closed instance.
+func (o *hopOutbounds) forget(inst *core.Instance) {
+	om, ok := inst.GetFeature(outbound.ManagerType()).(outbound.Manager)
+	if !ok {
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for tag, h := range o.hops {
+		if h.owner == om {
+			delete(o.hops, tag)
+		}
+	}
+	if o.latest == om {
+		o.latest = nil
+	}
+}
+
+// manager returns the manager of the most recently created instance.
+func (o *hopOutbounds) manager() outbound.Manager {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	return o.latest
+}
+
+func (o *hopOutbounds) Type() interface{} {
+	return outbound.ManagerType()
+}
+
+// Start does nothing, managers of the instances are started and closed with them.
+func (o *hopOutbounds) Start() error {
+	return nil
+}
+
+// Close does nothing, managers of the instances are started and closed with them.
+func (o *hopOutbounds) Close() error {
+	return nil
+}
+
+func (o *hopOutbounds) GetHandler(tag string) outbound.Handler {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if h, ok := o.hops[tag]; ok {
+		if h.handler != nil {
+			return h.handler
+		}
+
+		return h.owner.GetHandler(tag)
+	}
+	if o.latest == nil {
+		return nil
+	}
+
+	return o.latest.GetHandler(tag)
+}
+
+func (o *hopOutbounds) GetDefaultHandler() outbound.Handler {
+	m := o.manager()
+	if m == nil {
+		return nil
+	}
+
+	return m.GetDefaultHandler()
+}
+
+func (o *hopOutbounds) AddHandler(ctx context.Context, handler outbound.Handler) error {
+	m := o.manager()
+	if m == nil {
+		return errNoOutboundManager
+	}
+
+	return m.AddHandler(ctx, handler)
+}
+
+func (o *hopOutbounds) RemoveHandler(ctx context.Context, tag string) error {
+	m := o.manager()
+	if m == nil {
+		return errNoOutboundManager
+	}
+
+	return m.RemoveHandler(ctx, tag)
+}
+
+func (o *hopOutbounds) ListHandlers(ctx context.Context) []outbound.Handler {
+	m := o.manager()
+	if m == nil {
+		return nil
+	}
+
+	return m.ListHandlers(ctx)
+}
@@ -0,0 +1,130 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/features/outbound"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+)
+
+func TestValidateChain(t *testing.T) {
+	parse := func(links ...string) []hop {
+		hops := make([]hop, len(links))
+		for i, link := range links {
+			info, err := ParseLink(link)
+			require.NoError(t, err)
+			hops[i] = hop{link: link, info: info}
+		}
+
+		return hops
+	}
+	tcpHop := "vless://" + testUUID + "@1.1.1.1:443?type=tcp&security=tls"
+	kcpHop := "vless://" + testUUID + "@2.2.2.2:443?type=kcp&security=none"
+	h3Hop := "vless://" + testUUID + "@3.3.3.3:443?type=xhttp&security=tls&alpn=h3"
+	h2Hop := "vless://" + testUUID + "@4.4.4.4:443?type=xhttp&security=tls&alpn=h2"
+	wgHop := "wireguard://" + escapeWGKey(testWGPrivateKey) + "@5.5.5.5:51820?address=10.0.0.2&publickey=" + escapeWGKey(testWGPublicKey)
+
+	require.NoError(t, validateChain(parse(tcpHop, h2Hop)))
+	require.NoError(t, validateChain(parse(kcpHop, tcpHop))) // Entry server is dialed directly.
+	require.NoError(t, validateChain(parse(wgHop, tcpHop)))
+
+	err := validateChain(parse(tcpHop, kcpHop))
+	require.ErrorIs(t, err, ErrHopNotChainable)
+	require.ErrorContains(t, err, "hop 2: kcp transport")
+	require.ErrorIs(t, validateChain(parse(tcpHop, h2Hop, h3Hop)), ErrHopNotChainable)
+	require.ErrorContains(t, validateChain(parse(tcpHop, wgHop)), "hop 2: udp transport")
+	err = validateChain(parse(tcpHop, h2Hop, tcpHop))
+	require.ErrorIs(t, err, ErrHopNotChainable)
+	require.ErrorContains(t, err, "hop 3: server 1.1.1.1:443 is already hop 1")
+}
+
+func TestClient_Chain(t *testing.T) {
+	vless := fmt.Sprintf(`{
+		"protocol": "vless",
+		"settings": {"clients": [{"id": %q}], "decryption": "none"},
+		"streamSettings": {"network": "tcp"}
+	}`, testUUID)
+	exitPort := startTestXrayServerWithOutbound(t, vless,
+		fmt.Sprintf(`{"protocol": "freedom", "settings": {"redirect": %q}}`, startTCPEcho(t)))
+	// Exit server address in the link is unreachable, the entry server takes traffic to the real one.
+	// Traffic reaching the echo server proves it went through both servers.
+	entryPort := startTestXrayServerWithOutbound(t, vless,
+		fmt.Sprintf(`{"protocol": "freedom", "settings": {"redirect": "127.0.0.1:%d"}}`, exitPort))
+	entry := fmt.Sprintf("vless://%s@127.0.0.1:%d?type=tcp&security=none#entry", testUUID, entryPort)
+	exit := fmt.Sprintf("vless://%s@127.0.0.2:%d?type=tcp&security=none#exit", testUUID, freeTCPPort(t))
+
+	app, dev := newTestAppStack(t)
+	cl := &Client{
+		cfg:           Config{Logger: slog.New(slog.NewTextHandler(os.Stdout, nil)), TUN: dev},
+		tunnelStopped: make(chan error),
+		pipe:          newNetstackPipe(defaultNetstackOpts),
+	}
+	require.NoError(t, cl.Connect(entry, exit))
+	require.Equal(t, "127.0.0.1", cl.xSrvIP.String()) // Route exception is made for the entry server.
+
+	// Other instances of the process must not break the chain.
+	other, _, err := newXrayInstance(&Config{Logger: cl.cfg.Logger}, entry, nil, nil)
+	require.NoError(t, err)
+	defer other.Close()
+
+	conn, err := gonet.DialTCP(app, tcpip.FullAddress{Addr: tcpip.AddrFrom4([4]byte{203, 0, 113, 10}), Port: 80}, ipv4.ProtocolNumber)
+	require.NoError(t, err)
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	reply := make([]byte, 5)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(reply))
+
+	require.NoError(t, cl.Disconnect(context.Background()))
+	require.Empty(t, dialerProxies.hops)
+}
+
+func TestHopOutbounds_Forget(t *testing.T) {
+	cfg := &Config{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	link := fmt.Sprintf("vless://%s@127.0.0.1:%d?type=tcp&security=none", testUUID, freeTCPPort(t))
+	first, _, err := newXrayInstance(cfg, link, nil, nil)
+	require.NoError(t, err)
+	defer first.Close()
+	second, _, err := newXrayInstance(cfg, link, nil, nil)
+	require.NoError(t, err)
+	defer second.Close()
+
+	// Outbounds which are not hops are looked up in the most recently created instance.
+	om := second.(*core.Instance).GetFeature(outbound.ManagerType()).(outbound.Manager)
+	require.Same(t, om.GetHandler(proxyOutboundTag), dialerProxies.GetHandler(proxyOutboundTag))
+	require.Same(t, om.GetDefaultHandler(), dialerProxies.GetDefaultHandler())
+	require.Len(t, dialerProxies.ListHandlers(context.Background()), 1)
+
+	dialerProxies.forget(first.(*core.Instance))
+	require.Same(t, om.GetDefaultHandler(), dialerProxies.GetDefaultHandler())
+
+	// The closed instance is not used anymore.
+	dialerProxies.forget(second.(*core.Instance))
+	require.Nil(t, dialerProxies.GetHandler(proxyOutboundTag))
+	require.Nil(t, dialerProxies.GetDefaultHandler())
+	require.Empty(t, dialerProxies.ListHandlers(context.Background()))
+	require.ErrorIs(t, dialerProxies.RemoveHandler(context.Background(), proxyOutboundTag), errNoOutboundManager)
+}
+
+func TestClient_ChainInvalid(t *testing.T) {
+	cl := &Client{cfg: Config{Logger: slog.New(slog.NewTextHandler(os.Stdout, nil)), TUN: &stackDevice{}}}
+	link := "vless://" + testUUID + "@127.0.0.1:443?type=tcp&security=none"
+
+	err := cl.Connect(link, "invalid_link")
+	require.ErrorContains(t, err, "invalid config: hop 2: protocol create:")
+	err = cl.Connect(link, "vless://"+testUUID+"@127.0.0.2:443?type=kcp&security=none")
+	require.ErrorIs(t, err, ErrHopNotChainable)
+	require.Equal(t, StateDisconnected, cl.State())
+}
@@ -11,29 +11,35 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/goxray/core/network/route"
 	"github.com/goxray/core/network/tun"
-	"github.com/goxray/core/pipe2socks"
 	"github.com/jackpal/gateway"
 
 	xrayproto "github.com/lilendian0x00/xray-knife/v3/pkg/protocol"
 	"github.com/lilendian0x00/xray-knife/v3/pkg/xray"
+	"github.com/xtls/xray-core/app/dispatcher"
 	xapplog "github.com/xtls/xray-core/app/log"
+	"github.com/xtls/xray-core/app/proxyman"
 	xcommlog "github.com/xtls/xray-core/common/log"
+	"github.com/xtls/xray-core/common/serial"
+	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/infra/conf"
 )
 
-const disconnectTimeout = 30 * time.Second
+const (
+	disconnectTimeout = 30 * time.Second
+	// inboundProxyAttempts is the number of ports tried for the inbound proxy,
+	// the free port found may be taken by someone else before XRay binds it.
+	inboundProxyAttempts = 5
+)
 
 var (
-	// defaultTUNAddress is the address new TUN device will be set up with.
-	defaultTUNAddress = &net.IPNet{IP: net.IPv4(192, 18, 0, 1), Mask: net.IPv4Mask(255, 255, 255, 255)}
-	// defaultInboundProxy default proxy will be set up for listening on 127.0.0.1.
-	defaultInboundProxy = &Proxy{
-		IP:   net.IPv4(127, 0, 0, 1),
-		Port: getFreePort(),
-	}
+	// defaultInboundProxyIP is the address inbound proxy listens on when Config.InboundProxy is not set.
+	defaultInboundProxyIP = net.IPv4(127, 0, 0, 1)
 
 	// DefaultRoutesToTUN will route all system traffic through the TUN.
 	DefaultRoutesToTUN = []*route.Addr{
@@ -54,20 +60,83 @@ type Config struct {
 	// Client will determine the system gateway IP automatically,
 	// and you don't have to set this field explicitly.
 	GatewayIP *net.IP
-	// Socks proxy address on which XRay creates inbound proxy (default: 127.0.0.1:10808).
+	// Socks proxy address on which XRay creates inbound proxy
+	// (default: 127.0.0.1 with a free port picked on every connect).
 	InboundProxy *Proxy
-	// TUN device address (default: 192.18.0.1).
+	// TUN device address (default: free address from 192.18.0.0/16 picked on connect, starting with 192.18.0.1).
+	//
+	// Addresses are unique among clients of the process, connect fails if the address is used by another client.
 	TUNAddress *net.IPNet
 	// List of routes to be pointed to TUN device (default: DefaultRoutesToTUN).
 	//
 	// One exception is explicitly added for XRay remote server IP and can not be altered.
+	// A route can be pointed to one client of the process only, so clients running side by side
+	// must be given different routes (or run in namespace mode).
 	RoutesToTUN []*route.Addr
 	// Whether to allow self-signed certificates or not.
 	TLSAllowInsecure bool
+	// TLSCA is PEM encoded CA certificates the server certificate is verified against instead of system roots.
+	TLSCA []byte
+	// TLSCAFile is the path to PEM file with CA certificates, they are added to TLSCA.
+	TLSCAFile string
+	// TLSClientCert and TLSClientKey are PEM encoded client certificate and key presented to the server (mutual TLS).
+	//
+	// XRay can't present client certificates, so servers are dialed by Go TLS with them: uTLS fingerprint
+	// of the link is not applied, and only tcp, ws, httpupgrade and grpc transports are supported.
+	TLSClientCert []byte
+	TLSClientKey  []byte
+	// TLSClientCertFile and TLSClientKeyFile are paths to PEM files used instead of TLSClientCert and TLSClientKey.
+	TLSClientCertFile string
+	TLSClientKeyFile  string
+	// TLSPins are SHA-256 hashes (base64 or hex) of the SubjectPublicKeyInfo of certificates
+	// (as "pin-sha256" of HPKP), a certificate of the verified server chain must match one of them.
+	TLSPins []string
+	// TLSServerName overrides server name (SNI) of the link, the server certificate is verified against it.
+	TLSServerName string
+	// TLSFingerprint overrides uTLS fingerprint (fp) of the link for TLS and REALITY servers
+	// (e.g. "chrome", "firefox", "safari", "randomized"), useful when the link one is outdated or blocked.
+	TLSFingerprint string
+	// TLSALPN overrides ALPN list of the link for TLS servers (e.g. "h2", "http/1.1").
+	TLSALPN []string
+	// RealityPublicKey, RealityShortID and RealitySpiderX override REALITY parameters of the link
+	// (pbk, sid and spx). Overrides are applied to every server of the chain, see Client.Effective.
+	RealityPublicKey string
+	RealityShortID   string
+	RealitySpiderX   string
 	// Pass logger with debug level to observe debug logs (default: slog.TextHandler).
 	Logger *slog.Logger
-	// XRayLogType is used to redefine xray core log type (default: LogType_None).
+	// XRayLogType is used to redefine xray core log type. By default (LogType_None, or LogType_Event)
+	// xray core general and access logs are routed to Logger as structured records, LogType_Console writes
+	// them to stdout in xray format.
 	XRayLogType xapplog.LogType
+	// DirectRules lists destinations that bypass the VPN server and go directly via GatewayIP.
+	//
+	// Supported entries: "geoip:XX", "geosite:category", domain suffixes ("example.com" matches
+	// the domain and its subdomains), XRay domain matchers ("domain:", "full:", "keyword:", "regexp:"),
+	// IPs and CIDRs (e.g. "10.0.0.0/8").
+	DirectRules []string
+	// AssetDir is the directory geoip.dat and geosite.dat files are loaded from
+	// (default: XRay asset location, the executable directory).
+	AssetDir string
+	// Blocklists are paths to domain and CIDR blocklist files, matching connections are dropped.
+	// Hosts files, AdGuard style domain lists ("||example.com^") and plain domain/CIDR lists are supported.
+	Blocklists []string
+	// TUN is an already open TUN device to use instead of creating one (see TUNFromFd and ReceiveTUN).
+	//
+	// Interface and route setup is skipped, so the client does not need root privileges,
+	// the device owner is responsible for addresses and routes (including the XRay server exception).
+	// Client closes the device on Disconnect. TUNAddress, RoutesToTUN and Namespace are ignored.
+	TUN io.ReadWriteCloser
+	// Namespace enables network namespace isolation mode (Linux only).
+	//
+	// TUN device is put into the namespace with the default route pointed to it, only processes
+	// in that namespace use the VPN. Host routing is left untouched and RoutesToTUN is ignored.
+	Namespace *Namespace
+	// OnStateChange is called on every connection state change (e.g. to report service status).
+	OnStateChange func(State)
+	// HealthTarget is reached through the VPN server by Client.Health, it is an URL or "host:port"
+	// as the target of Probe (default: DefaultHealthTarget).
+	HealthTarget string
 }
 
 func (c *Config) apply(new *Config) {
@@ -89,6 +158,66 @@ func (c *Config) apply(new *Config) {
 	if new.XRayLogType != xapplog.LogType_None {
 		c.XRayLogType = new.XRayLogType
 	}
+	if new.DirectRules != nil {
+		c.DirectRules = new.DirectRules
+	}
+	if new.AssetDir != "" {
+		c.AssetDir = new.AssetDir
+	}
+	if new.Blocklists != nil {
+		c.Blocklists = new.Blocklists
+	}
+	if new.TUN != nil {
+		c.TUN = new.TUN
+	}
+	if new.Namespace != nil {
+		c.Namespace = new.Namespace
+	}
+	if new.OnStateChange != nil {
+		c.OnStateChange = new.OnStateChange
+	}
+	if new.HealthTarget != "" {
+		c.HealthTarget = new.HealthTarget
+	}
+	if new.TLSCA != nil {
+		c.TLSCA = new.TLSCA
+	}
+	if new.TLSCAFile != "" {
+		c.TLSCAFile = new.TLSCAFile
+	}
+	if new.TLSClientCert != nil {
+		c.TLSClientCert = new.TLSClientCert
+	}
+	if new.TLSClientKey != nil {
+		c.TLSClientKey = new.TLSClientKey
+	}
+	if new.TLSClientCertFile != "" {
+		c.TLSClientCertFile = new.TLSClientCertFile
+	}
+	if new.TLSClientKeyFile != "" {
+		c.TLSClientKeyFile = new.TLSClientKeyFile
+	}
+	if new.TLSPins != nil {
+		c.TLSPins = new.TLSPins
+	}
+	if new.TLSServerName != "" {
+		c.TLSServerName = new.TLSServerName
+	}
+	if new.TLSFingerprint != "" {
+		c.TLSFingerprint = new.TLSFingerprint
+	}
+	if new.TLSALPN != nil {
+		c.TLSALPN = new.TLSALPN
+	}
+	if new.RealityPublicKey != "" {
+		c.RealityPublicKey = new.RealityPublicKey
+	}
+	if new.RealityShortID != "" {
+		c.RealityShortID = new.RealityShortID
+	}
+	if new.RealitySpiderX != "" {
+		c.RealitySpiderX = new.RealitySpiderX
+	}
 }
 
 // Client is the actual VPN cl. It manages connections, routing and tunneling of the requests.
@@ -97,15 +226,34 @@ func (c *Config) apply(new *Config) {
 type Client struct {
 	cfg Config
 
-	xInst  runnable
-	xCfg   *xrayproto.GeneralConfig
-	xSrvIP *net.IPAddr
-	tunnel io.ReadWriteCloser
-	pipe   pipe
-	routes ipTable
+	xInst   runnable
+	xCfg    *xrayproto.GeneralConfig
+	xSrvIP  *net.IPAddr
+	inbound *Proxy     // Inbound proxy of the connection.
+	tunAddr *net.IPNet // TUN address of the connection.
+	tunnel  io.ReadWriteCloser
+	flows   *flowTracker
+	tap     *packetTap
+	blocker *blocker
+	streams []StreamSettings // Effective stream settings of the connection.
+	pipe    pipe
+	routes  ipTable
+
+	state       atomic.Int32
+	pipeRunning atomic.Bool
+	// exceptionAdded is set when XRay server route exception is added by the client.
+	exceptionAdded bool
+	tunnelStopped  chan error
+	stopTunnel     func()
+}
 
-	tunnelStopped chan error
-	stopTunnel    func()
+// Namespace selects network namespace for isolation mode.
+type Namespace struct {
+	// Name of the namespace in /run/netns (as in "ip netns"), it is created if it does not exist
+	// and deleted on disconnect.
+	Name string
+	// PID of the process to join network namespace of (e.g. a container), used when Name is empty.
+	PID int
 }
 
 // Proxy will set up XRay inbound.
@@ -126,11 +274,6 @@ func NewClient() (*Client, error) {
 		return nil, fmt.Errorf("discover gateway: %w", err)
 	}
 
-	p, err := pipe2socks.NewPipe(pipe2socks.DefaultOpts)
-	if err != nil {
-		return nil, fmt.Errorf("tun2socks new pipe: %w", err)
-	}
-
 	r, err := route.New()
 	if err != nil {
 		return nil, fmt.Errorf("route new: %w", err)
@@ -138,14 +281,12 @@ func NewClient() (*Client, error) {
 
 	return &Client{
 		cfg: Config{
-			GatewayIP:    &gatewayIP,
-			InboundProxy: defaultInboundProxy,
-			TUNAddress:   defaultTUNAddress,
-			RoutesToTUN:  DefaultRoutesToTUN,
-			Logger:       slog.New(slog.NewTextHandler(os.Stdout, nil)),
+			GatewayIP:   &gatewayIP,
+			RoutesToTUN: DefaultRoutesToTUN,
+			Logger:      slog.New(slog.NewTextHandler(os.Stdout, nil)),
 		},
 		tunnelStopped: make(chan error),
-		pipe:          p,
+		pipe:          newNetstackPipe(defaultNetstackOpts),
 		routes:        r,
 	}, nil
 }
@@ -168,37 +309,73 @@ func (c *Client) GatewayIP() net.IP {
 	return *c.cfg.GatewayIP
 }
 
-// TUNAddress returns address the TUN device is set up on.
+// TUNAddress returns address the TUN device is set up on (nil if not connected and not configured).
 // Traffic is routed to this TUN device.
 func (c *Client) TUNAddress() net.IP {
-	return c.cfg.TUNAddress.IP
+	if c.tunAddr != nil {
+		return c.tunAddr.IP
+	}
+	if c.cfg.TUNAddress != nil {
+		return c.cfg.TUNAddress.IP
+	}
+
+	return nil
 }
 
-// InboundProxy returns proxy address initialized by XRay core.
+// InboundProxy returns proxy address initialized by XRay core (zero if not connected and not configured).
 // Traffic from TUN device is routed to this proxy.
 func (c *Client) InboundProxy() Proxy {
-	return *c.cfg.InboundProxy
+	if c.inbound != nil {
+		return *c.inbound
+	}
+	if c.cfg.InboundProxy != nil {
+		return *c.cfg.InboundProxy
+	}
+
+	return Proxy{}
+}
+
+// Routes returns host routes pointed to the TUN device of the client.
+func (c *Client) Routes() []string {
+	return hostRoutes.owned(c)
+}
+
+// Effective returns stream settings the servers of the connection are dialed with (entry server first):
+// link parameters with Config overrides applied. Nil is returned if the client is not connected.
+// Use EffectiveStreams to check the settings before connecting.
+func (c *Client) Effective() []StreamSettings {
+	return c.streams
 }
 
 // Connect creates a global tunnel and routes all incoming connections (or traffic specified in Config.RoutesToTUN)
-// to the VPN server via newly created defaultInboundProxy.
-func (c *Client) Connect(link string) error {
-	var err error
+// to the VPN server via newly created inbound proxy.
+//
+// Optional hops make a multi-hop chain: traffic goes to the link server first, which connects
+// to hops[0] and so on, the last hop is the exit server. Each server only sees the address of the previous one.
+// The route exception is added for the link (entry) server only.
+func (c *Client) Connect(link string, hops ...string) (err error) {
 	c.cfg.Logger.Debug("Connecting to tunnel", "cfg", c.cfg)
+	c.setState(StateConnecting)
+	defer func() {
+		if err != nil {
+			c.cleanup()
+			c.setState(StateDisconnected)
+		}
+	}()
 
-	c.xInst, c.xCfg, err = c.createXrayProxy(link)
-	if err != nil {
-		c.cfg.Logger.Error("xray core creation failed", "err", err, "xray_config", c.xCfg)
-
-		return fmt.Errorf("create xray core instance: %w", err)
+	if c.cfg.TUN == nil {
+		if c.tunAddr, err = c.allocateTUNAddress(); err != nil {
+			return err
+		}
 	}
-	c.cfg.Logger.Debug("xray core instance created", "xray_config", c.xCfg)
 
-	c.cfg.Logger.Debug("starting xray core instance")
-	if err = c.xInst.Start(); err != nil {
-		c.cfg.Logger.Error("xray core instance startup failed", "err", err)
+	// Certificate problems would otherwise show up as failing connections only.
+	if err = verifyServerTLS(context.Background(), &c.cfg, link); err != nil {
+		return err
+	}
 
-		return fmt.Errorf("start xray core instance: %w", err)
+	if err = c.startXrayProxy(append([]string{link}, hops...)); err != nil {
+		return err
 	}
 	time.Sleep(100 * time.Millisecond) // Sometimes XRay instance should have a bit more time to set up.
 	c.cfg.Logger.Debug("xray core instance started")
@@ -211,31 +388,39 @@ func (c *Client) Connect(link string) error {
 
 		return fmt.Errorf("setup TUN device: %w", err)
 	}
-	c.tunnel = newReaderMetrics(c.tunnel)
+	c.tap = newPacketTap(c.tunnel)
+	c.flows = newFlowTracker(c.tap)
+	c.tunnel = newReaderMetrics(c.flows)
 	c.cfg.Logger.Debug("TUN device created")
 
-	c.cfg.Logger.Debug("adding routes for TUN device")
-	// Set XRay remote address to be routed through the default gateway, so that we don't get a loop.
-	_ = c.routes.Delete(c.xrayToGatewayRoute()) // In case previous run failed.
-	c.cfg.Logger.Debug("deleted dangling routes")
-	err = c.routes.Add(c.xrayToGatewayRoute())
-	if err != nil {
-		c.cfg.Logger.Error("routing xray server IP to default route failed", "err", err, "route", c.xrayToGatewayRoute())
-
-		return fmt.Errorf("add xray server route exception: %w", err)
+	if c.managesRoutes() {
+		c.cfg.Logger.Debug("adding routes for TUN device")
+		// Set XRay remote address to be routed through the default gateway, so that we don't get a loop.
+		// The route is shared with other clients connected to the same server.
+		err = hostRoutes.addException(c.routes, c.xrayToGatewayRoute())
+		if err != nil {
+			c.cfg.Logger.Error("routing xray server IP to default route failed", "err", err, "route", c.xrayToGatewayRoute())
+
+			return fmt.Errorf("add xray server route exception: %w", err)
+		}
+		c.exceptionAdded = true
+		c.cfg.Logger.Debug("routing xray server IP to default route")
 	}
-	c.cfg.Logger.Debug("routing xray server IP to default route")
 
 	var wg sync.WaitGroup
 	wg.Add(1)
 	var ctx context.Context
 	ctx, c.stopTunnel = context.WithCancel(context.Background())
+	c.pipeRunning.Store(true)
 	go func() {
 		wg.Done()
-		c.tunnelStopped <- c.pipe.Copy(ctx, c.tunnel, c.cfg.InboundProxy.String())
-		c.cfg.Logger.Debug("tunnel pipe closed", "err", err)
+		pipeErr := c.pipe.Copy(ctx, c.tunnel, c.inbound.String())
+		c.pipeRunning.Store(false)
+		c.cfg.Logger.Debug("tunnel pipe closed", "err", pipeErr)
+		c.tunnelStopped <- pipeErr
 	}()
 	wg.Wait()
+	c.setState(StateConnected)
 	c.cfg.Logger.Debug("client connected")
 
 	return nil
@@ -250,8 +435,19 @@ func (c *Client) Disconnect(ctx context.Context) error {
 		return nil // not connected
 	}
 
+	c.setState(StateDisconnecting)
+	defer c.setState(StateDisconnected)
+
 	c.stopTunnel()
-	err := errors.Join(c.xInst.Close(), c.tunnel.Close(), c.routes.Delete(c.xrayToGatewayRoute()))
+	err := errors.Join(c.StopCapture(), c.xInst.Close(), c.tunnel.Close())
+	forgetInstance(c.xInst)
+	if c.managesRoutes() {
+		err = errors.Join(err, hostRoutes.deleteException(c.routes, c.xrayToGatewayRoute()))
+		hostRoutes.unclaim(c)
+		c.exceptionAdded = false
+	}
+	c.releaseTUNAddress()
+	c.tunAddr, c.inbound, c.stopTunnel, c.streams = nil, nil, nil, nil
 
 	// Waiting till the tunnel actually done with processing connections.
 	ctx, cancel := context.WithTimeout(ctx, disconnectTimeout)
@@ -292,6 +488,110 @@ func (c *Client) BytesWritten() int {
 	return c.tunnel.(*readerMetrics).BytesWritten()
 }
 
+// Connections returns active connections going through the TUN device, sorted by traffic volume.
+// On Linux each connection is attributed to the owning process when possible.
+func (c *Client) Connections() []Connection {
+	if c.flows == nil {
+		return nil
+	}
+
+	return c.flows.Connections()
+}
+
+// startXrayProxy creates and starts XRay instance. If the inbound proxy port is not configured,
+// a free port is picked, and another one is tried if the port gets taken before XRay binds it.
+func (c *Client) startXrayProxy(links []string) (err error) {
+	for attempt := 1; ; attempt++ {
+		if c.inbound, err = c.inboundProxy(); err != nil {
+			return err
+		}
+
+		c.xInst, c.xCfg, err = c.createXrayProxy(links)
+		if err != nil {
+			c.cfg.Logger.Error("xray core creation failed", "err", err, "xray_config", c.xCfg)
+
+			return fmt.Errorf("create xray core instance: %w", err)
+		}
+		c.cfg.Logger.Debug("xray core instance created", "xray_config", c.xCfg)
+
+		c.cfg.Logger.Debug("starting xray core instance", "inbound_proxy", c.inbound.String())
+		err = c.xInst.Start()
+		if err == nil {
+			return nil
+		}
+		_ = c.xInst.Close()
+		forgetInstance(c.xInst)
+		c.xInst = nil
+		if c.cfg.InboundProxy == nil && errors.Is(err, syscall.EADDRINUSE) && attempt < inboundProxyAttempts {
+			c.cfg.Logger.Debug("inbound proxy port is taken, retrying", "port", c.inbound.Port)
+			continue
+		}
+		c.cfg.Logger.Error("xray core instance startup failed", "err", err)
+
+		return fmt.Errorf("start xray core instance: %w", err)
+	}
+}
+
+// inboundProxy returns configured inbound proxy or the one on a free port.
+func (c *Client) inboundProxy() (*Proxy, error) {
+	if c.cfg.InboundProxy != nil {
+		return c.cfg.InboundProxy, nil
+	}
+	port, err := getFreePort(defaultInboundProxyIP)
+	if err != nil {
+		return nil, fmt.Errorf("find free inbound proxy port: %w", err)
+	}
+
+	return &Proxy{IP: defaultInboundProxyIP, Port: port}, nil
+}
+
+// allocateTUNAddress reserves configured TUN address or picks a free one from the pool.
+func (c *Client) allocateTUNAddress() (*net.IPNet, error) {
+	if c.cfg.TUNAddress != nil {
+		if err := tunAddresses.reserve(c.cfg.TUNAddress); err != nil {
+			return nil, err
+		}
+
+		return c.cfg.TUNAddress, nil
+	}
+
+	return tunAddresses.acquire()
+}
+
+func (c *Client) releaseTUNAddress() {
+	if c.tunAddr != nil {
+		tunAddresses.release(c.tunAddr)
+	}
+}
+
+// cleanup releases resources of the failed connection attempt.
+func (c *Client) cleanup() {
+	if c.tunnel != nil {
+		_ = c.tunnel.Close()
+		c.tunnel = nil
+	}
+	if c.xInst != nil {
+		_ = c.xInst.Close()
+		forgetInstance(c.xInst)
+		c.xInst = nil
+	}
+	if c.exceptionAdded {
+		_ = hostRoutes.deleteException(c.routes, c.xrayToGatewayRoute())
+		c.exceptionAdded = false
+	}
+	hostRoutes.unclaim(c)
+	c.releaseTUNAddress()
+	c.tunAddr = nil
+	c.inbound = nil
+	c.streams = nil
+}
+
+// managesRoutes reports whether the client changes host routing table,
+// it does not in namespace mode and with user provided TUN device.
+func (c *Client) managesRoutes() bool {
+	return c.cfg.TUN == nil && c.cfg.Namespace == nil
+}
+
 // xrayToGatewayRoute is a setup to route VPN requests to gateway.
 // Used as exception to not interfere with traffic going to remote XRay instance.
 func (c *Client) xrayToGatewayRoute() route.Opts {
@@ -299,47 +599,226 @@ func (c *Client) xrayToGatewayRoute() route.Opts {
 	return route.Opts{Gateway: *c.cfg.GatewayIP, Routes: []*route.Addr{route.MustParseAddr(c.xSrvIP.String() + "/32")}}
 }
 
-// createXrayProxy creates XRay instance from connection link with additional proxy listening on {addr}:{port}.
-func (c *Client) createXrayProxy(link string) (xrayproto.Instance, *xrayproto.GeneralConfig, error) {
+// createXrayProxy creates XRay instance from connection links (the chain of servers)
+// with additional proxy listening on {addr}:{port}.
+func (c *Client) createXrayProxy(links []string) (xrayproto.Instance, *xrayproto.GeneralConfig, error) {
 	// Make the inbound for local proxy.
 	// We will later use it to redirect all traffic from TUN device to this proxy.
 	inbound := &xray.Socks{
 		Remark:  "GoXRay-TUN-Listener",
-		Address: c.cfg.InboundProxy.IP.String(),
-		Port:    strconv.Itoa(c.cfg.InboundProxy.Port),
+		Address: c.inbound.IP.String(),
+		Port:    strconv.Itoa(c.inbound.Port),
 	}
 
-	svc := xray.NewXrayService(true,
-		c.cfg.TLSAllowInsecure,
-		xray.WithCustomLogLevel(c.cfg.XRayLogType, xRayLogLevel(c.cfg.Logger.Handler())),
-		xray.WithInbound(inbound),
-	)
+	var err error
+	if len(c.cfg.Blocklists) > 0 {
+		if c.blocker, err = newBlocker(c.cfg.Blocklists); err != nil {
+			return nil, nil, err
+		}
+	}
 
-	link = strings.TrimSpace(link)
-	protocol, err := svc.CreateProtocol(link)
+	inst, cfg, streams, err := newChainXrayInstance(&c.cfg, links, inbound, c.blocker)
 	if err != nil {
-		return nil, nil, fmt.Errorf("invalid config: protocol create: %w", err)
+		return nil, nil, err
 	}
+	c.cfg.Logger.Debug("effective stream settings", "streams", streams)
 
-	if err := protocol.Parse(); err != nil {
-		return nil, nil, fmt.Errorf("invalid config: parse: %w", err)
+	// Validate xray proto addr, it is the first hop of the chain, so the route exception is made for it only.
+	ip, err := net.ResolveIPAddr("ip", cfg.Address)
+	if err != nil {
+		return nil, nil, fmt.Errorf("xray address not resolvable: %w", err)
 	}
+	c.xSrvIP = ip
+	c.streams = streams
+
+	return inst, cfg, nil
+}
+
+// newXrayInstance creates XRay instance from connection link, inbound is optional.
+// Blocker is optional too, it is attached to the created instance.
+func newXrayInstance(
+	cfg *Config, link string, inbound xray.Protocol, b *blocker,
+) (xrayproto.Instance, *xrayproto.GeneralConfig, error) {
+	inst, generalCfg, _, err := newChainXrayInstance(cfg, []string{link}, inbound, b)
 
-	cfg := protocol.ConvertToGeneralConfig()
+	return inst, generalCfg, err
+}
 
-	inst, err := svc.MakeInstance(protocol)
+// newChainXrayInstance creates XRay instance sending traffic through the chain of servers,
+// links go from the entry server to the exit one. Returned are the config of the entry server
+// and the stream settings the instance dials the chain with.
+func newChainXrayInstance(
+	cfg *Config, links []string, inbound xray.Protocol, b *blocker,
+) (xrayproto.Instance, *xrayproto.GeneralConfig, []StreamSettings, error) {
+	rules, err := parseDirectRules(cfg.DirectRules)
 	if err != nil {
-		return nil, nil, fmt.Errorf("make instance: %w", err)
+		return nil, nil, nil, fmt.Errorf("invalid config: %w", err)
 	}
 
-	// Validate xray proto addr.
-	ip, err := net.ResolveIPAddr("ip", cfg.Address)
+	hops, err := parseChain(cfg, links)
 	if err != nil {
-		return nil, nil, fmt.Errorf("xray address not resolvable: %w", err)
+		return nil, nil, nil, err
+	}
+
+	generalCfg := hops[0].protocol.ConvertToGeneralConfig()
+
+	xCfg, ch, err := buildXrayConfig(cfg, hops, inbound, rules, b)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("make instance: %w", err)
+	}
+	inst, err := core.New(xCfg)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("make instance: %w", err)
+	}
+	if err = dialerProxies.register(inst, ch.dialers...); err != nil {
+		_ = inst.Close()
+		return nil, nil, nil, fmt.Errorf("register dialer proxies: %w", err)
+	}
+	if b != nil {
+		if err = b.attach(inst); err != nil {
+			_ = inst.Close()
+			return nil, nil, nil, fmt.Errorf("attach blocklists: %w", err)
+		}
+	}
+
+	if !xrayOwnLog(cfg.XRayLogType) {
+		xrayLogs.register(inst, cfg.Logger)
+	}
+
+	return inst, &generalCfg, ch.streams, nil
+}
+
+// forgetInstance releases what the closed instance was registered with: hop outbounds and its logger.
+func forgetInstance(inst xrayproto.Instance) {
+	if inst, ok := inst.(*core.Instance); ok {
+		dialerProxies.forget(inst)
+		xrayLogs.forget(inst)
+	}
+}
+
+// parseChain parses links of the chain of servers and checks the chain can be dialed.
+func parseChain(cfg *Config, links []string) ([]hop, error) {
+	var err error
+	hops := make([]hop, len(links))
+	for i, link := range links {
+		if hops[i], err = parseHop(cfg, link, len(links) > 1); err != nil {
+			if len(links) > 1 {
+				return nil, fmt.Errorf("invalid config: hop %d: %w", i+1, err)
+			}
+
+			return nil, fmt.Errorf("invalid config: %w", err)
+		}
+	}
+	if len(hops) > 1 {
+		if err = validateChain(hops); err != nil {
+			return nil, fmt.Errorf("invalid config: %w", err)
+		}
 	}
-	c.xSrvIP = ip
 
-	return inst, &cfg, nil
+	return hops, nil
+}
+
+// parseHop parses connection link or path to wg-quick config file. Server info is needed for chain validation only.
+func parseHop(cfg *Config, link string, withInfo bool) (hop, error) {
+	var err error
+	h := hop{link: strings.TrimSpace(link)}
+	if isWireGuardConfigPath(h.link) {
+		wg, err := LoadWireGuardConfig(h.link)
+		if err != nil {
+			return h, err
+		}
+		h.link = wg.Link()
+	}
+	if h.protocol, err = newLinkProtocol(cfg, h.link); err != nil {
+		return h, err
+	}
+
+	if withInfo {
+		if h.info, err = ParseLink(h.link); err != nil {
+			return h, err
+		}
+	}
+
+	return h, nil
+}
+
+// newLinkProtocol creates XRay protocol of the link, WireGuard links are handled on our own.
+func newLinkProtocol(cfg *Config, link string) (xray.Protocol, error) {
+	if isWireGuardLink(link) {
+		p := &wireGuardProtocol{link: link}
+		if err := p.Parse(); err != nil {
+			return nil, fmt.Errorf("parse: %w", err)
+		}
+
+		return p, nil
+	}
+
+	svc := xray.NewXrayService(true, cfg.TLSAllowInsecure)
+	protocol, err := svc.CreateProtocol(link)
+	if err != nil {
+		return nil, fmt.Errorf("protocol create: %w", err)
+	}
+	if err = protocol.Parse(); err != nil {
+		return nil, fmt.Errorf("parse: %w", err)
+	}
+
+	return protocol.(xray.Protocol), nil
+}
+
+// buildXrayConfig builds XRay core config with the outbounds to the chain of servers (the exit one is the default route),
+// optional inbound, direct routing and blocklists. Returned chain is the one the outbounds are of.
+func buildXrayConfig(
+	cfg *Config, hops []hop, inbound xray.Protocol, rules directRules, b *blocker,
+) (*core.Config, *chainOutbounds, error) {
+	ch, err := buildChainOutbounds(cfg, hops)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var apps []*serial.TypedMessage
+	if xrayOwnLog(cfg.XRayLogType) {
+		apps = append(apps, serial.ToTypedMessage(&xapplog.Config{
+			ErrorLogType:  cfg.XRayLogType,
+			AccessLogType: cfg.XRayLogType,
+			ErrorLogLevel: xRayLogLevel(cfg.Logger.Handler()),
+		}))
+	}
+	xCfg := &core.Config{
+		App: append(apps,
+			serial.ToTypedMessage(&dispatcher.Config{}),
+			serial.ToTypedMessage(&proxyman.OutboundConfig{}),
+		),
+		Outbound: ch.outbounds,
+	}
+
+	if inbound != nil {
+		ib, err := inbound.BuildInboundDetourConfig()
+		if err != nil {
+			return nil, nil, fmt.Errorf("build inbound: %w", err)
+		}
+		if !rules.empty() || b != nil {
+			// TUN traffic comes with destination IPs only, sniff domains to match domain rules.
+			ib.SniffingConfig = &conf.SniffingConfig{
+				Enabled:      true,
+				DestOverride: &conf.StringList{"http", "tls", "quic"},
+				RouteOnly:    true,
+			}
+		}
+		ibBuilt, err := ib.Build()
+		if err != nil {
+			return nil, nil, fmt.Errorf("build inbound: %w", err)
+		}
+		xCfg.App = append(xCfg.App, serial.ToTypedMessage(&proxyman.InboundConfig{}))
+		xCfg.Inbound = []*core.InboundHandlerConfig{ibBuilt}
+	}
+
+	if !rules.empty() || b != nil {
+		if err = addRouting(xCfg, cfg, rules, b); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return xCfg, ch, nil
 }
 
 // xRayLogLevel maps slog.Level to xray core log level (xcommlog.Severity) by checking Config.Logger level.
@@ -350,42 +829,55 @@ func xRayLogLevel(h slog.Handler) xcommlog.Severity {
 		return xcommlog.Severity_Debug
 	case h.Enabled(ctx, slog.LevelInfo):
 		return xcommlog.Severity_Info
-	case h.Enabled(ctx, slog.LevelError):
-		return xcommlog.Severity_Error
 	case h.Enabled(ctx, slog.LevelWarn):
 		return xcommlog.Severity_Warning
+	case h.Enabled(ctx, slog.LevelError):
+		return xcommlog.Severity_Error
 	}
 
 	return xcommlog.Severity_Unknown
 }
 
 // setupTunnel creates new TUN interface in the system and routes all traffic to it.
-func (c *Client) setupTunnel() (*tun.Interface, error) {
+// In namespace mode the interface is created in the namespace instead,
+// user provided TUN device is used as is.
+func (c *Client) setupTunnel() (io.ReadWriteCloser, error) {
+	if c.cfg.TUN != nil {
+		return c.cfg.TUN, nil
+	}
+	if c.cfg.Namespace != nil {
+		return c.setupNamespaceTunnel()
+	}
+
 	ifc, err := tun.New("", 1500)
 	if err != nil {
 		return nil, fmt.Errorf("create tun: %w", err)
 	}
 
-	if err = ifc.Up(c.cfg.TUNAddress, c.cfg.TUNAddress.IP); err != nil {
+	if err = ifc.Up(c.tunAddr, c.tunAddr.IP); err != nil {
+		_ = ifc.Close()
 		return nil, fmt.Errorf("setup interface: %w", err)
 	}
 
+	if err = hostRoutes.claim(c, c.cfg.RoutesToTUN); err != nil {
+		_ = ifc.Close()
+		return nil, err
+	}
 	if err = c.routes.Add(route.Opts{IfName: ifc.Name(), Routes: c.cfg.RoutesToTUN}); err != nil {
+		_ = ifc.Close()
 		return nil, fmt.Errorf("add route: %w", err)
 	}
 
 	return ifc, nil
 }
 
-func getFreePort() int {
-	ln, err := net.Listen("tcp", "localhost:0")
+// getFreePort returns TCP port which is free at the moment on the given IP.
+func getFreePort(ip net.IP) (int, error) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: ip})
 	if err != nil {
-		return 10808
+		return 0, err
 	}
 	defer ln.Close()
 
-	addr := ln.Addr().(*net.TCPAddr)
-	port := addr.Port
-
-	return port
+	return ln.Addr().(*net.TCPAddr).Port, nil
 }
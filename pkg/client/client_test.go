@@ -149,12 +149,14 @@ func newTestClient(xInst runnable, tun io.ReadWriteCloser, routes ipTable, pipe
 			InboundProxy: expProxy,
 			GatewayIP:    expGateway,
 		},
+		inbound:       expProxy,
 		tunnelStopped: make(chan error),
 		xInst:         xInst,
 		tunnel:        tun,
 		routes:        routes,
 		pipe:          pipe,
 		xCfg:          expGeneralConfig,
+		xSrvIP:        &net.IPAddr{IP: net.ParseIP(expGeneralConfig.Address)},
 	}
 	if stopTunnel != nil {
 		cl.stopTunnel = func() {
@@ -0,0 +1,322 @@
+package client
+
+import (
+	"cmp"
+	"encoding/binary"
+	"io"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// flowIdleTimeout is how long a flow is kept in the table without any packets.
+	flowIdleTimeout = 2 * time.Minute
+	// flowClosedTimeout is how long a TCP flow is kept after FIN or RST was seen.
+	flowClosedTimeout = 10 * time.Second
+	// maxFlows caps the flow table size, idle flows are pruned when it is reached.
+	maxFlows = 4096
+)
+
+// IP protocol numbers recognized by the flow tracker.
+const (
+	protoICMP   = 1
+	protoTCP    = 6
+	protoUDP    = 17
+	protoICMPv6 = 58
+)
+
+// Connection is a snapshot of a single flow (5-tuple) observed on the TUN device.
+//
+// Source is always the local side of the flow, so Sent means packets going from the system into the tunnel
+// and Received means packets coming back from the tunnel.
+type Connection struct {
+	Protocol    string
+	Source      netip.AddrPort
+	Destination netip.AddrPort
+
+	BytesSent       uint64
+	BytesReceived   uint64
+	PacketsSent     uint64
+	PacketsReceived uint64
+
+	Started      time.Time
+	LastActivity time.Time
+
+	// PID and Executable of the process owning the local socket (Linux only, zero values if unknown).
+	PID        int
+	Executable string
+}
+
+// flowKey identifies a flow from the local side perspective.
+type flowKey struct {
+	proto uint8
+	local netip.AddrPort
+	peer  netip.AddrPort
+}
+
+type flow struct {
+	Connection
+
+	closed   bool
+	resolved bool
+}
+
+// processResolver resolves the process owning a local socket.
+type processResolver func(keys []flowKey) map[flowKey]process
+
+type process struct {
+	PID        int
+	Executable string
+}
+
+// flowTracker wraps the TUN io.ReadWriteCloser and keeps a table of active flows.
+//
+// Reads are packets leaving the system (sent), writes are packets coming back from the tunnel (received).
+type flowTracker struct {
+	io.ReadWriteCloser
+
+	mu      sync.Mutex
+	flows   map[flowKey]*flow
+	resolve processResolver
+	now     func() time.Time
+}
+
+func newFlowTracker(rw io.ReadWriteCloser) *flowTracker {
+	return &flowTracker{
+		ReadWriteCloser: rw,
+		flows:           make(map[flowKey]*flow),
+		resolve:         lookupProcesses,
+		now:             time.Now,
+	}
+}
+
+func (f *flowTracker) Read(p []byte) (n int, err error) {
+	n, err = f.ReadWriteCloser.Read(p)
+	if err == nil && n > 0 {
+		f.record(p[:n], true)
+	}
+
+	return n, err
+}
+
+func (f *flowTracker) Write(p []byte) (n int, err error) {
+	n, err = f.ReadWriteCloser.Write(p)
+	if err == nil {
+		f.record(p, false)
+	}
+
+	return n, err
+}
+
+// record accounts the packet to its flow, creating a new one if needed.
+func (f *flowTracker) record(packet []byte, sent bool) {
+	pkt, ok := parsePacket(packet)
+	if !ok {
+		return
+	}
+
+	key := flowKey{proto: pkt.proto, local: pkt.src, peer: pkt.dst}
+	if !sent {
+		key.local, key.peer = pkt.dst, pkt.src
+	}
+
+	now := f.now()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fl, ok := f.flows[key]
+	if !ok {
+		if len(f.flows) >= maxFlows {
+			f.pruneLocked(now)
+		}
+		fl = &flow{Connection: Connection{
+			Protocol:    protoName(key.proto),
+			Source:      key.local,
+			Destination: key.peer,
+			Started:     now,
+		}}
+		f.flows[key] = fl
+	}
+
+	fl.LastActivity = now
+	if sent {
+		fl.BytesSent += uint64(len(packet))
+		fl.PacketsSent++
+	} else {
+		fl.BytesReceived += uint64(len(packet))
+		fl.PacketsReceived++
+	}
+	if pkt.fin {
+		fl.closed = true
+	}
+}
+
+// Connections returns active flows sorted by total traffic (largest first).
+func (f *flowTracker) Connections() []Connection {
+	now := f.now()
+
+	f.mu.Lock()
+	f.pruneLocked(now)
+	var unresolved []flowKey
+	for key, fl := range f.flows {
+		if !fl.resolved {
+			unresolved = append(unresolved, key)
+		}
+	}
+	f.mu.Unlock()
+
+	// Process lookup walks /proc and may be slow, don't hold the lock while doing it.
+	var procs map[flowKey]process
+	if len(unresolved) > 0 && f.resolve != nil {
+		procs = f.resolve(unresolved)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	conns := make([]Connection, 0, len(f.flows))
+	for key, fl := range f.flows {
+		if p, ok := procs[key]; ok {
+			fl.PID, fl.Executable = p.PID, p.Executable
+			fl.resolved = true
+		}
+		conns = append(conns, fl.Connection)
+	}
+
+	slices.SortFunc(conns, func(a, b Connection) int {
+		return cmp.Compare(b.BytesSent+b.BytesReceived, a.BytesSent+a.BytesReceived)
+	})
+
+	return conns
+}
+
+// pruneLocked removes idle and closed flows. f.mu must be held.
+func (f *flowTracker) pruneLocked(now time.Time) {
+	for key, fl := range f.flows {
+		idle := now.Sub(fl.LastActivity)
+		if idle > flowIdleTimeout || (fl.closed && idle > flowClosedTimeout) {
+			delete(f.flows, key)
+		}
+	}
+}
+
+// packetInfo is the part of IP/TCP/UDP headers the flow tracker cares about.
+type packetInfo struct {
+	proto uint8
+	src   netip.AddrPort
+	dst   netip.AddrPort
+	fin   bool // TCP FIN or RST flag is set.
+}
+
+// parsePacket parses IPv4/IPv6 headers and TCP/UDP ports of a raw IP packet.
+// Non-first fragments and malformed packets are reported as not ok.
+func parsePacket(b []byte) (packetInfo, bool) {
+	if len(b) < 1 {
+		return packetInfo{}, false
+	}
+
+	var (
+		info       packetInfo
+		src, dst   netip.Addr
+		payload    []byte
+		ok         bool
+		nextHeader uint8
+	)
+
+	switch b[0] >> 4 {
+	case 4:
+		if len(b) < 20 {
+			return info, false
+		}
+		ihl := int(b[0]&0x0f) * 4
+		if ihl < 20 || len(b) < ihl {
+			return info, false
+		}
+		if binary.BigEndian.Uint16(b[6:8])&0x1fff != 0 {
+			return info, false // Non-first fragment carries no L4 header.
+		}
+		nextHeader = b[9]
+		src, _ = netip.AddrFromSlice(b[12:16])
+		dst, _ = netip.AddrFromSlice(b[16:20])
+		payload = b[ihl:]
+	case 6:
+		if len(b) < 40 {
+			return info, false
+		}
+		src, _ = netip.AddrFromSlice(b[8:24])
+		dst, _ = netip.AddrFromSlice(b[24:40])
+		nextHeader, payload, ok = skipIPv6Extensions(b[6], b[40:])
+		if !ok {
+			return info, false
+		}
+	default:
+		return info, false
+	}
+
+	info.proto = nextHeader
+	var srcPort, dstPort uint16
+	switch nextHeader {
+	case protoTCP:
+		if len(payload) < 14 {
+			return info, false
+		}
+		srcPort, dstPort = binary.BigEndian.Uint16(payload[0:2]), binary.BigEndian.Uint16(payload[2:4])
+		info.fin = payload[13]&0x05 != 0 // FIN or RST.
+	case protoUDP:
+		if len(payload) < 4 {
+			return info, false
+		}
+		srcPort, dstPort = binary.BigEndian.Uint16(payload[0:2]), binary.BigEndian.Uint16(payload[2:4])
+	}
+
+	info.src = netip.AddrPortFrom(src, srcPort)
+	info.dst = netip.AddrPortFrom(dst, dstPort)
+
+	return info, true
+}
+
+// skipIPv6Extensions walks over the common IPv6 extension headers and returns the upper layer protocol.
+func skipIPv6Extensions(next uint8, b []byte) (uint8, []byte, bool) {
+	for {
+		switch next {
+		case 0, 43, 60: // Hop-by-Hop, Routing, Destination Options.
+			if len(b) < 8 {
+				return 0, nil, false
+			}
+			l := (int(b[1]) + 1) * 8
+			if len(b) < l {
+				return 0, nil, false
+			}
+			next, b = b[0], b[l:]
+		case 44: // Fragment.
+			if len(b) < 8 {
+				return 0, nil, false
+			}
+			if binary.BigEndian.Uint16(b[2:4])&0xfff8 != 0 {
+				return 0, nil, false // Non-first fragment.
+			}
+			next, b = b[0], b[8:]
+		default:
+			return next, b, true
+		}
+	}
+}
+
+func protoName(proto uint8) string {
+	switch proto {
+	case protoTCP:
+		return "tcp"
+	case protoUDP:
+		return "udp"
+	case protoICMP:
+		return "icmp"
+	case protoICMPv6:
+		return "icmpv6"
+	}
+
+	return "ip:" + strconv.Itoa(int(proto))
+}
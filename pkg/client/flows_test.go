@@ -0,0 +1,196 @@
+package client
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+
+	"github.com/goxray/tun/pkg/client/mocks"
+)
+
+func TestParsePacket(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet []byte
+		ok     bool
+		want   packetInfo
+	}{
+		{
+			name:   "ipv4 tcp",
+			packet: testIPv4Packet(protoTCP, "10.0.0.2:40000", "1.1.1.1:443", 0x02),
+			ok:     true,
+			want: packetInfo{
+				proto: protoTCP,
+				src:   netip.MustParseAddrPort("10.0.0.2:40000"),
+				dst:   netip.MustParseAddrPort("1.1.1.1:443"),
+			},
+		},
+		{
+			name:   "ipv4 tcp fin",
+			packet: testIPv4Packet(protoTCP, "10.0.0.2:40000", "1.1.1.1:443", 0x11),
+			ok:     true,
+			want: packetInfo{
+				proto: protoTCP,
+				src:   netip.MustParseAddrPort("10.0.0.2:40000"),
+				dst:   netip.MustParseAddrPort("1.1.1.1:443"),
+				fin:   true,
+			},
+		},
+		{
+			name:   "ipv4 udp",
+			packet: testIPv4Packet(protoUDP, "10.0.0.2:5353", "8.8.8.8:53", 0),
+			ok:     true,
+			want: packetInfo{
+				proto: protoUDP,
+				src:   netip.MustParseAddrPort("10.0.0.2:5353"),
+				dst:   netip.MustParseAddrPort("8.8.8.8:53"),
+			},
+		},
+		{
+			name:   "ipv6 udp",
+			packet: testIPv6Packet(protoUDP, "[fd00::2]:5353", "[2001:db8::1]:53"),
+			ok:     true,
+			want: packetInfo{
+				proto: protoUDP,
+				src:   netip.MustParseAddrPort("[fd00::2]:5353"),
+				dst:   netip.MustParseAddrPort("[2001:db8::1]:53"),
+			},
+		},
+		{
+			name:   "truncated",
+			packet: testIPv4Packet(protoTCP, "10.0.0.2:40000", "1.1.1.1:443", 0)[:25],
+		},
+		{
+			name:   "garbage",
+			packet: []byte{0xff, 0x00},
+		},
+		{
+			name:   "empty",
+			packet: nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := parsePacket(test.packet)
+			require.Equal(t, test.ok, ok)
+			if test.ok {
+				require.Equal(t, test.want, got)
+			}
+		})
+	}
+}
+
+func TestFlowTracker(t *testing.T) {
+	out := testIPv4Packet(protoTCP, "10.0.0.2:40000", "1.1.1.1:443", 0x02)
+	in := testIPv4Packet(protoTCP, "1.1.1.1:443", "10.0.0.2:40000", 0x12)
+	dns := testIPv4Packet(protoUDP, "10.0.0.2:5353", "8.8.8.8:53", 0)
+
+	ioMock := mocks.NewMockioReadWriteCloser(gomock.NewController(t))
+	reads := [][]byte{out, out, dns}
+	ioMock.EXPECT().Read(gomock.Any()).DoAndReturn(func(buf []byte) (int, error) {
+		n := copy(buf, reads[0])
+		reads = reads[1:]
+		return n, nil
+	}).Times(len(reads))
+	ioMock.EXPECT().Write(gomock.Any()).DoAndReturn(func(buf []byte) (int, error) {
+		return len(buf), nil
+	}).AnyTimes()
+
+	now := time.Unix(1000, 0)
+	ft := newFlowTracker(ioMock)
+	ft.now = func() time.Time { return now }
+	ft.resolve = func(keys []flowKey) map[flowKey]process {
+		procs := make(map[flowKey]process)
+		for _, k := range keys {
+			if k.proto == protoTCP {
+				procs[k] = process{PID: 42, Executable: "/usr/bin/curl"}
+			}
+		}
+		return procs
+	}
+
+	buf := make([]byte, 1500)
+	for range 3 {
+		_, err := ft.Read(buf)
+		require.NoError(t, err)
+	}
+	_, err := ft.Write(in)
+	require.NoError(t, err)
+
+	conns := ft.Connections()
+	require.Len(t, conns, 2)
+
+	tcp := conns[0]
+	require.Equal(t, "tcp", tcp.Protocol)
+	require.Equal(t, netip.MustParseAddrPort("10.0.0.2:40000"), tcp.Source)
+	require.Equal(t, netip.MustParseAddrPort("1.1.1.1:443"), tcp.Destination)
+	require.Equal(t, uint64(2*len(out)), tcp.BytesSent)
+	require.Equal(t, uint64(len(in)), tcp.BytesReceived)
+	require.Equal(t, uint64(2), tcp.PacketsSent)
+	require.Equal(t, uint64(1), tcp.PacketsReceived)
+	require.Equal(t, now, tcp.Started)
+	require.Equal(t, 42, tcp.PID)
+	require.Equal(t, "/usr/bin/curl", tcp.Executable)
+
+	udp := conns[1]
+	require.Equal(t, "udp", udp.Protocol)
+	require.Zero(t, udp.PID)
+
+	// Idle flows are pruned.
+	now = now.Add(flowIdleTimeout + time.Second)
+	require.Empty(t, ft.Connections())
+}
+
+func testIPv4Packet(proto uint8, src, dst string, tcpFlags byte) []byte {
+	s, d := netip.MustParseAddrPort(src), netip.MustParseAddrPort(dst)
+	l4 := testL4Header(proto, s, d, tcpFlags)
+
+	b := make([]byte, 20+len(l4))
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	b[8] = 64
+	b[9] = proto
+	copy(b[12:16], s.Addr().AsSlice())
+	copy(b[16:20], d.Addr().AsSlice())
+	copy(b[20:], l4)
+
+	return b
+}
+
+func testIPv6Packet(proto uint8, src, dst string) []byte {
+	s, d := netip.MustParseAddrPort(src), netip.MustParseAddrPort(dst)
+	l4 := testL4Header(proto, s, d, 0)
+
+	b := make([]byte, 40+len(l4))
+	b[0] = 0x60
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(l4)))
+	b[6] = proto
+	b[7] = 64
+	copy(b[8:24], s.Addr().AsSlice())
+	copy(b[24:40], d.Addr().AsSlice())
+	copy(b[40:], l4)
+
+	return b
+}
+
+func testL4Header(proto uint8, s, d netip.AddrPort, tcpFlags byte) []byte {
+	var l4 []byte
+	switch proto {
+	case protoTCP:
+		l4 = make([]byte, 20)
+		l4[12] = 5 << 4
+		l4[13] = tcpFlags
+	case protoUDP:
+		l4 = make([]byte, 8)
+		binary.BigEndian.PutUint16(l4[4:6], 8)
+	}
+	binary.BigEndian.PutUint16(l4[0:2], s.Port())
+	binary.BigEndian.PutUint16(l4[2:4], d.Port())
+
+	return l4
+}
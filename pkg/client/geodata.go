@@ -0,0 +1,161 @@
+package client
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/xtls/xray-core/app/router"
+	"github.com/xtls/xray-core/common/platform"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	geoIPFile   = "geoip.dat"
+	geoSiteFile = "geosite.dat"
+)
+
+// geoRules moves "geoip:" and "geosite:" entries out of the direct rules and returns them as routing rules
+// to the direct outbound. Geo data files are read from dir, or from XRay asset location if dir is empty.
+//
+// The files are read here instead of leaving them to XRay config builder, which only looks them up in
+// the process-wide asset location, so that clients with different asset directories do not affect each other.
+func geoRules(direct directRules, dir string) (directRules, []*router.RoutingRule, error) {
+	var (
+		rest    directRules
+		geoIPs  []*router.GeoIP
+		domains []*router.Domain
+		files   = make(map[string][]byte)
+	)
+	read := func(name string) ([]byte, error) {
+		if data, ok := files[name]; ok {
+			return data, nil
+		}
+		path := platform.GetAssetLocation(name)
+		if dir != "" {
+			path = filepath.Join(dir, name)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read geo data: %w", err)
+		}
+		files[name] = data
+
+		return data, nil
+	}
+
+	for _, rule := range direct.ips {
+		code, ok := strings.CutPrefix(rule, "geoip:")
+		if !ok {
+			rest.ips = append(rest.ips, rule)
+			continue
+		}
+		code, reverse := strings.CutPrefix(code, "!")
+		data, err := read(geoIPFile)
+		if err != nil {
+			return rest, nil, err
+		}
+		var geoIP router.GeoIP
+		if err = loadGeoEntry(data, code, &geoIP); err != nil {
+			return rest, nil, fmt.Errorf("direct rule %q: %s: %w", rule, geoIPFile, err)
+		}
+		geoIP.ReverseMatch = reverse
+		geoIPs = append(geoIPs, &geoIP)
+	}
+
+	for _, rule := range direct.domains {
+		value, ok := strings.CutPrefix(rule, "geosite:")
+		if !ok {
+			rest.domains = append(rest.domains, rule)
+			continue
+		}
+		code, attrs, _ := strings.Cut(value, "@")
+		data, err := read(geoSiteFile)
+		if err != nil {
+			return rest, nil, err
+		}
+		var site router.GeoSite
+		if err = loadGeoEntry(data, code, &site); err != nil {
+			return rest, nil, fmt.Errorf("direct rule %q: %s: %w", rule, geoSiteFile, err)
+		}
+		for _, domain := range site.Domain {
+			if hasDomainAttrs(domain, attrs) {
+				domains = append(domains, domain)
+			}
+		}
+	}
+
+	var rules []*router.RoutingRule
+	target := &router.RoutingRule_Tag{Tag: directOutboundTag}
+	if len(geoIPs) > 0 {
+		rules = append(rules, &router.RoutingRule{TargetTag: target, Geoip: geoIPs})
+	}
+	if len(domains) > 0 {
+		rules = append(rules, &router.RoutingRule{TargetTag: target, Domain: domains})
+	}
+
+	return rest, rules, nil
+}
+
+// loadGeoEntry unmarshals the entry of geoip.dat or geosite.dat list with the code (case-insensitive) into entry.
+// Only the matching entry is unmarshalled, lists are large.
+func loadGeoEntry(data []byte, code string, entry proto.Message) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return fmt.Errorf("invalid geo data: %w", protowire.ParseError(n))
+		}
+		data = data[n:]
+		if num != 1 || typ != protowire.BytesType {
+			if n = protowire.ConsumeFieldValue(num, typ, data); n < 0 {
+				return fmt.Errorf("invalid geo data: %w", protowire.ParseError(n))
+			}
+			data = data[n:]
+			continue
+		}
+		b, n := protowire.ConsumeBytes(data)
+		if n < 0 {
+			return fmt.Errorf("invalid geo data: %w", protowire.ParseError(n))
+		}
+		data = data[n:]
+
+		// Country code is the first field of both GeoIP and GeoSite.
+		num, typ, n = protowire.ConsumeTag(b)
+		if n < 0 || num != 1 || typ != protowire.BytesType {
+			continue
+		}
+		if c, m := protowire.ConsumeBytes(b[n:]); m < 0 || !strings.EqualFold(string(c), code) {
+			continue
+		}
+		if err := proto.Unmarshal(b, entry); err != nil {
+			return fmt.Errorf("invalid geo data of %q: %w", code, err)
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("code %q not found", code)
+}
+
+// hasDomainAttrs reports whether geosite domain has all of "@" separated attributes, e.g. "cn@ads".
+func hasDomainAttrs(domain *router.Domain, attrs string) bool {
+	for _, attr := range strings.Split(attrs, "@") {
+		if attr == "" {
+			continue
+		}
+		found := false
+		for _, a := range domain.Attribute {
+			if strings.EqualFold(a.Key, attr) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,77 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/xtls/xray-core/app/router"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestGeoRules(t *testing.T) {
+	dir := t.TempDir()
+	writeGeoData(t, dir)
+
+	direct, err := parseDirectRules([]string{
+		"geoip:lo", "geoip:!doc", "10.0.0.0/8", "geosite:test", "geosite:test@ads", "example.com",
+	})
+	require.NoError(t, err)
+	rest, rules, err := geoRules(direct, dir)
+	require.NoError(t, err)
+	require.Equal(t, directRules{domains: []string{"domain:example.com"}, ips: []string{"10.0.0.0/8"}}, rest)
+	require.Len(t, rules, 2)
+	for _, rule := range rules {
+		require.Equal(t, directOutboundTag, rule.GetTag())
+	}
+
+	geoIPs := rules[0].Geoip
+	require.Len(t, geoIPs, 2)
+	require.Equal(t, "LO", geoIPs[0].CountryCode)
+	require.False(t, geoIPs[0].ReverseMatch)
+	require.Equal(t, []byte{127, 0, 0, 0}, geoIPs[0].Cidr[0].Ip)
+	require.Equal(t, "DOC", geoIPs[1].CountryCode)
+	require.True(t, geoIPs[1].ReverseMatch)
+
+	var domains []string
+	for _, d := range rules[1].Domain {
+		domains = append(domains, d.Value)
+	}
+	require.Equal(t, []string{"example.org", "ads.example.org", "ads.example.org"}, domains)
+
+	// Rules without geo data do not need the files.
+	rest, rules, err = geoRules(directRules{ips: []string{"10.0.0.0/8"}}, t.TempDir())
+	require.NoError(t, err)
+	require.Equal(t, directRules{ips: []string{"10.0.0.0/8"}}, rest)
+	require.Empty(t, rules)
+
+	_, _, err = geoRules(directRules{ips: []string{"geoip:ru"}}, dir)
+	require.ErrorContains(t, err, `geoip.dat: code "ru" not found`)
+	_, _, err = geoRules(directRules{domains: []string{"geosite:test"}}, t.TempDir())
+	require.ErrorContains(t, err, "geosite.dat")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, geoIPFile), []byte{0x0a, 0x10}, 0o600))
+	_, _, err = geoRules(directRules{ips: []string{"geoip:lo"}}, dir)
+	require.ErrorContains(t, err, "invalid geo data")
+}
+
+// writeGeoData writes geoip.dat with LO (127.0.0.0/8) and DOC (192.0.2.0/24) codes
+// and geosite.dat with TEST code to dir.
+func writeGeoData(t *testing.T, dir string) {
+	geoIP, err := proto.Marshal(&router.GeoIPList{Entry: []*router.GeoIP{
+		{CountryCode: "DOC", Cidr: []*router.CIDR{{Ip: []byte{192, 0, 2, 0}, Prefix: 24}}},
+		{CountryCode: "LO", Cidr: []*router.CIDR{{Ip: []byte{127, 0, 0, 0}, Prefix: 8}}},
+	}})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, geoIPFile), geoIP, 0o600))
+
+	geoSite, err := proto.Marshal(&router.GeoSiteList{Entry: []*router.GeoSite{
+		{CountryCode: "OTHER", Domain: []*router.Domain{{Type: router.Domain_Full, Value: "other.example"}}},
+		{CountryCode: "TEST", Domain: []*router.Domain{
+			{Type: router.Domain_Domain, Value: "example.org"},
+			{Type: router.Domain_Full, Value: "ads.example.org", Attribute: []*router.Domain_Attribute{{Key: "ads"}}},
+		}},
+	}})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, geoSiteFile), geoSite, 0o600))
+}
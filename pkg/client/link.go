@@ -0,0 +1,309 @@
+package client
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	xrayproto "github.com/lilendian0x00/xray-knife/v3/pkg/protocol"
+	"github.com/lilendian0x00/xray-knife/v3/pkg/xray"
+)
+
+// Supported link protocols.
+const (
+	ProtocolVLESS       = "vless"
+	ProtocolVMess       = "vmess"
+	ProtocolTrojan      = "trojan"
+	ProtocolShadowsocks = "shadowsocks"
+	ProtocolWireGuard   = "wireguard"
+)
+
+// ErrUnsupportedProtocol is returned by ParseLink for links of unsupported protocols.
+var ErrUnsupportedProtocol = errors.New("unsupported protocol")
+
+// ServerInfo is a parsed and normalized connection link.
+type ServerInfo struct {
+	Protocol    string // One of Protocol* constants.
+	Address     string // Server host name or IP (IPv6 without brackets).
+	Port        int
+	Transport   string // Network type: tcp, ws, grpc, xhttp, httpupgrade, kcp e.t.c.
+	Security    string // Stream security: none, tls or reality.
+	SNI         string
+	Fingerprint string // uTLS fingerprint (e.g. chrome).
+	Remark      string
+
+	// ID is the user UUID for vless and vmess, and the password for trojan and shadowsocks.
+	ID string
+	// Method is the shadowsocks cipher or the vmess security (e.g. auto, aes-128-gcm).
+	Method string
+	// AlterID is the vmess alter ID.
+	AlterID int
+	// Flow is the vless flow control (e.g. xtls-rprx-vision).
+	Flow string
+
+	// Transport settings.
+	Host        string
+	Path        string
+	HeaderType  string // TCP header obfuscation type (none, http).
+	ServiceName string // gRPC service name.
+	Authority   string // gRPC authority.
+	Mode        string // gRPC or xhttp mode.
+
+	// TLS and REALITY settings.
+	ALPN          []string
+	AllowInsecure bool
+	PublicKey     string // REALITY public key.
+	ShortID       string // REALITY short ID.
+	SpiderX       string // REALITY spider path.
+
+	// WireGuard is the full config of wireguard links, Transport of them is always udp.
+	WireGuard *WireGuardConfig
+}
+
+// ParseLink parses connection link (vless://, vmess://, trojan://, ss://, wireguard://) into ServerInfo.
+func ParseLink(link string) (*ServerInfo, error) {
+	link = strings.TrimSpace(link)
+	if isWireGuardLink(link) {
+		wg, err := ParseWireGuardLink(link)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config: parse: %w", err)
+		}
+
+		return newWireGuardServerInfo(wg)
+	}
+
+	svc := xray.NewXrayService(false, false)
+	protocol, err := svc.CreateProtocol(link)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config: protocol create: %w", err)
+	}
+	if err = protocol.Parse(); err != nil {
+		return nil, fmt.Errorf("invalid config: parse: %w", err)
+	}
+
+	return newServerInfo(protocol)
+}
+
+// newWireGuardServerInfo converts parsed WireGuard config to ServerInfo.
+func newWireGuardServerInfo(wg *WireGuardConfig) (*ServerInfo, error) {
+	host, port, _ := net.SplitHostPort(wg.Endpoint)
+	s := &ServerInfo{Protocol: ProtocolWireGuard, Address: host, Transport: "udp", Remark: wg.Remark, WireGuard: wg}
+	if err := s.setPort(port); err != nil {
+		return nil, err
+	}
+	s.normalize()
+
+	return s, nil
+}
+
+// newServerInfo converts parsed xray-knife protocol to ServerInfo.
+func newServerInfo(protocol xrayproto.Protocol) (*ServerInfo, error) {
+	var s *ServerInfo
+	switch p := protocol.(type) {
+	case *xray.Vless:
+		s = &ServerInfo{
+			Protocol: ProtocolVLESS, Address: p.Address, Transport: p.Type, Security: p.Security, SNI: p.SNI,
+			Fingerprint: p.TlsFingerprint, Remark: p.Remark, ID: p.ID, Flow: p.Flow, Host: p.Host, Path: p.Path,
+			HeaderType: p.HeaderType, ServiceName: p.ServiceName, Authority: p.Authority, Mode: p.Mode,
+			ALPN: splitList(p.ALPN), AllowInsecure: parseBool(p.AllowInsecure),
+			PublicKey: p.PublicKey, ShortID: p.ShortIds, SpiderX: p.SpiderX,
+		}
+		if err := s.setPort(p.Port); err != nil {
+			return nil, err
+		}
+	case *xray.Trojan:
+		s = &ServerInfo{
+			Protocol: ProtocolTrojan, Address: p.Address, Transport: p.Type, Security: p.Security, SNI: p.SNI,
+			Fingerprint: p.TlsFingerprint, Remark: p.Remark, ID: p.Password, Flow: p.Flow, Host: p.Host, Path: p.Path,
+			HeaderType: p.HeaderType, ServiceName: p.ServiceName, Authority: p.Authority, Mode: p.Mode,
+			ALPN: splitList(p.ALPN), AllowInsecure: parseBool(p.AllowInsecure),
+			PublicKey: p.PublicKey, ShortID: p.ShortIds, SpiderX: p.SpiderX,
+		}
+		if err := s.setPort(p.Port); err != nil {
+			return nil, err
+		}
+	case *xray.Vmess:
+		s = &ServerInfo{
+			Protocol: ProtocolVMess, Address: p.Address, Transport: p.Network, Security: p.TLS, SNI: p.SNI,
+			Fingerprint: p.TlsFingerprint, Remark: p.Remark, ID: p.ID, Method: p.Security, Host: p.Host,
+			Path: p.Path, HeaderType: p.Type, ALPN: splitList(p.ALPN),
+			AllowInsecure: parseBool(fmt.Sprint(p.AllowInsecure)),
+		}
+		if s.Transport == "grpc" {
+			s.ServiceName, s.Path = p.Path, ""
+		}
+		if err := s.setPort(fmt.Sprint(p.Port)); err != nil {
+			return nil, err
+		}
+		if aid := fmt.Sprint(p.Aid); p.Aid != nil && aid != "" {
+			var err error
+			if s.AlterID, err = strconv.Atoi(aid); err != nil {
+				return nil, fmt.Errorf("invalid vmess alter id %q: %w", aid, err)
+			}
+		}
+	case *xray.Shadowsocks:
+		s = &ServerInfo{
+			Protocol: ProtocolShadowsocks, Address: p.Address, Transport: "tcp", Remark: p.Remark,
+			ID: p.Password, Method: p.Encryption,
+		}
+		if err := s.setPort(p.Port); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%w: %T", ErrUnsupportedProtocol, protocol)
+	}
+
+	s.normalize()
+
+	return s, nil
+}
+
+func (s *ServerInfo) setPort(port string) error {
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q: %w", port, err)
+	}
+	s.Port = int(p)
+
+	return nil
+}
+
+// normalize fills implicit defaults, so that equal configurations produce equal ServerInfo.
+func (s *ServerInfo) normalize() {
+	s.Address = strings.Trim(s.Address, "[]")
+	if s.Transport == "" {
+		s.Transport = "tcp"
+	}
+	if s.Security == "" {
+		s.Security = "none"
+	}
+	if s.HeaderType == "none" {
+		s.HeaderType = ""
+	}
+	if s.Protocol == ProtocolVMess && s.Method == "" {
+		s.Method = "auto"
+	}
+}
+
+// HostPort returns server address in host:port form.
+func (s *ServerInfo) HostPort() string {
+	return net.JoinHostPort(s.Address, strconv.Itoa(s.Port))
+}
+
+// Link serializes ServerInfo back to a connection link.
+//
+// The link is normalized: parameters are sorted and only non-default ones are set,
+// so parsing the result with ParseLink gives the same ServerInfo.
+func (s *ServerInfo) Link() string {
+	switch s.Protocol {
+	case ProtocolVMess:
+		return s.vmessLink()
+	case ProtocolWireGuard:
+		return s.WireGuard.Link()
+	case ProtocolShadowsocks:
+		userInfo := base64.RawURLEncoding.EncodeToString([]byte(s.Method + ":" + s.ID))
+		return "ss://" + userInfo + "@" + s.HostPort() + remarkFragment(s.Remark)
+	}
+
+	q := url.Values{}
+	set := func(key, value string) {
+		if value != "" {
+			q.Set(key, value)
+		}
+	}
+	set("type", s.Transport)
+	set("security", s.Security)
+	if s.Protocol == ProtocolVLESS {
+		q.Set("encryption", "none")
+	}
+	set("sni", s.SNI)
+	set("fp", s.Fingerprint)
+	set("alpn", strings.Join(s.ALPN, ","))
+	set("flow", s.Flow)
+	set("host", s.Host)
+	set("path", s.Path)
+	set("headerType", s.HeaderType)
+	set("serviceName", s.ServiceName)
+	set("authority", s.Authority)
+	set("mode", s.Mode)
+	set("pbk", s.PublicKey)
+	set("sid", s.ShortID)
+	set("spx", s.SpiderX)
+	if s.AllowInsecure {
+		q.Set("allowInsecure", "1")
+	}
+
+	u := url.URL{
+		Scheme:   s.Protocol,
+		User:     url.User(s.ID),
+		Host:     s.HostPort(),
+		RawQuery: q.Encode(),
+	}
+
+	return u.String() + remarkFragment(s.Remark)
+}
+
+// vmessLink serializes ServerInfo into v2rayN style vmess link (base64 encoded JSON).
+func (s *ServerInfo) vmessLink() string {
+	path := s.Path
+	if s.Transport == "grpc" {
+		path = s.ServiceName
+	}
+	tls := s.Security
+	if tls == "none" {
+		tls = ""
+	}
+	headerType := s.HeaderType
+	if headerType == "" {
+		headerType = "none"
+	}
+
+	v := map[string]string{
+		"v":    "2",
+		"ps":   s.Remark,
+		"add":  s.Address,
+		"port": strconv.Itoa(s.Port),
+		"id":   s.ID,
+		"aid":  strconv.Itoa(s.AlterID),
+		"scy":  s.Method,
+		"net":  s.Transport,
+		"type": headerType,
+		"host": s.Host,
+		"path": path,
+		"tls":  tls,
+		"sni":  s.SNI,
+		"alpn": strings.Join(s.ALPN, ","),
+		"fp":   s.Fingerprint,
+	}
+	if s.AllowInsecure {
+		v["allowinsecure"] = "1"
+	}
+	b, _ := json.Marshal(v) // Map keys are sorted, the output is stable.
+
+	return "vmess://" + base64.StdEncoding.EncodeToString(b)
+}
+
+func remarkFragment(remark string) string {
+	if remark == "" {
+		return ""
+	}
+
+	return "#" + url.PathEscape(remark)
+}
+
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+
+	return strings.Split(s, ",")
+}
+
+func parseBool(s string) bool {
+	return s == "1" || strings.EqualFold(s, "true")
+}
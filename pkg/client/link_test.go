@@ -0,0 +1,93 @@
+package client
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLink(t *testing.T) {
+	vmessJSON := `{"v":"2","ps":"vmess ws","add":"example.com","port":"443","id":"` + testUUID +
+		`","aid":"0","scy":"auto","net":"ws","type":"none","host":"cdn.example.com","path":"/ws","tls":"tls","sni":"example.com","fp":"chrome"}`
+
+	tests := []struct {
+		name string
+		link string
+		exp  ServerInfo
+	}{
+		{
+			name: "vless reality",
+			link: "vless://" + testUUID + "@1.2.3.4:443?type=tcp&security=reality&sni=www.google.com&fp=firefox" +
+				"&pbk=public-key&sid=abcd&spx=%2F&flow=xtls-rprx-vision&encryption=none#my%20server",
+			exp: ServerInfo{
+				Protocol: ProtocolVLESS, Address: "1.2.3.4", Port: 443, Transport: "tcp", Security: "reality",
+				SNI: "www.google.com", Fingerprint: "firefox", Remark: "my server", ID: testUUID,
+				Flow: "xtls-rprx-vision", PublicKey: "public-key", ShortID: "abcd", SpiderX: "/",
+			},
+		},
+		{
+			name: "vless grpc ipv6",
+			link: "vless://" + testUUID + "@[2001:db8::1]:8443?type=grpc&serviceName=svc&mode=multi&security=tls" +
+				"&sni=example.com&alpn=h2,http%2F1.1#grpc",
+			exp: ServerInfo{
+				Protocol: ProtocolVLESS, Address: "2001:db8::1", Port: 8443, Transport: "grpc", Security: "tls",
+				SNI: "example.com", Fingerprint: "chrome", Remark: "grpc", ID: testUUID, ServiceName: "svc",
+				Mode: "multi", ALPN: []string{"h2", "http/1.1"},
+			},
+		},
+		{
+			name: "vmess ws",
+			link: "vmess://" + base64.StdEncoding.EncodeToString([]byte(vmessJSON)),
+			exp: ServerInfo{
+				Protocol: ProtocolVMess, Address: "example.com", Port: 443, Transport: "ws", Security: "tls",
+				SNI: "example.com", Fingerprint: "chrome", Remark: "vmess ws", ID: testUUID, Method: "auto",
+				Host: "cdn.example.com", Path: "/ws",
+			},
+		},
+		{
+			name: "trojan",
+			link: "trojan://secret@example.org:443?sni=example.org&type=ws&path=%2Ftrojan&allowInsecure=1#trojan",
+			exp: ServerInfo{
+				Protocol: ProtocolTrojan, Address: "example.org", Port: 443, Transport: "ws", Security: "tls",
+				SNI: "example.org", Fingerprint: "chrome", Remark: "trojan", ID: "secret", Path: "/trojan", AllowInsecure: true,
+			},
+		},
+		{
+			name: "shadowsocks",
+			link: "ss://" + base64.StdEncoding.EncodeToString([]byte("chacha20-ietf-poly1305:pass@word")) +
+				"@5.6.7.8:8388#ss%20server",
+			exp: ServerInfo{
+				Protocol: ProtocolShadowsocks, Address: "5.6.7.8", Port: 8388, Transport: "tcp", Security: "none",
+				Remark: "ss server", ID: "pass@word", Method: "chacha20-ietf-poly1305",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			info, err := ParseLink(test.link)
+			require.NoError(t, err)
+			require.Equal(t, test.exp, *info)
+
+			// Serialized link is parsed back to the same info and serialization is stable.
+			link := info.Link()
+			info2, err := ParseLink(link)
+			require.NoError(t, err, link)
+			require.Equal(t, *info, *info2, link)
+			require.Equal(t, link, info2.Link())
+		})
+	}
+}
+
+func TestParseLink_Invalid(t *testing.T) {
+	for _, link := range []string{
+		"",
+		"invalid_link",
+		"http://example.com",
+		"vless://" + testUUID + "@1.2.3.4:port?type=tcp",
+	} {
+		_, err := ParseLink(link)
+		require.Error(t, err, link)
+	}
+}
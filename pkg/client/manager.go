@@ -0,0 +1,149 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+)
+
+var (
+	// ErrTunnelExists is returned by Manager.Connect when tunnel with the name is already running.
+	ErrTunnelExists = errors.New("tunnel already exists")
+	// ErrTunnelNotFound is returned by Manager when there is no tunnel with the name.
+	ErrTunnelNotFound = errors.New("tunnel not found")
+)
+
+// TunnelInfo describes tunnel run by Manager.
+type TunnelInfo struct {
+	Name         string
+	State        State
+	InboundProxy Proxy
+	TUNAddress   net.IP
+	Routes       []string // Host routes pointed to the TUN device.
+	BytesRead    int
+	BytesWritten int
+}
+
+// Manager runs several tunnels (Clients) side by side in one process.
+//
+// Every tunnel gets its own inbound proxy port and TUN address. Host routes can't be shared,
+// so tunnels either must be given different Config.RoutesToTUN or run in namespace mode or on own TUN device.
+type Manager struct {
+	newClient func(Config) (*Client, error)
+
+	mu      sync.Mutex
+	tunnels map[string]*Client // nil value reserves the name of the tunnel being connected.
+}
+
+// NewManager creates Manager without tunnels.
+func NewManager() *Manager {
+	return &Manager{newClient: NewClientWithOpts, tunnels: make(map[string]*Client)}
+}
+
+// Connect creates new Client with cfg and connects it to link (through optional chain hops, see Client.Connect),
+// the tunnel is referred to by name.
+func (m *Manager) Connect(name, link string, cfg Config, hops ...string) error {
+	m.mu.Lock()
+	if _, ok := m.tunnels[name]; ok {
+		m.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrTunnelExists, name)
+	}
+	m.tunnels[name] = nil
+	m.mu.Unlock()
+
+	c, err := m.newClient(cfg)
+	if err == nil {
+		err = c.Connect(link, hops...)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		delete(m.tunnels, name)
+		return fmt.Errorf("connect %s: %w", name, err)
+	}
+	m.tunnels[name] = c
+
+	return nil
+}
+
+// Disconnect disconnects the tunnel and removes it from the Manager.
+func (m *Manager) Disconnect(ctx context.Context, name string) error {
+	m.mu.Lock()
+	c := m.tunnels[name]
+	if c == nil {
+		m.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrTunnelNotFound, name)
+	}
+	delete(m.tunnels, name)
+	m.mu.Unlock()
+
+	if err := c.Disconnect(ctx); err != nil {
+		return fmt.Errorf("disconnect %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// Get returns connected tunnel client.
+func (m *Manager) Get(name string) (*Client, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c := m.tunnels[name]
+
+	return c, c != nil
+}
+
+// Tunnels returns connected tunnels sorted by name.
+func (m *Manager) Tunnels() []TunnelInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tunnels := make([]TunnelInfo, 0, len(m.tunnels))
+	for name, c := range m.tunnels {
+		if c == nil {
+			continue
+		}
+		tunnels = append(tunnels, TunnelInfo{
+			Name:         name,
+			State:        c.State(),
+			InboundProxy: c.InboundProxy(),
+			TUNAddress:   c.TUNAddress(),
+			Routes:       c.Routes(),
+			BytesRead:    c.BytesRead(),
+			BytesWritten: c.BytesWritten(),
+		})
+	}
+	sort.Slice(tunnels, func(i, j int) bool { return tunnels[i].Name < tunnels[j].Name })
+
+	return tunnels
+}
+
+// Close disconnects all tunnels concurrently.
+func (m *Manager) Close(ctx context.Context) error {
+	m.mu.Lock()
+	names := make([]string, 0, len(m.tunnels))
+	for name, c := range m.tunnels {
+		if c != nil {
+			names = append(names, name)
+		}
+	}
+	m.mu.Unlock()
+
+	errs := make([]error, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = m.Disconnect(ctx, name)
+		}()
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
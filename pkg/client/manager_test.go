@@ -0,0 +1,97 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+)
+
+func TestManager(t *testing.T) {
+	// Loopback destinations are dropped by network stacks, so the server redirects everything to echo server.
+	srvPort := startTestXrayServerWithOutbound(t, fmt.Sprintf(`{
+		"protocol": "vless",
+		"settings": {"clients": [{"id": %q}], "decryption": "none"},
+		"streamSettings": {"network": "tcp"}
+	}`, testUUID), fmt.Sprintf(`{"protocol": "freedom", "settings": {"redirect": %q}}`, startTCPEcho(t)))
+	link := fmt.Sprintf("vless://%s@127.0.0.1:%d?type=tcp&security=none#manager", testUUID, srvPort)
+	dst := tcpip.FullAddress{Addr: tcpip.AddrFrom4([4]byte{203, 0, 113, 10}), Port: 443}
+
+	m := NewManager()
+	apps := make(map[string]*gonet.TCPConn)
+	for _, name := range []string{"b", "a"} {
+		app, dev := newTestAppStack(t)
+		// Health target is redirected to the echo server too.
+		require.NoError(t, m.Connect(name, link, Config{TUN: dev, HealthTarget: "tcp://203.0.113.10:443"}))
+		require.ErrorIs(t, m.Connect(name, link, Config{TUN: dev}), ErrTunnelExists)
+
+		conn, err := gonet.DialTCP(app, dst, ipv4.ProtocolNumber)
+		require.NoError(t, err)
+		require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+		apps[name] = conn
+	}
+
+	// Tunnels work side by side.
+	for name, conn := range apps {
+		_, err := conn.Write([]byte("hello " + name))
+		require.NoError(t, err)
+	}
+	for name, conn := range apps {
+		reply := make([]byte, 7)
+		_, err := io.ReadFull(conn, reply)
+		require.NoError(t, err)
+		require.Equal(t, "hello "+name, string(reply))
+	}
+
+	tunnels := m.Tunnels()
+	require.Len(t, tunnels, 2)
+	require.Equal(t, "a", tunnels[0].Name)
+	require.Equal(t, "b", tunnels[1].Name)
+	require.NotEqual(t, tunnels[0].InboundProxy.Port, tunnels[1].InboundProxy.Port)
+	for _, tunnel := range tunnels {
+		require.Equal(t, StateConnected, tunnel.State)
+		require.Positive(t, tunnel.BytesRead)
+		require.Positive(t, tunnel.BytesWritten)
+		require.Nil(t, tunnel.TUNAddress) // Own TUN device, the address is set up by its owner.
+	}
+
+	c, ok := m.Get("a")
+	require.True(t, ok)
+	require.NoError(t, c.Health())
+	_, ok = m.Get("c")
+	require.False(t, ok)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, m.Disconnect(ctx, "a"))
+	require.ErrorIs(t, m.Disconnect(ctx, "a"), ErrTunnelNotFound)
+	require.Equal(t, StateDisconnected, c.State())
+	require.Len(t, m.Tunnels(), 1)
+
+	require.NoError(t, m.Close(ctx))
+	require.Empty(t, m.Tunnels())
+}
+
+func TestManager_ConnectFailure(t *testing.T) {
+	m := NewManager()
+	_, dev := newTestAppStack(t)
+	require.ErrorContains(t, m.Connect("a", "invalid_link", Config{TUN: dev}), "connect a: create xray core instance")
+	require.Empty(t, m.Tunnels())
+
+	// Configured inbound proxy port is not retried.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	link := fmt.Sprintf("vless://%s@127.0.0.1:%d?type=tcp&security=none", testUUID, freeTCPPort(t))
+	err = m.Connect("a", link, Config{TUN: dev, InboundProxy: &Proxy{IP: net.IPv4(127, 0, 0, 1), Port: ln.Addr().(*net.TCPAddr).Port}})
+	require.ErrorIs(t, err, syscall.EADDRINUSE)
+	require.Empty(t, m.Tunnels())
+}
@@ -2,14 +2,15 @@ package client
 
 import (
 	"io"
+	"sync/atomic"
 )
 
-// readerMetrics wraps io.ReadWriteCloser with simple metrics.
+// readerMetrics wraps io.ReadWriteCloser with simple metrics, they may be read while the data is copied.
 type readerMetrics struct {
 	io.ReadWriteCloser
 
-	nRead    int
-	nWritten int
+	nRead    atomic.Int64
+	nWritten atomic.Int64
 }
 
 func newReaderMetrics(rw io.ReadWriteCloser) *readerMetrics {
@@ -17,17 +18,17 @@ func newReaderMetrics(rw io.ReadWriteCloser) *readerMetrics {
 }
 
 func (s *readerMetrics) BytesRead() int {
-	return s.nRead
+	return int(s.nRead.Load())
 }
 
 func (s *readerMetrics) BytesWritten() int {
-	return s.nWritten
+	return int(s.nWritten.Load())
 }
 
 func (s *readerMetrics) Read(p []byte) (n int, err error) {
 	n, err = s.ReadWriteCloser.Read(p)
 	if err == nil {
-		s.nRead += n
+		s.nRead.Add(int64(n))
 	}
 
 	return n, err
@@ -36,7 +37,7 @@ func (s *readerMetrics) Read(p []byte) (n int, err error) {
 func (s *readerMetrics) Write(p []byte) (n int, err error) {
 	n, err = s.ReadWriteCloser.Write(p)
 	if err == nil {
-		s.nWritten += n
+		s.nWritten.Add(int64(n))
 	}
 
 	return n, err
@@ -0,0 +1,164 @@
+//go:build linux
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"runtime"
+
+	"github.com/goxray/core/network/tun"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// namespaceTunnel is TUN device living in another network namespace.
+// Closing it destroys the device and deletes the namespace if it was created by the client.
+type namespaceTunnel struct {
+	*tun.Interface
+	ns      netns.NsHandle
+	created string // Name of the namespace created by the client.
+}
+
+func (t *namespaceTunnel) Close() error {
+	err := errors.Join(t.Interface.Close(), t.ns.Close())
+	if t.created != "" {
+		if delErr := netns.DeleteNamed(t.created); delErr != nil {
+			err = errors.Join(err, fmt.Errorf("delete namespace %s: %w", t.created, delErr))
+		}
+	}
+
+	return err
+}
+
+// setupNamespaceTunnel creates TUN device and moves it into the network namespace set in Config.Namespace.
+// Inside the namespace the device gets TUNAddress and the default route, host routing is left untouched.
+// XRay instance keeps running in the host namespace, so the outbound connections use host routing.
+func (c *Client) setupNamespaceTunnel() (io.ReadWriteCloser, error) {
+	ns, created, err := openNamespace(c.cfg.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	t := &namespaceTunnel{ns: ns}
+	if created {
+		t.created = c.cfg.Namespace.Name
+	}
+
+	t.Interface, err = tun.New("", 1500)
+	if err != nil {
+		_ = t.ns.Close()
+		if created {
+			_ = netns.DeleteNamed(t.created)
+		}
+
+		return nil, fmt.Errorf("create tun: %w", err)
+	}
+	if err = setupNamespaceLink(ns, t.Name(), c.tunAddr); err != nil {
+		return nil, errors.Join(err, t.Close())
+	}
+
+	return t, nil
+}
+
+// setupNamespaceLink moves the link into the namespace, assigns the address and routes all traffic to it.
+func setupNamespaceLink(ns netns.NsHandle, name string, addr *net.IPNet) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("find %s interface: %w", name, err)
+	}
+	if err = netlink.LinkSetNsFd(link, int(ns)); err != nil {
+		return fmt.Errorf("move %s interface to namespace: %w", name, err)
+	}
+
+	h, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return fmt.Errorf("open namespace netlink handle: %w", err)
+	}
+	defer h.Close()
+
+	// Loopback is down in newly created namespaces.
+	if lo, err := h.LinkByName("lo"); err == nil {
+		if err = h.LinkSetUp(lo); err != nil {
+			return fmt.Errorf("set lo interface up: %w", err)
+		}
+	}
+
+	if link, err = h.LinkByName(name); err != nil {
+		return fmt.Errorf("find %s interface in namespace: %w", name, err)
+	}
+	if err = h.AddrAdd(link, &netlink.Addr{IPNet: addr}); err != nil {
+		return fmt.Errorf("set address on %s interface: %w", name, err)
+	}
+	if err = h.LinkSetUp(link); err != nil {
+		return fmt.Errorf("set %s interface up: %w", name, err)
+	}
+
+	defaultRoute := &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}
+	err = h.RouteAdd(&netlink.Route{LinkIndex: link.Attrs().Index, Scope: netlink.SCOPE_LINK, Dst: defaultRoute})
+	if err != nil {
+		return fmt.Errorf("add default route: %w", err)
+	}
+
+	return nil
+}
+
+// openNamespace opens the named namespace (creating it if it does not exist) or the namespace of the process.
+func openNamespace(cfg *Namespace) (ns netns.NsHandle, created bool, err error) {
+	switch {
+	case cfg.Name != "":
+		ns, err = netns.GetFromName(cfg.Name)
+		if err == nil {
+			return ns, false, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return ns, false, fmt.Errorf("open namespace %s: %w", cfg.Name, err)
+		}
+		if ns, err = newNamedNamespace(cfg.Name); err != nil {
+			return ns, false, fmt.Errorf("create namespace %s: %w", cfg.Name, err)
+		}
+
+		return ns, true, nil
+	case cfg.PID != 0:
+		if ns, err = netns.GetFromPid(cfg.PID); err != nil {
+			return ns, false, fmt.Errorf("open namespace of process %d: %w", cfg.PID, err)
+		}
+
+		return ns, false, nil
+	}
+
+	return netns.None(), false, errors.New("namespace name or PID is required")
+}
+
+// newNamedNamespace creates named namespace (like "ip netns add") without switching
+// namespace of the calling goroutine.
+func newNamedNamespace(name string) (netns.NsHandle, error) {
+	type result struct {
+		ns  netns.NsHandle
+		err error
+	}
+	res := make(chan result, 1)
+	go func() {
+		// NewNamed switches the thread to the new namespace. The thread is unlocked only after
+		// switching it back, otherwise it is terminated when the goroutine exits instead of being reused.
+		runtime.LockOSThread()
+		orig, err := netns.Get()
+		if err != nil {
+			runtime.UnlockOSThread()
+			res <- result{netns.None(), fmt.Errorf("get current namespace: %w", err)}
+			return
+		}
+		defer orig.Close()
+
+		ns, err := netns.NewNamed(name)
+		if setErr := netns.Set(orig); setErr == nil {
+			runtime.UnlockOSThread()
+		}
+		res <- result{ns, err}
+	}()
+	r := <-res
+
+	return r.ns, r.err
+}
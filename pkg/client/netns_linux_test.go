@@ -0,0 +1,84 @@
+//go:build linux
+
+package client
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+func TestSetupNamespaceTunnel(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("root is required to manage network namespaces")
+	}
+	name := fmt.Sprintf("goxray-test-%d", os.Getpid())
+	tunAddr := &net.IPNet{IP: net.IPv4(192, 18, 0, 1), Mask: net.CIDRMask(32, 32)}
+	cl := &Client{cfg: Config{Namespace: &Namespace{Name: name}}, tunAddr: tunAddr}
+
+	tunnel, err := cl.setupNamespaceTunnel()
+	if err != nil {
+		_ = netns.DeleteNamed(name)
+		t.Skipf("network namespaces are not available: %v", err)
+	}
+	ifName := tunnel.(*namespaceTunnel).Name()
+
+	// The device is not visible on the host.
+	_, err = netlink.LinkByName(ifName)
+	require.Error(t, err)
+
+	ns, err := netns.GetFromName(name)
+	require.NoError(t, err)
+	h, err := netlink.NewHandleAt(ns)
+	require.NoError(t, err)
+	link, err := h.LinkByName(ifName)
+	require.NoError(t, err)
+	addrs, err := h.AddrList(link, netlink.FAMILY_V4)
+	require.NoError(t, err)
+	require.Len(t, addrs, 1)
+	require.Equal(t, tunAddr.String(), addrs[0].IPNet.String())
+	routes, err := h.RouteList(link, netlink.FAMILY_V4)
+	require.NoError(t, err)
+	require.True(t, hasDefaultRoute(routes), "routes: %v", routes)
+
+	h.Close()
+	require.NoError(t, ns.Close())
+	require.NoError(t, tunnel.Close())
+	_, err = netns.GetFromName(name)
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	// Existing namespace is joined and is not deleted on close.
+	ns, err = newNamedNamespace(name)
+	require.NoError(t, err)
+	defer netns.DeleteNamed(name)
+	require.NoError(t, ns.Close())
+	tunnel, err = cl.setupNamespaceTunnel()
+	require.NoError(t, err)
+	require.Empty(t, tunnel.(*namespaceTunnel).created)
+	require.NoError(t, tunnel.Close())
+	_, err = netns.GetFromName(name)
+	require.NoError(t, err)
+}
+
+func hasDefaultRoute(routes []netlink.Route) bool {
+	for _, r := range routes {
+		if r.Dst == nil || r.Dst.String() == "0.0.0.0/0" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestOpenNamespace_Invalid(t *testing.T) {
+	_, _, err := openNamespace(&Namespace{})
+	require.Error(t, err)
+
+	_, _, err = openNamespace(&Namespace{PID: 1 << 30})
+	require.Error(t, err)
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package client
+
+import (
+	"errors"
+	"io"
+)
+
+func (c *Client) setupNamespaceTunnel() (io.ReadWriteCloser, error) {
+	return nil, errors.New("network namespace mode is supported on Linux only")
+}
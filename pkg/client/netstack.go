@@ -0,0 +1,317 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+const (
+	netstackNICID = 1
+	// netstackQueueSize is the number of outbound packets buffered before they are written to the device.
+	netstackQueueSize = 512
+	// netstackMaxInFlight is the maximum number of TCP connections being established at once.
+	netstackMaxInFlight = 1024
+)
+
+// netstackOpts contain options of the userspace network stack connecting TUN device to the socks proxy.
+type netstackOpts struct {
+	MTU        int
+	UDPTimeout time.Duration // UDP flow is closed after this period of inactivity.
+}
+
+var defaultNetstackOpts = netstackOpts{
+	MTU:        1500,
+	UDPTimeout: 30 * time.Second,
+}
+
+// netstackPipe routes IP packets from io.ReadWriteCloser to socks5 proxy and back.
+//
+// Each Copy call runs its own userspace TCP/IP stack, so several pipes can run in one process
+// (unlike pipe2socks which is backed by a global lwIP stack).
+type netstackPipe struct {
+	opts netstackOpts
+}
+
+func newNetstackPipe(opts netstackOpts) *netstackPipe {
+	return &netstackPipe{opts: opts}
+}
+
+// Copy reads IP packets from dev and routes TCP and UDP flows to socks5 proxy.
+//
+// It blocks till ctx is cancelled (returns nil) or dev fails.
+func (p *netstackPipe) Copy(ctx context.Context, dev io.ReadWriteCloser, socks5 string) error {
+	if _, err := netip.ParseAddrPort(socks5); err != nil {
+		return fmt.Errorf("parse socks addr: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ep := channel.New(netstackQueueSize, uint32(p.opts.MTU), "")
+	s, err := p.newStack(ctx, ep, socks5)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		ep.Close()
+		s.Close()
+		s.Wait()
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer cancel() // Unblock device reading if we can't write to it anymore.
+		for {
+			pkt := ep.ReadContext(ctx)
+			if pkt == nil {
+				return
+			}
+			view := pkt.ToView()
+			_, err := dev.Write(view.AsSlice())
+			view.Release()
+			pkt.DecRef()
+			if err != nil {
+				return
+			}
+		}
+	}()
+	defer wg.Wait()
+
+	buf := make([]byte, p.opts.MTU)
+	for {
+		n, err := dev.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			return fmt.Errorf("read device: %w", err)
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		if n == 0 {
+			continue
+		}
+
+		var proto tcpip.NetworkProtocolNumber
+		switch header.IPVersion(buf[:n]) {
+		case header.IPv4Version:
+			proto = ipv4.ProtocolNumber
+		case header.IPv6Version:
+			proto = ipv6.ProtocolNumber
+		default:
+			continue
+		}
+		pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+			Payload: buffer.MakeWithData(append([]byte(nil), buf[:n]...)),
+		})
+		ep.InjectInbound(proto, pkt)
+		pkt.DecRef()
+	}
+}
+
+// newStack creates network stack accepting connections to any address and forwarding them to the proxy.
+func (p *netstackPipe) newStack(ctx context.Context, ep stack.LinkEndpoint, socks5 string) (*stack.Stack, error) {
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+		HandleLocal:        false,
+	})
+	if err := s.CreateNIC(netstackNICID, ep); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("create nic: %s", err)
+	}
+	// Act as every destination host: accept packets to any address and reply from it.
+	if err := s.SetPromiscuousMode(netstackNICID, true); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("set promiscuous mode: %s", err)
+	}
+	if err := s.SetSpoofing(netstackNICID, true); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("set spoofing: %s", err)
+	}
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: header.IPv4EmptySubnet, NIC: netstackNICID},
+		{Destination: header.IPv6EmptySubnet, NIC: netstackNICID},
+	})
+
+	tcpFwd := tcp.NewForwarder(s, 0, netstackMaxInFlight, func(r *tcp.ForwarderRequest) {
+		p.handleTCP(ctx, r, socks5)
+	})
+	s.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpFwd.HandlePacket)
+	udpFwd := udp.NewForwarder(s, func(r *udp.ForwarderRequest) {
+		p.handleUDP(ctx, r, socks5)
+	})
+	s.SetTransportProtocolHandler(udp.ProtocolNumber, udpFwd.HandlePacket)
+
+	return s, nil
+}
+
+// handleTCP connects to the destination via proxy first, the connection from device is
+// accepted only if it succeeds (otherwise it is reset).
+func (p *netstackPipe) handleTCP(ctx context.Context, r *tcp.ForwarderRequest, socks5 string) {
+	id := r.ID()
+	remote, _, err := dialSocks(ctx, socks5, socksCmdConnect, endpointAddr(id.LocalAddress, id.LocalPort))
+	if err != nil {
+		r.Complete(true)
+		return
+	}
+
+	var wq waiter.Queue
+	ep, tcpErr := r.CreateEndpoint(&wq)
+	if tcpErr != nil {
+		r.Complete(true)
+		_ = remote.Close()
+		return
+	}
+	r.Complete(false)
+
+	relay(ctx, gonet.NewTCPConn(&wq, ep), remote)
+}
+
+// handleUDP relays UDP flow through proxy UDP association. Forwarder calls it synchronously,
+// so the relay itself runs in background.
+func (p *netstackPipe) handleUDP(ctx context.Context, r *udp.ForwarderRequest, socks5 string) {
+	id := r.ID()
+	var wq waiter.Queue
+	ep, tcpErr := r.CreateEndpoint(&wq)
+	if tcpErr != nil {
+		return
+	}
+	local := gonet.NewUDPConn(&wq, ep)
+
+	go func() {
+		defer local.Close()
+		_ = p.relayUDP(ctx, local, socks5, endpointAddr(id.LocalAddress, id.LocalPort))
+	}()
+}
+
+func (p *netstackPipe) relayUDP(ctx context.Context, local net.Conn, socks5 string, dst netip.AddrPort) error {
+	ctrl, bound, err := dialSocks(ctx, socks5, socksCmdAssociate, netip.AddrPortFrom(netip.IPv4Unspecified(), 0))
+	if err != nil {
+		return err
+	}
+	defer ctrl.Close()
+
+	relayAddr := bound
+	if !relayAddr.Addr().IsValid() || relayAddr.Addr().IsUnspecified() {
+		proxy, _ := netip.ParseAddrPort(socks5)
+		relayAddr = netip.AddrPortFrom(proxy.Addr(), bound.Port())
+	}
+	remote, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(relayAddr))
+	if err != nil {
+		return fmt.Errorf("dial socks udp relay: %w", err)
+	}
+	defer remote.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	idle := time.AfterFunc(p.opts.UDPTimeout, cancel)
+	defer idle.Stop()
+	go func() {
+		// Association lives as long as the control connection, the flow ends with either of them.
+		_, _ = io.Copy(io.Discard, ctrl)
+		cancel()
+	}()
+	go func() {
+		<-ctx.Done()
+		_ = local.Close()
+		_ = remote.Close()
+		_ = ctrl.Close()
+	}()
+
+	go func() {
+		defer cancel()
+		buf := make([]byte, p.opts.MTU)
+		for {
+			n, err := remote.Read(buf)
+			if err != nil {
+				return
+			}
+			_, payload, err := parseSocksUDP(buf[:n])
+			if err != nil {
+				continue
+			}
+			if _, err = local.Write(payload); err != nil {
+				return
+			}
+			idle.Reset(p.opts.UDPTimeout)
+		}
+	}()
+
+	head := appendSocksAddr([]byte{0, 0, 0}, dst)
+	buf := make([]byte, len(head)+p.opts.MTU)
+	copy(buf, head)
+	for {
+		n, err := local.Read(buf[len(head):])
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			return err
+		}
+		if _, err = remote.Write(buf[:len(head)+n]); err != nil {
+			return err
+		}
+		idle.Reset(p.opts.UDPTimeout)
+	}
+}
+
+// relay copies data between connections till both directions are done or ctx is cancelled.
+func relay(ctx context.Context, a, b net.Conn) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		_ = a.Close()
+		_ = b.Close()
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	cp := func(dst, src net.Conn) {
+		defer wg.Done()
+		_, err := io.Copy(dst, src)
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			cancel()
+			return
+		}
+		// Pass EOF on, the other direction may still be sending.
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
+		} else {
+			cancel()
+		}
+	}
+	go cp(a, b)
+	go cp(b, a)
+	wg.Wait()
+}
+
+func endpointAddr(addr tcpip.Address, port uint16) netip.AddrPort {
+	ip, _ := netip.AddrFromSlice(addr.AsSlice())
+
+	return netip.AddrPortFrom(ip, port)
+}
@@ -0,0 +1,189 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+func TestNetstackPipe(t *testing.T) {
+	tcpEcho := startTCPEcho(t)
+	udpEcho := startUDPEcho(t)
+	// Every destination is redirected to the echo servers by the proxy.
+	tcpProxy := startTestSocksRedirect(t, tcpEcho)
+	udpProxy := startTestSocksRedirect(t, udpEcho)
+
+	dst := tcpip.FullAddress{Addr: tcpip.AddrFrom4([4]byte{203, 0, 113, 10}), Port: 443}
+
+	for _, proxy := range []string{tcpProxy, udpProxy} {
+		app, dev := newTestAppStack(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		copied := make(chan error)
+		go func() {
+			copied <- newNetstackPipe(defaultNetstackOpts).Copy(ctx, dev, proxy)
+		}()
+
+		if proxy == tcpProxy {
+			conn, err := gonet.DialTCP(app, dst, ipv4.ProtocolNumber)
+			require.NoError(t, err)
+			require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+			_, err = conn.Write([]byte("hello tcp"))
+			require.NoError(t, err)
+			reply := make([]byte, 9)
+			_, err = io.ReadFull(conn, reply)
+			require.NoError(t, err)
+			require.Equal(t, "hello tcp", string(reply))
+			require.NoError(t, conn.Close())
+		} else {
+			conn, err := gonet.DialUDP(app, nil, &dst, ipv4.ProtocolNumber)
+			require.NoError(t, err)
+			require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+			_, err = conn.Write([]byte("hello udp"))
+			require.NoError(t, err)
+			reply := make([]byte, 64)
+			n, err := conn.Read(reply)
+			require.NoError(t, err)
+			require.Equal(t, "hello udp", string(reply[:n]))
+			require.NoError(t, conn.Close())
+		}
+
+		cancel()
+		require.NoError(t, dev.Close())
+		select {
+		case err := <-copied:
+			require.NoError(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("pipe did not stop")
+		}
+	}
+}
+
+func TestNetstackPipe_InvalidProxy(t *testing.T) {
+	_, dev := newTestAppStack(t)
+	err := newNetstackPipe(defaultNetstackOpts).Copy(context.Background(), dev, "localhost")
+	require.ErrorContains(t, err, "parse socks addr")
+}
+
+// newTestAppStack creates network stack playing the role of applications behind the TUN device,
+// returned device reads packets sent by the stack and writes packets into it.
+func newTestAppStack(t *testing.T) (*stack.Stack, io.ReadWriteCloser) {
+	t.Helper()
+
+	ep := channel.New(netstackQueueSize, 1500, "")
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+	require.Nil(t, s.CreateNIC(1, ep))
+	require.Nil(t, s.AddProtocolAddress(1, tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddrFrom4([4]byte{192, 18, 0, 1}).WithPrefix(),
+	}, stack.AddressProperties{}))
+	s.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: 1}})
+	t.Cleanup(func() {
+		ep.Close()
+		s.Close()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return s, &stackDevice{ep: ep, ctx: ctx, cancel: cancel}
+}
+
+type stackDevice struct {
+	ep     *channel.Endpoint
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (d *stackDevice) Read(p []byte) (int, error) {
+	pkt := d.ep.ReadContext(d.ctx)
+	if pkt == nil {
+		return 0, io.EOF
+	}
+	defer pkt.DecRef()
+	view := pkt.ToView()
+	defer view.Release()
+
+	return copy(p, view.AsSlice()), nil
+}
+
+func (d *stackDevice) Write(p []byte) (int, error) {
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(append([]byte(nil), p...))})
+	d.ep.InjectInbound(ipv4.ProtocolNumber, pkt)
+	pkt.DecRef()
+
+	return len(p), nil
+}
+
+func (d *stackDevice) Close() error {
+	d.cancel()
+	return nil
+}
+
+// startTestSocksRedirect starts XRay socks server sending all connections to the target address.
+func startTestSocksRedirect(t *testing.T, target string) string {
+	t.Helper()
+
+	port := startTestXrayServerWithOutbound(t,
+		`{"protocol": "socks", "settings": {"udp": true}}`,
+		fmt.Sprintf(`{"protocol": "freedom", "settings": {"redirect": %q}}`, target))
+
+	return fmt.Sprintf("127.0.0.1:%d", port)
+}
+
+func startTCPEcho(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func startUDPEcho(t *testing.T) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
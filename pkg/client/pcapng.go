@@ -0,0 +1,98 @@
+package client
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// pcapng block types and constants, see https://www.ietf.org/archive/id/draft-tuexen-opsawg-pcapng-05.html
+const (
+	pcapngSectionHeader  = 0x0A0D0D0A
+	pcapngInterfaceDesc  = 0x00000001
+	pcapngEnhancedPacket = 0x00000006
+	pcapngByteOrderMagic = 0x1A2B3C4D
+	pcapngLinkTypeRaw    = 101 // LINKTYPE_RAW, packet begins with IPv4 or IPv6 header.
+	pcapngOptEndOfOpt    = 0
+	pcapngOptIfTsResol   = 9
+	pcapngOptEPBFlags    = 2
+	pcapngFlagInbound    = 0x1
+	pcapngFlagOutbound   = 0x2
+	pcapngTsResolutionNS = 9
+)
+
+// pcapngWriter writes a single section with a single RAW IP interface.
+type pcapngWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+// newPcapngWriter writes section header and interface description blocks to w.
+func newPcapngWriter(w io.Writer) (*pcapngWriter, error) {
+	p := &pcapngWriter{w: w}
+
+	// Section Header Block.
+	shb := make([]byte, 28)
+	binary.LittleEndian.PutUint32(shb[0:], pcapngSectionHeader)
+	binary.LittleEndian.PutUint32(shb[4:], uint32(len(shb)))
+	binary.LittleEndian.PutUint32(shb[8:], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[12:], 1)                  // Major version.
+	binary.LittleEndian.PutUint16(shb[14:], 0)                  // Minor version.
+	binary.LittleEndian.PutUint64(shb[16:], 0xFFFFFFFFFFFFFFFF) // Section length is not specified.
+	binary.LittleEndian.PutUint32(shb[24:], uint32(len(shb)))
+
+	// Interface Description Block with nanosecond timestamps.
+	idb := make([]byte, 32)
+	binary.LittleEndian.PutUint32(idb[0:], pcapngInterfaceDesc)
+	binary.LittleEndian.PutUint32(idb[4:], uint32(len(idb)))
+	binary.LittleEndian.PutUint16(idb[8:], pcapngLinkTypeRaw)
+	binary.LittleEndian.PutUint32(idb[12:], 0) // Snap length, no limit.
+	binary.LittleEndian.PutUint16(idb[16:], pcapngOptIfTsResol)
+	binary.LittleEndian.PutUint16(idb[18:], 1)
+	idb[20] = pcapngTsResolutionNS
+	binary.LittleEndian.PutUint16(idb[24:], pcapngOptEndOfOpt)
+	binary.LittleEndian.PutUint16(idb[26:], 0)
+	binary.LittleEndian.PutUint32(idb[28:], uint32(len(idb)))
+
+	if _, err := w.Write(append(shb, idb...)); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// WritePacket writes Enhanced Packet Block with direction flag and returns number of bytes written.
+func (p *pcapngWriter) WritePacket(ts time.Time, packet []byte, outbound bool) (int, error) {
+	padded := (len(packet) + 3) &^ 3
+	// Header (8) + interface, ts, lengths (20) + data + epb_flags option (8) + end of options (4) + trailer (4).
+	total := 28 + padded + 8 + 4 + 4
+
+	if cap(p.buf) < total {
+		p.buf = make([]byte, total)
+	}
+	b := p.buf[:total]
+	clear(b)
+
+	nanos := uint64(ts.UnixNano())
+	binary.LittleEndian.PutUint32(b[0:], pcapngEnhancedPacket)
+	binary.LittleEndian.PutUint32(b[4:], uint32(total))
+	binary.LittleEndian.PutUint32(b[8:], 0) // Interface ID.
+	binary.LittleEndian.PutUint32(b[12:], uint32(nanos>>32))
+	binary.LittleEndian.PutUint32(b[16:], uint32(nanos))
+	binary.LittleEndian.PutUint32(b[20:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(b[24:], uint32(len(packet)))
+	copy(b[28:], packet)
+
+	opt := b[28+padded:]
+	flags := uint32(pcapngFlagInbound)
+	if outbound {
+		flags = pcapngFlagOutbound
+	}
+	binary.LittleEndian.PutUint16(opt[0:], pcapngOptEPBFlags)
+	binary.LittleEndian.PutUint16(opt[2:], 4)
+	binary.LittleEndian.PutUint32(opt[4:], flags)
+	binary.LittleEndian.PutUint16(opt[8:], pcapngOptEndOfOpt)
+	binary.LittleEndian.PutUint32(b[total-4:], uint32(total))
+
+	return p.w.Write(b)
+}
@@ -0,0 +1,194 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/goxray/core/network/route"
+)
+
+var (
+	// ErrTUNAddressInUse is returned on connect when TUN address is used by another client of the process.
+	ErrTUNAddressInUse = errors.New("tun address is used by another client")
+	// ErrRouteInUse is returned on connect when a route to TUN is already pointed to TUN device of another client.
+	ErrRouteInUse = errors.New("route is used by another client")
+	// ErrTUNAddressPoolExhausted is returned on connect when all TUN addresses are taken.
+	ErrTUNAddressPoolExhausted = errors.New("no free tun address left")
+)
+
+var (
+	// tunAddresses hands out TUN device addresses to clients of the process.
+	tunAddresses = newAddressPool(netip.MustParsePrefix("192.18.0.0/16"))
+	// hostRoutes keeps track of host routes changed by clients of the process.
+	hostRoutes = newRouteBook()
+)
+
+// addressPool allocates unique addresses from the prefix, starting with the first host address
+// (192.18.0.1 is the first address handed out).
+type addressPool struct {
+	prefix netip.Prefix
+
+	mu   sync.Mutex
+	used map[netip.Addr]bool
+}
+
+func newAddressPool(prefix netip.Prefix) *addressPool {
+	return &addressPool{prefix: prefix.Masked(), used: make(map[netip.Addr]bool)}
+}
+
+// acquire returns the lowest free address of the pool.
+func (p *addressPool) acquire() (*net.IPNet, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for addr := p.prefix.Addr().Next(); p.prefix.Contains(addr); addr = addr.Next() {
+		if !p.used[addr] {
+			p.used[addr] = true
+
+			return hostIPNet(addr), nil
+		}
+	}
+
+	return nil, ErrTUNAddressPoolExhausted
+}
+
+// reserve marks the address (may be outside the pool prefix) as used.
+func (p *addressPool) reserve(ipNet *net.IPNet) error {
+	addr, ok := netip.AddrFromSlice(ipNet.IP)
+	if !ok {
+		return fmt.Errorf("invalid tun address %s", ipNet)
+	}
+	addr = addr.Unmap()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.used[addr] {
+		return fmt.Errorf("%w: %s", ErrTUNAddressInUse, addr)
+	}
+	p.used[addr] = true
+
+	return nil
+}
+
+func (p *addressPool) release(ipNet *net.IPNet) {
+	addr, ok := netip.AddrFromSlice(ipNet.IP)
+	if !ok {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.used, addr.Unmap())
+}
+
+func hostIPNet(addr netip.Addr) *net.IPNet {
+	return &net.IPNet{IP: addr.AsSlice(), Mask: net.CIDRMask(addr.BitLen(), addr.BitLen())}
+}
+
+// routeBook tracks host routes added by clients of the process.
+//
+// Routes to TUN devices are exclusive: a destination can be routed to one client only.
+// XRay server exception routes are shared by clients connected to the same server,
+// they are added by the first client and deleted by the last one.
+type routeBook struct {
+	mu         sync.Mutex
+	tunRoutes  map[string]*Client
+	exceptions map[string]int
+}
+
+func newRouteBook() *routeBook {
+	return &routeBook{tunRoutes: make(map[string]*Client), exceptions: make(map[string]int)}
+}
+
+// claim marks routes as owned by the client. Fails if any of them is owned by another client.
+func (b *routeBook) claim(c *Client, routes []*route.Addr) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, r := range routes {
+		if owner, ok := b.tunRoutes[r.String()]; ok && owner != c {
+			return fmt.Errorf("%w: %s", ErrRouteInUse, r)
+		}
+	}
+	for _, r := range routes {
+		b.tunRoutes[r.String()] = c
+	}
+
+	return nil
+}
+
+// unclaim releases all routes owned by the client.
+func (b *routeBook) unclaim(c *Client) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for r, owner := range b.tunRoutes {
+		if owner == c {
+			delete(b.tunRoutes, r)
+		}
+	}
+}
+
+// owned returns routes owned by the client.
+func (b *routeBook) owned(c *Client) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var routes []string
+	for r, owner := range b.tunRoutes {
+		if owner == c {
+			routes = append(routes, r)
+		}
+	}
+	sort.Strings(routes)
+
+	return routes
+}
+
+// addException adds the exception route to the table unless another client has already added it.
+func (b *routeBook) addException(table ipTable, opts route.Opts) error {
+	key := exceptionKey(opts)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.exceptions[key] == 0 {
+		_ = table.Delete(opts) // In case previous run failed.
+		if err := table.Add(opts); err != nil {
+			return err
+		}
+	}
+	b.exceptions[key]++
+
+	return nil
+}
+
+// deleteException deletes the exception route from the table if no other client uses it.
+// Routes not tracked by the book are deleted right away.
+func (b *routeBook) deleteException(table ipTable, opts route.Opts) error {
+	key := exceptionKey(opts)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.exceptions[key] > 1 {
+		b.exceptions[key]--
+
+		return nil
+	}
+	delete(b.exceptions, key)
+
+	return table.Delete(opts)
+}
+
+func exceptionKey(opts route.Opts) string {
+	routes := make([]string, 0, len(opts.Routes))
+	for _, r := range opts.Routes {
+		routes = append(routes, r.String())
+	}
+
+	return opts.Gateway.String() + " " + strings.Join(routes, ",")
+}
@@ -0,0 +1,83 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/goxray/core/network/route"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+
+	"github.com/goxray/tun/pkg/client/mocks"
+)
+
+func TestAddressPool(t *testing.T) {
+	pool := newAddressPool(netip.MustParsePrefix("192.18.0.0/30"))
+
+	first, err := pool.acquire()
+	require.NoError(t, err)
+	require.Equal(t, "192.18.0.1/32", first.String())
+	second, err := pool.acquire()
+	require.NoError(t, err)
+	require.Equal(t, "192.18.0.2/32", second.String())
+
+	require.ErrorIs(t, pool.reserve(second), ErrTUNAddressInUse)
+	third := &net.IPNet{IP: net.IPv4(192, 18, 0, 3), Mask: net.CIDRMask(32, 32)}
+	require.NoError(t, pool.reserve(third))
+	_, err = pool.acquire()
+	require.ErrorIs(t, err, ErrTUNAddressPoolExhausted)
+
+	pool.release(first)
+	again, err := pool.acquire()
+	require.NoError(t, err)
+	require.Equal(t, first.String(), again.String())
+
+	// Addresses outside the pool can be reserved too.
+	require.NoError(t, pool.reserve(&net.IPNet{IP: net.IPv4(10, 0, 0, 1), Mask: net.CIDRMask(32, 32)}))
+}
+
+func TestRouteBook_Claim(t *testing.T) {
+	book := newRouteBook()
+	a, b := &Client{}, &Client{}
+
+	require.NoError(t, book.claim(a, DefaultRoutesToTUN))
+	require.NoError(t, book.claim(a, DefaultRoutesToTUN)) // Claiming own routes again is fine.
+	require.ErrorIs(t, book.claim(b, []*route.Addr{route.MustParseAddr("10.0.0.0/8"), DefaultRoutesToTUN[0]}), ErrRouteInUse)
+	require.Empty(t, book.owned(b))
+	require.NoError(t, book.claim(b, []*route.Addr{route.MustParseAddr("10.0.0.0/8")}))
+	require.Equal(t, []string{"0.0.0.0/1", "128.0.0.0/1"}, book.owned(a))
+
+	book.unclaim(a)
+	require.Empty(t, book.owned(a))
+	require.NoError(t, book.claim(b, DefaultRoutesToTUN))
+	require.Equal(t, []string{"0.0.0.0/1", "10.0.0.0/8", "128.0.0.0/1"}, book.owned(b))
+}
+
+func TestRouteBook_Exceptions(t *testing.T) {
+	book := newRouteBook()
+	table := mocks.NewMockipTable(gomock.NewController(t))
+	opts := route.Opts{Gateway: net.IPv4(10, 0, 0, 1), Routes: []*route.Addr{route.MustParseAddr("1.2.3.4/32")}}
+	other := route.Opts{Gateway: net.IPv4(10, 0, 0, 1), Routes: []*route.Addr{route.MustParseAddr("5.6.7.8/32")}}
+
+	// Route is added by the first client only.
+	table.EXPECT().Delete(opts).Return(errors.New("no such route"))
+	table.EXPECT().Add(opts).Return(nil)
+	require.NoError(t, book.addException(table, opts))
+	require.NoError(t, book.addException(table, opts))
+
+	table.EXPECT().Delete(other).Return(nil)
+	table.EXPECT().Add(other).Return(errors.New("add err"))
+	require.ErrorContains(t, book.addException(table, other), "add err")
+
+	// And deleted by the last one.
+	require.NoError(t, book.deleteException(table, opts))
+	table.EXPECT().Delete(opts).Return(nil)
+	require.NoError(t, book.deleteException(table, opts))
+
+	// Failed route is not tracked.
+	table.EXPECT().Delete(other).Return(nil)
+	table.EXPECT().Add(other).Return(nil)
+	require.NoError(t, book.addException(table, other))
+}
@@ -0,0 +1,315 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"time"
+
+	xrayproto "github.com/lilendian0x00/xray-knife/v3/pkg/protocol"
+	xraynet "github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/core"
+)
+
+const (
+	// probeTimeout is applied when ctx passed to Probe has no deadline.
+	probeTimeout = 15 * time.Second
+	// probeTCPSettle is how long TCP probe waits for the tunnel to be torn down after connecting.
+	// Proxy protocols report failed target connections by closing the stream, and servers
+	// retry the dial for ~1.5s (freedom outbound) before giving up.
+	probeTCPSettle = 3 * time.Second
+	// probeServerDialTimeout is used to check server reachability when classifying errors.
+	probeServerDialTimeout = 3 * time.Second
+)
+
+// ProbeErrorKind classifies probe failures.
+type ProbeErrorKind int
+
+const (
+	// ProbeErrorLink means the link is invalid and instance could not be created.
+	ProbeErrorLink ProbeErrorKind = iota + 1
+	// ProbeErrorServer means the proxy server is not reachable.
+	ProbeErrorServer
+	// ProbeErrorTarget means the server is reachable, but the target could not be reached through it.
+	ProbeErrorTarget
+	// ProbeErrorTimeout means the probe did not finish in time.
+	ProbeErrorTimeout
+	// ProbeErrorTLS means TLS handshake with the target failed, or the server failed TLS verification (see TLSError).
+	ProbeErrorTLS
+	// ProbeErrorHTTP means the target returned malformed HTTP response.
+	ProbeErrorHTTP
+)
+
+func (k ProbeErrorKind) String() string {
+	switch k {
+	case ProbeErrorLink:
+		return "link"
+	case ProbeErrorServer:
+		return "server"
+	case ProbeErrorTarget:
+		return "target"
+	case ProbeErrorTimeout:
+		return "timeout"
+	case ProbeErrorTLS:
+		return "tls"
+	case ProbeErrorHTTP:
+		return "http"
+	}
+
+	return "unknown"
+}
+
+// ProbeError is returned by Probe, use errors.As to inspect the failure kind.
+type ProbeError struct {
+	Kind ProbeErrorKind
+	Err  error
+}
+
+func (e *ProbeError) Error() string {
+	return fmt.Sprintf("probe failed (%s): %v", e.Kind, e.Err)
+}
+
+func (e *ProbeError) Unwrap() error {
+	return e.Err
+}
+
+// ProbeResult holds timings of a successful probe.
+type ProbeResult struct {
+	// Handshake is the time to establish connection to the target through the server,
+	// including TLS handshake for https targets.
+	Handshake time.Duration
+	// TTFB is the time from the probe start to the first byte received from the target.
+	// It is zero for TCP targets that did not send anything.
+	TTFB time.Duration
+	// Total is the whole probe duration, not including instance creation.
+	Total time.Duration
+	// StatusCode is the HTTP response status code (HTTP targets only).
+	StatusCode int
+}
+
+// Probe checks that the link works before committing routes to it.
+//
+// It creates a temporary XRay instance from the link (no TUN device and no routes are set up)
+// and reaches the target through it. Target is either an URL ("http://..." or "https://...")
+// which is requested with GET, or "host:port" ("tcp://host:port") which is just connected to.
+//
+// Returned error is always *ProbeError.
+func Probe(ctx context.Context, link, target string) (*ProbeResult, error) {
+	return ProbeWithOpts(ctx, Config{}, link, target)
+}
+
+// ProbeWithOpts is the same as Probe, but XRay instance is configured with cfg.
+// Only XRay related fields of the Config are used.
+func ProbeWithOpts(ctx context.Context, cfg Config, link, target string) (*ProbeResult, error) {
+	if cfg.Logger == nil {
+		cfg.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, probeTimeout)
+		defer cancel()
+	}
+
+	if err := verifyServerTLS(ctx, &cfg, link); err != nil {
+		var tlsErr *TLSError
+		if errors.As(err, &tlsErr) {
+			return nil, &ProbeError{Kind: ProbeErrorTLS, Err: err}
+		}
+
+		return nil, &ProbeError{Kind: ProbeErrorLink, Err: err}
+	}
+
+	inst, xCfg, err := newXrayInstance(&cfg, link, nil, nil)
+	if err != nil {
+		return nil, &ProbeError{Kind: ProbeErrorLink, Err: err}
+	}
+	defer forgetInstance(inst)
+	if err = inst.Start(); err != nil {
+		return nil, &ProbeError{Kind: ProbeErrorLink, Err: fmt.Errorf("start xray core instance: %w", err)}
+	}
+	defer inst.Close()
+
+	res, err := probeTarget(ctx, instanceDialer(inst.(*core.Instance)), target)
+	if err != nil {
+		return nil, classifyProbeError(ctx, xCfg, err)
+	}
+
+	return res, nil
+}
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// instanceDialer returns dialFunc connecting through XRay instance.
+func instanceDialer(inst *core.Instance) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dest, err := xraynet.ParseDestination(network + ":" + addr)
+		if err != nil {
+			return nil, err
+		}
+
+		return core.Dial(ctx, inst, dest)
+	}
+}
+
+// probeTarget reaches the target with dial, see Probe for the target format.
+func probeTarget(ctx context.Context, dial dialFunc, target string) (*ProbeResult, error) {
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		return probeHTTP(ctx, dial, target)
+	}
+
+	return probeTCP(ctx, dial, strings.TrimPrefix(target, "tcp://"))
+}
+
+func probeHTTP(ctx context.Context, dial dialFunc, target string) (*ProbeResult, error) {
+	if _, err := url.Parse(target); err != nil {
+		return nil, &ProbeError{Kind: ProbeErrorLink, Err: fmt.Errorf("invalid target: %w", err)}
+	}
+
+	var res ProbeResult
+	start := time.Now()
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			res.Handshake = time.Since(start)
+		},
+		GotFirstResponseByte: func() {
+			res.TTFB = time.Since(start)
+		},
+	}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodGet, target, nil)
+	if err != nil {
+		return nil, &ProbeError{Kind: ProbeErrorLink, Err: fmt.Errorf("invalid target: %w", err)}
+	}
+
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			DialContext:       dial,
+			DisableKeepAlives: true,
+			ForceAttemptHTTP2: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+
+	res.Total = time.Since(start)
+	res.StatusCode = resp.StatusCode
+
+	return &res, nil
+}
+
+func probeTCP(ctx context.Context, dial dialFunc, target string) (*ProbeResult, error) {
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		return nil, &ProbeError{Kind: ProbeErrorLink, Err: fmt.Errorf("invalid target: %w", err)}
+	}
+
+	var res ProbeResult
+	start := time.Now()
+	conn, err := dial(ctx, "tcp", target)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	res.Handshake = time.Since(start)
+
+	// Proxy protocols don't report target connection failures explicitly, the stream is just closed.
+	// Wait for the stream to either deliver the first byte, stay open for a while or get closed.
+	// Connections returned by XRay core ignore deadlines, so read in background.
+	readDone := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		readDone <- err
+	}()
+
+	settle := time.NewTimer(probeTCPSettle)
+	defer settle.Stop()
+	select {
+	case err = <-readDone:
+		if err != nil {
+			return nil, fmt.Errorf("connection closed by server: %w", err)
+		}
+		res.TTFB = time.Since(start)
+	case <-settle.C:
+		// Connection stayed open without data, target is reachable.
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	res.Total = time.Since(start)
+
+	return &res, nil
+}
+
+// classifyProbeError wraps err into ProbeError with the most specific kind.
+func classifyProbeError(ctx context.Context, xCfg *xrayproto.GeneralConfig, err error) error {
+	var probeErr *ProbeError
+	if errors.As(err, &probeErr) {
+		return err
+	}
+
+	var (
+		recordErr   tls.RecordHeaderError
+		certErr     *tls.CertificateVerificationError
+		unknownAuth x509.UnknownAuthorityError
+		hostnameErr x509.HostnameError
+	)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded) || isTimeout(err):
+		return &ProbeError{Kind: ProbeErrorTimeout, Err: err}
+	case errors.As(err, &recordErr), errors.As(err, &certErr), errors.As(err, &unknownAuth),
+		errors.As(err, &hostnameErr), strings.Contains(err.Error(), "tls: "):
+		return &ProbeError{Kind: ProbeErrorTLS, Err: err}
+	case strings.Contains(err.Error(), "malformed HTTP"):
+		return &ProbeError{Kind: ProbeErrorHTTP, Err: err}
+	}
+
+	// The failure could be either on the way to the server or from the server to the target,
+	// check server reachability directly to tell them apart.
+	if serverErr := checkServerReachable(ctx, xCfg); serverErr != nil {
+		return &ProbeError{Kind: ProbeErrorServer, Err: errors.Join(err, serverErr)}
+	}
+
+	return &ProbeError{Kind: ProbeErrorTarget, Err: err}
+}
+
+// checkServerReachable dials XRay server directly, only TCP based transports are checked.
+func checkServerReachable(ctx context.Context, xCfg *xrayproto.GeneralConfig) error {
+	if xCfg.Protocol == "wireguard" {
+		return nil
+	}
+	switch xCfg.Type {
+	case "kcp", "quic":
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, probeServerDialTimeout)
+	defer cancel()
+
+	host := strings.Trim(xCfg.Address, "[]")
+	addr := net.JoinHostPort(host, xCfg.Port)
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("server %s is not reachable: %w", addr, err)
+	}
+
+	return conn.Close()
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,136 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/infra/conf"
+)
+
+const testUUID = "b831381d-6324-4d53-ad4f-8cda48b30811"
+
+func TestProbe(t *testing.T) {
+	srvPort := startTestXrayServer(t, fmt.Sprintf(`{
+		"protocol": "vless",
+		"settings": {"clients": [{"id": %q}], "decryption": "none"},
+		"streamSettings": {"network": "tcp"}
+	}`, testUUID))
+	link := fmt.Sprintf("vless://%s@127.0.0.1:%d?type=tcp&security=none#probe", testUUID, srvPort)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer target.Close()
+	closedPort := freeTCPPort(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	t.Run("http", func(t *testing.T) {
+		res, err := Probe(ctx, link, target.URL)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusTeapot, res.StatusCode)
+		require.Positive(t, res.TTFB)
+		require.LessOrEqual(t, res.Handshake, res.TTFB)
+		require.LessOrEqual(t, res.TTFB, res.Total)
+	})
+
+	t.Run("tcp", func(t *testing.T) {
+		res, err := Probe(ctx, link, strings.TrimPrefix(target.URL, "http://"))
+		require.NoError(t, err)
+		require.Zero(t, res.StatusCode)
+		require.Zero(t, res.TTFB) // HTTP server does not talk first.
+		require.GreaterOrEqual(t, res.Total, probeTCPSettle)
+	})
+
+	t.Run("target unreachable", func(t *testing.T) {
+		_, err := Probe(ctx, link, fmt.Sprintf("http://127.0.0.1:%d", closedPort))
+		requireProbeErrorKind(t, err, ProbeErrorTarget)
+
+		_, err = Probe(ctx, link, fmt.Sprintf("tcp://127.0.0.1:%d", closedPort))
+		requireProbeErrorKind(t, err, ProbeErrorTarget)
+	})
+
+	t.Run("server unreachable", func(t *testing.T) {
+		badLink := fmt.Sprintf("vless://%s@127.0.0.1:%d?type=tcp&security=none", testUUID, closedPort)
+		_, err := Probe(ctx, badLink, target.URL)
+		requireProbeErrorKind(t, err, ProbeErrorServer)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		// The listener accepts connections but never responds.
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer ln.Close()
+
+		_, err = Probe(ctx, link, "http://"+ln.Addr().String())
+		requireProbeErrorKind(t, err, ProbeErrorTimeout)
+	})
+
+	t.Run("invalid link", func(t *testing.T) {
+		_, err := Probe(ctx, "invalid_link", target.URL)
+		requireProbeErrorKind(t, err, ProbeErrorLink)
+	})
+}
+
+func requireProbeErrorKind(t *testing.T, err error, kind ProbeErrorKind) {
+	t.Helper()
+
+	var probeErr *ProbeError
+	require.True(t, errors.As(err, &probeErr), "unexpected error: %v", err)
+	require.Equal(t, kind, probeErr.Kind, "unexpected error: %v", err)
+}
+
+// startTestXrayServer starts XRay server on loopback with the given inbound (without listen and port)
+// and freedom outbound. Returns the port server listens on.
+func startTestXrayServer(t *testing.T, inbound string) int {
+	t.Helper()
+
+	return startTestXrayServerWithOutbound(t, inbound, `{"protocol": "freedom"}`)
+}
+
+// startTestXrayServerWithOutbound is startTestXrayServer with the given outbound.
+func startTestXrayServerWithOutbound(t *testing.T, inbound, outbound string) int {
+	t.Helper()
+
+	port := freeTCPPort(t)
+	inbound = strings.Replace(inbound, "{", fmt.Sprintf(`{"listen": "127.0.0.1", "port": %d,`, port), 1)
+	var jsonCfg conf.Config
+	require.NoError(t, json.Unmarshal([]byte(fmt.Sprintf(`{
+		"log": {"loglevel": "none"},
+		"inbounds": [%s],
+		"outbounds": [%s]
+	}`, inbound, outbound)), &jsonCfg))
+	cfg, err := jsonCfg.Build()
+	require.NoError(t, err)
+
+	srv, err := core.New(cfg)
+	require.NoError(t, err)
+	require.NoError(t, srv.Start())
+	t.Cleanup(func() { _ = srv.Close() })
+
+	return port
+}
+
+func freeTCPPort(t *testing.T) int {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	return ln.Addr().(*net.TCPAddr).Port
+}
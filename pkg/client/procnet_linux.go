@@ -0,0 +1,210 @@
+//go:build linux
+
+package client
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// procRoot is the procfs mount point, overridden in tests.
+var procRoot = "/proc"
+
+// lookupProcesses resolves owning processes of the local sockets of the given flows
+// using /proc/net/{tcp,udp}{,6} and /proc/*/fd.
+func lookupProcesses(keys []flowKey) map[flowKey]process {
+	// Find socket inodes for the local addresses first.
+	inodes := make(map[flowKey]uint64, len(keys))
+	tables := make(map[string][]procNetEntry)
+	for _, key := range keys {
+		name := procNetTable(key)
+		if name == "" {
+			continue
+		}
+		entries, ok := tables[name]
+		if !ok {
+			entries, _ = readProcNet(filepath.Join(procRoot, "net", name))
+			tables[name] = entries
+		}
+		if inode := findInode(entries, key.local); inode != 0 {
+			inodes[key] = inode
+		}
+	}
+	if len(inodes) == 0 {
+		return nil
+	}
+
+	wanted := make(map[uint64]struct{}, len(inodes))
+	for _, inode := range inodes {
+		wanted[inode] = struct{}{}
+	}
+	owners := socketOwners(wanted)
+
+	procs := make(map[flowKey]process, len(inodes))
+	for key, inode := range inodes {
+		if p, ok := owners[inode]; ok {
+			procs[key] = p
+		}
+	}
+
+	return procs
+}
+
+// procNetTable returns the /proc/net file name holding sockets for the flow.
+func procNetTable(key flowKey) string {
+	var name string
+	switch key.proto {
+	case protoTCP:
+		name = "tcp"
+	case protoUDP:
+		name = "udp"
+	default:
+		return ""
+	}
+	if key.local.Addr().Is6() {
+		name += "6"
+	}
+
+	return name
+}
+
+type procNetEntry struct {
+	local netip.AddrPort
+	inode uint64
+}
+
+// readProcNet parses /proc/net/{tcp,udp}{,6} file.
+func readProcNet(path string) ([]procNetEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []procNetEntry
+	sc := bufio.NewScanner(f)
+	sc.Scan() // Skip header.
+	for sc.Scan() {
+		e, err := parseProcNetLine(sc.Text())
+		if err != nil {
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, sc.Err()
+}
+
+// parseProcNetLine parses one socket line, e.g.:
+//
+//	0: 0100007F:0035 00000000:0000 0A 00000000:00000000 00:00000000 00000000   101        0 20120 1 ...
+func parseProcNetLine(line string) (procNetEntry, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 10 {
+		return procNetEntry{}, fmt.Errorf("unexpected fields count: %d", len(fields))
+	}
+
+	local, err := parseProcNetAddr(fields[1])
+	if err != nil {
+		return procNetEntry{}, fmt.Errorf("parse local address: %w", err)
+	}
+
+	inode, err := strconv.ParseUint(fields[9], 10, 64)
+	if err != nil {
+		return procNetEntry{}, fmt.Errorf("parse inode: %w", err)
+	}
+
+	return procNetEntry{local: local, inode: inode}, nil
+}
+
+// parseProcNetAddr parses "HEXADDR:HEXPORT" where address is written as host endian 32-bit words.
+func parseProcNetAddr(s string) (netip.AddrPort, error) {
+	addrHex, portHex, ok := strings.Cut(s, ":")
+	if !ok {
+		return netip.AddrPort{}, fmt.Errorf("invalid address %q", s)
+	}
+
+	raw, err := hex.DecodeString(addrHex)
+	if err != nil || (len(raw) != 4 && len(raw) != 16) {
+		return netip.AddrPort{}, fmt.Errorf("invalid address %q", s)
+	}
+	// Each 32-bit word is stored in host (little) endian order.
+	for i := 0; i < len(raw); i += 4 {
+		binary.BigEndian.PutUint32(raw[i:], binary.LittleEndian.Uint32(raw[i:]))
+	}
+
+	port, err := strconv.ParseUint(portHex, 16, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid port %q", s)
+	}
+
+	addr, _ := netip.AddrFromSlice(raw)
+
+	return netip.AddrPortFrom(addr.Unmap(), uint16(port)), nil
+}
+
+// findInode finds the socket bound to local address, falling back to wildcard bound sockets.
+func findInode(entries []procNetEntry, local netip.AddrPort) uint64 {
+	var wildcard uint64
+	for _, e := range entries {
+		if e.local.Port() != local.Port() || e.inode == 0 {
+			continue
+		}
+		if e.local.Addr() == local.Addr().Unmap() {
+			return e.inode
+		}
+		if e.local.Addr().IsUnspecified() {
+			wildcard = e.inode
+		}
+	}
+
+	return wildcard
+}
+
+// socketOwners walks /proc/*/fd looking for the given socket inodes.
+func socketOwners(inodes map[uint64]struct{}) map[uint64]process {
+	owners := make(map[uint64]process, len(inodes))
+
+	pids, err := os.ReadDir(procRoot)
+	if err != nil {
+		return owners
+	}
+	for _, d := range pids {
+		pid, err := strconv.Atoi(d.Name())
+		if err != nil {
+			continue
+		}
+		fdDir := filepath.Join(procRoot, d.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue // Process is gone or we lack permissions.
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			inode, err := strconv.ParseUint(strings.TrimSuffix(link[len("socket:["):], "]"), 10, 64)
+			if err != nil {
+				continue
+			}
+			if _, ok := inodes[inode]; !ok {
+				continue
+			}
+			exe, _ := os.Readlink(filepath.Join(procRoot, d.Name(), "exe"))
+			owners[inode] = process{PID: pid, Executable: exe}
+			if len(owners) == len(inodes) {
+				return owners
+			}
+		}
+	}
+
+	return owners
+}
@@ -0,0 +1,72 @@
+//go:build linux
+
+package client
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseProcNetLine(t *testing.T) {
+	tests := []struct {
+		name  string
+		line  string
+		local string
+		inode uint64
+		err   bool
+	}{
+		{
+			name:  "ipv4",
+			line:  "   0: 0100007F:0035 00000000:0000 0A 00000000:00000000 00:00000000 00000000   101        0 20120 1 0000000000000000 100 0 0 10 0",
+			local: "127.0.0.1:53",
+			inode: 20120,
+		},
+		{
+			name:  "ipv6",
+			line:  "   0: 000080FE00000000FF570502CD4E39FE:A4B8 00000000000000000000000000000000:0000 07 00000000:00000000 00:00000000 00000000  1000        0 64011 2 0000000000000000 0",
+			local: "[fe80::205:57ff:fe39:4ecd]:42168",
+			inode: 64011,
+		},
+		{
+			name: "short",
+			line: "   0: 0100007F:0035 00000000:0000 0A",
+			err:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e, err := parseProcNetLine(test.line)
+			if test.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, netip.MustParseAddrPort(test.local), e.local)
+			require.Equal(t, test.inode, e.inode)
+		})
+	}
+}
+
+func TestLookupProcesses_Self(t *testing.T) {
+	if _, err := os.Stat("/proc/net/tcp"); err != nil {
+		t.Skip("procfs is not available")
+	}
+
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	key := flowKey{
+		proto: protoTCP,
+		local: ln.Addr().(*net.TCPAddr).AddrPort(),
+		peer:  netip.MustParseAddrPort("1.1.1.1:443"),
+	}
+	procs := lookupProcesses([]flowKey{key})
+	require.Equal(t, os.Getpid(), procs[key].PID)
+	require.NotEmpty(t, procs[key].Executable)
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package client
+
+// lookupProcesses is not supported on this platform, connections are reported without process info.
+func lookupProcesses(_ []flowKey) map[flowKey]process {
+	return nil
+}
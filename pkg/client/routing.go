@@ -0,0 +1,173 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/xtls/xray-core/app/router"
+	"github.com/xtls/xray-core/common/serial"
+	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/infra/conf"
+)
+
+const (
+	// proxyOutboundTag is the tag of outbound connecting to the XRay server, it is the default route.
+	proxyOutboundTag = "proxy"
+	// directOutboundTag is the tag of freedom outbound for destinations bypassing the XRay server.
+	directOutboundTag = "direct"
+)
+
+// directRules is Config.DirectRules split into XRay routing rule matchers.
+type directRules struct {
+	domains []string
+	ips     []string
+}
+
+func (r directRules) empty() bool {
+	return len(r.domains) == 0 && len(r.ips) == 0
+}
+
+// parseDirectRules converts Config.DirectRules entries into XRay domain and IP matchers.
+func parseDirectRules(rules []string) (directRules, error) {
+	var r directRules
+	for _, rule := range rules {
+		rule = strings.TrimSpace(rule)
+		prefix, value, _ := strings.Cut(rule, ":")
+		switch {
+		case rule == "":
+			continue
+		case prefix == "geoip":
+			if value == "" {
+				return r, fmt.Errorf("invalid direct rule %q: empty geoip code", rule)
+			}
+			r.ips = append(r.ips, rule)
+		case prefix == "geosite", prefix == "domain", prefix == "full", prefix == "regexp", prefix == "keyword":
+			if value == "" {
+				return r, fmt.Errorf("invalid direct rule %q: empty %s value", rule, prefix)
+			}
+			r.domains = append(r.domains, rule)
+		case strings.Contains(rule, "/"):
+			p, err := netip.ParsePrefix(rule)
+			if err != nil {
+				return r, fmt.Errorf("invalid direct rule %q: %w", rule, err)
+			}
+			r.ips = append(r.ips, p.Masked().String())
+		default:
+			if _, err := netip.ParseAddr(rule); err == nil {
+				r.ips = append(r.ips, rule)
+				continue
+			}
+			if strings.ContainsAny(rule, " :/") {
+				return r, fmt.Errorf("invalid direct rule %q", rule)
+			}
+			// Plain domains match the domain itself and all of its subdomains.
+			r.domains = append(r.domains, "domain:"+strings.TrimPrefix(rule, "."))
+		}
+	}
+
+	return r, nil
+}
+
+// fieldRule is XRay routing rule in JSON config format.
+type fieldRule struct {
+	Type        string   `json:"type"`
+	OutboundTag string   `json:"outboundTag"`
+	Domain      []string `json:"domain,omitempty"`
+	IP          []string `json:"ip,omitempty"`
+}
+
+// buildRouterConfig builds routing rules: blocklists go first, then direct rules.
+// Everything else goes to the default (first) outbound, which is the XRay server.
+// Geo data of "geoip:" and "geosite:" rules is read from assetDir (see geoRules).
+func buildRouterConfig(direct directRules, lists []*blocklist, assetDir string) (*router.Config, error) {
+	direct, geo, err := geoRules(direct, assetDir)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := blockRules(lists)
+	if len(direct.domains) > 0 {
+		rules = append(rules, fieldRule{Type: "field", OutboundTag: directOutboundTag, Domain: direct.domains})
+	}
+	if len(direct.ips) > 0 {
+		rules = append(rules, fieldRule{Type: "field", OutboundTag: directOutboundTag, IP: direct.ips})
+	}
+
+	var jsonRules []json.RawMessage
+	for _, rule := range rules {
+		b, err := json.Marshal(rule)
+		if err != nil {
+			return nil, fmt.Errorf("marshal routing rule: %w", err)
+		}
+		jsonRules = append(jsonRules, b)
+	}
+	routerCfg, err := (&conf.RouterConfig{RuleList: jsonRules}).Build()
+	if err != nil {
+		return nil, fmt.Errorf("build routing rules: %w", err)
+	}
+	routerCfg.Rule = append(routerCfg.Rule, geo...)
+
+	return routerCfg, nil
+}
+
+// addRouting adds routing section, direct outbound and blocklists blackhole outbounds to XRay config.
+// Direct outbound is bound to the gateway interface, so that its traffic does not loop back into the TUN.
+func addRouting(xCfg *core.Config, cfg *Config, direct directRules, b *blocker) error {
+	var lists []*blocklist
+	if b != nil {
+		lists = b.current()
+		obs, err := b.outbounds()
+		if err != nil {
+			return err
+		}
+		xCfg.Outbound = append(xCfg.Outbound, obs...)
+	}
+	routerCfg, err := buildRouterConfig(direct, lists, cfg.AssetDir)
+	if err != nil {
+		return err
+	}
+	xCfg.App = append(xCfg.App, serial.ToTypedMessage(routerCfg))
+
+	if direct.empty() {
+		return nil
+	}
+	directOb := &conf.OutboundDetourConfig{Protocol: "freedom", Tag: directOutboundTag}
+	if cfg.GatewayIP != nil {
+		ifName, err := gatewayInterface(*cfg.GatewayIP)
+		if err != nil {
+			return err
+		}
+		directOb.StreamSetting = &conf.StreamConfig{SocketSettings: &conf.SocketConfig{Interface: ifName}}
+	}
+	directCfg, err := directOb.Build()
+	if err != nil {
+		return fmt.Errorf("build direct outbound: %w", err)
+	}
+	xCfg.Outbound = append(xCfg.Outbound, directCfg)
+
+	return nil
+}
+
+// gatewayInterface returns the name of the network interface gateway IP is reachable on.
+func gatewayInterface(gw net.IP) (string, error) {
+	ifcs, err := net.Interfaces()
+	if err != nil {
+		return "", fmt.Errorf("list interfaces: %w", err)
+	}
+	for _, ifc := range ifcs {
+		addrs, err := ifc.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.Contains(gw) {
+				return ifc.Name, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("no interface found for gateway %s", gw)
+}
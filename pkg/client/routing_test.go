@@ -0,0 +1,135 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	xrayproto "github.com/lilendian0x00/xray-knife/v3/pkg/protocol"
+	"github.com/stretchr/testify/require"
+	xraynet "github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/platform"
+	"github.com/xtls/xray-core/core"
+)
+
+func TestParseDirectRules(t *testing.T) {
+	rules, err := parseDirectRules([]string{
+		"geoip:ru", "geosite:category-gov-ru", "example.com", ".example.org", "full:api.example.net",
+		"10.1.2.3/8", "2001:db8::/32", "192.168.1.1", " ",
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"geosite:category-gov-ru", "domain:example.com", "domain:example.org", "full:api.example.net"}, rules.domains)
+	require.Equal(t, []string{"geoip:ru", "10.0.0.0/8", "2001:db8::/32", "192.168.1.1"}, rules.ips)
+
+	rules, err = parseDirectRules(nil)
+	require.NoError(t, err)
+	require.True(t, rules.empty())
+
+	for _, rule := range []string{"geoip:", "geosite:", "10.0.0.0/33", "not a domain", "example.com/path"} {
+		_, err = parseDirectRules([]string{rule})
+		require.Error(t, err, rule)
+	}
+}
+
+func TestNewXrayInstance_DirectRouting(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer target.Close()
+	// The server is unreachable, so only direct traffic may succeed.
+	link := fmt.Sprintf("vless://%s@127.0.0.1:%d?type=tcp&security=none", testUUID, freeTCPPort(t))
+
+	get := func(t *testing.T, directRules []string) error {
+		cfg := &Config{Logger: slog.New(slog.NewTextHandler(io.Discard, nil)), DirectRules: directRules}
+		inst, _, err := newXrayInstance(cfg, link, nil, nil)
+		require.NoError(t, err)
+		require.NoError(t, inst.Start())
+		defer inst.Close()
+
+		return httpGetVia(inst, target.URL)
+	}
+
+	require.Error(t, get(t, nil))
+	require.NoError(t, get(t, []string{"127.0.0.0/8"}))
+	require.NoError(t, get(t, []string{"127.0.0.1"}))
+	require.Error(t, get(t, []string{"10.0.0.0/8"}))
+}
+
+func TestNewXrayInstance_GeoData(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer target.Close()
+	link := fmt.Sprintf("vless://%s@127.0.0.1:%d?type=tcp&security=none", testUUID, freeTCPPort(t))
+	location := os.Getenv(platform.AssetLocation)
+
+	// Clients with different asset directories each use their own geo data.
+	withLo, withoutLo := t.TempDir(), t.TempDir()
+	writeGeoData(t, withLo)
+	require.NoError(t, os.WriteFile(filepath.Join(withoutLo, geoIPFile), nil, 0o600))
+	for dir, reachable := range map[string]bool{withLo: true, withoutLo: false} {
+		cfg := &Config{
+			Logger:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+			DirectRules: []string{"geoip:lo"},
+			AssetDir:    dir,
+		}
+		inst, _, err := newXrayInstance(cfg, link, nil, nil)
+		if !reachable {
+			require.ErrorContains(t, err, `code "lo" not found`)
+			continue
+		}
+		require.NoError(t, err)
+		require.NoError(t, inst.Start())
+		require.NoError(t, httpGetVia(inst, target.URL))
+		require.NoError(t, inst.Close())
+	}
+	require.Equal(t, location, os.Getenv(platform.AssetLocation), "process environment is not changed")
+}
+
+// httpGetVia makes GET request through XRay instance.
+func httpGetVia(inst xrayproto.Instance, url string) error {
+	httpClient := &http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{
+		DisableKeepAlives: true,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dest, err := xraynet.ParseDestination(network + ":" + addr)
+			if err != nil {
+				return nil, err
+			}
+
+			return core.Dial(ctx, inst.(*core.Instance), dest)
+		},
+	}}
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+func TestNewXrayInstance_MissingGeoData(t *testing.T) {
+	cfg := &Config{
+		Logger:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+		DirectRules: []string{"geoip:ru"},
+		AssetDir:    t.TempDir(),
+	}
+	_, _, err := newXrayInstance(cfg, "vless://"+testUUID+"@127.0.0.1:443?type=tcp&security=none", nil, nil)
+	require.ErrorContains(t, err, "geoip.dat")
+}
+
+func TestGatewayInterface(t *testing.T) {
+	name, err := gatewayInterface(net.IPv4(127, 0, 0, 1))
+	require.NoError(t, err)
+	require.NotEmpty(t, name)
+
+	_, err = gatewayInterface(net.ParseIP("198.51.100.1"))
+	require.Error(t, err)
+}
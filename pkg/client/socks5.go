@@ -0,0 +1,152 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// Minimal SOCKS5 client (RFC 1928) without authentication, used to reach XRay inbound proxy.
+const (
+	socksVersion      = 5
+	socksCmdConnect   = 1
+	socksCmdAssociate = 3
+	socksAtypIPv4     = 1
+	socksAtypDomain   = 3
+	socksAtypIPv6     = 4
+
+	socksHandshakeTimeout = 10 * time.Second
+)
+
+// dialSocks connects to the proxy and sends the command for addr.
+// Returns control connection and the address bound by the proxy.
+func dialSocks(ctx context.Context, proxy string, cmd byte, addr netip.AddrPort) (net.Conn, netip.AddrPort, error) {
+	ctx, cancel := context.WithTimeout(ctx, socksHandshakeTimeout)
+	defer cancel()
+
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", proxy)
+	if err != nil {
+		return nil, netip.AddrPort{}, fmt.Errorf("dial socks proxy: %w", err)
+	}
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+
+	bound, err := socksHandshake(conn, cmd, addr)
+	if err != nil {
+		_ = conn.Close()
+		return nil, netip.AddrPort{}, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	return conn, bound, nil
+}
+
+func socksHandshake(conn net.Conn, cmd byte, addr netip.AddrPort) (netip.AddrPort, error) {
+	if _, err := conn.Write([]byte{socksVersion, 1, 0}); err != nil {
+		return netip.AddrPort{}, fmt.Errorf("socks greeting: %w", err)
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return netip.AddrPort{}, fmt.Errorf("socks greeting: %w", err)
+	}
+	if reply[0] != socksVersion || reply[1] != 0 {
+		return netip.AddrPort{}, fmt.Errorf("socks greeting: unsupported auth method %d", reply[1])
+	}
+
+	req := appendSocksAddr([]byte{socksVersion, cmd, 0}, addr)
+	if _, err := conn.Write(req); err != nil {
+		return netip.AddrPort{}, fmt.Errorf("socks request: %w", err)
+	}
+	reply = make([]byte, 3)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return netip.AddrPort{}, fmt.Errorf("socks reply: %w", err)
+	}
+	if reply[1] != 0 {
+		return netip.AddrPort{}, fmt.Errorf("socks reply: request failed with code %d", reply[1])
+	}
+
+	return readSocksAddr(conn)
+}
+
+// appendSocksAddr appends SOCKS5 address (ATYP, address, port) to b.
+func appendSocksAddr(b []byte, addr netip.AddrPort) []byte {
+	ip := addr.Addr().Unmap()
+	if ip.Is4() {
+		b = append(b, socksAtypIPv4)
+	} else {
+		b = append(b, socksAtypIPv6)
+	}
+	b = append(b, ip.AsSlice()...)
+
+	return binary.BigEndian.AppendUint16(b, addr.Port())
+}
+
+// readSocksAddr reads SOCKS5 address (ATYP, address, port), domain addresses are not resolved.
+func readSocksAddr(r io.Reader) (netip.AddrPort, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return netip.AddrPort{}, fmt.Errorf("read socks address: %w", err)
+	}
+
+	var b []byte
+	switch atyp[0] {
+	case socksAtypIPv4:
+		b = make([]byte, 4+2)
+	case socksAtypIPv6:
+		b = make([]byte, 16+2)
+	case socksAtypDomain:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(r, l); err != nil {
+			return netip.AddrPort{}, fmt.Errorf("read socks address: %w", err)
+		}
+		b = make([]byte, int(l[0])+2)
+	default:
+		return netip.AddrPort{}, fmt.Errorf("read socks address: unknown address type %d", atyp[0])
+	}
+	if _, err := io.ReadFull(r, b); err != nil {
+		return netip.AddrPort{}, fmt.Errorf("read socks address: %w", err)
+	}
+	port := binary.BigEndian.Uint16(b[len(b)-2:])
+	if atyp[0] == socksAtypDomain {
+		return netip.AddrPortFrom(netip.Addr{}, port), nil
+	}
+	ip, _ := netip.AddrFromSlice(b[:len(b)-2]) // 4 or 16 bytes by the address type.
+
+	return netip.AddrPortFrom(ip, port), nil
+}
+
+// parseSocksUDP strips SOCKS5 UDP request header from the datagram.
+func parseSocksUDP(b []byte) (netip.AddrPort, []byte, error) {
+	if len(b) < 4 {
+		return netip.AddrPort{}, nil, errors.New("socks udp datagram is too short")
+	}
+	if b[2] != 0 {
+		return netip.AddrPort{}, nil, errors.New("socks udp fragmentation is not supported")
+	}
+	r := &byteReader{b: b[3:]}
+	addr, err := readSocksAddr(r)
+	if err != nil {
+		return netip.AddrPort{}, nil, err
+	}
+
+	return addr, r.b, nil
+}
+
+type byteReader struct {
+	b []byte
+}
+
+func (r *byteReader) Read(p []byte) (int, error) {
+	if len(r.b) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.b)
+	r.b = r.b[n:]
+
+	return n, nil
+}
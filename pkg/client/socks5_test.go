@@ -0,0 +1,46 @@
+package client
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadSocksAddr(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+		exp  netip.AddrPort
+		err  string
+	}{
+		{name: "ipv4", b: []byte{socksAtypIPv4, 192, 0, 2, 1, 0, 53}, exp: netip.MustParseAddrPort("192.0.2.1:53")},
+		{
+			name: "ipv6",
+			b:    append(append([]byte{socksAtypIPv6}, netip.MustParseAddr("2001:db8::1").AsSlice()...), 1, 187),
+			exp:  netip.MustParseAddrPort("[2001:db8::1]:443"),
+		},
+		{name: "domain", b: append([]byte{socksAtypDomain, 11}, "example.com\x01\xbb"...), exp: netip.AddrPortFrom(netip.Addr{}, 443)},
+		// Domains as long as IP addresses are not taken for them.
+		{name: "domain of 4 bytes", b: append([]byte{socksAtypDomain, 4}, "a.io\x01\xbb"...), exp: netip.AddrPortFrom(netip.Addr{}, 443)},
+		{
+			name: "domain of 16 bytes",
+			b:    append([]byte{socksAtypDomain, 16}, "mail.example.org\x01\xbb"...),
+			exp:  netip.AddrPortFrom(netip.Addr{}, 443),
+		},
+		{name: "unknown type", b: []byte{2, 0, 0}, err: "unknown address type 2"},
+		{name: "short", b: []byte{socksAtypIPv4, 192, 0}, err: "unexpected EOF"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, err := readSocksAddr(bytes.NewReader(tt.b))
+			if tt.err != "" {
+				require.ErrorContains(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.exp, addr)
+		})
+	}
+}
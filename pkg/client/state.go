@@ -0,0 +1,88 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/core"
+)
+
+const (
+	// DefaultHealthTarget is reached by Health when Config.HealthTarget is not set.
+	DefaultHealthTarget = "https://www.google.com/generate_204"
+	// healthCheckTimeout limits reaching the health target in Health.
+	healthCheckTimeout = 10 * time.Second
+)
+
+// State is the Client connection state.
+type State int32
+
+const (
+	StateDisconnected State = iota
+	StateConnecting
+	StateConnected
+	StateDisconnecting
+)
+
+func (s State) String() string {
+	switch s {
+	case StateDisconnected:
+		return "disconnected"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateDisconnecting:
+		return "disconnecting"
+	}
+
+	return "unknown"
+}
+
+// State returns current connection state.
+func (c *Client) State() State {
+	return State(c.state.Load())
+}
+
+// setState updates connection state and calls Config.OnStateChange hook if state changed.
+func (c *Client) setState(s State) {
+	if State(c.state.Swap(int32(s))) == s {
+		return
+	}
+	c.cfg.Logger.Debug("client state changed", "state", s)
+	if c.cfg.OnStateChange != nil {
+		c.cfg.OnStateChange(s)
+	}
+}
+
+// Health checks that the connected tunnel is working: packets from the TUN device are being piped
+// and Config.HealthTarget is reachable through the VPN server. It is meant for liveness checks (e.g. systemd watchdog).
+func (c *Client) Health() error {
+	if c.State() != StateConnected {
+		return ErrNotConnected
+	}
+	if !c.pipeRunning.Load() {
+		return errors.New("tunnel pipe is not running")
+	}
+	inst, ok := c.xInst.(*core.Instance)
+	if !ok {
+		return errors.New("xray core instance is not running")
+	}
+
+	// The target is reached through the server even if it matches direct rules.
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	ctx = session.SetForcedOutboundTagToContext(ctx, proxyOutboundTag)
+	target := c.cfg.HealthTarget
+	if target == "" {
+		target = DefaultHealthTarget
+	}
+	if _, err := probeTarget(ctx, instanceDialer(inst), target); err != nil {
+		return fmt.Errorf("health target %s is not reachable through the server: %w", target, err)
+	}
+
+	return nil
+}
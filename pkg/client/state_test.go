@@ -0,0 +1,76 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/xtls/xray-core/core"
+	"go.uber.org/mock/gomock"
+
+	"github.com/goxray/tun/pkg/client/mocks"
+)
+
+func TestClient_StateChanges(t *testing.T) {
+	xInstMock := mocks.NewMockrunnable(gomock.NewController(t))
+	routesMock := mocks.NewMockipTable(gomock.NewController(t))
+	tunMock := mocks.NewMockioReadWriteCloser(gomock.NewController(t))
+	cl := newTestClient(xInstMock, tunMock, routesMock, nil, func(stopped chan error) { stopped <- nil })
+
+	var states []State
+	cl.cfg.OnStateChange = func(s State) { states = append(states, s) }
+	cl.setState(StateConnected)
+	cl.setState(StateConnected)
+	require.Equal(t, []State{StateConnected}, states)
+	require.Equal(t, StateConnected, cl.State())
+
+	xInstMock.EXPECT().Close().Return(nil)
+	tunMock.EXPECT().Close().Return(nil)
+	mockSuccessDisconnectIP(t, cl, routesMock)
+	require.NoError(t, cl.Disconnect(context.Background()))
+	require.Equal(t, []State{StateConnected, StateDisconnecting, StateDisconnected}, states)
+	require.Equal(t, "disconnected", cl.State().String())
+}
+
+func TestClient_Health(t *testing.T) {
+	srvPort := startTestXrayServer(t, fmt.Sprintf(`{
+		"protocol": "vless",
+		"settings": {"clients": [{"id": %q}], "decryption": "none"},
+		"streamSettings": {"network": "tcp"}
+	}`, testUUID))
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer target.Close()
+
+	newInstance := func(serverPort int) *core.Instance {
+		// The target is reachable directly as well, Health must go through the server regardless.
+		cfg := &Config{Logger: slog.New(slog.NewTextHandler(io.Discard, nil)), DirectRules: []string{"127.0.0.0/8"}}
+		link := fmt.Sprintf("vless://%s@127.0.0.1:%d?type=tcp&security=none", testUUID, serverPort)
+		inst, _, err := newXrayInstance(cfg, link, nil, nil)
+		require.NoError(t, err)
+		require.NoError(t, inst.Start())
+		t.Cleanup(func() { _ = inst.Close() })
+
+		return inst.(*core.Instance)
+	}
+
+	cl := newTestClient(nil, nil, nil, nil, nil)
+	cl.cfg.HealthTarget = target.URL
+	require.ErrorIs(t, cl.Health(), ErrNotConnected)
+
+	cl.setState(StateConnected)
+	require.ErrorContains(t, cl.Health(), "tunnel pipe is not running")
+
+	cl.pipeRunning.Store(true)
+	cl.xInst = newInstance(srvPort)
+	require.NoError(t, cl.Health())
+
+	cl.xInst = newInstance(freeTCPPort(t))
+	require.ErrorContains(t, cl.Health(), "is not reachable through the server")
+}
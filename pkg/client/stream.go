@@ -0,0 +1,193 @@
+package client
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/xtls/xray-core/infra/conf"
+	xtls "github.com/xtls/xray-core/transport/internet/tls"
+)
+
+// StreamSettings is the final transport and security settings a server of the chain is dialed with:
+// link parameters with Config overrides applied.
+type StreamSettings struct {
+	Server    string // Server host:port.
+	Protocol  string // Proxy protocol (vless, vmess, trojan, shadowsocks, wireguard...).
+	Transport string // Transport network (tcp, ws, grpc, xhttp, udp...).
+	Security  string // Stream security: none, tls or reality.
+
+	ServerName    string   // Server name (SNI).
+	Fingerprint   string   // uTLS fingerprint, empty if TLS is made by Go (ClientCert).
+	ALPN          []string // TLS application protocols.
+	AllowInsecure bool     // Server certificate is not verified.
+	ClientCert    bool     // Client certificate is presented to the server.
+
+	PublicKey string // REALITY public key.
+	ShortID   string // REALITY short ID.
+	SpiderX   string // REALITY spider path.
+}
+
+// EffectiveStreams returns stream settings the chain of servers (entry server first) would be dialed with,
+// without connecting. See Client.Connect for the meaning of link and hops.
+func EffectiveStreams(cfg Config, link string, hops ...string) ([]StreamSettings, error) {
+	parsed, err := parseChain(&cfg, append([]string{link}, hops...))
+	if err != nil {
+		return nil, err
+	}
+
+	ch, err := buildChainOutbounds(&cfg, parsed)
+	if err != nil {
+		return nil, err
+	}
+
+	return ch.streams, nil
+}
+
+// streamOverrides are Config overrides of the link stream settings, applied to every hop of the chain.
+type streamOverrides struct {
+	fingerprint string
+	alpn        []string
+	publicKey   string
+	shortID     string
+	spiderX     string
+}
+
+// newStreamOverrides validates overrides of the config, nil is returned if there are none.
+func newStreamOverrides(cfg *Config) (*streamOverrides, error) {
+	o := &streamOverrides{
+		fingerprint: strings.ToLower(strings.TrimSpace(cfg.TLSFingerprint)),
+		alpn:        cfg.TLSALPN,
+		publicKey:   strings.TrimSpace(cfg.RealityPublicKey),
+		shortID:     strings.ToLower(strings.TrimSpace(cfg.RealityShortID)),
+		spiderX:     strings.TrimSpace(cfg.RealitySpiderX),
+	}
+	if o.fingerprint == "" && len(o.alpn) == 0 && !o.reality() {
+		return nil, nil
+	}
+
+	if o.fingerprint != "" && o.fingerprint != "unsafe" && xtls.GetFingerprint(o.fingerprint) == nil {
+		return nil, fmt.Errorf("tls: unknown fingerprint %q", cfg.TLSFingerprint)
+	}
+	for _, p := range o.alpn {
+		if p == "" || len(p) > 255 {
+			return nil, fmt.Errorf("tls: invalid ALPN protocol %q", p)
+		}
+	}
+	if o.publicKey != "" {
+		if key, err := base64.RawURLEncoding.DecodeString(o.publicKey); err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("reality: public key must be 32 bytes in URL-safe base64 without padding")
+		}
+	}
+	if o.shortID != "" {
+		if _, err := hex.DecodeString(o.shortID); err != nil || len(o.shortID) > 16 {
+			return nil, fmt.Errorf("reality: short ID must be up to 16 hex digits of even length")
+		}
+	}
+	if o.spiderX != "" && !strings.HasPrefix(o.spiderX, "/") {
+		return nil, fmt.Errorf("reality: spiderX must be a path starting with /")
+	}
+
+	return o, nil
+}
+
+// reality reports whether REALITY parameters are overridden.
+func (o *streamOverrides) reality() bool {
+	return o.publicKey != "" || o.shortID != "" || o.spiderX != ""
+}
+
+// tls reports whether TLS parameters (used by REALITY too) are overridden.
+func (o *streamOverrides) tls() bool {
+	return o.fingerprint != "" || len(o.alpn) > 0
+}
+
+// apply sets the overrides to the outbound built from the link, it must be done before tlsTrust.apply.
+func (o *streamOverrides) apply(ob *conf.OutboundDetourConfig) {
+	ss := ob.StreamSetting
+	if o == nil || ss == nil {
+		return
+	}
+
+	switch ss.Security {
+	case "reality":
+		if ss.REALITYSettings == nil {
+			return
+		}
+		r := ss.REALITYSettings
+		if o.fingerprint != "" {
+			r.Fingerprint = o.fingerprint
+		}
+		if o.publicKey != "" {
+			r.PublicKey = o.publicKey
+		}
+		if o.shortID != "" {
+			r.ShortId = o.shortID
+		}
+		if o.spiderX != "" {
+			r.SpiderX = o.spiderX
+		}
+	case "tls":
+		if ss.TLSSettings == nil {
+			ss.TLSSettings = &conf.TLSConfig{}
+		}
+		if o.fingerprint != "" {
+			ss.TLSSettings.Fingerprint = o.fingerprint
+		}
+		if len(o.alpn) > 0 {
+			alpn := conf.StringList(o.alpn)
+			ss.TLSSettings.ALPN = &alpn
+		}
+	}
+}
+
+// newStreamSettings describes the hop outbound with all settings applied, dialer is the one returned by tlsTrust.apply.
+func newStreamSettings(h hop, ob *conf.OutboundDetourConfig, dialer *tlsDialer) StreamSettings {
+	g := h.protocol.ConvertToGeneralConfig()
+	s := StreamSettings{
+		Server:    net.JoinHostPort(g.Address, g.Port),
+		Protocol:  ob.Protocol,
+		Transport: "tcp",
+		Security:  "none",
+	}
+	if ob.Protocol == ProtocolWireGuard {
+		s.Transport = "udp"
+	}
+
+	ss := ob.StreamSetting
+	if ss == nil {
+		return s
+	}
+	if ss.Network != nil && *ss.Network != "" {
+		s.Transport = strings.ToLower(string(*ss.Network))
+	}
+	if ss.Security != "" {
+		s.Security = ss.Security
+	}
+
+	switch {
+	case dialer != nil:
+		s.Security = "tls"
+		s.ServerName = dialer.serverName
+		s.ALPN = dialer.alpn
+		s.AllowInsecure = dialer.trust.insecure
+		s.ClientCert = true
+	case ss.Security == "tls" && ss.TLSSettings != nil:
+		s.ServerName = ss.TLSSettings.ServerName
+		s.Fingerprint = ss.TLSSettings.Fingerprint
+		if ss.TLSSettings.ALPN != nil {
+			s.ALPN = *ss.TLSSettings.ALPN
+		}
+		s.AllowInsecure = ss.TLSSettings.Insecure
+	case ss.Security == "reality" && ss.REALITYSettings != nil:
+		r := ss.REALITYSettings
+		s.ServerName = r.ServerName
+		s.Fingerprint = r.Fingerprint
+		s.PublicKey = r.PublicKey
+		s.ShortID = r.ShortId
+		s.SpiderX = r.SpiderX
+	}
+
+	return s
+}
@@ -0,0 +1,139 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewStreamOverrides(t *testing.T) {
+	o, err := newStreamOverrides(&Config{})
+	require.NoError(t, err)
+	require.Nil(t, o)
+
+	o, err = newStreamOverrides(&Config{TLSFingerprint: " Firefox ", RealityShortID: "AB12"})
+	require.NoError(t, err)
+	require.Equal(t, "firefox", o.fingerprint)
+	require.Equal(t, "ab12", o.shortID)
+	require.True(t, o.tls())
+	require.True(t, o.reality())
+
+	for name, tc := range map[string]struct {
+		cfg Config
+		err string
+	}{
+		"fingerprint": {Config{TLSFingerprint: "netscape"}, `unknown fingerprint "netscape"`},
+		"alpn":        {Config{TLSALPN: []string{"h2", ""}}, `invalid ALPN protocol ""`},
+		"public key":  {Config{RealityPublicKey: "AAAA"}, "public key must be 32 bytes"},
+		"short id":    {Config{RealityShortID: "abc"}, "short ID must be up to 16 hex digits"},
+		"long id":     {Config{RealityShortID: "0123456789abcdef01"}, "short ID must be up to 16 hex digits"},
+		"spiderX":     {Config{RealitySpiderX: "index.html"}, "spiderX must be a path"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := newStreamOverrides(&tc.cfg)
+			require.ErrorContains(t, err, tc.err)
+		})
+	}
+}
+
+func TestEffectiveStreams(t *testing.T) {
+	tlsLink := "vless://" + testUUID + "@1.1.1.1:443?type=ws&security=tls&sni=link.test&fp=chrome&alpn=h2&path=%2Fws"
+	realityLink := "vless://" + testUUID + "@2.2.2.2:443?type=tcp&security=reality&sni=link.test&pbk=" +
+		"SbVKOEMjK0sIlbwg4akyBg5mL5KZwwB-ed4eEE7YnRc&sid=01&spx=%2F&fp=chrome"
+	wgLink := "wireguard://" + escapeWGKey(testWGPrivateKey) + "@5.5.5.5:51820?address=10.0.0.2&publickey=" + escapeWGKey(testWGPublicKey)
+
+	// Link parameters are used as is without overrides.
+	streams, err := EffectiveStreams(Config{}, realityLink, tlsLink)
+	require.NoError(t, err)
+	require.Equal(t, []StreamSettings{{
+		Server: "2.2.2.2:443", Protocol: "vless", Transport: "tcp", Security: "reality",
+		ServerName: "link.test", Fingerprint: "chrome",
+		PublicKey: "SbVKOEMjK0sIlbwg4akyBg5mL5KZwwB-ed4eEE7YnRc", ShortID: "01", SpiderX: "/",
+	}, {
+		Server: "1.1.1.1:443", Protocol: "vless", Transport: "ws", Security: "tls",
+		ServerName: "link.test", Fingerprint: "chrome", ALPN: []string{"h2"},
+	}}, streams)
+
+	// Overrides are applied to every hop they are relevant to.
+	cfg := Config{
+		TLSFingerprint:   "firefox",
+		TLSALPN:          []string{"http/1.1"},
+		TLSServerName:    "forced.test",
+		RealityPublicKey: "Dcs-kLWhTxLNFRXSQpOaZT-H1VnUadTT8SXBo8h7IAY",
+		RealityShortID:   "abcdef",
+		RealitySpiderX:   "/index.html",
+	}
+	streams, err = EffectiveStreams(cfg, realityLink, tlsLink)
+	require.NoError(t, err)
+	require.Equal(t, []StreamSettings{{
+		Server: "2.2.2.2:443", Protocol: "vless", Transport: "tcp", Security: "reality",
+		ServerName: "forced.test", Fingerprint: "firefox",
+		PublicKey: cfg.RealityPublicKey, ShortID: "abcdef", SpiderX: "/index.html",
+	}, {
+		Server: "1.1.1.1:443", Protocol: "vless", Transport: "ws", Security: "tls",
+		ServerName: "forced.test", Fingerprint: "firefox", ALPN: []string{"http/1.1"},
+	}}, streams)
+
+	// The instance reports the settings of the chain it was built with.
+	cfg.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	inst, _, built, err := newChainXrayInstance(&cfg, []string{realityLink, tlsLink}, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, streams, built)
+	forgetInstance(inst)
+	require.NoError(t, inst.Close())
+
+	// Overrides must be valid for XRay too.
+	_, err = EffectiveStreams(Config{TLSFingerprint: "unsafe"}, realityLink)
+	require.ErrorContains(t, err, `invalid "fingerprint": unsafe`)
+	_, err = EffectiveStreams(Config{TLSFingerprint: "unsafe"}, tlsLink)
+	require.NoError(t, err)
+
+	// Overrides need a server they apply to.
+	_, err = EffectiveStreams(Config{RealityShortID: "01"}, tlsLink)
+	require.ErrorContains(t, err, "need a server with REALITY security")
+	_, err = EffectiveStreams(Config{TLSFingerprint: "safari"}, wgLink)
+	require.ErrorContains(t, err, "need a server with TLS or REALITY security")
+
+	streams, err = EffectiveStreams(Config{}, wgLink)
+	require.NoError(t, err)
+	require.Equal(t, []StreamSettings{{Server: "5.5.5.5:51820", Protocol: "wireguard", Transport: "udp", Security: "none"}}, streams)
+
+	// TLS made by Go for the client certificate has no uTLS fingerprint.
+	ca := newTestCA(t)
+	client := ca.issue(t, "client", time.Hour)
+	streams, err = EffectiveStreams(Config{TLSFingerprint: "firefox", TLSClientCert: client.certPEM, TLSClientKey: client.keyPEM}, tlsLink)
+	require.NoError(t, err)
+	require.Equal(t, []StreamSettings{{
+		Server: "1.1.1.1:443", Protocol: "vless", Transport: "ws", Security: "tls",
+		ServerName: "link.test", ALPN: []string{"h2"}, ClientCert: true,
+	}}, streams)
+}
+
+func TestClient_Effective(t *testing.T) {
+	port := startTestXrayServerWithOutbound(t, fmt.Sprintf(`{
+		"protocol": "vless",
+		"settings": {"clients": [{"id": %q}], "decryption": "none"},
+		"streamSettings": {"network": "tcp"}
+	}`, testUUID), `{"protocol": "freedom"}`)
+
+	_, dev := newTestAppStack(t)
+	cl := &Client{
+		cfg:           Config{Logger: slog.New(slog.NewTextHandler(os.Stdout, nil)), TUN: dev},
+		tunnelStopped: make(chan error),
+		pipe:          newNetstackPipe(defaultNetstackOpts),
+	}
+	require.Nil(t, cl.Effective())
+	require.NoError(t, cl.Connect(fmt.Sprintf("vless://%s@127.0.0.1:%d?type=tcp&security=none", testUUID, port)))
+	require.Equal(t, []StreamSettings{{
+		Server: fmt.Sprintf("127.0.0.1:%d", port), Protocol: "vless", Transport: "tcp", Security: "none",
+	}}, cl.Effective())
+
+	require.NoError(t, cl.Disconnect(context.Background()))
+	require.Nil(t, cl.Effective())
+}
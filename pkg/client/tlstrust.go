@@ -0,0 +1,465 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/buf"
+	xraynet "github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/serial"
+	"github.com/xtls/xray-core/common/session"
+	"github.com/xtls/xray-core/common/task"
+	"github.com/xtls/xray-core/infra/conf"
+	"github.com/xtls/xray-core/transport"
+	"github.com/xtls/xray-core/transport/internet"
+)
+
+const (
+	// tlsCheckTimeout limits TLS verification of the server on connect.
+	tlsCheckTimeout = 10 * time.Second
+	// tlsClientCertWait is how long to wait for the server to reject client certificate after the handshake,
+	// if the server requested one.
+	// TLS 1.3 servers do it after the handshake is completed on client side.
+	tlsClientCertWait = 500 * time.Millisecond
+)
+
+// errTLSPinMismatch is reported when no certificate of the server chain matches Config.TLSPins.
+var errTLSPinMismatch = errors.New("no certificate of the chain matches pins")
+
+// TLSErrorKind classifies server TLS verification failures.
+type TLSErrorKind int
+
+const (
+	// TLSErrorUnknownAuthority means the server certificate is not signed by a trusted CA.
+	TLSErrorUnknownAuthority TLSErrorKind = iota + 1
+	// TLSErrorHostname means the server certificate is not valid for the server name (SNI).
+	TLSErrorHostname
+	// TLSErrorExpired means the server certificate is expired or not valid yet.
+	TLSErrorExpired
+	// TLSErrorPinMismatch means no certificate of the server chain matches Config.TLSPins.
+	TLSErrorPinMismatch
+	// TLSErrorClientCert means the server rejected (or required) client certificate.
+	TLSErrorClientCert
+	// TLSErrorHandshake means TLS handshake failed for another reason.
+	TLSErrorHandshake
+)
+
+func (k TLSErrorKind) String() string {
+	switch k {
+	case TLSErrorUnknownAuthority:
+		return "unknown authority"
+	case TLSErrorHostname:
+		return "hostname mismatch"
+	case TLSErrorExpired:
+		return "expired"
+	case TLSErrorPinMismatch:
+		return "pin mismatch"
+	case TLSErrorClientCert:
+		return "client certificate rejected"
+	case TLSErrorHandshake:
+		return "handshake"
+	}
+
+	return "unknown"
+}
+
+// TLSError is returned on connect when the server fails TLS verification, use errors.As to inspect the kind.
+type TLSError struct {
+	Kind   TLSErrorKind
+	Server string // Server address (host:port).
+	Err    error
+}
+
+func (e *TLSError) Error() string {
+	return fmt.Sprintf("tls verification of %s failed (%s): %v", e.Server, e.Kind, e.Err)
+}
+
+func (e *TLSError) Unwrap() error {
+	return e.Err
+}
+
+// newTLSError wraps handshake error into TLSError with the most specific kind.
+func newTLSError(server string, err error) *TLSError {
+	var (
+		unknownAuth x509.UnknownAuthorityError
+		hostnameErr x509.HostnameError
+		invalidErr  x509.CertificateInvalidError
+	)
+	kind := TLSErrorHandshake
+	switch {
+	case errors.Is(err, errTLSPinMismatch):
+		kind = TLSErrorPinMismatch
+	case errors.As(err, &unknownAuth):
+		kind = TLSErrorUnknownAuthority
+	case errors.As(err, &hostnameErr):
+		kind = TLSErrorHostname
+	case errors.As(err, &invalidErr) && invalidErr.Reason == x509.Expired:
+		kind = TLSErrorExpired
+	case isClientCertAlert(err):
+		kind = TLSErrorClientCert
+	}
+
+	return &TLSError{Kind: kind, Server: server, Err: err}
+}
+
+// isClientCertAlert reports whether err is TLS alert sent by the server about the client certificate.
+func isClientCertAlert(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	for _, alert := range []string{
+		"bad certificate", "certificate required", "unknown certificate authority",
+		"certificate expired", "certificate revoked", "unsupported certificate", "certificate unknown",
+	} {
+		if strings.Contains(msg, "remote error: tls: "+alert) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tlsTrust is the TLS verification settings of the Config applied to servers of the link.
+type tlsTrust struct {
+	caPEM      []byte
+	roots      *x509.CertPool // nil means system roots.
+	cert       *tls.Certificate
+	pins       [][]byte // SHA-256 of SubjectPublicKeyInfo.
+	serverName string
+	insecure   bool
+	logger     *slog.Logger
+}
+
+// newTLSTrust loads TLS settings of the config, nil is returned if there is nothing to apply.
+func newTLSTrust(cfg *Config) (*tlsTrust, error) {
+	t := &tlsTrust{serverName: cfg.TLSServerName, insecure: cfg.TLSAllowInsecure, logger: cfg.Logger}
+
+	t.caPEM = append(t.caPEM, cfg.TLSCA...)
+	if cfg.TLSCAFile != "" {
+		b, err := os.ReadFile(cfg.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls: read CA file: %w", err)
+		}
+		t.caPEM = append(append(t.caPEM, '\n'), b...)
+	}
+	if len(t.caPEM) > 0 {
+		t.roots = x509.NewCertPool()
+		if !t.roots.AppendCertsFromPEM(t.caPEM) {
+			return nil, fmt.Errorf("tls: no CA certificates found in PEM")
+		}
+	}
+
+	certPEM, err := readPEM(cfg.TLSClientCertFile, cfg.TLSClientCert)
+	if err != nil {
+		return nil, fmt.Errorf("tls: read client certificate: %w", err)
+	}
+	keyPEM, err := readPEM(cfg.TLSClientKeyFile, cfg.TLSClientKey)
+	if err != nil {
+		return nil, fmt.Errorf("tls: read client key: %w", err)
+	}
+	if len(certPEM) > 0 || len(keyPEM) > 0 {
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("tls: client certificate: %w", err)
+		}
+		t.cert = &cert
+	}
+
+	for _, pin := range cfg.TLSPins {
+		b, err := parsePin(pin)
+		if err != nil {
+			return nil, err
+		}
+		t.pins = append(t.pins, b)
+	}
+	if len(t.pins) > 0 && t.insecure {
+		return nil, fmt.Errorf("tls: pins can't be checked with TLSAllowInsecure, add the server certificate as CA instead")
+	}
+
+	if !t.verifies() && t.serverName == "" {
+		return nil, nil
+	}
+
+	return t, nil
+}
+
+// readPEM reads PEM file if the path is set, b is returned otherwise.
+func readPEM(path string, b []byte) ([]byte, error) {
+	if path == "" {
+		return b, nil
+	}
+
+	return os.ReadFile(path)
+}
+
+// parsePin decodes SHA-256 pin given in base64 or hex.
+func parsePin(pin string) ([]byte, error) {
+	if b, err := base64.StdEncoding.DecodeString(pin); err == nil && len(b) == sha256.Size {
+		return b, nil
+	}
+	if b, err := hex.DecodeString(strings.ReplaceAll(pin, ":", "")); err == nil && len(b) == sha256.Size {
+		return b, nil
+	}
+
+	return nil, fmt.Errorf("tls: pin %q is not SHA-256 in base64 or hex", pin)
+}
+
+// verifies reports whether there are settings changing server certificate verification.
+func (t *tlsTrust) verifies() bool {
+	return t != nil && (t.roots != nil || t.cert != nil || len(t.pins) > 0)
+}
+
+// apply applies the settings to TLS or REALITY stream settings of the outbound.
+// Servers requiring client certificate are dialed with returned dialer, its tag and previous hop are to be set by the caller.
+func (t *tlsTrust) apply(ob *conf.OutboundDetourConfig) (*tlsDialer, error) {
+	ss := ob.StreamSetting
+	if t == nil || ss == nil {
+		return nil, nil
+	}
+
+	switch ss.Security {
+	case "reality":
+		// REALITY server is verified by its public key, only the server name can be changed.
+		if t.serverName != "" && ss.REALITYSettings != nil {
+			ss.REALITYSettings.ServerName = t.serverName
+		}
+	case "tls":
+		if ss.TLSSettings == nil {
+			ss.TLSSettings = &conf.TLSConfig{}
+		}
+		tlsCfg := ss.TLSSettings
+		if t.serverName != "" {
+			tlsCfg.ServerName = t.serverName
+		}
+		if t.cert != nil {
+			return t.dialerFor(ss)
+		}
+		if len(t.caPEM) > 0 {
+			tlsCfg.Certs = append(tlsCfg.Certs, &conf.TLSCertConfig{
+				CertStr: strings.Split(strings.TrimSpace(string(t.caPEM)), "\n"),
+				Usage:   "verify",
+			})
+			tlsCfg.DisableSystemRoot = true
+		}
+		if len(t.pins) > 0 {
+			pins := make([]string, len(t.pins))
+			for i, pin := range t.pins {
+				pins[i] = base64.StdEncoding.EncodeToString(pin)
+			}
+			tlsCfg.PinnedPeerCertificatePublicKeySha256 = &pins
+		}
+	}
+
+	return nil, nil
+}
+
+// dialerFor moves TLS of the stream to tlsDialer, XRay TLS can't present client certificates.
+// The stream is sent in plain text to the dialer, so transports running over TLS directly are supported only.
+func (t *tlsTrust) dialerFor(ss *conf.StreamConfig) (*tlsDialer, error) {
+	network := "tcp"
+	if ss.Network != nil {
+		network = strings.ToLower(string(*ss.Network))
+	}
+	alpn := []string{"http/1.1"}
+	switch network {
+	case "tcp", "raw", "ws", "websocket", "httpupgrade":
+	case "grpc", "gun":
+		alpn = []string{"h2"}
+	default:
+		return nil, fmt.Errorf("tls: client certificate is not supported with %s transport", network)
+	}
+	if ss.TLSSettings.ALPN != nil && len(*ss.TLSSettings.ALPN) > 0 {
+		alpn = *ss.TLSSettings.ALPN
+	}
+
+	d := &tlsDialer{trust: t, serverName: ss.TLSSettings.ServerName, alpn: alpn}
+	ss.Security = "none"
+	ss.TLSSettings = nil
+
+	return d, nil
+}
+
+// clientConfig returns TLS config verifying the server the same way XRay does with the settings applied.
+func (t *tlsTrust) clientConfig(serverName string, alpn []string) *tls.Config {
+	c := &tls.Config{
+		ServerName:         serverName,
+		RootCAs:            t.roots,
+		NextProtos:         alpn,
+		InsecureSkipVerify: t.insecure,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if t.cert != nil {
+		c.Certificates = []tls.Certificate{*t.cert}
+	}
+	if len(t.pins) > 0 {
+		c.VerifyConnection = t.verifyPins
+	}
+
+	return c
+}
+
+// verifyPins checks that a certificate of the verified chain matches a pin.
+func (t *tlsTrust) verifyPins(cs tls.ConnectionState) error {
+	for _, chain := range cs.VerifiedChains {
+		for _, cert := range chain {
+			hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range t.pins {
+				if subtle.ConstantTimeCompare(hash[:], pin) == 1 {
+					return nil
+				}
+			}
+		}
+	}
+
+	return errTLSPinMismatch
+}
+
+// verifyServer makes TLS handshake with the server of the link, so that verification failures
+// are reported on connect as TLSError rather than as failing connections later.
+// Servers with other security and packet transports are not checked, neither are unreachable servers.
+func (t *tlsTrust) verifyServer(ctx context.Context, info *ServerInfo) error {
+	if !t.verifies() || info.Security != "tls" || isPacketTransport(info) {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, tlsCheckTimeout)
+	defer cancel()
+
+	addr := info.HostPort()
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		t.logger.Warn("TLS verification skipped, server is not reachable", "server", addr, "err", err)
+		return nil
+	}
+	defer conn.Close()
+
+	serverName := info.SNI
+	if t.serverName != "" {
+		serverName = t.serverName
+	}
+	if serverName == "" {
+		serverName = info.Address
+	}
+	alpn := info.ALPN
+	if len(alpn) == 0 {
+		alpn = []string{"h2", "http/1.1"}
+	}
+	tlsCfg := t.clientConfig(serverName, alpn)
+	certRequested := false
+	tlsCfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		certRequested = true
+		if t.cert != nil {
+			return t.cert, nil
+		}
+
+		return &tls.Certificate{}, nil
+	}
+	tlsConn := tls.Client(conn, tlsCfg)
+	err = tlsConn.HandshakeContext(ctx)
+	if err == nil && certRequested {
+		_ = tlsConn.SetReadDeadline(time.Now().Add(tlsClientCertWait))
+		if _, readErr := tlsConn.Read(make([]byte, 1)); isClientCertAlert(readErr) {
+			err = readErr
+		}
+	}
+	if err != nil {
+		return newTLSError(addr, err)
+	}
+
+	return nil
+}
+
+// verifyServerTLS verifies TLS of the server the link connects to directly (entry server of the chain).
+func verifyServerTLS(ctx context.Context, cfg *Config, link string) error {
+	t, err := newTLSTrust(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	if !t.verifies() {
+		return nil
+	}
+	h, err := parseHop(cfg, link, true)
+	if err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+
+	return t.verifyServer(ctx, h.info)
+}
+
+// tlsDialer is the dialer proxy wrapping connections to the server into TLS with client certificate.
+type tlsDialer struct {
+	tag        string
+	prev       string // Dialer proxy of the hop, dialed directly if empty.
+	trust      *tlsTrust
+	serverName string // Server address is used if empty.
+	alpn       []string
+}
+
+func (d *tlsDialer) Start() error                         { return nil }
+func (d *tlsDialer) Close() error                         { return nil }
+func (d *tlsDialer) Tag() string                          { return d.tag }
+func (d *tlsDialer) SenderSettings() *serial.TypedMessage { return nil }
+func (d *tlsDialer) ProxySettings() *serial.TypedMessage  { return nil }
+
+func (d *tlsDialer) Dispatch(ctx context.Context, link *transport.Link) {
+	obs := session.OutboundsFromContext(ctx)
+	dest := obs[len(obs)-1].Target
+	conn, err := d.dial(ctx, dest)
+	if err != nil {
+		d.trust.logger.Error("server TLS connection failed", "server", dest.NetAddr(), "err", err)
+		common.Interrupt(link.Writer)
+		common.Interrupt(link.Reader)
+
+		return
+	}
+	defer conn.Close()
+
+	requestDone := func() error {
+		return buf.Copy(link.Reader, buf.NewWriter(conn))
+	}
+	responseDone := func() error {
+		return buf.Copy(buf.NewReader(conn), link.Writer)
+	}
+	if err = task.Run(ctx, requestDone, task.OnSuccess(responseDone, task.Close(link.Writer))); err != nil {
+		common.Interrupt(link.Writer)
+		common.Interrupt(link.Reader)
+	}
+}
+
+func (d *tlsDialer) dial(ctx context.Context, dest xraynet.Destination) (net.Conn, error) {
+	var sockopt *internet.SocketConfig
+	if d.prev != "" {
+		sockopt = &internet.SocketConfig{DialerProxy: d.prev}
+	}
+	raw, err := internet.DialSystem(ctx, dest, sockopt)
+	if err != nil {
+		return nil, fmt.Errorf("dial: %w", err)
+	}
+
+	serverName := d.serverName
+	if serverName == "" {
+		serverName = dest.Address.String()
+	}
+	ctx, cancel := context.WithTimeout(ctx, tlsCheckTimeout)
+	defer cancel()
+	conn := tls.Client(raw, d.trust.clientConfig(serverName, d.alpn))
+	if err = conn.HandshakeContext(ctx); err != nil {
+		_ = raw.Close()
+		return nil, newTLSError(dest.NetAddr(), err)
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,375 @@
+package client
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+)
+
+func TestNewTLSTrust(t *testing.T) {
+	ca := newTestCA(t)
+	client := ca.issue(t, "client", time.Hour)
+
+	trust, err := newTLSTrust(&Config{TLSAllowInsecure: true})
+	require.NoError(t, err)
+	require.Nil(t, trust) // Nothing to apply.
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, ca.certPEM, 0o600))
+	trust, err = newTLSTrust(&Config{
+		TLSCAFile:     caFile,
+		TLSClientCert: client.certPEM,
+		TLSClientKey:  client.keyPEM,
+		TLSPins:       []string{ca.pin(), hex.EncodeToString(make([]byte, 32))},
+	})
+	require.NoError(t, err)
+	require.True(t, trust.verifies())
+	require.NotNil(t, trust.roots)
+	require.NotNil(t, trust.cert)
+	require.Len(t, trust.pins, 2)
+
+	for name, tc := range map[string]struct {
+		cfg Config
+		err string
+	}{
+		"bad CA":      {Config{TLSCA: []byte("not a pem")}, "no CA certificates found"},
+		"no CA file":  {Config{TLSCAFile: filepath.Join(t.TempDir(), "missing.pem")}, "read CA file"},
+		"no key":      {Config{TLSClientCert: client.certPEM}, "client certificate"},
+		"bad pin":     {Config{TLSPins: []string{"abc"}}, `pin "abc" is not SHA-256`},
+		"insecure":    {Config{TLSPins: []string{ca.pin()}, TLSAllowInsecure: true}, "pins can't be checked"},
+		"no key file": {Config{TLSClientCert: client.certPEM, TLSClientKeyFile: "/nonexistent"}, "read client key"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := newTLSTrust(&tc.cfg)
+			require.ErrorContains(t, err, tc.err)
+		})
+	}
+}
+
+func TestBuildChainOutbounds_TLSTrust(t *testing.T) {
+	ca := newTestCA(t)
+	client := ca.issue(t, "client", time.Hour)
+	cfg := &Config{TLSCA: ca.certPEM, TLSPins: []string{ca.pin()}, TLSServerName: "forced.test"}
+	tlsLink := "vless://" + testUUID + "@1.1.1.1:443?type=ws&security=tls&sni=link.test&path=%2Fws"
+	realityLink := "vless://" + testUUID + "@2.2.2.2:443?type=tcp&security=reality&sni=link.test&pbk=" +
+		"SbVKOEMjK0sIlbwg4akyBg5mL5KZwwB-ed4eEE7YnRc&fp=chrome"
+
+	hops := parseTestHops(t, tlsLink)
+	ob, err := hops[0].protocol.BuildOutboundDetourConfig(false)
+	require.NoError(t, err)
+	trust, err := newTLSTrust(cfg)
+	require.NoError(t, err)
+	dialer, err := trust.apply(ob)
+	require.NoError(t, err)
+	require.Nil(t, dialer)
+	tlsCfg := ob.StreamSetting.TLSSettings
+	require.Equal(t, "forced.test", tlsCfg.ServerName)
+	require.True(t, tlsCfg.DisableSystemRoot)
+	require.Len(t, tlsCfg.Certs, 1)
+	require.Equal(t, "verify", tlsCfg.Certs[0].Usage)
+	require.Equal(t, []string{ca.pin()}, *tlsCfg.PinnedPeerCertificatePublicKeySha256)
+	_, err = ob.Build()
+	require.NoError(t, err)
+
+	// REALITY gets server name only.
+	hops = parseTestHops(t, realityLink)
+	ob, err = hops[0].protocol.BuildOutboundDetourConfig(false)
+	require.NoError(t, err)
+	_, err = trust.apply(ob)
+	require.NoError(t, err)
+	require.Equal(t, "forced.test", ob.StreamSetting.REALITYSettings.ServerName)
+	// And verification settings need a TLS server.
+	_, err = buildChainOutbounds(cfg, hops)
+	require.ErrorContains(t, err, "need a server with TLS security")
+	_, err = buildChainOutbounds(cfg, parseTestHops(t, realityLink, tlsLink))
+	require.NoError(t, err)
+
+	// Client certificate moves TLS to own dialer, the outbound is dialed through it.
+	mtls := &Config{TLSCA: ca.certPEM, TLSClientCert: client.certPEM, TLSClientKey: client.keyPEM}
+	ch, err := buildChainOutbounds(mtls, parseTestHops(t, realityLink, tlsLink))
+	require.NoError(t, err)
+	require.Len(t, ch.outbounds, 2)
+	require.Len(t, ch.dialers, 1)
+	d := ch.dialers[0].(*tlsDialer)
+	require.Regexp(t, `^hop-\d+-1-tls$`, d.Tag())
+	require.Regexp(t, `^hop-\d+-0$`, d.prev)
+	require.Equal(t, "link.test", d.serverName)
+	require.Equal(t, []string{"http/1.1"}, d.alpn)
+
+	_, err = buildChainOutbounds(mtls, parseTestHops(t, "vless://"+testUUID+"@1.1.1.1:443?type=xhttp&security=tls"))
+	require.ErrorContains(t, err, "client certificate is not supported with xhttp transport")
+}
+
+func TestVerifyServerTLS(t *testing.T) {
+	ca, otherCA := newTestCA(t), newTestCA(t)
+	server := ca.issue(t, "server.test", time.Hour)
+	client, otherClient := ca.issue(t, "client", time.Hour), otherCA.issue(t, "client", time.Hour)
+	plainAddr := startTestTLSServer(t, server, nil)
+	mtlsAddr := startTestTLSServer(t, server, ca)
+	expiredAddr := startTestTLSServer(t, ca.issue(t, "server.test", -time.Hour), nil)
+	link := func(addr string) string {
+		return fmt.Sprintf("vless://%s@%s?type=tcp&security=tls&sni=server.test", testUUID, addr)
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	for name, tc := range map[string]struct {
+		cfg  Config
+		addr string
+		kind TLSErrorKind
+	}{
+		"ok":               {Config{TLSCA: ca.certPEM}, plainAddr, 0},
+		"pin ok":           {Config{TLSCA: ca.certPEM, TLSPins: []string{ca.pin()}}, plainAddr, 0},
+		"mtls ok":          {Config{TLSCA: ca.certPEM, TLSClientCert: client.certPEM, TLSClientKey: client.keyPEM}, mtlsAddr, 0},
+		"unknown CA":       {Config{TLSCA: otherCA.certPEM}, plainAddr, TLSErrorUnknownAuthority},
+		"hostname":         {Config{TLSCA: ca.certPEM, TLSServerName: "other.test"}, plainAddr, TLSErrorHostname},
+		"expired":          {Config{TLSCA: ca.certPEM}, expiredAddr, TLSErrorExpired},
+		"pin mismatch":     {Config{TLSCA: ca.certPEM, TLSPins: []string{otherCA.pin()}}, plainAddr, TLSErrorPinMismatch},
+		"no client cert":   {Config{TLSCA: ca.certPEM}, mtlsAddr, TLSErrorClientCert},
+		"untrusted client": {Config{TLSCA: ca.certPEM, TLSClientCert: otherClient.certPEM, TLSClientKey: otherClient.keyPEM}, mtlsAddr, TLSErrorClientCert},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tc.cfg.Logger = logger
+			err := verifyServerTLS(context.Background(), &tc.cfg, link(tc.addr))
+			if tc.kind == 0 {
+				require.NoError(t, err)
+				return
+			}
+			var tlsErr *TLSError
+			require.ErrorAs(t, err, &tlsErr)
+			require.Equal(t, tc.kind, tlsErr.Kind, err.Error())
+			require.Equal(t, tc.addr, tlsErr.Server)
+		})
+	}
+
+	// Unreachable servers and servers without TLS are not checked.
+	require.NoError(t, verifyServerTLS(context.Background(), &Config{TLSCA: ca.certPEM, Logger: logger},
+		link(fmt.Sprintf("127.0.0.1:%d", freeTCPPort(t)))))
+	require.NoError(t, verifyServerTLS(context.Background(), &Config{TLSCA: ca.certPEM, Logger: logger},
+		"vless://"+testUUID+"@"+plainAddr+"?type=tcp&security=none"))
+}
+
+func TestClient_TLSTrust(t *testing.T) {
+	ca := newTestCA(t)
+	server := ca.issue(t, "server.test", time.Hour)
+	client := ca.issue(t, "client", time.Hour)
+	echo := fmt.Sprintf(`{"protocol": "freedom", "settings": {"redirect": %q}}`, startTCPEcho(t))
+
+	// XRay TLS server, verified by XRay with the CA and pins.
+	tlsPort := startTestXrayServerWithOutbound(t, fmt.Sprintf(`{
+		"protocol": "vless",
+		"settings": {"clients": [{"id": %q}], "decryption": "none"},
+		"streamSettings": {"network": "tcp", "security": "tls", "tlsSettings": {"certificates": [{"certificate": %s, "key": %s}]}}
+	}`, testUUID, pemLines(t, server.certPEM), pemLines(t, server.keyPEM)), echo)
+	// Plain server behind TLS terminator requiring client certificates.
+	plainPort := startTestXrayServerWithOutbound(t, fmt.Sprintf(`{
+		"protocol": "vless",
+		"settings": {"clients": [{"id": %q}], "decryption": "none"},
+		"streamSettings": {"network": "tcp"}
+	}`, testUUID), echo)
+	mtlsAddr := startTestTLSServer(t, server, ca, fmt.Sprintf("127.0.0.1:%d", plainPort))
+
+	for name, tc := range map[string]struct {
+		addr string
+		cfg  Config
+	}{
+		"ca and pins": {fmt.Sprintf("127.0.0.1:%d", tlsPort), Config{TLSCA: ca.certPEM, TLSPins: []string{ca.pin()}}},
+		"mtls":        {mtlsAddr, Config{TLSCA: ca.certPEM, TLSClientCert: client.certPEM, TLSClientKey: client.keyPEM}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			// Server name is forced, the link has none.
+			link := fmt.Sprintf("vless://%s@%s?type=tcp&security=tls", testUUID, tc.addr)
+			tc.cfg.TLSServerName = "server.test"
+			tc.cfg.Logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
+			app, dev := newTestAppStack(t)
+			tc.cfg.TUN = dev
+			cl := &Client{cfg: tc.cfg, tunnelStopped: make(chan error), pipe: newNetstackPipe(defaultNetstackOpts)}
+			require.NoError(t, cl.Connect(link))
+
+			conn, err := gonet.DialTCP(app, tcpip.FullAddress{Addr: tcpip.AddrFrom4([4]byte{203, 0, 113, 10}), Port: 80}, ipv4.ProtocolNumber)
+			require.NoError(t, err)
+			require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+			_, err = conn.Write([]byte("hello"))
+			require.NoError(t, err)
+			reply := make([]byte, 5)
+			_, err = io.ReadFull(conn, reply)
+			require.NoError(t, err)
+			require.Equal(t, "hello", string(reply))
+
+			require.NoError(t, cl.Disconnect(context.Background()))
+			require.Empty(t, dialerProxies.hops)
+		})
+	}
+
+	// Verification failure is reported on connect.
+	cl := &Client{cfg: Config{
+		Logger: slog.New(slog.NewTextHandler(os.Stdout, nil)), TUN: &stackDevice{},
+		TLSCA: ca.certPEM, TLSServerName: "server.test",
+	}}
+	err := cl.Connect(fmt.Sprintf("vless://%s@%s?type=tcp&security=tls", testUUID, mtlsAddr))
+	var tlsErr *TLSError
+	require.ErrorAs(t, err, &tlsErr)
+	require.Equal(t, TLSErrorClientCert, tlsErr.Kind)
+	require.Equal(t, StateDisconnected, cl.State())
+}
+
+func parseTestHops(t *testing.T, links ...string) []hop {
+	t.Helper()
+
+	hops := make([]hop, len(links))
+	for i, link := range links {
+		var err error
+		hops[i], err = parseHop(&Config{}, link, true)
+		require.NoError(t, err)
+	}
+
+	return hops
+}
+
+type testCA struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+}
+
+type testCert struct {
+	tls     tls.Certificate
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return &testCA{cert: cert, key: key, certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue issues certificate valid for the name (also used as DNS name) and the duration,
+// negative duration makes expired certificate.
+func (ca *testCA) issue(t *testing.T, name string, validFor time.Duration) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-2 * time.Hour),
+		NotAfter:     time.Now().Add(validFor),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	c := &testCert{
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+	c.tls, err = tls.X509KeyPair(c.certPEM, c.keyPEM)
+	require.NoError(t, err)
+
+	return c
+}
+
+// pin returns base64 SHA-256 of the CA public key.
+func (ca *testCA) pin() string {
+	hash := sha256.Sum256(ca.cert.RawSubjectPublicKeyInfo)
+
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// startTestTLSServer starts TLS server with the certificate, client certificates issued by clientCA are required if set.
+// Connections are forwarded to the target if given, and just closed after the handshake otherwise.
+func startTestTLSServer(t *testing.T, cert *testCert, clientCA *testCA, target ...string) string {
+	t.Helper()
+
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert.tls}}
+	if clientCA != nil {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		cfg.ClientCAs = x509.NewCertPool()
+		cfg.ClientCAs.AddCert(clientCA.cert)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if err := conn.(*tls.Conn).Handshake(); err != nil || len(target) == 0 {
+					return
+				}
+				upstream, err := net.Dial("tcp", target[0])
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				go func() {
+					_, _ = io.Copy(upstream, conn)
+					_ = upstream.(*net.TCPConn).CloseWrite()
+				}()
+				_, _ = io.Copy(conn, upstream)
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+// pemLines returns PEM as JSON list of lines, the way XRay config takes certificates.
+func pemLines(t *testing.T, b []byte) string {
+	t.Helper()
+
+	lines, err := json.Marshal(strings.Split(strings.TrimSpace(string(b)), "\n"))
+	require.NoError(t, err)
+
+	return string(lines)
+}
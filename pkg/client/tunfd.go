@@ -0,0 +1,76 @@
+//go:build unix
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+)
+
+// TUNFromFd wraps already open TUN device file descriptor to be used as Config.TUN.
+// The descriptor may be inherited from a privileged parent process, received with ReceiveTUN
+// or provided by a platform VPN framework. Packets must be raw IP packets without any header
+// (IFF_NO_PI on Linux).
+func TUNFromFd(fd uintptr) (io.ReadWriteCloser, error) {
+	// Non-blocking mode makes os.File use the runtime poller, so Close interrupts pending reads.
+	if err := syscall.SetNonblock(int(fd), true); err != nil {
+		return nil, fmt.Errorf("set tun fd %d non-blocking: %w", fd, err)
+	}
+	f := os.NewFile(fd, fmt.Sprintf("tun-fd-%d", fd))
+	if f == nil {
+		return nil, fmt.Errorf("invalid tun fd %d", fd)
+	}
+
+	return f, nil
+}
+
+// SendTUN sends TUN device file descriptor over Unix socket (SCM_RIGHTS), so that a privileged
+// helper can create the device and pass it to the unprivileged VPN process calling ReceiveTUN.
+// The sender keeps its copy of the descriptor and may close it after sending.
+func SendTUN(conn *net.UnixConn, tun *os.File) error {
+	rights := syscall.UnixRights(int(tun.Fd()))
+	if _, _, err := conn.WriteMsgUnix([]byte{0}, rights, nil); err != nil {
+		return fmt.Errorf("send tun fd: %w", err)
+	}
+
+	return nil
+}
+
+// ReceiveTUN receives TUN device file descriptor sent with SendTUN and wraps it with TUNFromFd.
+func ReceiveTUN(conn *net.UnixConn) (io.ReadWriteCloser, error) {
+	oob := make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := conn.ReadMsgUnix(make([]byte, 1), oob)
+	if err != nil {
+		return nil, fmt.Errorf("receive tun fd: %w", err)
+	}
+
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, fmt.Errorf("parse control message: %w", err)
+	}
+	var fds []int
+	for _, msg := range msgs {
+		rights, err := syscall.ParseUnixRights(&msg)
+		if err == nil {
+			fds = append(fds, rights...)
+		}
+	}
+	if len(fds) == 0 {
+		return nil, errors.New("receive tun fd: no file descriptor in message")
+	}
+	for _, fd := range fds[1:] {
+		_ = syscall.Close(fd)
+	}
+
+	tun, err := TUNFromFd(uintptr(fds[0]))
+	if err != nil {
+		_ = syscall.Close(fds[0])
+		return nil, err
+	}
+
+	return tun, nil
+}
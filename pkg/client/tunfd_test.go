@@ -0,0 +1,99 @@
+//go:build unix
+
+package client
+
+import (
+	"context"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+
+	"github.com/goxray/tun/pkg/client/mocks"
+)
+
+func TestSendReceiveTUN(t *testing.T) {
+	sender, receiver := unixConnPair(t, syscall.SOCK_STREAM)
+	// Datagram socket pair stands in for TUN device, it keeps packet boundaries the same way.
+	dev, peer := socketPair(t, syscall.SOCK_DGRAM)
+	defer peer.Close()
+
+	require.NoError(t, SendTUN(sender, dev))
+	require.NoError(t, dev.Close()) // Sender's copy is not needed anymore.
+
+	tun, err := ReceiveTUN(receiver)
+	require.NoError(t, err)
+
+	packet := testIPv4Packet(protoUDP, "10.0.0.2:5353", "8.8.8.8:53", 0)
+	_, err = tun.Write(packet)
+	require.NoError(t, err)
+	buf := make([]byte, 1500)
+	n, err := peer.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, packet, buf[:n])
+
+	_, err = peer.Write(packet[:20])
+	require.NoError(t, err)
+	n, err = tun.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, packet[:20], buf[:n])
+
+	// Close interrupts pending reads.
+	readErr := make(chan error)
+	go func() {
+		_, err := tun.Read(buf)
+		readErr <- err
+	}()
+	require.NoError(t, tun.Close())
+	require.Error(t, <-readErr)
+
+	// Message without descriptors is rejected.
+	_, err = sender.Write([]byte{0})
+	require.NoError(t, err)
+	_, err = ReceiveTUN(receiver)
+	require.ErrorContains(t, err, "no file descriptor")
+}
+
+func TestClient_OwnTUN(t *testing.T) {
+	xInstMock := mocks.NewMockrunnable(gomock.NewController(t))
+	routesMock := mocks.NewMockipTable(gomock.NewController(t)) // No routes are changed.
+	tunMock := mocks.NewMockioReadWriteCloser(gomock.NewController(t))
+	cl := newTestClient(xInstMock, tunMock, routesMock, nil, func(stopped chan error) { stopped <- nil })
+	cl.cfg.TUN = tunMock
+
+	tunnel, err := cl.setupTunnel()
+	require.NoError(t, err)
+	require.Equal(t, tunMock, tunnel)
+
+	xInstMock.EXPECT().Close().Return(nil)
+	tunMock.EXPECT().Close().Return(nil)
+	require.NoError(t, cl.Disconnect(context.Background()))
+}
+
+func socketPair(t *testing.T, typ int) (*os.File, *os.File) {
+	t.Helper()
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, typ, 0)
+	require.NoError(t, err)
+
+	return os.NewFile(uintptr(fds[0]), "a"), os.NewFile(uintptr(fds[1]), "b")
+}
+
+func unixConnPair(t *testing.T, typ int) (*net.UnixConn, *net.UnixConn) {
+	t.Helper()
+
+	a, b := socketPair(t, typ)
+	defer a.Close()
+	defer b.Close()
+	connA, err := net.FileConn(a)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = connA.Close() })
+	connB, err := net.FileConn(b)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = connB.Close() })
+
+	return connA.(*net.UnixConn), connB.(*net.UnixConn)
+}
@@ -0,0 +1,463 @@
+package client
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	xrayproto "github.com/lilendian0x00/xray-knife/v3/pkg/protocol"
+	"github.com/xtls/xray-core/infra/conf"
+)
+
+const (
+	// wireGuardDefaultMTU is the MTU of the tunnel used by wg-quick and XRay when it is not set.
+	wireGuardDefaultMTU = 1420
+	wireGuardMinMTU     = 576
+	wireGuardMaxMTU     = 65535 - 80 // Max UDP datagram minus WireGuard and IPv6 overhead.
+)
+
+// WireGuardConfig is a parsed WireGuard server configuration, the interface of the client and the single peer (server).
+type WireGuardConfig struct {
+	PrivateKey string   // Interface private key (base64).
+	Addresses  []string // Interface addresses in CIDR notation.
+	MTU        int      // Tunnel MTU, wireGuardDefaultMTU if zero.
+	Remark     string
+
+	PublicKey    string   // Peer public key (base64).
+	PreSharedKey string   // Optional peer preshared key (base64).
+	Endpoint     string   // Peer host:port.
+	AllowedIPs   []string // Routed through the peer, everything if empty.
+	KeepAlive    int      // Persistent keepalive interval in seconds, disabled if zero.
+	// Reserved is 3 bytes put into the reserved field of WireGuard messages, required by some servers (e.g. Cloudflare WARP).
+	Reserved []byte
+}
+
+// ParseWireGuardLink parses wireguard:// (or wg://) link:
+//
+//	wireguard://<private key>@<host>:<port>?publickey=<key>&address=<cidr,...>[&presharedkey=<key>][&mtu=<mtu>]
+//		[&reserved=<b1,b2,b3>][&keepalive=<seconds>][&allowedips=<cidr,...>][#remark]
+//
+// Keys may be URL escaped or not (a literal + of base64 is kept), reserved bytes can be given as comma separated
+// numbers or base64 of 3 bytes.
+func ParseWireGuardLink(link string) (*WireGuardConfig, error) {
+	u, err := url.Parse(strings.TrimSpace(link))
+	if err != nil {
+		return nil, fmt.Errorf("invalid wireguard link: %w", err)
+	}
+	if !isWireGuardScheme(u.Scheme) {
+		return nil, fmt.Errorf("invalid wireguard link: unexpected scheme %q", u.Scheme)
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("invalid wireguard link: endpoint port is missing")
+	}
+
+	q := u.Query()
+	wg := &WireGuardConfig{
+		PublicKey:    rawQueryValue(u.RawQuery, "publickey"),
+		PreSharedKey: rawQueryValue(u.RawQuery, "presharedkey"),
+		Endpoint:     u.Host,
+		Addresses:    splitList(q.Get("address")),
+		AllowedIPs:   splitList(q.Get("allowedips")),
+		Remark:       u.Fragment,
+	}
+	if u.User != nil {
+		wg.PrivateKey = u.User.Username()
+	}
+	if v := q.Get("mtu"); v != "" {
+		if wg.MTU, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("invalid wireguard link: invalid mtu %q", v)
+		}
+	}
+	if v := q.Get("keepalive"); v != "" {
+		if wg.KeepAlive, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("invalid wireguard link: invalid keepalive %q", v)
+		}
+	}
+	if v := rawQueryValue(u.RawQuery, "reserved"); v != "" {
+		if wg.Reserved, err = parseReserved(v); err != nil {
+			return nil, fmt.Errorf("invalid wireguard link: %w", err)
+		}
+	}
+
+	if err = wg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid wireguard link: %w", err)
+	}
+
+	return wg, nil
+}
+
+// LoadWireGuardConfig reads wg-quick style config file, see ParseWireGuardConfig.
+func LoadWireGuardConfig(path string) (*WireGuardConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open wireguard config: %w", err)
+	}
+	defer f.Close()
+
+	return ParseWireGuardConfig(f)
+}
+
+// ParseWireGuardConfig parses wg-quick style config with the [Interface] and a single [Peer] sections.
+// Settings of the host interface (DNS, Table, Pre/PostUp hooks e.t.c.) are ignored, as well as comments.
+// Non standard Reserved key is accepted in both sections.
+func ParseWireGuardConfig(r io.Reader) (*WireGuardConfig, error) {
+	var (
+		wg      = &WireGuardConfig{}
+		section string
+		peers   int
+		lineNo  int
+	)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lineNo++
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			switch section {
+			case "interface":
+			case "peer":
+				if peers++; peers > 1 {
+					return nil, fmt.Errorf("invalid wireguard config: line %d: only one peer is supported", lineNo)
+				}
+			default:
+				return nil, fmt.Errorf("invalid wireguard config: line %d: unknown section %q", lineNo, line)
+			}
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid wireguard config: line %d: expected key = value", lineNo)
+		}
+		if err := wg.set(section, strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)); err != nil {
+			return nil, fmt.Errorf("invalid wireguard config: line %d: %w", lineNo, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read wireguard config: %w", err)
+	}
+	if peers == 0 {
+		return nil, fmt.Errorf("invalid wireguard config: [Peer] section is missing")
+	}
+
+	if err := wg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid wireguard config: %w", err)
+	}
+
+	return wg, nil
+}
+
+// set sets wg-quick config key of the section.
+func (w *WireGuardConfig) set(section, key, value string) error {
+	var err error
+	switch section + "." + key {
+	case "interface.privatekey":
+		w.PrivateKey = value
+	case "interface.address":
+		w.Addresses = append(w.Addresses, splitList(value)...)
+	case "interface.mtu":
+		if w.MTU, err = strconv.Atoi(value); err != nil {
+			return fmt.Errorf("invalid MTU %q", value)
+		}
+	case "interface.dns", "interface.table", "interface.listenport", "interface.fwmark", "interface.saveconfig",
+		"interface.preup", "interface.postup", "interface.predown", "interface.postdown":
+		// Host interface settings, the tunnel is run by XRay.
+	case "interface.reserved", "peer.reserved":
+		if w.Reserved, err = parseReserved(value); err != nil {
+			return err
+		}
+	case "peer.publickey":
+		w.PublicKey = value
+	case "peer.presharedkey":
+		w.PreSharedKey = value
+	case "peer.endpoint":
+		w.Endpoint = value
+	case "peer.allowedips":
+		w.AllowedIPs = append(w.AllowedIPs, splitList(value)...)
+	case "peer.persistentkeepalive":
+		if value == "off" {
+			return nil
+		}
+		if w.KeepAlive, err = strconv.Atoi(value); err != nil {
+			return fmt.Errorf("invalid PersistentKeepalive %q", value)
+		}
+	default:
+		if section == "" {
+			return fmt.Errorf("key %q is outside of a section", key)
+		}
+		return fmt.Errorf("unknown key %q in [%s] section", key, section)
+	}
+
+	return nil
+}
+
+// validate checks the config and normalizes addresses.
+func (w *WireGuardConfig) validate() error {
+	if err := validateWireGuardKey(w.PrivateKey); err != nil {
+		return fmt.Errorf("private key: %w", err)
+	}
+	if err := validateWireGuardKey(w.PublicKey); err != nil {
+		return fmt.Errorf("public key: %w", err)
+	}
+	if w.PreSharedKey != "" {
+		if err := validateWireGuardKey(w.PreSharedKey); err != nil {
+			return fmt.Errorf("preshared key: %w", err)
+		}
+	}
+
+	host, port, err := net.SplitHostPort(w.Endpoint)
+	if err != nil || host == "" {
+		return fmt.Errorf("invalid endpoint %q", w.Endpoint)
+	}
+	if _, err = strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("invalid endpoint port %q", port)
+	}
+
+	if len(w.Addresses) == 0 {
+		return fmt.Errorf("interface address is missing")
+	}
+	for i, addr := range w.Addresses {
+		if w.Addresses[i], err = normalizePrefix(addr); err != nil {
+			return fmt.Errorf("invalid address: %w", err)
+		}
+	}
+	for i, addr := range w.AllowedIPs {
+		if w.AllowedIPs[i], err = normalizePrefix(addr); err != nil {
+			return fmt.Errorf("invalid allowed IPs: %w", err)
+		}
+	}
+
+	if w.MTU != 0 && (w.MTU < wireGuardMinMTU || w.MTU > wireGuardMaxMTU) {
+		return fmt.Errorf("MTU %d is out of range [%d, %d]", w.MTU, wireGuardMinMTU, wireGuardMaxMTU)
+	}
+	if w.KeepAlive < 0 || w.KeepAlive > 65535 {
+		return fmt.Errorf("keepalive %d is out of range [0, 65535]", w.KeepAlive)
+	}
+	if len(w.Reserved) != 0 && len(w.Reserved) != 3 {
+		return fmt.Errorf("reserved must be 3 bytes, got %d", len(w.Reserved))
+	}
+
+	return nil
+}
+
+// EndpointHost returns the peer host name or IP (IPv6 without brackets), the route exception is made for it.
+func (w *WireGuardConfig) EndpointHost() string {
+	host, _, _ := net.SplitHostPort(w.Endpoint)
+
+	return host
+}
+
+func (w *WireGuardConfig) mtu() int {
+	if w.MTU == 0 {
+		return wireGuardDefaultMTU
+	}
+
+	return w.MTU
+}
+
+// Link returns wireguard:// link of the config.
+func (w *WireGuardConfig) Link() string {
+	q := url.Values{}
+	q.Set("publickey", w.PublicKey)
+	if w.PreSharedKey != "" {
+		q.Set("presharedkey", w.PreSharedKey)
+	}
+	q.Set("address", strings.Join(w.Addresses, ","))
+	if w.MTU != 0 {
+		q.Set("mtu", strconv.Itoa(w.MTU))
+	}
+	if len(w.Reserved) > 0 {
+		reserved := make([]string, len(w.Reserved))
+		for i, b := range w.Reserved {
+			reserved[i] = strconv.Itoa(int(b))
+		}
+		q.Set("reserved", strings.Join(reserved, ","))
+	}
+	if w.KeepAlive != 0 {
+		q.Set("keepalive", strconv.Itoa(w.KeepAlive))
+	}
+	if len(w.AllowedIPs) > 0 {
+		q.Set("allowedips", strings.Join(w.AllowedIPs, ","))
+	}
+	u := url.URL{
+		Scheme:   ProtocolWireGuard,
+		User:     url.User(w.PrivateKey),
+		Host:     w.Endpoint,
+		RawQuery: q.Encode(),
+	}
+
+	return u.String() + remarkFragment(w.Remark)
+}
+
+// wireGuardProtocol builds XRay WireGuard outbound, xray-knife can't set reserved bytes and keepalive.
+type wireGuardProtocol struct {
+	link string
+	cfg  *WireGuardConfig
+}
+
+func (p *wireGuardProtocol) Parse() error {
+	var err error
+	p.cfg, err = ParseWireGuardLink(p.link)
+
+	return err
+}
+
+func (p *wireGuardProtocol) BuildOutboundDetourConfig(bool) (*conf.OutboundDetourConfig, error) {
+	peer := map[string]any{
+		"publicKey": p.cfg.PublicKey,
+		"endpoint":  p.cfg.Endpoint,
+		"keepAlive": p.cfg.KeepAlive,
+	}
+	if p.cfg.PreSharedKey != "" {
+		peer["preSharedKey"] = p.cfg.PreSharedKey
+	}
+	if len(p.cfg.AllowedIPs) > 0 {
+		peer["allowedIPs"] = p.cfg.AllowedIPs
+	}
+	settings := map[string]any{
+		"secretKey": p.cfg.PrivateKey,
+		"address":   p.cfg.Addresses,
+		"peers":     []any{peer},
+		"mtu":       p.cfg.mtu(),
+		// Userspace stack, so that no host interface is created for the tunnel.
+		"noKernelTun": true,
+	}
+	if len(p.cfg.Reserved) > 0 {
+		reserved := make([]int, len(p.cfg.Reserved)) // []byte would be marshaled as base64.
+		for i, b := range p.cfg.Reserved {
+			reserved[i] = int(b)
+		}
+		settings["reserved"] = reserved
+	}
+
+	b, err := json.Marshal(settings)
+	if err != nil {
+		return nil, fmt.Errorf("marshal wireguard settings: %w", err)
+	}
+	raw := json.RawMessage(b)
+
+	return &conf.OutboundDetourConfig{Protocol: ProtocolWireGuard, Settings: &raw}, nil
+}
+
+func (p *wireGuardProtocol) BuildInboundDetourConfig() (*conf.InboundDetourConfig, error) {
+	return nil, fmt.Errorf("%w: wireguard inbound", ErrUnsupportedProtocol)
+}
+
+func (p *wireGuardProtocol) DetailsStr() string {
+	return fmt.Sprintf("Protocol: %s\nRemark: %s\nEndpoint: %s\nAddress: %s\nMTU: %d\n",
+		ProtocolWireGuard, p.cfg.Remark, p.cfg.Endpoint, strings.Join(p.cfg.Addresses, ","), p.cfg.mtu())
+}
+
+func (p *wireGuardProtocol) ConvertToGeneralConfig() xrayproto.GeneralConfig {
+	_, port, _ := net.SplitHostPort(p.cfg.Endpoint)
+
+	return xrayproto.GeneralConfig{
+		Protocol: ProtocolWireGuard,
+		Address:  p.cfg.EndpointHost(),
+		Port:     port,
+		Network:  "udp",
+		Type:     "udp",
+		Remark:   p.cfg.Remark,
+		OrigLink: p.link,
+	}
+}
+
+// isWireGuardScheme reports whether the link scheme is of WireGuard link.
+func isWireGuardScheme(scheme string) bool {
+	return strings.EqualFold(scheme, ProtocolWireGuard) || strings.EqualFold(scheme, "wg")
+}
+
+// isWireGuardLink reports whether the link is wireguard:// (or wg://) one.
+func isWireGuardLink(link string) bool {
+	scheme, _, ok := strings.Cut(link, "://")
+
+	return ok && isWireGuardScheme(scheme)
+}
+
+// isWireGuardConfigPath reports whether the link is a path to wg-quick config file rather than a link.
+func isWireGuardConfigPath(link string) bool {
+	return !strings.Contains(link, "://") && strings.HasSuffix(link, ".conf")
+}
+
+// rawQueryValue returns the first value of the query parameter unescaped as a path, so a literal + of base64
+// is kept rather than turned into a space as by url.Values. Empty if missing or badly escaped.
+func rawQueryValue(rawQuery, key string) string {
+	for rawQuery != "" {
+		var param string
+		param, rawQuery, _ = strings.Cut(rawQuery, "&")
+		k, v, _ := strings.Cut(param, "=")
+		if k, err := url.PathUnescape(k); err != nil || k != key {
+			continue
+		}
+		v, _ = url.PathUnescape(v)
+		return v
+	}
+
+	return ""
+}
+
+// validateWireGuardKey checks that the key is 32 bytes in base64 or hex, as XRay accepts both.
+func validateWireGuardKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("key is missing")
+	}
+	if b, err := base64.StdEncoding.DecodeString(key); err == nil && len(b) == 32 {
+		return nil
+	}
+	if b, err := hex.DecodeString(key); err == nil && len(b) == 32 {
+		return nil
+	}
+
+	return fmt.Errorf("key must be 32 bytes in base64 or hex")
+}
+
+// parseReserved parses reserved bytes given as comma separated numbers (1,2,3) or base64 (AQID).
+func parseReserved(s string) ([]byte, error) {
+	if !strings.Contains(s, ",") {
+		if b, err := base64.StdEncoding.DecodeString(s); err == nil && len(b) == 3 {
+			return b, nil
+		}
+	}
+
+	parts := splitList(s)
+	reserved := make([]byte, len(parts))
+	for i, part := range parts {
+		n, err := strconv.ParseUint(strings.TrimSpace(part), 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid reserved %q", s)
+		}
+		reserved[i] = byte(n)
+	}
+	if len(reserved) != 3 {
+		return nil, fmt.Errorf("reserved must be 3 bytes, got %d", len(reserved))
+	}
+
+	return reserved, nil
+}
+
+// normalizePrefix parses IP prefix, single IP is turned into host prefix.
+func normalizePrefix(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if p, err := netip.ParsePrefix(s); err == nil {
+		return p.String(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return "", fmt.Errorf("%q is not an IP or CIDR", s)
+	}
+
+	return netip.PrefixFrom(addr, addr.BitLen()).String(), nil
+}
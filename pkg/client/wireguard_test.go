@@ -0,0 +1,282 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+)
+
+const (
+	testWGPrivateKey = "n14ckhfWbHUEtdXxXBhdLvrWfKEVHi7gLtaX4BWUGx0="
+	testWGPublicKey  = "/bD8Guq/5ql/mzDFYWOg/ta746G7kB8aEPU+EjRBpgM="
+)
+
+func TestParseWireGuardLink(t *testing.T) {
+	link := "wireguard://" + escapeWGKey(testWGPrivateKey) + "@wg.example.com:51820?publickey=" + escapeWGKey(testWGPublicKey) +
+		"&address=10.0.0.2,fd00::2/128&mtu=1280&reserved=AQID&keepalive=25#my%20server"
+
+	wg, err := ParseWireGuardLink(link)
+	require.NoError(t, err)
+	require.Equal(t, &WireGuardConfig{
+		PrivateKey: testWGPrivateKey,
+		Addresses:  []string{"10.0.0.2/32", "fd00::2/128"},
+		MTU:        1280,
+		Remark:     "my server",
+		PublicKey:  testWGPublicKey,
+		Endpoint:   "wg.example.com:51820",
+		KeepAlive:  25,
+		Reserved:   []byte{1, 2, 3},
+	}, wg)
+	require.Equal(t, "wg.example.com", wg.EndpointHost())
+
+	// Serialized link is parsed into the same config, wg:// is an alias.
+	again, err := ParseWireGuardLink(wg.Link())
+	require.NoError(t, err)
+	require.Equal(t, wg, again)
+	alias, err := ParseWireGuardLink(strings.Replace(link, "wireguard://", "wg://", 1))
+	require.NoError(t, err)
+	require.Equal(t, wg, alias)
+
+	// Keys are usually not escaped in links, + of base64 is kept.
+	raw, err := ParseWireGuardLink("wireguard://" + testWGPrivateKey + "@wg.example.com:51820?publickey=" + testWGPublicKey +
+		"&presharedkey=" + testWGPublicKey + "&address=10.0.0.2&reserved=+/8A")
+	require.NoError(t, err)
+	require.Equal(t, testWGPrivateKey, raw.PrivateKey)
+	require.Equal(t, testWGPublicKey, raw.PublicKey)
+	require.Equal(t, testWGPublicKey, raw.PreSharedKey)
+	require.Equal(t, []byte{0xfb, 0xff, 0}, raw.Reserved)
+
+	info, err := ParseLink(link)
+	require.NoError(t, err)
+	require.Equal(t, ProtocolWireGuard, info.Protocol)
+	require.Equal(t, "wg.example.com:51820", info.HostPort())
+	require.Equal(t, "udp", info.Transport)
+	require.Equal(t, wg, info.WireGuard)
+	require.Equal(t, wg.Link(), info.Link())
+
+	for name, tc := range map[string]struct{ link, err string }{
+		"no port":      {strings.Replace(link, ":51820", "", 1), "endpoint port is missing"},
+		"no key":       {strings.Replace(link, "publickey=", "x=", 1), "public key: key is missing"},
+		"bad key":      {strings.Replace(link, "publickey=", "publickey=AAAA", 1), "public key: key must be 32 bytes"},
+		"no address":   {strings.Replace(link, "address=", "x=", 1), "interface address is missing"},
+		"bad address":  {strings.Replace(link, "10.0.0.2", "10.0.0.256", 1), "invalid address"},
+		"low mtu":      {strings.Replace(link, "mtu=1280", "mtu=500", 1), "MTU 500 is out of range"},
+		"bad reserved": {strings.Replace(link, "reserved=AQID", "reserved=1,2", 1), "reserved must be 3 bytes"},
+		"big reserved": {strings.Replace(link, "reserved=AQID", "reserved=1,2,256", 1), "invalid reserved"},
+		"bad scheme":   {strings.Replace(link, "wireguard://", "vless://", 1), "unexpected scheme"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := ParseWireGuardLink(tc.link)
+			require.ErrorContains(t, err, tc.err)
+		})
+	}
+}
+
+func TestParseWireGuardConfig(t *testing.T) {
+	wg, err := ParseWireGuardConfig(strings.NewReader(`
+# wg-quick config
+[Interface]
+PrivateKey = ` + testWGPrivateKey + `
+Address = 10.0.0.2/32, fd00::2/128
+DNS = 1.1.1.1
+MTU = 1380
+PostUp = iptables -A FORWARD -i %i -j ACCEPT
+
+[Peer]
+PublicKey = ` + testWGPublicKey + `
+PresharedKey = ` + testWGPrivateKey + `
+Endpoint = [2001:db8::1]:51820
+AllowedIPs = 0.0.0.0/0
+AllowedIPs = ::/0
+PersistentKeepalive = 15 # seconds
+Reserved = 1, 2, 3
+`))
+	require.NoError(t, err)
+	require.Equal(t, &WireGuardConfig{
+		PrivateKey:   testWGPrivateKey,
+		Addresses:    []string{"10.0.0.2/32", "fd00::2/128"},
+		MTU:          1380,
+		PublicKey:    testWGPublicKey,
+		PreSharedKey: testWGPrivateKey,
+		Endpoint:     "[2001:db8::1]:51820",
+		AllowedIPs:   []string{"0.0.0.0/0", "::/0"},
+		KeepAlive:    15,
+		Reserved:     []byte{1, 2, 3},
+	}, wg)
+	require.Equal(t, "2001:db8::1", wg.EndpointHost())
+
+	again, err := ParseWireGuardLink(wg.Link())
+	require.NoError(t, err)
+	require.Equal(t, wg, again)
+
+	base := "[Interface]\nPrivateKey = " + testWGPrivateKey + "\nAddress = 10.0.0.2/32\n" +
+		"[Peer]\nPublicKey = " + testWGPublicKey + "\nEndpoint = 1.2.3.4:51820\n"
+	_, err = ParseWireGuardConfig(strings.NewReader(base))
+	require.NoError(t, err)
+	for name, tc := range map[string]struct{ cfg, err string }{
+		"two peers":   {base + "[Peer]\n", "line 7: only one peer is supported"},
+		"no peer":     {"[Interface]\nPrivateKey = " + testWGPrivateKey + "\n", "[Peer] section is missing"},
+		"unknown key": {base + "Foo = bar\n", `line 7: unknown key "foo" in [peer] section`},
+		"no section":  {"PrivateKey = x\n" + base, "outside of a section"},
+		"bad line":    {base + "Endpoint\n", "expected key = value"},
+		"bad mtu":     {base + "[Interface]\nMTU = big\n", `invalid MTU "big"`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := ParseWireGuardConfig(strings.NewReader(tc.cfg))
+			require.ErrorContains(t, err, tc.err)
+		})
+	}
+}
+
+func TestWireGuardProtocol_Outbound(t *testing.T) {
+	p := &wireGuardProtocol{link: "wireguard://" + escapeWGKey(testWGPrivateKey) + "@127.0.0.1:51820?publickey=" +
+		escapeWGKey(testWGPublicKey) + "&address=10.0.0.2/32&reserved=1,2,3"}
+	require.NoError(t, p.Parse())
+
+	ob, err := p.BuildOutboundDetourConfig(false)
+	require.NoError(t, err)
+	require.Equal(t, ProtocolWireGuard, ob.Protocol)
+	require.JSONEq(t, `{
+		"secretKey": "`+testWGPrivateKey+`",
+		"address": ["10.0.0.2/32"],
+		"peers": [{"publicKey": "`+testWGPublicKey+`", "endpoint": "127.0.0.1:51820", "keepAlive": 0}],
+		"mtu": 1420,
+		"noKernelTun": true,
+		"reserved": [1, 2, 3]
+	}`, string(*ob.Settings))
+	_, err = ob.Build()
+	require.NoError(t, err)
+
+	g := p.ConvertToGeneralConfig()
+	require.Equal(t, "127.0.0.1", g.Address)
+	require.Equal(t, "51820", g.Port)
+}
+
+func TestClient_WireGuard(t *testing.T) {
+	serverKey, clientKey := newTestWGKey(t), newTestWGKey(t)
+	serverPort := startTestXrayServerWithOutbound(t, fmt.Sprintf(`{
+		"protocol": "wireguard",
+		"settings": {"secretKey": %q, "peers": [{"publicKey": %q, "allowedIPs": ["10.0.0.2/32"]}]}
+	}`, wgKey(serverKey), wgKey(clientKey.PublicKey())),
+		fmt.Sprintf(`{"protocol": "freedom", "settings": {"redirect": %q}}`, startTCPEcho(t)))
+	// Reserved bytes are not a part of WireGuard protocol, the relay checks and clears them for the server.
+	relayPort, reservedOK := startTestWGRelay(t, serverPort, []byte{7, 8, 9})
+
+	confPath := filepath.Join(t.TempDir(), "wg0.conf")
+	require.NoError(t, os.WriteFile(confPath, []byte(fmt.Sprintf(`[Interface]
+PrivateKey = %s
+Address = 10.0.0.2/32
+MTU = 1280
+
+[Peer]
+PublicKey = %s
+Endpoint = 127.0.0.1:%d
+AllowedIPs = 0.0.0.0/0
+Reserved = 7,8,9
+`, wgKey(clientKey), wgKey(serverKey.PublicKey()), relayPort)), 0o600))
+
+	app, dev := newTestAppStack(t)
+	cl := &Client{
+		cfg:           Config{Logger: slog.New(slog.NewTextHandler(os.Stdout, nil)), TUN: dev},
+		tunnelStopped: make(chan error),
+		pipe:          newNetstackPipe(defaultNetstackOpts),
+	}
+	require.NoError(t, cl.Connect(confPath))
+	defer func() { require.NoError(t, cl.Disconnect(context.Background())) }()
+	require.Equal(t, "127.0.0.1", cl.xSrvIP.String()) // Route exception is made for the peer endpoint.
+
+	conn, err := gonet.DialTCP(app, tcpip.FullAddress{Addr: tcpip.AddrFrom4([4]byte{203, 0, 113, 10}), Port: 80}, ipv4.ProtocolNumber)
+	require.NoError(t, err)
+	require.NoError(t, conn.SetDeadline(time.Now().Add(10*time.Second)))
+	// Bigger than the tunnel MTU, so the data is split into several packets.
+	msg := bytes.Repeat([]byte("hello wireguard "), 1000)
+	go func() { _, _ = conn.Write(msg) }()
+	reply := make([]byte, len(msg))
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	require.Equal(t, msg, reply)
+	require.True(t, reservedOK.Load())
+}
+
+func newTestWGKey(t *testing.T) *ecdh.PrivateKey {
+	t.Helper()
+
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	return key
+}
+
+func wgKey(key interface{ Bytes() []byte }) string {
+	return base64.StdEncoding.EncodeToString(key.Bytes())
+}
+
+// startTestWGRelay relays UDP packets to the server port, client packets must have the reserved bytes.
+// Returned flag is set once a client packet with the reserved bytes passed.
+func startTestWGRelay(t *testing.T, serverPort int, reserved []byte) (int, *atomic.Bool) {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	server, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: serverPort})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+		_ = server.Close()
+	})
+
+	var ok atomic.Bool
+	var client atomic.Pointer[net.UDPAddr]
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if n < 4 || !bytes.Equal(buf[1:4], reserved) {
+				continue
+			}
+			ok.Store(true)
+			client.Store(addr)
+			copy(buf[1:4], []byte{0, 0, 0})
+			_, _ = server.Write(buf[:n])
+		}
+	}()
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, err := server.Read(buf)
+			if err != nil {
+				return
+			}
+			if addr := client.Load(); addr != nil {
+				_, _ = conn.WriteToUDP(buf[:n], addr)
+			}
+		}
+	}()
+
+	return conn.LocalAddr().(*net.UDPAddr).Port, &ok
+}
+
+// escapeWGKey escapes base64 key for wireguard:// link.
+func escapeWGKey(key string) string {
+	return strings.NewReplacer("/", "%2F", "+", "%2B", "=", "%3D").Replace(key)
+}
@@ -0,0 +1,162 @@
+package client
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+
+	xapplog "github.com/xtls/xray-core/app/log"
+	xcommlog "github.com/xtls/xray-core/common/log"
+	"github.com/xtls/xray-core/common/serial"
+	"github.com/xtls/xray-core/core"
+)
+
+// xrayLogs routes XRay logs of all instances to Config.Logger.
+var xrayLogs = &xrayLogMux{}
+
+// xrayLogMux is the process-wide XRay log handler. XRay logs through a single global handler and its messages
+// do not tell the instance they come from, so they go to the logger of the most recently created instance
+// which is not closed yet: a probe takes the logs over while it runs, they return to the client when it is closed.
+type xrayLogMux struct {
+	mu      sync.RWMutex
+	loggers []instanceLogger // The most recent last.
+}
+
+type instanceLogger struct {
+	inst    *core.Instance
+	handler *xrayLogHandler
+}
+
+// register routes XRay logs to the logger of inst and installs the mux as the global XRay log handler
+// (instances with XRay's own log replace it when created).
+func (m *xrayLogMux) register(inst *core.Instance, logger *slog.Logger) {
+	m.mu.Lock()
+	m.loggers = append(m.loggers, instanceLogger{inst: inst, handler: &xrayLogHandler{logger: logger}})
+	m.mu.Unlock()
+	xcommlog.RegisterHandler(m)
+}
+
+// forget stops routing XRay logs to the logger of the closed instance.
+func (m *xrayLogMux) forget(inst *core.Instance) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.loggers = slices.DeleteFunc(m.loggers, func(l instanceLogger) bool { return l.inst == inst })
+}
+
+func (m *xrayLogMux) Handle(msg xcommlog.Message) {
+	m.mu.RLock()
+	var h *xrayLogHandler
+	if len(m.loggers) > 0 {
+		h = m.loggers[len(m.loggers)-1].handler
+	}
+	m.mu.RUnlock()
+	if h != nil {
+		h.Handle(msg)
+	}
+}
+
+// xrayOwnLog reports whether XRay logs are written by XRay itself (console or file) rather than to Config.Logger.
+func xrayOwnLog(t xapplog.LogType) bool {
+	return t != xapplog.LogType_None && t != xapplog.LogType_Event
+}
+
+// xrayLogHandler converts XRay log messages into structured slog records. Access messages come for every
+// connection, so they are logged at debug level.
+type xrayLogHandler struct {
+	logger *slog.Logger
+}
+
+func (h *xrayLogHandler) Handle(msg xcommlog.Message) {
+	ctx := context.Background()
+	switch msg := msg.(type) {
+	case *xcommlog.GeneralMessage:
+		level := xRaySeverityLevel(msg.Severity)
+		if !h.logger.Enabled(ctx, level) {
+			return
+		}
+		text, attrs := parseXRayMessage(serial.ToString(msg.Content))
+		h.logger.LogAttrs(ctx, level, text, attrs...)
+	case *xcommlog.AccessMessage:
+		if !h.logger.Enabled(ctx, slog.LevelDebug) {
+			return
+		}
+		attrs := []slog.Attr{
+			slog.String("source", serial.ToString(msg.From)),
+			slog.String("destination", serial.ToString(msg.To)),
+			slog.String("status", string(msg.Status)),
+		}
+		if msg.Detour != "" {
+			inTag, outTag := parseXRayDetour(msg.Detour)
+			if inTag != "" {
+				attrs = append(attrs, slog.String("inbound_tag", inTag))
+			}
+			attrs = append(attrs, slog.String("outbound_tag", outTag))
+		}
+		if reason := serial.ToString(msg.Reason); reason != "" {
+			attrs = append(attrs, slog.String("reason", reason))
+		}
+		if msg.Email != "" {
+			attrs = append(attrs, slog.String("email", msg.Email))
+		}
+		h.logger.LogAttrs(ctx, slog.LevelDebug, "xray access", attrs...)
+	case *xcommlog.DNSLog:
+		attrs := []slog.Attr{
+			slog.String("server", msg.Server),
+			slog.String("domain", msg.Domain),
+			slog.Any("result", msg.Result),
+			slog.Duration("elapsed", msg.Elapsed),
+		}
+		if msg.Error != nil {
+			attrs = append(attrs, slog.String("err", msg.Error.Error()))
+		}
+		h.logger.LogAttrs(ctx, slog.LevelDebug, "xray dns", attrs...)
+	default:
+		h.logger.Info(msg.String())
+	}
+}
+
+// parseXRayMessage splits XRay error message "[session] module/path: text" into text and attributes.
+func parseXRayMessage(s string) (string, []slog.Attr) {
+	var attrs []slog.Attr
+	for strings.HasPrefix(s, "[") {
+		end := strings.Index(s, "] ")
+		if end < 0 {
+			break
+		}
+		attrs = append(attrs, slog.String("session", s[1:end]))
+		s = s[end+2:]
+	}
+	if module, text, ok := strings.Cut(s, ": "); ok && !strings.ContainsAny(module, " []") {
+		attrs = append(attrs, slog.String("module", module))
+		s = text
+	}
+
+	return s, attrs
+}
+
+// parseXRayDetour splits access log detour ("inbound >> outbound") into inbound and outbound tags.
+func parseXRayDetour(detour string) (inTag, outTag string) {
+	for _, sep := range []string{" >> ", " -> ", " ==> "} {
+		if in, out, ok := strings.Cut(detour, sep); ok {
+			return in, out
+		}
+	}
+
+	return "", detour
+}
+
+// xRaySeverityLevel maps XRay log severity to slog.Level.
+func xRaySeverityLevel(s xcommlog.Severity) slog.Level {
+	switch s {
+	case xcommlog.Severity_Error:
+		return slog.LevelError
+	case xcommlog.Severity_Warning:
+		return slog.LevelWarn
+	case xcommlog.Severity_Info:
+		return slog.LevelInfo
+	}
+
+	return slog.LevelDebug
+}
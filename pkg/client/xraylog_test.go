@@ -0,0 +1,232 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lilendian0x00/xray-knife/v3/pkg/xray"
+	"github.com/stretchr/testify/require"
+	xcommlog "github.com/xtls/xray-core/common/log"
+	xraynet "github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/core"
+)
+
+func TestParseXRayMessage(t *testing.T) {
+	tests := []struct {
+		in    string
+		text  string
+		attrs []slog.Attr
+	}{
+		{in: "plain message", text: "plain message"},
+		{
+			in:    "app/dispatcher: taking detour [proxy] for [tcp:1.1.1.1:443]",
+			text:  "taking detour [proxy] for [tcp:1.1.1.1:443]",
+			attrs: []slog.Attr{slog.String("module", "app/dispatcher")},
+		},
+		{
+			in:    "[2718281828] proxy/vless/outbound: tunneling request to tcp:example.com:443",
+			text:  "tunneling request to tcp:example.com:443",
+			attrs: []slog.Attr{slog.String("session", "2718281828"), slog.String("module", "proxy/vless/outbound")},
+		},
+		{in: "failed to dial: connection refused", text: "failed to dial: connection refused"},
+	}
+
+	for _, test := range tests {
+		text, attrs := parseXRayMessage(test.in)
+		require.Equal(t, test.text, text)
+		require.Equal(t, test.attrs, attrs)
+	}
+}
+
+func TestXRayLogHandler(t *testing.T) {
+	access := &xcommlog.AccessMessage{
+		From:   xraynet.TCPDestination(xraynet.LocalHostIP, 40000),
+		To:     xraynet.TCPDestination(xraynet.DomainAddress("example.com"), 443),
+		Status: xcommlog.AccessAccepted,
+		Detour: "socks >> proxy",
+	}
+	var buf syncBuffer
+	h := &xrayLogHandler{logger: slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo}))}
+
+	h.Handle(&xcommlog.GeneralMessage{Severity: xcommlog.Severity_Warning, Content: "app/router: no rule matched"})
+	h.Handle(&xcommlog.GeneralMessage{Severity: xcommlog.Severity_Debug, Content: "filtered out by level"})
+	h.Handle(access)
+
+	records := buf.records(t)
+	require.Len(t, records, 1, "access is logged at debug level")
+	require.Equal(t, map[string]any{"level": "WARN", "msg": "no rule matched", "module": "app/router"}, withoutTime(records[0]))
+
+	var debug syncBuffer
+	h = &xrayLogHandler{logger: slog.New(slog.NewJSONHandler(&debug, &slog.HandlerOptions{Level: slog.LevelDebug}))}
+	h.Handle(access)
+	records = debug.records(t)
+	require.Len(t, records, 1)
+	require.Equal(t, map[string]any{
+		"level": "DEBUG", "msg": "xray access", "source": "tcp:127.0.0.1:40000", "destination": "tcp:example.com:443",
+		"status": "accepted", "inbound_tag": "socks", "outbound_tag": "proxy",
+	}, withoutTime(records[0]))
+}
+
+func TestXRayLogMux(t *testing.T) {
+	var first, second syncBuffer
+	m := &xrayLogMux{}
+	a, b := &core.Instance{}, &core.Instance{}
+	m.register(a, slog.New(slog.NewJSONHandler(&first, nil)))
+	m.register(b, slog.New(slog.NewJSONHandler(&second, nil)))
+	log := func(text string) {
+		m.Handle(&xcommlog.GeneralMessage{Severity: xcommlog.Severity_Warning, Content: text})
+	}
+
+	// Logs go to the most recent instance, then back to the previous one when it is closed.
+	log("to the second")
+	m.forget(b)
+	log("to the first")
+	m.forget(a)
+	log("dropped")
+	require.Equal(t, []string{"to the second"}, messages(t, &second))
+	require.Equal(t, []string{"to the first"}, messages(t, &first))
+}
+
+func TestNewXrayInstance_LogToSlog(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+	srvPort := startTestXrayServer(t, fmt.Sprintf(`{
+		"protocol": "vless",
+		"settings": {"clients": [{"id": %q}], "decryption": "none"}
+	}`, testUUID))
+	link := fmt.Sprintf("vless://%s@127.0.0.1:%d?type=tcp&security=none", testUUID, srvPort)
+
+	// XRay logs go to Logger by default.
+	var buf syncBuffer
+	cfg := &Config{Logger: slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))}
+	socksPort := freeTCPPort(t)
+	inbound := &xray.Socks{Remark: "test", Address: "127.0.0.1", Port: strconv.Itoa(socksPort)}
+	inst, _, err := newXrayInstance(cfg, link, inbound, nil)
+	require.NoError(t, err)
+	require.NoError(t, inst.Start())
+	defer forgetInstance(inst)
+	defer inst.Close()
+
+	// Another instance (e.g. a probe) takes the logs over until it is closed.
+	var probeBuf syncBuffer
+	probe, _, err := newXrayInstance(&Config{Logger: slog.New(slog.NewJSONHandler(&probeBuf, nil))}, link, nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, probe.Start())
+	require.NoError(t, probe.Close())
+	forgetInstance(probe)
+
+	conn := dialSocks5(t, fmt.Sprintf("127.0.0.1:%d", socksPort), target.Listener.Addr().(*net.TCPAddr))
+	_, err = fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: test\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+	_, _ = io.Copy(io.Discard, conn)
+	require.NoError(t, conn.Close())
+
+	require.Eventually(t, func() bool {
+		for _, r := range buf.records(t) {
+			if r["msg"] == "xray access" && r["outbound_tag"] == proxyOutboundTag &&
+				r["destination"] == "tcp:"+target.Listener.Addr().String() {
+				return true
+			}
+		}
+
+		return false
+	}, 5*time.Second, 10*time.Millisecond, buf.String())
+}
+
+// messages returns messages of the JSON log records.
+func messages(t *testing.T, b *syncBuffer) []string {
+	var msgs []string
+	for _, r := range b.records(t) {
+		msgs = append(msgs, r["msg"].(string))
+	}
+
+	return msgs
+}
+
+// dialSocks5 connects to the target through SOCKS5 proxy without authentication.
+func dialSocks5(t *testing.T, proxyAddr string, target *net.TCPAddr) net.Conn {
+	t.Helper()
+
+	conn, err := net.DialTimeout("tcp", proxyAddr, 5*time.Second)
+	require.NoError(t, err)
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	r := bufio.NewReader(conn)
+
+	_, err = conn.Write([]byte{5, 1, 0})
+	require.NoError(t, err)
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(r, reply)
+	require.NoError(t, err)
+	require.Equal(t, []byte{5, 0}, reply)
+
+	req := append([]byte{5, 1, 0, 1}, target.IP.To4()...)
+	req = binary.BigEndian.AppendUint16(req, uint16(target.Port))
+	_, err = conn.Write(req)
+	require.NoError(t, err)
+	reply = make([]byte, 10)
+	_, err = io.ReadFull(r, reply)
+	require.NoError(t, err)
+	require.Zero(t, reply[1], "socks connect failed")
+
+	return &bufferedConn{Conn: conn, r: r}
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
+
+// records parses JSON log records.
+func (b *syncBuffer) records(t *testing.T) []map[string]any {
+	var records []map[string]any
+	dec := json.NewDecoder(bytes.NewBufferString(b.String()))
+	for dec.More() {
+		var r map[string]any
+		require.NoError(t, dec.Decode(&r))
+		records = append(records, r)
+	}
+
+	return records
+}
+
+func withoutTime(r map[string]any) map[string]any {
+	delete(r, "time")
+
+	return r
+}
@@ -0,0 +1,37 @@
+package l3tunnel
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// backoff computes delays between connection attempts. The delay doubles with every attempt from min up to max
+// and is randomized in its upper half, so clients disconnected together do not reconnect in lockstep.
+type backoff struct {
+	min, max time.Duration
+	attempt  int
+	// rand returns a random number in [0, n), rand.Int64N if nil.
+	rand func(n int64) int64
+}
+
+// next returns the delay before the next attempt.
+func (b *backoff) next() time.Duration {
+	d := b.max
+	if b.attempt < 32 && b.min<<b.attempt < b.max {
+		d = b.min << b.attempt
+	}
+	b.attempt++
+
+	random := b.rand
+	if random == nil {
+		random = rand.Int64N
+	}
+	half := d / 2
+
+	return half + time.Duration(random(int64(d-half)+1))
+}
+
+// reset starts the delays from min again.
+func (b *backoff) reset() {
+	b.attempt = 0
+}
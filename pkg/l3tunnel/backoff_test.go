@@ -0,0 +1,40 @@
+package l3tunnel
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackoff(t *testing.T) {
+	// The largest random number gives the upper bound of every delay, zero gives the lower one.
+	upper := func(n int64) int64 { return n - 1 }
+	b := backoff{min: 100 * time.Millisecond, max: time.Second, rand: upper}
+	var delays []time.Duration
+	for range 6 {
+		delays = append(delays, b.next())
+	}
+	require.Equal(t, []time.Duration{
+		100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond,
+		time.Second, time.Second,
+	}, delays)
+
+	b.reset()
+	b.rand = func(int64) int64 { return 0 }
+	require.Equal(t, 50*time.Millisecond, b.next())
+	require.Equal(t, 100*time.Millisecond, b.next())
+
+	// Shifting does not overflow after many attempts.
+	b.attempt = 100
+	require.Equal(t, 500*time.Millisecond, b.next())
+
+	// Random delays stay in the upper half of the exponential delay.
+	b = backoff{min: time.Second, max: time.Minute}
+	for i := range 10 {
+		d := b.next()
+		ceil := min(time.Second<<i, time.Minute)
+		require.GreaterOrEqual(t, d, ceil/2)
+		require.LessOrEqual(t, d, ceil)
+	}
+}
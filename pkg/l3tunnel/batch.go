@@ -0,0 +1,137 @@
+package l3tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/goxray/tun/pkg/l3tunnel/frame"
+)
+
+const (
+	// defaultBatchSize is the largest batch message if not configured, a few full-sized packets.
+	defaultBatchSize = 16 << 10
+	// defaultGatewayBatchWindow is the longest time the gateway holds a packet for a batch if not configured.
+	defaultGatewayBatchWindow = 2 * time.Millisecond
+)
+
+// errBatch is returned for a batch message with a truncated packet.
+var errBatch = errors.New("truncated packet in batch")
+
+// batchParams are the batching parameters of a session. The client asks for batching with its parameters
+// in clientHello, the gateway replies with the agreed ones in serverHello (the lower of both), or without them
+// if batching is disabled. Both directions of the session are batched with the agreed parameters.
+//
+// Every message of a batched session carries one or more packets, each prefixed with its length as in untyped
+// framing of package frame: length (2, big endian) | packet.
+type batchParams struct {
+	// Window is the longest time the first packet of a batch waits for others.
+	Window Duration `json:"window"`
+	// Size is the largest batch message in bytes, a packet that does not fit starts the next batch.
+	Size int `json:"size"`
+}
+
+// agree returns the parameters both ends accept, nil if either of them does not batch.
+func (p *batchParams) agree(o *batchParams) *batchParams {
+	if p == nil || o == nil || p.Window <= 0 || o.Window <= 0 || p.Size <= 0 || o.Size <= 0 {
+		return nil
+	}
+
+	return &batchParams{Window: min(p.Window, o.Window), Size: min(p.Size, o.Size)}
+}
+
+// batchWriter coalesces packets into batch messages.
+type batchWriter struct {
+	params batchParams
+	// write sends a batch message, the message must not be retained.
+	write func(batch []byte) error
+	buf   []byte
+}
+
+func newBatchWriter(params batchParams, write func(batch []byte) error) *batchWriter {
+	return &batchWriter{params: params, write: write, buf: make([]byte, 0, params.Size)}
+}
+
+// run sends packets received from in as batch messages until done is closed or sending fails.
+// A batch is sent when it is full or the window started by its first packet is over. release is called
+// with every packet once it is copied to the batch (or dropped as too large), it may be nil.
+func (w *batchWriter) run(done <-chan struct{}, in <-chan []byte, release func([]byte)) error {
+	timer := time.NewTimer(time.Duration(w.params.Window))
+	timer.Stop()
+	defer timer.Stop()
+	add := func(p []byte) error {
+		var err error
+		if len(p) <= frame.MaxSize {
+			if len(w.buf) > 0 && len(w.buf)+2+len(p) > w.params.Size {
+				err = w.flush()
+			}
+			w.buf = binary.BigEndian.AppendUint16(w.buf, uint16(len(p)))
+			w.buf = append(w.buf, p...)
+		}
+		if release != nil {
+			release(p)
+		}
+		return err
+	}
+
+	for {
+		select {
+		case <-done:
+			return nil
+		case p := <-in:
+			if err := add(p); err != nil {
+				return err
+			}
+		}
+		if len(w.buf) == 0 {
+			continue
+		}
+
+		timer.Reset(time.Duration(w.params.Window))
+	collect:
+		for len(w.buf) < w.params.Size {
+			select {
+			case <-done:
+				return nil
+			case <-timer.C:
+				break collect
+			case p := <-in:
+				if err := add(p); err != nil {
+					return err
+				}
+			}
+		}
+		timer.Stop()
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// flush sends the collected packets.
+func (w *batchWriter) flush() error {
+	err := w.write(w.buf)
+	w.buf = w.buf[:0]
+
+	return err
+}
+
+// splitBatch calls fn with every packet of the batch message b, packets are slices of b.
+// The error of fn is returned, or errBatch if b is truncated.
+func splitBatch(b []byte, fn func(packet []byte) error) error {
+	for len(b) > 0 {
+		if len(b) < 2 {
+			return errBatch
+		}
+		n := int(binary.BigEndian.Uint16(b))
+		if len(b) < 2+n {
+			return errBatch
+		}
+		if err := fn(b[2 : 2+n]); err != nil {
+			return err
+		}
+		b = b[2+n:]
+	}
+
+	return nil
+}
@@ -0,0 +1,74 @@
+package l3tunnel
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatchWriter(t *testing.T) {
+	batches := make(chan []byte, 16)
+	params := batchParams{Window: Duration(20 * time.Millisecond), Size: 10}
+	w := newBatchWriter(params, func(b []byte) error {
+		batches <- bytes.Clone(b)
+		return nil
+	})
+	in := make(chan []byte, 16)
+	var released [][]byte
+	done := make(chan struct{})
+	stopped := make(chan error)
+	go func() {
+		stopped <- w.run(done, in, func(p []byte) { released = append(released, p) })
+	}()
+
+	// Packets are coalesced up to the size, the rest is sent when the window is over.
+	for _, p := range []string{"abc", "def", "ghi"} {
+		in <- []byte(p)
+	}
+	require.Equal(t, []byte("\x00\x03abc\x00\x03def"), receive(t, batches))
+	require.Equal(t, []byte("\x00\x03ghi"), receive(t, batches))
+
+	// A packet larger than the size goes alone, the one that does not fit starts the next batch.
+	in <- []byte("a")
+	in <- []byte("large packet")
+	in <- []byte("b")
+	require.Equal(t, []byte("\x00\x01a"), receive(t, batches))
+	require.Equal(t, []byte("\x00\x0clarge packet"), receive(t, batches))
+	require.Equal(t, []byte("\x00\x01b"), receive(t, batches))
+
+	close(done)
+	require.NoError(t, receive(t, stopped))
+	require.Len(t, released, 6)
+
+	// Sending errors stop the writer.
+	w = newBatchWriter(params, func([]byte) error { return errors.New("closed") })
+	in <- []byte("abc")
+	require.EqualError(t, w.run(nil, in, nil), "closed")
+}
+
+func TestSplitBatch(t *testing.T) {
+	var packets []string
+	collect := func(p []byte) error {
+		packets = append(packets, string(p))
+		return nil
+	}
+	require.NoError(t, splitBatch([]byte("\x00\x03abc\x00\x00\x00\x01d"), collect))
+	require.Equal(t, []string{"abc", "", "d"}, packets)
+
+	for _, b := range []string{"\x00", "\x00\x03ab", "\x00\x01a\x00"} {
+		require.ErrorIs(t, splitBatch([]byte(b), collect), errBatch, "%q", b)
+	}
+	require.EqualError(t, splitBatch([]byte("\x00\x01a"), func([]byte) error { return errors.New("write") }), "write")
+}
+
+func TestBatchParams_Agree(t *testing.T) {
+	client := &batchParams{Window: Duration(time.Millisecond), Size: 32 << 10}
+	gateway := &batchParams{Window: Duration(2 * time.Millisecond), Size: 16 << 10}
+	require.Equal(t, &batchParams{Window: Duration(time.Millisecond), Size: 16 << 10}, client.agree(gateway))
+	require.Nil(t, client.agree(nil))
+	require.Nil(t, (*batchParams)(nil).agree(gateway))
+	require.Nil(t, client.agree(&batchParams{Size: 1500}), "zero window")
+}
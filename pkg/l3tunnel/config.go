@@ -0,0 +1,479 @@
+package l3tunnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goxray/tun/pkg/l3tunnel/frame"
+	"github.com/goxray/tun/pkg/l3tunnel/vless"
+)
+
+const (
+	// DefaultProfile is used when Config.Profile is empty.
+	DefaultProfile = "generic"
+	// defaultPath is the WebSocket path of the gateway server.
+	defaultPath = "/tun"
+	// defaultKeepalive is shorter than idle timeouts of carrier-grade NATs.
+	defaultKeepalive = 15 * time.Second
+	// defaultDeadPeerTimeout allows two pings to be lost.
+	defaultDeadPeerTimeout = 45 * time.Second
+)
+
+// Config is the L3 tunnel configuration, usually loaded from a JSON file with LoadConfig:
+//
+//	{
+//	  "server": "vps.example.com:443",
+//	  "uuid": "27848739-7e62-4138-9fd3-098a63964b6b",
+//	  "profile": "e3372h",
+//	  "tls": true,
+//	  "headers": {"User-Agent": "okhttp/4.12.0"},
+//	  "device": {"gateway": "10.64.64.2"},
+//	  "profiles": {"router": {"wan_interface": "eth1", "tun_name": "tun-router"}}
+//	}
+type Config struct {
+	// Server is the address the client dials (host:port): the gateway server, or a CDN edge when Host
+	// is the domain of the gateway behind it. The route to it is kept out of the tunnel.
+	Server string `json:"server"`
+	// UUID is the VLESS user ID the server authenticates the client by (UUID or a string of up to 30 bytes, as in XRay).
+	UUID string `json:"uuid"`
+	// Transport is "ws" for WebSocket (default) or "tcp" for the stream listener of the gateway, where messages
+	// are framed by package frame. Path, Host, Headers and EarlyData apply to WebSocket only.
+	Transport string `json:"transport"`
+	// Path is the WebSocket path of the gateway server with an optional query (default: /tun).
+	// The early data size may be given in the query as in XRay (/tun?ed=2048), it overrides EarlyData.
+	Path string `json:"path"`
+	// Host is the Host header of the WebSocket handshake (default: the host of Server).
+	Host string `json:"host"`
+	// TLS enables TLS (wss:// for WebSocket).
+	TLS bool `json:"tls"`
+	// SNI is the TLS server name (default: Host if set, the host of Server otherwise).
+	SNI string `json:"sni"`
+	// Insecure disables verification of the server certificate.
+	Insecure bool `json:"insecure"`
+	// Headers are added to the WebSocket handshake request, e.g. User-Agent.
+	Headers map[string]string `json:"headers"`
+	// EarlyData is the largest early data in bytes: VLESS request header is sent in Sec-WebSocket-Protocol
+	// header of the handshake if it is not longer, as XRay does, saving a message. Disabled if zero.
+	EarlyData int `json:"early_data"`
+	// TUNAddress is the client address in CIDR notation the gateway is asked for, it is assigned if free.
+	// The address is assigned by the gateway if empty.
+	TUNAddress string `json:"tun_address"`
+	// Keepalive is the interval of WebSocket pings keeping the connection and NAT mappings alive (default: 15s).
+	Keepalive Duration `json:"keepalive"`
+	// DeadPeerTimeout is the time without messages and pongs from the server after which the connection
+	// is considered dead and the client reconnects (default: 45s), must be longer than Keepalive.
+	DeadPeerTimeout Duration `json:"dead_peer_timeout"`
+	// BatchWindow enables batching of packets if the gateway supports it: packets read within the window
+	// (e.g. "2ms") are sent in one message, so it is the latency added to a packet at most.
+	BatchWindow Duration `json:"batch_window"`
+	// BatchSize is the largest batch message in bytes (default: 16384).
+	BatchSize int `json:"batch_size"`
+	// Profile is the name of the device profile, built-in (see BuiltinProfiles) or from Profiles (default: generic).
+	Profile string `json:"profile"`
+	// Profiles are custom device profiles, they override built-in ones with the same name.
+	// Fields missing in a custom profile are taken from the generic one.
+	Profiles map[string]Profile `json:"profiles"`
+	// Device overrides non-zero fields of the selected profile (LoadTUNModule can only be turned on,
+	// define a custom profile to turn it off).
+	Device Profile `json:"device"`
+	// Logger receives tunnel logs (default: slog.Default()).
+	Logger *slog.Logger `json:"-"`
+}
+
+// Profile describes a device the tunnel runs on: how the server is reached and how the TUN device is set up.
+type Profile struct {
+	// WANInterface is the interface the server is reached through (e.g. wan0 or rmnet0),
+	// the route exception for the server is made via Gateway only if empty.
+	WANInterface string `json:"wan_interface,omitempty"`
+	// Gateway is the next hop to the server, detected from the default route if empty.
+	// Point-to-point WAN interfaces (like rmnet) need no gateway.
+	Gateway string `json:"gateway,omitempty"`
+	// TUNName is the name of the TUN device.
+	TUNName string `json:"tun_name,omitempty"`
+	// MTU is the largest MTU of the TUN device, the MTU pushed by the gateway is used if lower.
+	MTU int `json:"mtu,omitempty"`
+	// BufferSize is the size of the TUN read buffer, must not be less than MTU.
+	BufferSize int `json:"buffer_size,omitempty"`
+	// PacketBuffers is the number of packets read from the TUN device and not sent yet at most, reading waits
+	// for the server when they are all in use. Memory of the buffers is PacketBuffers × BufferSize.
+	PacketBuffers int `json:"packet_buffers,omitempty"`
+	// RouteMetric is the metric of the routes pointed to the TUN device.
+	RouteMetric int `json:"route_metric,omitempty"`
+	// ResolvConf is the file the DNS servers pushed by the gateway are written to (e.g. /etc/resolv.conf),
+	// DNS is not changed if empty. The original contents are restored when the tunnel exits.
+	ResolvConf string `json:"resolv_conf,omitempty"`
+	// LoadTUNModule loads the embedded tun.ko kernel module and creates /dev/net/tun
+	// for devices shipped without TUN support.
+	LoadTUNModule bool `json:"load_tun_module,omitempty"`
+	// Tuning is the runtime tuning applied on start. The packet buffers and the buffers of a session must fit
+	// in its memory limit.
+	Tuning Tuning `json:"tuning"`
+}
+
+// Tuning is the process and Go runtime tuning for devices with little CPU and memory.
+type Tuning struct {
+	// GOMAXPROCS limits the number of OS threads running Go code, not changed if zero.
+	GOMAXPROCS int `json:"gomaxprocs,omitempty"`
+	// OOMScoreAdj is written to /proc/self/oom_score_adj (-1000 disables OOM killing of the process).
+	OOMScoreAdj *int `json:"oom_score_adj,omitempty"`
+	// Nice is the process priority (-20 is the highest).
+	Nice *int `json:"nice,omitempty"`
+	// MemoryLimit is the soft memory limit of the Go runtime in MiB (see debug.SetMemoryLimit),
+	// garbage is collected more often near it. Not changed if zero.
+	MemoryLimit int `json:"memory_limit,omitempty"`
+}
+
+// builtinProfiles are profiles of the devices the tunnel is known to run on.
+var builtinProfiles = map[string]Profile{
+	// Any Linux host: the server is reached via the default gateway.
+	"generic": {
+		TUNName:       "tun-l3",
+		MTU:           1500,
+		BufferSize:    1500,
+		PacketBuffers: 256,
+	},
+	// Huawei E3372H LTE modem: 41 MB of RAM, single core and no TUN support in the stock kernel.
+	// LTE uplink is wan0, the default route via br0 points back to the LAN.
+	"e3372h": {
+		WANInterface:  "wan0",
+		Gateway:       "10.64.64.1",
+		TUNName:       "tun-e3372h",
+		MTU:           1500,
+		BufferSize:    2048,
+		PacketBuffers: 64,
+		RouteMetric:   100,
+		LoadTUNModule: true,
+		Tuning:        Tuning{GOMAXPROCS: 1, OOMScoreAdj: intPtr(-1000), Nice: intPtr(-20), MemoryLimit: 16},
+	},
+	// Android devices with Qualcomm modems, the mobile data interface is point-to-point rmnet0.
+	"android-rmnet": {
+		WANInterface:  "rmnet0",
+		TUNName:       "tun-android",
+		MTU:           1500,
+		BufferSize:    2048,
+		PacketBuffers: 64,
+		RouteMetric:   100,
+		Tuning:        Tuning{GOMAXPROCS: 1, OOMScoreAdj: intPtr(-1000), Nice: intPtr(-20)},
+	},
+}
+
+// BuiltinProfiles returns names of the built-in device profiles.
+func BuiltinProfiles() []string {
+	names := make([]string, 0, len(builtinProfiles))
+	for name := range builtinProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// LoadConfig reads JSON config file.
+func LoadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("load config: %w", err)
+	}
+	defer f.Close()
+
+	return ParseConfig(f)
+}
+
+// ParseConfig parses JSON config, unknown fields are rejected to catch typos.
+func ParseConfig(r io.Reader) (*Config, error) {
+	var cfg Config
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	return &cfg, nil
+}
+
+// ApplyLink sets the server, UUID and WebSocket parameters from vless:// link as shared by XRay panels:
+//
+//	vless://<uuid>@<server>:<port>?type=ws&security=tls&path=%2Ftun%3Fed%3D2048&host=<host>&sni=<sni>#<name>
+//
+// Only WebSocket transport with TLS or without security is supported. Parameters of no use to the tunnel
+// (e.g. fp or alpn) are ignored.
+func (c *Config) ApplyLink(link string) error {
+	u, err := url.Parse(strings.TrimSpace(link))
+	if err != nil {
+		return fmt.Errorf("invalid link: %w", err)
+	}
+	if u.Scheme != "vless" {
+		return fmt.Errorf("invalid link: protocol %q is not vless", u.Scheme)
+	}
+	if u.User == nil || u.Hostname() == "" || u.Port() == "" {
+		return fmt.Errorf("invalid link: user ID, server and port are required")
+	}
+	q := u.Query()
+	if t := q.Get("type"); t != "" && t != "ws" {
+		return fmt.Errorf("invalid link: transport %q is not ws", t)
+	}
+	if e := q.Get("encryption"); e != "" && e != "none" {
+		return fmt.Errorf("invalid link: encryption %q is not supported", e)
+	}
+	if f := q.Get("flow"); f != "" {
+		return fmt.Errorf("invalid link: flow %q is not supported", f)
+	}
+	switch sec := q.Get("security"); sec {
+	case "", "none":
+		c.TLS = false
+	case "tls":
+		c.TLS = true
+	default:
+		return fmt.Errorf("invalid link: security %q is not supported", sec)
+	}
+
+	c.Server = u.Host
+	c.UUID = u.User.Username()
+	c.Path = q.Get("path")
+	c.Host = q.Get("host")
+	c.SNI = q.Get("sni")
+	c.Insecure = q.Get("allowInsecure") == "1" || q.Get("allowInsecure") == "true"
+
+	return nil
+}
+
+// profile returns the selected profile with Device overrides applied.
+func (c *Config) profile() (Profile, error) {
+	name := c.Profile
+	p, ok := c.Profiles[name]
+	if ok {
+		p.merge(builtinProfiles[DefaultProfile])
+	} else if p, ok = builtinProfiles[name]; !ok {
+		return Profile{}, fmt.Errorf("unknown profile %q", name)
+	}
+	// Device overrides take precedence, the profile fills the rest.
+	d := c.Device
+	d.merge(p)
+	var batchSize int
+	if c.BatchWindow > 0 {
+		batchSize = c.BatchSize
+	}
+
+	return d, d.validate(batchSize)
+}
+
+// merge sets zero fields of p from o.
+func (p *Profile) merge(o Profile) {
+	if p.WANInterface == "" {
+		p.WANInterface = o.WANInterface
+	}
+	if p.Gateway == "" {
+		p.Gateway = o.Gateway
+	}
+	if p.TUNName == "" {
+		p.TUNName = o.TUNName
+	}
+	if p.MTU == 0 {
+		p.MTU = o.MTU
+	}
+	if p.BufferSize == 0 {
+		p.BufferSize = o.BufferSize
+	}
+	if p.PacketBuffers == 0 {
+		p.PacketBuffers = o.PacketBuffers
+	}
+	if p.RouteMetric == 0 {
+		p.RouteMetric = o.RouteMetric
+	}
+	if p.ResolvConf == "" {
+		p.ResolvConf = o.ResolvConf
+	}
+	if !p.LoadTUNModule {
+		p.LoadTUNModule = o.LoadTUNModule
+	}
+	if p.Tuning.GOMAXPROCS == 0 {
+		p.Tuning.GOMAXPROCS = o.Tuning.GOMAXPROCS
+	}
+	if p.Tuning.OOMScoreAdj == nil {
+		p.Tuning.OOMScoreAdj = o.Tuning.OOMScoreAdj
+	}
+	if p.Tuning.Nice == nil {
+		p.Tuning.Nice = o.Tuning.Nice
+	}
+	if p.Tuning.MemoryLimit == 0 {
+		p.Tuning.MemoryLimit = o.Tuning.MemoryLimit
+	}
+}
+
+// validate checks the profile, batchSize is the largest batch message of a session (zero if not batching).
+func (p *Profile) validate(batchSize int) error {
+	if p.TUNName == "" || len(p.TUNName) > 15 {
+		return fmt.Errorf("invalid profile: TUN name %q must be 1 to 15 characters", p.TUNName)
+	}
+	if p.MTU < 576 || p.MTU > 65535 {
+		return fmt.Errorf("invalid profile: MTU %d is out of range [576, 65535]", p.MTU)
+	}
+	if p.BufferSize < p.MTU {
+		return fmt.Errorf("invalid profile: buffer size %d is less than MTU %d", p.BufferSize, p.MTU)
+	}
+	if p.PacketBuffers < 1 {
+		return fmt.Errorf("invalid profile: packet buffers %d must be positive", p.PacketBuffers)
+	}
+	if p.RouteMetric < 0 {
+		return fmt.Errorf("invalid profile: negative route metric %d", p.RouteMetric)
+	}
+	if p.Gateway != "" && net.ParseIP(p.Gateway) == nil {
+		return fmt.Errorf("invalid profile: gateway %q is not an IP address", p.Gateway)
+	}
+	if p.ResolvConf != "" && !filepath.IsAbs(p.ResolvConf) {
+		return fmt.Errorf("invalid profile: resolv.conf path %q must be absolute", p.ResolvConf)
+	}
+	if p.Tuning.GOMAXPROCS < 0 {
+		return fmt.Errorf("invalid profile: negative GOMAXPROCS %d", p.Tuning.GOMAXPROCS)
+	}
+	if n := p.Tuning.OOMScoreAdj; n != nil && (*n < -1000 || *n > 1000) {
+		return fmt.Errorf("invalid profile: OOM score adjustment %d is out of range [-1000, 1000]", *n)
+	}
+	if n := p.Tuning.Nice; n != nil && (*n < -20 || *n > 19) {
+		return fmt.Errorf("invalid profile: nice %d is out of range [-20, 19]", *n)
+	}
+	if p.Tuning.MemoryLimit < 0 {
+		return fmt.Errorf("invalid profile: negative memory limit %d", p.Tuning.MemoryLimit)
+	}
+	if limit := p.Tuning.MemoryLimit << 20; limit > 0 {
+		pool, session := p.PacketBuffers*p.BufferSize, sessionBuffers(p.BufferSize, batchSize)
+		if pool+session > limit {
+			return fmt.Errorf("invalid profile: packet buffers (%d × %d bytes) and session buffers (%d bytes) exceed memory limit of %d MiB",
+				p.PacketBuffers, p.BufferSize, session, p.Tuning.MemoryLimit)
+		}
+	}
+
+	return nil
+}
+
+// validate checks the config and sets defaults.
+func (c *Config) validate() error {
+	host, port, err := net.SplitHostPort(c.Server)
+	if err != nil || host == "" || port == "" {
+		return fmt.Errorf("invalid config: server %q must be host:port", c.Server)
+	}
+	if _, err = vless.ParseUUID(c.UUID); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	if c.Profile == "" {
+		c.Profile = DefaultProfile
+	}
+	if c.Transport == "" {
+		c.Transport = TransportWebSocket
+	}
+	if c.Transport != TransportWebSocket && c.Transport != TransportStream {
+		return fmt.Errorf("invalid config: transport %q is not %s or %s", c.Transport, TransportWebSocket, TransportStream)
+	}
+	if c.Path == "" {
+		c.Path = defaultPath
+	}
+	if !strings.HasPrefix(c.Path, "/") {
+		return fmt.Errorf("invalid config: path %q must start with /", c.Path)
+	}
+	if path, query, ok := strings.Cut(c.Path, "?"); ok {
+		q, err := url.ParseQuery(query)
+		if err != nil {
+			return fmt.Errorf("invalid config: path query: %w", err)
+		}
+		if ed := q.Get("ed"); ed != "" {
+			if c.EarlyData, err = strconv.Atoi(ed); err != nil {
+				return fmt.Errorf("invalid config: early data size %q in path", ed)
+			}
+			q.Del("ed")
+		}
+		// The early data size is for the client only, the rest of the query is sent.
+		if c.Path = path; len(q) > 0 {
+			c.Path += "?" + q.Encode()
+		}
+	}
+	if c.EarlyData < 0 {
+		return fmt.Errorf("invalid config: negative early data size %d", c.EarlyData)
+	}
+	if c.SNI == "" {
+		c.SNI = host
+		if c.Host != "" {
+			c.SNI = c.Host
+			if h, _, err := net.SplitHostPort(c.Host); err == nil {
+				c.SNI = h
+			}
+		}
+	}
+	for name := range c.Headers {
+		switch http.CanonicalHeaderKey(name) {
+		case "Host", "Upgrade", "Connection", "Sec-Websocket-Key", "Sec-Websocket-Version", "Sec-Websocket-Extensions",
+			"Sec-Websocket-Protocol":
+			return fmt.Errorf("invalid config: header %q is set by the tunnel", name)
+		}
+	}
+	if c.TUNAddress != "" {
+		if _, _, err = net.ParseCIDR(c.TUNAddress); err != nil {
+			return fmt.Errorf("invalid config: TUN address: %w", err)
+		}
+	}
+	if c.Keepalive == 0 {
+		c.Keepalive = Duration(defaultKeepalive)
+	}
+	if c.DeadPeerTimeout == 0 {
+		c.DeadPeerTimeout = Duration(defaultDeadPeerTimeout)
+	}
+	if c.Keepalive < 0 {
+		return fmt.Errorf("invalid config: negative keepalive %s", c.Keepalive)
+	}
+	if c.DeadPeerTimeout <= c.Keepalive {
+		return fmt.Errorf("invalid config: dead peer timeout %s must be longer than keepalive %s", c.DeadPeerTimeout, c.Keepalive)
+	}
+	if c.BatchWindow < 0 || c.BatchSize < 0 {
+		return fmt.Errorf("invalid config: negative batch window %s or size %d", c.BatchWindow, c.BatchSize)
+	}
+	if c.BatchSize == 0 {
+		c.BatchSize = defaultBatchSize
+	}
+	if c.Transport == TransportStream && c.BatchSize > frame.MaxSize {
+		return fmt.Errorf("invalid config: batch size %d exceeds frame size %d of transport %s", c.BatchSize, frame.MaxSize, c.Transport)
+	}
+	if c.Logger == nil {
+		c.Logger = slog.Default()
+	}
+
+	return nil
+}
+
+// Duration is time.Duration encoded in JSON as a string like "15s" or "1m30s".
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"15s\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+
+	return nil
+}
+
+func intPtr(n int) *int {
+	return &n
+}
@@ -0,0 +1,177 @@
+package l3tunnel
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testUUID = "27848739-7e62-4138-9fd3-098a63964b6b"
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "l3tunnel.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{
+		"server": "vps.example.com:443",
+		"uuid": "27848739-7e62-4138-9fd3-098a63964b6b",
+		"profile": "router",
+		"tls": true,
+		"keepalive": "10s",
+		"device": {"gateway": "192.168.1.254", "tuning": {"nice": 5}},
+		"profiles": {"router": {"wan_interface": "eth1", "tun_name": "tun-router", "route_metric": 50}}
+	}`), 0o600))
+
+	cfg, err := LoadConfig(path)
+	require.NoError(t, err)
+	tun, err := New(*cfg)
+	require.NoError(t, err)
+	require.Equal(t, Profile{
+		WANInterface:  "eth1",
+		Gateway:       "192.168.1.254",
+		TUNName:       "tun-router",
+		MTU:           1500, // From the generic profile.
+		BufferSize:    1500,
+		PacketBuffers: 256,
+		RouteMetric:   50,
+		Tuning:        Tuning{Nice: intPtr(5)},
+	}, tun.Profile())
+	require.Equal(t, "/tun", tun.cfg.Path)
+	require.Empty(t, tun.cfg.TUNAddress, "assigned by the gateway")
+	require.Equal(t, Duration(10*time.Second), tun.cfg.Keepalive)
+	require.Equal(t, Duration(45*time.Second), tun.cfg.DeadPeerTimeout, "default")
+
+	_, err = ParseConfig(strings.NewReader(`{"server": "vps:443", "uuid": "user", "profle": "e3372h"}`))
+	require.ErrorContains(t, err, `unknown field "profle"`)
+	_, err = ParseConfig(strings.NewReader(`{"server": "vps:443", "uuid": "user", "keepalive": 15}`))
+	require.ErrorContains(t, err, `duration must be a string like "15s"`)
+	_, err = ParseConfig(strings.NewReader(`{"server": "vps:443", "uuid": "user", "keepalive": "15 seconds"}`))
+	require.ErrorContains(t, err, `unknown unit " seconds"`)
+	_, err = LoadConfig(filepath.Join(t.TempDir(), "missing.json"))
+	require.ErrorContains(t, err, "load config")
+}
+
+func TestConfig_ApplyLink(t *testing.T) {
+	cfg := Config{Server: "old:443", Path: "/old", Profile: "e3372h"}
+	require.NoError(t, cfg.ApplyLink("vless://"+testUUID+"@104.16.0.1:443?type=ws&security=tls&encryption=none"+
+		"&path=%2Ftun%3Fed%3D2048&host=gw.example.com&sni=front.example.com&fp=chrome&allowInsecure=1#modem"))
+	tun, err := New(cfg)
+	require.NoError(t, err)
+	require.Equal(t, "104.16.0.1:443", tun.cfg.Server)
+	require.Equal(t, testUUID, tun.cfg.UUID)
+	require.Equal(t, "/tun", tun.cfg.Path)
+	require.Equal(t, 2048, tun.cfg.EarlyData)
+	require.True(t, tun.early)
+	require.Equal(t, "gw.example.com", tun.cfg.Host)
+	require.Equal(t, "front.example.com", tun.cfg.SNI)
+	require.True(t, tun.cfg.TLS)
+	require.True(t, tun.cfg.Insecure)
+	require.Equal(t, "e3372h", tun.cfg.Profile, "device settings are kept")
+
+	require.NoError(t, cfg.ApplyLink("vless://"+testUUID+"@[2001:db8::1]:8080"))
+	require.Equal(t, "[2001:db8::1]:8080", cfg.Server)
+	require.False(t, cfg.TLS)
+	require.Empty(t, cfg.Host)
+
+	for link, err := range map[string]string{
+		"vmess://" + testUUID + "@vps:443":                       `protocol "vmess" is not vless`,
+		"vless://vps:443":                                        "user ID, server and port are required",
+		"vless://" + testUUID + "@vps":                           "user ID, server and port are required",
+		"vless://" + testUUID + "@vps:443?type=grpc":             `transport "grpc" is not ws`,
+		"vless://" + testUUID + "@vps:443?security=reality":      `security "reality" is not supported`,
+		"vless://" + testUUID + "@vps:443?flow=xtls-rprx-vision": `flow "xtls-rprx-vision" is not supported`,
+		"vless://" + testUUID + "@vps:443?encryption=aes":        `encryption "aes" is not supported`,
+	} {
+		require.ErrorContains(t, (&Config{}).ApplyLink(link), err, link)
+	}
+}
+
+func TestConfig_Endpoint(t *testing.T) {
+	// The early data size is taken out of the path, the rest of the query is kept.
+	tun, err := New(Config{Server: "vps:443", UUID: testUUID, Path: "/tun?ed=2048&token=1"})
+	require.NoError(t, err)
+	require.Equal(t, "/tun?token=1", tun.cfg.Path)
+	require.Equal(t, 2048, tun.cfg.EarlyData)
+
+	// SNI is the Host header if set, the server host otherwise.
+	tun, err = New(Config{Server: "104.16.0.1:443", UUID: testUUID, Host: "gw.example.com:443"})
+	require.NoError(t, err)
+	require.Equal(t, "gw.example.com", tun.cfg.SNI)
+	require.False(t, tun.early)
+	tun, err = New(Config{Server: "vps:443", UUID: testUUID, EarlyData: 16})
+	require.NoError(t, err)
+	require.Equal(t, "vps", tun.cfg.SNI)
+	require.False(t, tun.early, "the request is longer than the early data")
+	tun, err = New(Config{Server: "vps:443", UUID: testUUID, Transport: TransportStream, EarlyData: 2048})
+	require.NoError(t, err)
+	require.False(t, tun.early, "no early data over the stream")
+
+	for name, tc := range map[string]struct {
+		cfg Config
+		err string
+	}{
+		"ed":        {Config{Server: "vps:443", UUID: testUUID, Path: "/tun?ed=max"}, `early data size "max" in path`},
+		"early":     {Config{Server: "vps:443", UUID: testUUID, EarlyData: -1}, "negative early data size -1"},
+		"header":    {Config{Server: "vps:443", UUID: testUUID, Headers: map[string]string{"host": "gw"}}, `header "host" is set by the tunnel`},
+		"transport": {Config{Server: "vps:443", UUID: testUUID, Transport: "grpc"}, `transport "grpc" is not ws or tcp`},
+		"frame":     {Config{Server: "vps:443", UUID: testUUID, Transport: TransportStream, BatchSize: 1 << 20}, "batch size 1048576 exceeds frame size 65535"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := New(tc.cfg)
+			require.ErrorContains(t, err, tc.err)
+		})
+	}
+}
+
+func TestConfig_Profile(t *testing.T) {
+	require.Equal(t, []string{"android-rmnet", "e3372h", "generic"}, BuiltinProfiles())
+
+	tun, err := New(Config{Server: "vps.example.com:8080", UUID: testUUID})
+	require.NoError(t, err)
+	require.Equal(t, builtinProfiles["generic"], tun.Profile())
+
+	tun, err = New(Config{Server: "vps.example.com:8080", UUID: testUUID, Profile: "e3372h", Device: Profile{BufferSize: 4096}})
+	require.NoError(t, err)
+	p := tun.Profile()
+	require.Equal(t, "wan0", p.WANInterface)
+	require.Equal(t, "10.64.64.1", p.Gateway)
+	require.Equal(t, 4096, p.BufferSize)
+	require.True(t, p.LoadTUNModule)
+	require.Equal(t, 1, p.Tuning.GOMAXPROCS)
+	require.Equal(t, -1000, *p.Tuning.OOMScoreAdj)
+	require.Equal(t, 16, p.Tuning.MemoryLimit)
+	// Built-in profile is not changed by the overrides.
+	require.Equal(t, 2048, builtinProfiles["e3372h"].BufferSize)
+
+	for name, tc := range map[string]struct {
+		cfg Config
+		err string
+	}{
+		"no server":   {Config{}, `server "" must be host:port`},
+		"no port":     {Config{Server: "vps.example.com", UUID: testUUID}, "must be host:port"},
+		"no uuid":     {Config{Server: "vps:443"}, `invalid UUID ""`},
+		"bad path":    {Config{Server: "vps:443", UUID: testUUID, Path: "tun"}, `path "tun" must start with /`},
+		"bad address": {Config{Server: "vps:443", UUID: testUUID, TUNAddress: "10.50.0.2"}, "TUN address"},
+		"keepalive":   {Config{Server: "vps:443", UUID: testUUID, Keepalive: -1}, "negative keepalive"},
+		"dead peer":   {Config{Server: "vps:443", UUID: testUUID, DeadPeerTimeout: Duration(time.Second)}, "dead peer timeout 1s must be longer than keepalive 15s"},
+		"batch":       {Config{Server: "vps:443", UUID: testUUID, BatchWindow: -1}, "negative batch window"},
+		"profile":     {Config{Server: "vps:443", UUID: testUUID, Profile: "nokia"}, `unknown profile "nokia"`},
+		"tun name":    {Config{Server: "vps:443", UUID: testUUID, Device: Profile{TUNName: "tun-with-a-long-name"}}, "must be 1 to 15 characters"},
+		"mtu":         {Config{Server: "vps:443", UUID: testUUID, Device: Profile{MTU: 100}}, "MTU 100 is out of range"},
+		"buffer":      {Config{Server: "vps:443", UUID: testUUID, Device: Profile{MTU: 9000}}, "buffer size 1500 is less than MTU 9000"},
+		"gateway":     {Config{Server: "vps:443", UUID: testUUID, Device: Profile{Gateway: "router"}}, `gateway "router" is not an IP address`},
+		"resolv.conf": {Config{Server: "vps:443", UUID: testUUID, Device: Profile{ResolvConf: "resolv.conf"}}, "must be absolute"},
+		"buffers":     {Config{Server: "vps:443", UUID: testUUID, Device: Profile{PacketBuffers: -1}}, "packet buffers -1 must be positive"},
+		"memory":      {Config{Server: "vps:443", UUID: testUUID, Device: Profile{Tuning: Tuning{MemoryLimit: -1}}}, "negative memory limit"},
+		"memory limit": {Config{Server: "vps:443", UUID: testUUID, Profile: "e3372h", Device: Profile{PacketBuffers: 8192}},
+			"packet buffers (8192 × 2048 bytes) and session buffers (73741 bytes) exceed memory limit of 16 MiB"},
+		"nice": {Config{Server: "vps:443", UUID: testUUID, Device: Profile{Tuning: Tuning{Nice: intPtr(-30)}}}, "nice -30 is out of range"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := New(tc.cfg)
+			require.ErrorContains(t, err, tc.err)
+		})
+	}
+}
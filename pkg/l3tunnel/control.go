@@ -0,0 +1,83 @@
+package l3tunnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+
+	"github.com/goxray/tun/pkg/l3tunnel/frame"
+)
+
+// controlVersion is the version of the control messages exchanged at session start:
+//
+//  1. The client sends VLESS request header and clientHello, each in its own message.
+//  2. The gateway replies with VLESS response header and serverHello carrying the tunnel configuration
+//     or the reason the session is refused. Packets follow.
+//
+// The gateway answers with its own version, the client refuses sessions of versions it does not support.
+const controlVersion = 1
+
+// maxControlSize is the largest control message, with VLESS header in front of it. It fits a frame of the stream.
+const maxControlSize = frame.MaxSize
+
+// clientHello is the first control message of the client.
+type clientHello struct {
+	Version int `json:"version"`
+	// Address is the address the client asks for (its address before reconnecting), with the prefix length.
+	Address string `json:"address,omitempty"`
+	// Batch asks for batching of packets, see batchParams.
+	Batch *batchParams `json:"batch,omitempty"`
+}
+
+// serverHello is the reply of the gateway to clientHello.
+type serverHello struct {
+	Version int           `json:"version"`
+	Error   string        `json:"error,omitempty"`
+	Config  *tunnelConfig `json:"config,omitempty"`
+	// Batch are the agreed batching parameters, the session is not batched if nil.
+	Batch *batchParams `json:"batch,omitempty"`
+}
+
+// tunnelConfig is the configuration of the client end of the tunnel pushed by the gateway.
+type tunnelConfig struct {
+	// Address is the client address with the prefix length of the tunnel network.
+	Address string `json:"address"`
+	// MTU of the TUN device.
+	MTU int `json:"mtu"`
+	// DNS servers of the tunnel.
+	DNS []string `json:"dns,omitempty"`
+	// Routes are networks routed to the TUN device.
+	Routes []string `json:"routes"`
+}
+
+// validate checks the configuration pushed by the gateway before it is applied to the device.
+func (c *tunnelConfig) validate() error {
+	if _, err := netip.ParsePrefix(c.Address); err != nil {
+		return fmt.Errorf("invalid tunnel config: address: %w", err)
+	}
+	if c.MTU < 576 || c.MTU > 65535 {
+		return fmt.Errorf("invalid tunnel config: MTU %d is out of range [576, 65535]", c.MTU)
+	}
+	for _, dns := range c.DNS {
+		if _, err := netip.ParseAddr(dns); err != nil {
+			return fmt.Errorf("invalid tunnel config: DNS server: %w", err)
+		}
+	}
+	for _, r := range c.Routes {
+		if _, err := netip.ParsePrefix(r); err != nil {
+			return fmt.Errorf("invalid tunnel config: route: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// writeControl sends the control message v.
+func writeControl(conn msgConn, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return conn.WriteMessage(b)
+}
@@ -0,0 +1,166 @@
+package l3tunnel
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"syscall"
+
+	"github.com/goxray/core/network/tun"
+	"github.com/jackpal/gateway"
+	"github.com/vishvananda/netlink"
+)
+
+// tunModule is TUN kernel module built for the E3372H modem kernel.
+//
+//go:embed tun.ko
+var tunModule []byte
+
+// tunDevice is the device number of /dev/net/tun (major 10, minor 200).
+const tunDevice = 10<<8 | 200
+
+// loadTUNModule creates /dev/net/tun device node and loads the embedded TUN module,
+// falling back to modprobe if insmod fails (the module may be built into the kernel or already loaded).
+func loadTUNModule() error {
+	if err := os.MkdirAll("/dev/net", 0o755); err != nil {
+		return fmt.Errorf("create /dev/net: %w", err)
+	}
+	err := syscall.Mknod("/dev/net/tun", syscall.S_IFCHR|0o666, tunDevice)
+	if err != nil && !errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("create /dev/net/tun: %w", err)
+	}
+
+	f, err := os.CreateTemp("", "tun-*.ko")
+	if err != nil {
+		return fmt.Errorf("write module: %w", err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(tunModule)
+	if err = errors.Join(err, f.Close()); err != nil {
+		return fmt.Errorf("write module: %w", err)
+	}
+
+	if out, err := exec.Command("insmod", f.Name()).CombinedOutput(); err != nil {
+		if out2, err2 := exec.Command("modprobe", "tun").CombinedOutput(); err2 != nil {
+			return fmt.Errorf("load module: insmod: %s, modprobe: %s", out, out2)
+		}
+	}
+
+	return nil
+}
+
+// applyTuning applies the runtime tuning, failures are logged only as the tunnel works without it.
+func applyTuning(t Tuning, log *slog.Logger) {
+	if t.GOMAXPROCS > 0 {
+		runtime.GOMAXPROCS(t.GOMAXPROCS)
+	}
+	if t.MemoryLimit > 0 {
+		debug.SetMemoryLimit(int64(t.MemoryLimit) << 20)
+	}
+	if t.OOMScoreAdj != nil {
+		if err := os.WriteFile("/proc/self/oom_score_adj", []byte(strconv.Itoa(*t.OOMScoreAdj)), 0); err != nil {
+			log.Warn("OOM score adjustment failed", "err", err)
+		}
+	}
+	if t.Nice != nil {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, 0, *t.Nice); err != nil {
+			log.Warn("priority change failed", "err", err)
+		}
+	}
+}
+
+// openTUN creates the TUN device of the profile, it is configured by configureTUN when connected.
+func openTUN(p Profile) (*tun.Interface, error) {
+	return tun.New(p.TUNName, p.MTU)
+}
+
+// configureTUN applies the tunnel configuration pushed by the gateway: address, MTU (limited by the profile)
+// and routes. Address and routes of the previous configuration which are not used any more are removed.
+func configureTUN(p Profile, cfg, prev *tunnelConfig) error {
+	link, err := netlink.LinkByName(p.TUNName)
+	if err != nil {
+		return fmt.Errorf("TUN device: %w", err)
+	}
+	if err = netlink.LinkSetMTU(link, min(cfg.MTU, p.MTU)); err != nil {
+		return fmt.Errorf("set MTU: %w", err)
+	}
+	if prev != nil && prev.Address != cfg.Address {
+		if addr, err := netlink.ParseAddr(prev.Address); err == nil {
+			_ = netlink.AddrDel(link, addr)
+		}
+	}
+	addr, err := netlink.ParseAddr(cfg.Address)
+	if err != nil {
+		return fmt.Errorf("address: %w", err)
+	}
+	if err = netlink.AddrReplace(link, addr); err != nil {
+		return fmt.Errorf("set address: %w", err)
+	}
+	if err = netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("set up: %w", err)
+	}
+
+	routes := make(map[string]bool, len(cfg.Routes))
+	for _, dst := range cfg.Routes {
+		_, ipNet, err := net.ParseCIDR(dst)
+		if err != nil {
+			return fmt.Errorf("route %s: %w", dst, err)
+		}
+		r := &netlink.Route{LinkIndex: link.Attrs().Index, Dst: ipNet, Priority: p.RouteMetric, Scope: netlink.SCOPE_LINK}
+		if err = netlink.RouteReplace(r); err != nil {
+			return fmt.Errorf("route %s: %w", dst, err)
+		}
+		routes[dst] = true
+	}
+	if prev != nil {
+		for _, dst := range prev.Routes {
+			if _, ipNet, err := net.ParseCIDR(dst); err == nil && !routes[dst] {
+				_ = netlink.RouteDel(&netlink.Route{LinkIndex: link.Attrs().Index, Dst: ipNet, Priority: p.RouteMetric})
+			}
+		}
+	}
+
+	return nil
+}
+
+// setupServerRoute makes the route to the server through the WAN, so the tunnel routes do not capture it.
+// Returned function removes the route.
+func setupServerRoute(p Profile, server net.IP) (func(), error) {
+	ip, bits := server, 128
+	if v4 := server.To4(); v4 != nil {
+		ip, bits = v4, 32
+	}
+	exception := &netlink.Route{Dst: &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}}
+	if p.WANInterface != "" {
+		wan, err := netlink.LinkByName(p.WANInterface)
+		if err != nil {
+			return nil, fmt.Errorf("WAN interface %s: %w", p.WANInterface, err)
+		}
+		exception.LinkIndex = wan.Attrs().Index
+	}
+	switch {
+	case p.Gateway != "":
+		exception.Gw = net.ParseIP(p.Gateway)
+	case p.WANInterface == "":
+		gw, err := gateway.DiscoverGateway()
+		if err != nil {
+			return nil, fmt.Errorf("discover gateway: %w", err)
+		}
+		exception.Gw = gw
+	default:
+		exception.Scope = netlink.SCOPE_LINK
+	}
+	// Replace makes the server reachable through the WAN even if the existing route points elsewhere (e.g. to the LAN).
+	if err := netlink.RouteReplace(exception); err != nil {
+		return nil, fmt.Errorf("server route exception: %w", err)
+	}
+
+	return func() { _ = netlink.RouteDel(exception) }, nil
+}
@@ -0,0 +1,36 @@
+//go:build !linux
+
+package l3tunnel
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+)
+
+func loadTUNModule() error {
+	return errUnsupported
+}
+
+func applyTuning(Tuning, *slog.Logger) {}
+
+func openTUN(Profile) (io.ReadWriteCloser, error) {
+	return nil, errUnsupported
+}
+
+func configureTUN(Profile, *tunnelConfig, *tunnelConfig) error {
+	return errUnsupported
+}
+
+func setupServerRoute(Profile, net.IP) (func(), error) {
+	return nil, errUnsupported
+}
+
+func openGatewayTUN(string, string, int) (io.ReadWriteCloser, error) {
+	return nil, errUnsupported
+}
+
+func setupNAT(string, netip.Prefix, string) (func(), error) {
+	return nil, errUnsupported
+}
@@ -0,0 +1,141 @@
+// Package frame implements length-prefixed framing of packets over stream transports (TCP, TLS or any net.Conn),
+// so packet boundaries are kept however the stream is split or coalesced:
+//
+//	length (2, big endian) | type (1, typed framing only) | payload (length bytes)
+//
+// The length does not include the type byte.
+package frame
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// MaxSize is the largest payload a frame can carry.
+const MaxSize = 1<<16 - 1
+
+// ErrTooLarge is returned when the payload is larger than MaxSize or the buffer it is read into.
+var ErrTooLarge = errors.New("frame: too large")
+
+// Type is the payload type of typed framing.
+type Type byte
+
+// TypePacket is the type of IP packets, frames of untyped framing are always of this type.
+const TypePacket Type = 0
+
+// Writer writes frames to the underlying writer, every frame with a single Write.
+// It is safe for concurrent use.
+type Writer struct {
+	mu    sync.Mutex
+	w     io.Writer
+	typed bool
+	buf   []byte
+}
+
+// NewWriter creates Writer, typed enables the type byte.
+func NewWriter(w io.Writer, typed bool) *Writer {
+	return &Writer{w: w, typed: typed}
+}
+
+// WriteFrame writes p as a frame of type t (ignored by untyped framing).
+func (w *Writer) WriteFrame(t Type, p []byte) error {
+	if len(p) > MaxSize {
+		return fmt.Errorf("%w: %d bytes", ErrTooLarge, len(p))
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = binary.BigEndian.AppendUint16(w.buf[:0], uint16(len(p)))
+	if w.typed {
+		w.buf = append(w.buf, byte(t))
+	}
+	w.buf = append(w.buf, p...)
+	_, err := w.w.Write(w.buf)
+
+	return err
+}
+
+// Reader reads frames from the underlying reader, it is buffered to read small frames with few calls.
+// Frames are read into the buffers of the caller, nothing is allocated after NewReader.
+type Reader struct {
+	r     *bufio.Reader
+	typed bool
+	head  [3]byte
+}
+
+// NewReader creates Reader, typed enables the type byte.
+func NewReader(r io.Reader, typed bool) *Reader {
+	return &Reader{r: bufio.NewReader(r), typed: typed}
+}
+
+// ReadFrame reads the next frame into p, returned are its type and payload length.
+// io.EOF is returned if the stream ends between frames, io.ErrUnexpectedEOF if inside a frame.
+// A frame larger than p is skipped with ErrTooLarge, the reader stays usable.
+func (r *Reader) ReadFrame(p []byte) (Type, int, error) {
+	head := r.head[:2]
+	if r.typed {
+		head = r.head[:3]
+	}
+	if n, err := io.ReadFull(r.r, head); err != nil {
+		if n > 0 && errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, 0, err
+	}
+	size := int(binary.BigEndian.Uint16(head))
+	t := TypePacket
+	if r.typed {
+		t = Type(head[2])
+	}
+
+	if size > len(p) {
+		if _, err := r.r.Discard(size); err != nil {
+			return t, 0, unexpectedEOF(err)
+		}
+		return t, 0, ErrTooLarge
+	}
+	if _, err := io.ReadFull(r.r, p[:size]); err != nil {
+		return t, 0, unexpectedEOF(err)
+	}
+
+	return t, size, nil
+}
+
+// unexpectedEOF converts io.EOF to io.ErrUnexpectedEOF, the stream ended inside a frame.
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Conn is net.Conn carrying packets with untyped framing: every Write sends a packet and every Read returns one.
+type Conn struct {
+	net.Conn
+	r *Reader
+	w *Writer
+}
+
+// NewConn wraps the stream connection c.
+func NewConn(c net.Conn) *Conn {
+	return &Conn{Conn: c, r: NewReader(c, false), w: NewWriter(c, false)}
+}
+
+// Read reads the next packet into p, packets larger than p are dropped with ErrTooLarge.
+func (c *Conn) Read(p []byte) (int, error) {
+	_, n, err := c.r.ReadFrame(p)
+	return n, err
+}
+
+// Write sends p as a single packet.
+func (c *Conn) Write(p []byte) (int, error) {
+	if err := c.w.WriteFrame(TypePacket, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
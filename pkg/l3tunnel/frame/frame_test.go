@@ -0,0 +1,172 @@
+package frame
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReader(t *testing.T) {
+	packets := [][]byte{[]byte("first packet"), {}, bytes.Repeat([]byte{0xaa}, 1500), []byte("last")}
+
+	for _, typed := range []bool{false, true} {
+		var stream bytes.Buffer
+		w := NewWriter(&stream, typed)
+		for i, p := range packets {
+			require.NoError(t, w.WriteFrame(Type(i), p))
+		}
+
+		// Single byte reads split every frame, the buffered reader coalesces them.
+		for name, src := range map[string]io.Reader{
+			"coalesced": bytes.NewReader(stream.Bytes()),
+			"split":     iotest.OneByteReader(bytes.NewReader(stream.Bytes())),
+		} {
+			r := NewReader(src, typed)
+			buf := make([]byte, 2048)
+			for i, p := range packets {
+				typ, n, err := r.ReadFrame(buf)
+				require.NoError(t, err, name)
+				require.Equal(t, p, buf[:n], name)
+				if typed {
+					require.Equal(t, Type(i), typ, name)
+				} else {
+					require.Equal(t, TypePacket, typ, name)
+				}
+			}
+			_, _, err := r.ReadFrame(buf)
+			require.ErrorIs(t, err, io.EOF, name)
+		}
+	}
+}
+
+func TestReader_Errors(t *testing.T) {
+	var stream bytes.Buffer
+	w := NewWriter(&stream, false)
+	require.NoError(t, w.WriteFrame(TypePacket, make([]byte, 100)))
+	require.NoError(t, w.WriteFrame(TypePacket, []byte("next")))
+	require.ErrorIs(t, w.WriteFrame(TypePacket, make([]byte, MaxSize+1)), ErrTooLarge)
+
+	// Too large frame is skipped.
+	r := NewReader(bytes.NewReader(stream.Bytes()), false)
+	buf := make([]byte, 10)
+	_, _, err := r.ReadFrame(buf)
+	require.ErrorIs(t, err, ErrTooLarge)
+	_, n, err := r.ReadFrame(buf)
+	require.NoError(t, err)
+	require.Equal(t, "next", string(buf[:n]))
+
+	// Truncated in the header, payload and while skipping.
+	for _, l := range []int{1, 50} {
+		r = NewReader(bytes.NewReader(stream.Bytes()[:l]), false)
+		_, _, err = r.ReadFrame(make([]byte, 200))
+		require.ErrorIs(t, err, io.ErrUnexpectedEOF, l)
+		r = NewReader(bytes.NewReader(stream.Bytes()[:l]), false)
+		_, _, err = r.ReadFrame(buf)
+		require.ErrorIs(t, err, io.ErrUnexpectedEOF, l)
+	}
+}
+
+func TestReader_Allocs(t *testing.T) {
+	var stream bytes.Buffer
+	w := NewWriter(&stream, true)
+	packet := make([]byte, 1400)
+	const frames = 1000
+	for range frames {
+		require.NoError(t, w.WriteFrame(TypePacket, packet))
+	}
+
+	r := NewReader(bytes.NewReader(stream.Bytes()), true)
+	buf := make([]byte, 1500)
+	allocs := testing.AllocsPerRun(frames-1, func() {
+		_, _, err := r.ReadFrame(buf)
+		require.NoError(t, err)
+	})
+	require.Zero(t, allocs)
+}
+
+func TestConn(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		conn := NewConn(c)
+		buf := make([]byte, MaxSize)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			if _, err = conn.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	conn := NewConn(c)
+	defer conn.Close()
+
+	// Packets written back to back are read one by one.
+	packets := [][]byte{[]byte("a"), bytes.Repeat([]byte("b"), 1500), bytes.Repeat([]byte("c"), MaxSize)}
+	for _, p := range packets {
+		n, err := conn.Write(p)
+		require.NoError(t, err)
+		require.Equal(t, len(p), n)
+	}
+	buf := make([]byte, MaxSize)
+	for _, p := range packets {
+		n, err := conn.Read(buf)
+		require.NoError(t, err)
+		require.Equal(t, p, buf[:n])
+	}
+}
+
+func FuzzReader(f *testing.F) {
+	f.Add([]byte{0, 4, 't', 'e', 's', 't'}, false)
+	f.Add([]byte{0, 1, 7, 'x', 0, 0, 1}, true)
+	f.Add([]byte{0xff, 0xff, 1, 2, 3}, false)
+	f.Add([]byte{0}, true)
+
+	f.Fuzz(func(t *testing.T, stream []byte, typed bool) {
+		r := NewReader(bytes.NewReader(stream), typed)
+		buf := make([]byte, 1500)
+		head := 2
+		if typed {
+			head = 3
+		}
+
+		// Every frame is read or skipped within the stream, the reader stops at its end.
+		read := 0
+		for {
+			_, n, err := r.ReadFrame(buf)
+			if err == io.EOF {
+				require.Equal(t, len(stream), read)
+				return
+			}
+			if err == io.ErrUnexpectedEOF {
+				require.Less(t, len(stream)-read, head+MaxSize)
+				return
+			}
+			size := int(binary.BigEndian.Uint16(stream[read:]))
+			if err != nil {
+				require.ErrorIs(t, err, ErrTooLarge)
+				require.Greater(t, size, len(buf))
+			} else {
+				require.Equal(t, size, n)
+				require.Equal(t, stream[read+head:read+head+n], buf[:n])
+			}
+			read += head + size
+		}
+	})
+}
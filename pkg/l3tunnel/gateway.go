@@ -0,0 +1,727 @@
+package l3tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/goxray/tun/pkg/l3tunnel/frame"
+	"github.com/goxray/tun/pkg/l3tunnel/vless"
+)
+
+const (
+	// defaultGatewayListen is the address the gateway server listens on.
+	defaultGatewayListen = ":8080"
+	// defaultGatewayTUNName is the name of the gateway TUN device.
+	defaultGatewayTUNName = "tun-gw"
+	// defaultGatewayTUNAddress is the gateway address of the tunnel network, clients use other addresses of it.
+	defaultGatewayTUNAddress = "10.50.0.1/24"
+	// sessionQueueLen is the number of packets queued to a client, more are dropped until it catches up.
+	sessionQueueLen = 256
+	// defaultGatewayPacketBuffers is the number of packets queued to all clients at most if not configured.
+	defaultGatewayPacketBuffers = 4096
+	// shutdownTimeout limits graceful shutdown of the HTTP server.
+	shutdownTimeout = 5 * time.Second
+	// acceptRetryDelay is the pause after a failed accept of the stream listener (e.g. out of file descriptors).
+	acceptRetryDelay = 100 * time.Millisecond
+)
+
+// defaultGatewayRoutes cover the whole IPv4 space, they are more specific than the default route of the client
+// which is left untouched.
+var defaultGatewayRoutes = []string{"0.0.0.0/1", "128.0.0.0/1"}
+
+// GatewayConfig is the gateway server configuration, usually loaded from a JSON file with LoadGatewayConfig:
+//
+//	{
+//	  "listen": ":443",
+//	  "cert_file": "/etc/l3gateway/cert.pem",
+//	  "key_file": "/etc/l3gateway/key.pem",
+//	  "users": ["27848739-7e62-4138-9fd3-098a63964b6b"],
+//	  "dns": ["1.1.1.1"],
+//	  "wan_interface": "eth0"
+//	}
+type GatewayConfig struct {
+	// Listen is the address of the WebSocket server (default: :8080).
+	Listen string `json:"listen"`
+	// Path is the WebSocket path (default: /tun).
+	Path string `json:"path"`
+	// StreamListen is the address of the stream listener for clients with transport tcp (messages are framed
+	// by package frame), over TLS if enabled. Disabled if empty.
+	StreamListen string `json:"stream_listen"`
+	// CertFile and KeyFile enable TLS (wss:// and TLS of the stream listener).
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// Users are VLESS user IDs of the clients allowed to connect.
+	Users []string `json:"users"`
+	// TUNName is the name of the gateway TUN device (default: tun-gw).
+	TUNName string `json:"tun_name"`
+	// TUNAddress is the gateway address of the tunnel network in CIDR notation (default: 10.50.0.1/24),
+	// other addresses of the network are assigned to the clients.
+	TUNAddress string `json:"tun_address"`
+	// MTU of the TUN devices of the gateway and the clients (default: 1500).
+	MTU int `json:"mtu"`
+	// DNS servers pushed to the clients.
+	DNS []string `json:"dns"`
+	// Routes pushed to the clients, the networks they route to the tunnel (default: the whole IPv4 space).
+	Routes []string `json:"routes"`
+	// WANInterface is the interface the traffic of clients leaves through, NAT is applied on all interfaces if empty.
+	WANInterface string `json:"wan_interface"`
+	// DisableNAT leaves IP forwarding and NAT to the system configuration.
+	DisableNAT bool `json:"disable_nat"`
+	// BatchWindow is the longest batch window agreed with the clients asking for batching of packets
+	// (default: 2ms), BatchSize is the largest batch message in bytes (default: 16384).
+	BatchWindow Duration `json:"batch_window"`
+	BatchSize   int      `json:"batch_size"`
+	// DisableBatching refuses batching, packets are sent in separate messages.
+	DisableBatching bool `json:"disable_batching"`
+	// PacketBuffers is the number of packets read from the TUN device and queued to the clients at most
+	// (default: 4096), reading waits for the clients when they are all in use. Memory of the buffers
+	// is PacketBuffers × MTU. A client queues 256 packets at most, so a few stalled clients do not stop the others.
+	PacketBuffers int `json:"packet_buffers"`
+	// Keepalive is the interval of WebSocket pings of the clients (default: 15s). Clients of the stream listener
+	// are not pinged, the framing has no pings of the gateway: they must ping within DeadPeerTimeout themselves.
+	Keepalive Duration `json:"keepalive"`
+	// DeadPeerTimeout is the time without messages, pings and pongs from a client after which its session
+	// is closed (default: 45s), must be longer than Keepalive. A client not taking a message for 10s
+	// is disconnected too, so dead clients do not hold packet buffers.
+	DeadPeerTimeout Duration `json:"dead_peer_timeout"`
+	// Logger receives gateway logs (default: slog.Default()).
+	Logger *slog.Logger `json:"-"`
+}
+
+// LoadGatewayConfig reads JSON gateway config file.
+func LoadGatewayConfig(path string) (*GatewayConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("load config: %w", err)
+	}
+	defer f.Close()
+
+	return ParseGatewayConfig(f)
+}
+
+// ParseGatewayConfig parses JSON gateway config, unknown fields are rejected to catch typos.
+func ParseGatewayConfig(r io.Reader) (*GatewayConfig, error) {
+	var cfg GatewayConfig
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	return &cfg, nil
+}
+
+func (c *GatewayConfig) validate() error {
+	if c.Listen == "" {
+		c.Listen = defaultGatewayListen
+	}
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		return fmt.Errorf("invalid config: listen address %q must be [host]:port", c.Listen)
+	}
+	if c.StreamListen != "" {
+		if _, _, err := net.SplitHostPort(c.StreamListen); err != nil {
+			return fmt.Errorf("invalid config: stream listen address %q must be [host]:port", c.StreamListen)
+		}
+	}
+	if c.Path == "" {
+		c.Path = defaultPath
+	}
+	if !strings.HasPrefix(c.Path, "/") {
+		return fmt.Errorf("invalid config: path %q must start with /", c.Path)
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return fmt.Errorf("invalid config: TLS needs both certificate and key files")
+	}
+	if len(c.Users) == 0 {
+		return fmt.Errorf("invalid config: no users")
+	}
+	for _, u := range c.Users {
+		if _, err := vless.ParseUUID(u); err != nil {
+			return fmt.Errorf("invalid config: %w", err)
+		}
+	}
+	if c.TUNName == "" {
+		c.TUNName = defaultGatewayTUNName
+	}
+	if len(c.TUNName) > 15 {
+		return fmt.Errorf("invalid config: TUN name %q must be 1 to 15 characters", c.TUNName)
+	}
+	if c.TUNAddress == "" {
+		c.TUNAddress = defaultGatewayTUNAddress
+	}
+	if _, err := netip.ParsePrefix(c.TUNAddress); err != nil {
+		return fmt.Errorf("invalid config: TUN address: %w", err)
+	}
+	if c.MTU == 0 {
+		c.MTU = 1500
+	}
+	if c.MTU < 576 || c.MTU > 65535 {
+		return fmt.Errorf("invalid config: MTU %d is out of range [576, 65535]", c.MTU)
+	}
+	for _, dns := range c.DNS {
+		if _, err := netip.ParseAddr(dns); err != nil {
+			return fmt.Errorf("invalid config: DNS server: %w", err)
+		}
+	}
+	if len(c.Routes) == 0 {
+		c.Routes = defaultGatewayRoutes
+	}
+	for _, r := range c.Routes {
+		if _, err := netip.ParsePrefix(r); err != nil {
+			return fmt.Errorf("invalid config: route: %w", err)
+		}
+	}
+	if c.BatchWindow < 0 || c.BatchSize < 0 {
+		return fmt.Errorf("invalid config: negative batch window %s or size %d", c.BatchWindow, c.BatchSize)
+	}
+	if c.BatchWindow == 0 {
+		c.BatchWindow = Duration(defaultGatewayBatchWindow)
+	}
+	if c.BatchSize == 0 {
+		c.BatchSize = defaultBatchSize
+	}
+	if c.StreamListen != "" && c.BatchSize > frame.MaxSize {
+		return fmt.Errorf("invalid config: batch size %d exceeds frame size %d of the stream listener", c.BatchSize, frame.MaxSize)
+	}
+	if c.PacketBuffers == 0 {
+		c.PacketBuffers = defaultGatewayPacketBuffers
+	}
+	if c.PacketBuffers < sessionQueueLen {
+		return fmt.Errorf("invalid config: packet buffers %d must be at least %d", c.PacketBuffers, sessionQueueLen)
+	}
+	if c.Keepalive == 0 {
+		c.Keepalive = Duration(defaultKeepalive)
+	}
+	if c.DeadPeerTimeout == 0 {
+		c.DeadPeerTimeout = Duration(defaultDeadPeerTimeout)
+	}
+	if c.Keepalive < 0 {
+		return fmt.Errorf("invalid config: negative keepalive %s", c.Keepalive)
+	}
+	if c.DeadPeerTimeout <= c.Keepalive {
+		return fmt.Errorf("invalid config: dead peer timeout %s must be longer than keepalive %s", c.DeadPeerTimeout, c.Keepalive)
+	}
+	if c.Logger == nil {
+		c.Logger = slog.Default()
+	}
+
+	return nil
+}
+
+// Gateway is the server end of the L3 tunnel. Clients connect over WebSocket or the stream listener and authenticate with VLESS request,
+// every client is assigned an address of the tunnel network and pushed the tunnel configuration (see controlVersion).
+// Packets of the clients are written to the gateway TUN device and packets read from it are sent to the client
+// the destination address is assigned to.
+type Gateway struct {
+	cfg    GatewayConfig
+	log    *slog.Logger
+	users  map[vless.UUID]struct{}
+	prefix netip.Prefix // Tunnel network.
+	gwAddr netip.Addr   // Gateway address in the tunnel network.
+	dev    io.ReadWriter
+	pool   *packetPool // Buffers of packets to the clients.
+
+	mu       sync.Mutex
+	sessions map[*session]struct{}
+	routes   map[netip.Addr]*session // Assigned client addresses.
+}
+
+// session is a connected client.
+type session struct {
+	conn  msgConn
+	user  vless.UUID
+	addr  netip.Addr   // Assigned address.
+	out   chan []byte  // Packets to the client.
+	batch *batchParams // Agreed batching, nil if packets are sent in separate messages.
+	done  chan struct{}
+}
+
+// NewGateway validates the config and creates Gateway, nothing is set up until Run.
+func NewGateway(cfg GatewayConfig) (*Gateway, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	users := make(map[vless.UUID]struct{}, len(cfg.Users))
+	for _, u := range cfg.Users {
+		id, _ := vless.ParseUUID(u) // Validated above.
+		users[id] = struct{}{}
+	}
+	addr, _ := netip.ParsePrefix(cfg.TUNAddress)
+
+	return &Gateway{
+		cfg:      cfg,
+		log:      cfg.Logger,
+		users:    users,
+		prefix:   addr.Masked(),
+		gwAddr:   addr.Addr(),
+		pool:     newPacketPool(cfg.PacketBuffers, cfg.MTU),
+		sessions: make(map[*session]struct{}),
+		routes:   make(map[netip.Addr]*session),
+	}, nil
+}
+
+// Run sets up the TUN device, IP forwarding and NAT, and serves clients until ctx is done.
+// NAT rules are removed and the TUN device is closed on return.
+func (g *Gateway) Run(ctx context.Context) error {
+	dev, err := openGatewayTUN(g.cfg.TUNName, g.cfg.TUNAddress, g.cfg.MTU)
+	if err != nil {
+		return fmt.Errorf("setup TUN device: %w", err)
+	}
+	defer dev.Close()
+
+	if !g.cfg.DisableNAT {
+		cleanup, err := setupNAT(g.cfg.TUNName, g.prefix, g.cfg.WANInterface)
+		if err != nil {
+			return fmt.Errorf("setup NAT: %w", err)
+		}
+		defer cleanup()
+	}
+
+	ln, err := net.Listen("tcp", g.cfg.Listen)
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+	var streamLn net.Listener
+	if g.cfg.StreamListen != "" {
+		if streamLn, err = g.listenStream(); err != nil {
+			_ = ln.Close()
+			return fmt.Errorf("listen stream: %w", err)
+		}
+	}
+	g.log.Info("L3 gateway active", "listen", ln.Addr(), "path", g.cfg.Path, "stream_listen", g.cfg.StreamListen,
+		"tun", g.cfg.TUNName, "address", g.cfg.TUNAddress, "tls", g.cfg.CertFile != "")
+
+	return g.serve(ctx, ln, streamLn, dev)
+}
+
+// listenStream opens the stream listener, with TLS if enabled.
+func (g *Gateway) listenStream() (net.Listener, error) {
+	var cert tls.Certificate
+	if g.cfg.CertFile != "" {
+		var err error
+		if cert, err = tls.LoadX509KeyPair(g.cfg.CertFile, g.cfg.KeyFile); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("tcp", g.cfg.StreamListen)
+	if err != nil {
+		return nil, err
+	}
+	if g.cfg.CertFile != "" {
+		ln = tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}})
+	}
+
+	return ln, nil
+}
+
+// serve serves clients on ln and on the stream listener streamLn (if not nil), and routes packets of dev to them
+// until ctx is done.
+func (g *Gateway) serve(ctx context.Context, ln, streamLn net.Listener, dev io.ReadWriter) error {
+	g.dev = dev
+	mux := http.NewServeMux()
+	mux.Handle(g.cfg.Path, g)
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: handshakeTimeout}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go g.routeToClients(ctx, dev)
+	if streamLn != nil {
+		defer streamLn.Close()
+		go g.serveStream(streamLn)
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+		g.closeSessions() // Hijacked connections are not closed by Shutdown.
+	}()
+
+	var err error
+	if g.cfg.CertFile != "" {
+		err = srv.ServeTLS(ln, g.cfg.CertFile, g.cfg.KeyFile)
+	} else {
+		err = srv.Serve(ln)
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+
+	return err
+}
+
+// serveStream serves clients connecting to the stream listener ln until it is closed.
+func (g *Gateway) serveStream(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			g.log.Warn("stream accept failed", "err", err)
+			time.Sleep(acceptRetryDelay)
+			continue
+		}
+		go g.serveClient(newStreamConn(conn, false), conn.RemoteAddr().String(), nil)
+	}
+}
+
+// ServeHTTP accepts the WebSocket connection of a client and forwards its packets to the TUN device
+// until the connection is closed.
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// VLESS request header may come as early data in Sec-WebSocket-Protocol header, which is echoed as XRay does.
+	var early []byte
+	var header http.Header
+	if proto := r.Header.Get("Sec-WebSocket-Protocol"); proto != "" {
+		var err error
+		if early, err = base64.RawURLEncoding.DecodeString(proto); err != nil {
+			http.Error(w, "invalid early data", http.StatusBadRequest)
+			return
+		}
+		header = http.Header{"Sec-Websocket-Protocol": {proto}}
+	}
+	upgrader := websocket.Upgrader{HandshakeTimeout: handshakeTimeout}
+	conn, err := upgrader.Upgrade(w, r, header)
+	if err != nil {
+		return // Upgrader replied with the error.
+	}
+	// Frames are read and written by wsConn, gorilla/websocket made the handshake only. The upgrade fails
+	// if the client sent frames before the handshake completed, so nothing is left buffered by it.
+	g.serveClient(newWSConn(conn.NetConn(), nil, false), r.RemoteAddr, early)
+}
+
+// serveClient makes the session handshake with the client connected from remote and forwards its packets
+// to the TUN device until the connection is closed. early is VLESS request header if it came with the connection.
+func (g *Gateway) serveClient(conn msgConn, remote string, early []byte) {
+	defer conn.Close()
+	log := g.log.With("remote", remote)
+	conn.SetWriteTimeout(writeTimeout)
+
+	s, err := g.accept(conn, early)
+	if err != nil {
+		log.Warn("client rejected", "err", err)
+		return
+	}
+	defer g.removeSession(s)
+	log = log.With("user", s.user, "address", s.addr)
+	log.Info("client connected", "batch", s.batch != nil)
+	defer log.Info("client disconnected")
+	// Any frame of the client keeps the session alive: messages, its pings and pongs of the keepalive pings.
+	conn.SetIdleTimeout(time.Duration(g.cfg.DeadPeerTimeout))
+	go g.writeLoop(s)
+	go g.keepalive(s)
+
+	write := func(packet []byte) error {
+		if src, ok := srcAddr(packet); !ok || src != s.addr {
+			log.Debug("packet dropped: source is not the client address", "src", src)
+			return nil
+		}
+		_, err := g.dev.Write(packet)
+		return err
+	}
+	// Messages are read into a buffer of the session, a batch may be larger than a packet.
+	var batchSize int
+	if s.batch != nil {
+		batchSize = s.batch.Size
+	}
+	buf := make([]byte, receiveBufferSize(g.cfg.MTU, batchSize))
+	var netErr net.Error
+	for {
+		n, err := conn.ReadMessage(buf)
+		if errors.Is(err, errMessageTooLarge) {
+			log.Debug("message dropped", "err", err)
+			continue
+		}
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			log.Warn("client is not responding", "timeout", g.cfg.DeadPeerTimeout)
+			return
+		}
+		if err != nil {
+			return
+		}
+		if s.batch != nil {
+			err = splitBatch(buf[:n], write)
+		} else {
+			err = write(buf[:n])
+		}
+		if errors.Is(err, errBatch) {
+			log.Warn("invalid batch", "err", err)
+			return
+		}
+		if err != nil {
+			log.Warn("TUN write failed", "err", err)
+			return
+		}
+	}
+}
+
+// accept makes the session handshake: reads VLESS request (unless it came as early data) and clientHello,
+// checks the user and the tunnel destination, assigns the client address and replies with VLESS response header
+// and serverHello. The session is registered on success.
+func (g *Gateway) accept(conn msgConn, early []byte) (*session, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	buf := make([]byte, maxControlSize)
+	msg := early
+	if msg == nil {
+		n, err := conn.ReadMessage(buf)
+		if err != nil {
+			return nil, fmt.Errorf("read VLESS request: %w", err)
+		}
+		msg = buf[:n]
+	}
+
+	r := bytes.NewReader(msg)
+	req, err := vless.ReadRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := g.users[req.UUID]; !ok {
+		return nil, fmt.Errorf("unknown user %s", req.UUID)
+	}
+	if req.Command != vless.CommandTCP || req.Address != tunnelAddress || req.Port != tunnelPort {
+		return nil, fmt.Errorf("not a tunnel request: %s %s:%d", req.Command, req.Address, req.Port)
+	}
+	if r.Len() > 0 {
+		return nil, fmt.Errorf("unexpected data after VLESS request")
+	}
+
+	n, err := conn.ReadMessage(buf)
+	if err != nil {
+		return nil, fmt.Errorf("read hello: %w", err)
+	}
+	var hello clientHello
+	if err = json.Unmarshal(buf[:n], &hello); err != nil {
+		return nil, fmt.Errorf("invalid hello: %w", err)
+	}
+	resp, _ := (&vless.Response{}).MarshalBinary()
+	if err = conn.WriteMessage(resp); err != nil {
+		return nil, fmt.Errorf("send VLESS response: %w", err)
+	}
+	refuse := func(err error) (*session, error) {
+		_ = writeControl(conn, serverHello{Version: controlVersion, Error: err.Error()})
+		return nil, err
+	}
+	if hello.Version < controlVersion {
+		return refuse(fmt.Errorf("unsupported control version %d", hello.Version))
+	}
+
+	s := &session{conn: conn, user: req.UUID, out: make(chan []byte, sessionQueueLen), done: make(chan struct{})}
+	if !g.cfg.DisableBatching {
+		s.batch = hello.Batch.agree(&batchParams{Window: g.cfg.BatchWindow, Size: g.cfg.BatchSize})
+	}
+	if err = g.addSession(s, hello.Address); err != nil {
+		return refuse(err)
+	}
+	cfg := &tunnelConfig{
+		Address: netip.PrefixFrom(s.addr, g.prefix.Bits()).String(),
+		MTU:     g.cfg.MTU,
+		DNS:     g.cfg.DNS,
+		Routes:  g.cfg.Routes,
+	}
+	if err = writeControl(conn, serverHello{Version: controlVersion, Config: cfg, Batch: s.batch}); err != nil {
+		g.removeSession(s)
+		return nil, fmt.Errorf("send hello: %w", err)
+	}
+
+	return s, nil
+}
+
+// addSession registers s with a free address of the tunnel network, the requested one if possible.
+// The requested address of another session of the same user is taken over, that session is closed
+// (the client reconnected before the old connection was found dead).
+func (g *Gateway) addSession(s *session, requested string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if p, err := netip.ParsePrefix(requested); err == nil && g.assignable(p.Addr()) {
+		switch old := g.routes[p.Addr()]; {
+		case old == nil:
+			s.addr = p.Addr()
+		case old.user == s.user:
+			_ = old.conn.Close()
+			s.addr = p.Addr()
+		}
+	}
+	for a := g.prefix.Addr(); !s.addr.IsValid() && g.prefix.Contains(a); a = a.Next() {
+		if g.assignable(a) && g.routes[a] == nil {
+			s.addr = a
+		}
+	}
+	if !s.addr.IsValid() {
+		return fmt.Errorf("no free address in %s", g.prefix)
+	}
+	g.routes[s.addr] = s
+	g.sessions[s] = struct{}{}
+
+	return nil
+}
+
+// assignable reports whether addr can be assigned to a client: it is in the tunnel network and is not
+// the network, gateway or broadcast address.
+func (g *Gateway) assignable(addr netip.Addr) bool {
+	return g.prefix.Contains(addr) && addr != g.prefix.Addr() && addr != g.gwAddr && g.prefix.Contains(addr.Next())
+}
+
+// removeSession stops s and releases its address.
+func (g *Gateway) removeSession(s *session) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.sessions, s)
+	if g.routes[s.addr] == s {
+		delete(g.routes, s.addr)
+	}
+	close(s.done)
+}
+
+// closeSessions closes connections of all clients.
+func (g *Gateway) closeSessions() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for s := range g.sessions {
+		_ = s.conn.Close()
+	}
+}
+
+// routeToClients sends packets read from dev to the clients owning their destination addresses,
+// packets to unknown addresses are dropped. Packets are read into buffers of the pool, reading waits
+// while all of them are queued to the clients.
+func (g *Gateway) routeToClients(ctx context.Context, dev io.Reader) {
+	for {
+		buf := g.pool.get(ctx.Done())
+		if buf == nil {
+			return
+		}
+		n, err := dev.Read(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				g.log.Error("TUN read failed", "err", err)
+			}
+			return
+		}
+		if !g.queue(buf[:n]) {
+			g.pool.put(buf)
+		}
+	}
+}
+
+// queue queues packet to the client owning its destination address, reported is whether it is queued.
+func (g *Gateway) queue(packet []byte) bool {
+	dst, ok := dstAddr(packet)
+	if !ok {
+		return false
+	}
+	// Queued under the lock, so no packet is queued to a removed session after writeLoop released its queue.
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	s := g.routes[dst]
+	if s == nil {
+		return false
+	}
+	select {
+	case s.out <- packet:
+		return true
+	default: // The client is too slow, the packet is dropped as by a full interface queue.
+		return false
+	}
+}
+
+// writeLoop sends queued packets to the client until the session is removed, buffers of the packets are
+// returned to the pool.
+func (g *Gateway) writeLoop(s *session) {
+	defer func() {
+		<-s.done
+		for {
+			select {
+			case packet := <-s.out:
+				g.pool.put(packet)
+			default:
+				return
+			}
+		}
+	}()
+
+	if s.batch != nil {
+		w := newBatchWriter(*s.batch, s.conn.WriteMessage)
+		if err := w.run(s.done, s.out, g.pool.put); err != nil {
+			_ = s.conn.Close() // Stops the read loop of the session.
+		}
+		return
+	}
+	for {
+		select {
+		case <-s.done:
+			return
+		case packet := <-s.out:
+			err := s.conn.WriteMessage(packet)
+			g.pool.put(packet)
+			if err != nil {
+				_ = s.conn.Close() // Stops the read loop of the session.
+				return
+			}
+		}
+	}
+}
+
+// keepalive pings the client every Keepalive interval until the session is removed, the connection is closed
+// if sending fails. Pongs keep the session of a client which does not ping alive.
+func (g *Gateway) keepalive(s *session) {
+	ticker := time.NewTicker(time.Duration(g.cfg.Keepalive))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		if err := s.conn.WritePing(nil); err != nil {
+			_ = s.conn.Close() // Stops the read loop of the session.
+			return
+		}
+	}
+}
+
+// srcAddr returns the source address of IPv4 or IPv6 packet.
+func srcAddr(packet []byte) (netip.Addr, bool) {
+	return packetAddr(packet, 12, 8)
+}
+
+// dstAddr returns the destination address of IPv4 or IPv6 packet.
+func dstAddr(packet []byte) (netip.Addr, bool) {
+	return packetAddr(packet, 16, 24)
+}
+
+// packetAddr returns the address at offset v4 of IPv4 or at offset v6 of IPv6 packet header.
+func packetAddr(packet []byte, v4, v6 int) (netip.Addr, bool) {
+	if len(packet) == 0 {
+		return netip.Addr{}, false
+	}
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) >= 20 {
+			return netip.AddrFrom4([4]byte(packet[v4 : v4+4])), true
+		}
+	case 6:
+		if len(packet) >= 40 {
+			return netip.AddrFrom16([16]byte(packet[v6 : v6+16])), true
+		}
+	}
+
+	return netip.Addr{}, false
+}
@@ -0,0 +1,94 @@
+package l3tunnel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+
+	"github.com/goxray/core/network/tun"
+	"github.com/vishvananda/netlink"
+)
+
+// openGatewayTUN creates the gateway TUN device with the address, the tunnel network is routed to it.
+func openGatewayTUN(name, addr string, mtu int) (*tun.Interface, error) {
+	ip, ipNet, err := net.ParseCIDR(addr)
+	if err != nil {
+		return nil, err
+	}
+	dev, err := tun.New(name, mtu)
+	if err != nil {
+		return nil, err
+	}
+	if err = upGatewayTUN(name, &net.IPNet{IP: ip, Mask: ipNet.Mask}, mtu); err != nil {
+		_ = dev.Close()
+		return nil, err
+	}
+
+	return dev, nil
+}
+
+func upGatewayTUN(name string, addr *net.IPNet, mtu int) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	if err = netlink.LinkSetMTU(link, mtu); err != nil {
+		return fmt.Errorf("set MTU: %w", err)
+	}
+	if err = netlink.AddrReplace(link, &netlink.Addr{IPNet: addr}); err != nil {
+		return fmt.Errorf("set address: %w", err)
+	}
+	if err = netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("set up: %w", err)
+	}
+
+	return nil
+}
+
+// setupNAT enables IPv4 forwarding and masquerades the tunnel network behind the WAN interface (all if empty).
+// Returned function removes the rules, forwarding is left enabled.
+func setupNAT(tunName string, network netip.Prefix, wan string) (func(), error) {
+	if err := os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0); err != nil {
+		return nil, fmt.Errorf("enable IP forwarding: %w", err)
+	}
+
+	masquerade := []string{"-t", "nat", "POSTROUTING", "-s", network.String()}
+	if wan != "" {
+		masquerade = append(masquerade, "-o", wan)
+	}
+	rules := [][]string{
+		append(masquerade, "-j", "MASQUERADE"),
+		{"-t", "filter", "FORWARD", "-i", tunName, "-j", "ACCEPT"},
+		{"-t", "filter", "FORWARD", "-o", tunName, "-m", "state", "--state", "RELATED,ESTABLISHED", "-j", "ACCEPT"},
+	}
+
+	var added [][]string
+	cleanup := func() {
+		for _, r := range added {
+			_ = iptables("-D", r)
+		}
+	}
+	for _, r := range rules {
+		// Inserted first, so the rules take precedence over the DROP rules of a firewall.
+		if err := iptables("-I", r); err != nil {
+			cleanup()
+			return nil, err
+		}
+		added = append(added, r)
+	}
+
+	return cleanup, nil
+}
+
+// iptables runs the action (-I or -D) on the rule given as: -t table chain match...
+func iptables(action string, rule []string) error {
+	args := append([]string{rule[0], rule[1], action, rule[2]}, rule[3:]...)
+	if out, err := exec.Command("iptables", args...).CombinedOutput(); err != nil {
+		return errors.Join(fmt.Errorf("iptables %v: %s", args, out), err)
+	}
+
+	return nil
+}
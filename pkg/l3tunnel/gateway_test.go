@@ -0,0 +1,422 @@
+package l3tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+
+	"github.com/goxray/tun/pkg/l3tunnel/frame"
+	"github.com/goxray/tun/pkg/l3tunnel/vless"
+)
+
+const otherUUID = "5b2a8f0e-4f0c-4b63-9a57-08c0b5b7c3a1"
+
+func TestGateway(t *testing.T) {
+	gwDev := newTestDevice()
+	_, addr := startTestGateway(t, GatewayConfig{DNS: []string{"1.1.1.1"}}, gwDev)
+
+	// Clients are assigned addresses of the tunnel network in turn.
+	clients := make(map[string]*testTunnel)
+	for _, want := range []string{"10.50.0.2", "10.50.0.3"} {
+		tun, configs := startTestTunnel(t, Config{Server: addr, UUID: testUUID})
+		require.Equal(t, &tunnelConfig{
+			Address: want + "/24",
+			MTU:     1500,
+			DNS:     []string{"1.1.1.1"},
+			Routes:  []string{"0.0.0.0/1", "128.0.0.0/1"},
+		}, receive(t, configs))
+		clients[want] = tun
+	}
+
+	for src, tun := range clients {
+		packet := testPacket(src, "198.51.100.1", "request from "+src)
+		tun.dev.in <- packet
+		require.Equal(t, packet, receive(t, gwDev.out))
+	}
+	// Replies are routed to the clients by the assigned addresses.
+	for dst, tun := range clients {
+		packet := testPacket("198.51.100.1", dst, "reply to "+dst)
+		gwDev.in <- packet
+		require.Equal(t, packet, receive(t, tun.dev.out))
+	}
+}
+
+func TestGateway_Assign(t *testing.T) {
+	gw, addr := startTestGateway(t, GatewayConfig{}, newTestDevice())
+
+	// The requested address is assigned if free, the address is kept over reconnects and re-applied.
+	_, configs := startTestTunnel(t, Config{Server: addr, UUID: testUUID, TUNAddress: "10.50.0.100/24"})
+	require.Equal(t, "10.50.0.100/24", receive(t, configs).Address)
+	gw.closeSessions()
+	require.Equal(t, "10.50.0.100/24", receive(t, configs).Address)
+
+	// Address of another user is not taken over, the same user takes its address over from a stale session.
+	_, configs = startTestTunnel(t, Config{Server: addr, UUID: otherUUID, TUNAddress: "10.50.0.100/24"})
+	require.Equal(t, "10.50.0.2/24", receive(t, configs).Address)
+	stale := dialTestGateway(t, addr, testUUID, clientHello{Version: controlVersion, Address: "10.50.0.3/24"})
+	require.Equal(t, "10.50.0.3/24", readServerHello(t, stale).Config.Address)
+	_, configs = startTestTunnel(t, Config{Server: addr, UUID: testUUID, TUNAddress: "10.50.0.3/24"})
+	require.Equal(t, "10.50.0.3/24", receive(t, configs).Address)
+	_, _, err := stale.ReadMessage()
+	require.Error(t, err, "stale session is closed")
+
+	// Network and broadcast addresses are not assigned, nor the gateway one.
+	_, addr = startTestGateway(t, GatewayConfig{TUNAddress: "10.60.0.1/30"}, newTestDevice())
+	conn := dialTestGateway(t, addr, testUUID, clientHello{Version: controlVersion, Address: "10.60.0.3/30"})
+	require.Equal(t, "10.60.0.2/30", readServerHello(t, conn).Config.Address)
+	conn = dialTestGateway(t, addr, otherUUID, clientHello{Version: controlVersion})
+	require.Equal(t, serverHello{Version: controlVersion, Error: "no free address in 10.60.0.0/30"}, *readServerHello(t, conn))
+}
+
+func TestGateway_Reject(t *testing.T) {
+	gwDev := newTestDevice()
+	_, addr := startTestGateway(t, GatewayConfig{}, gwDev)
+	id, err := vless.ParseUUID(testUUID)
+	require.NoError(t, err)
+	unknown, err := vless.ParseUUID("unknown-user")
+	require.NoError(t, err)
+
+	for name, req := range map[string]vless.Request{
+		"unknown user": {UUID: unknown, Command: vless.CommandTCP, Address: tunnelAddress, Port: tunnelPort},
+		"destination":  {UUID: id, Command: vless.CommandTCP, Address: "example.com", Port: 443},
+		"command":      {UUID: id, Command: vless.CommandMux},
+	} {
+		t.Run(name, func(t *testing.T) {
+			conn := dialTestGatewayRequest(t, addr, req, clientHello{Version: controlVersion})
+			_, _, err := conn.ReadMessage()
+			require.Error(t, err, "connection is closed without response")
+		})
+	}
+
+	conn := dialTestGateway(t, addr, testUUID, clientHello{})
+	require.Equal(t, serverHello{Version: controlVersion, Error: "unsupported control version 0"}, *readServerHello(t, conn))
+
+	// Packets from addresses other than the assigned one are dropped.
+	conn = dialTestGateway(t, addr, testUUID, clientHello{Version: controlVersion})
+	require.Equal(t, "10.50.0.2/24", readServerHello(t, conn).Config.Address)
+	for _, p := range [][]byte{testPacket("192.0.2.1", "198.51.100.1", "spoofed"), testPacket("10.50.0.3", "198.51.100.1", "other client"), []byte("garbage")} {
+		require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, p))
+	}
+	packet := testPacket("10.50.0.2", "198.51.100.1", "valid")
+	require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, packet))
+	require.Equal(t, packet, receive(t, gwDev.out))
+}
+
+func TestGateway_EarlyData(t *testing.T) {
+	_, addr := startTestGateway(t, GatewayConfig{}, newTestDevice())
+	id, err := vless.ParseUUID(testUUID)
+	require.NoError(t, err)
+	req, err := (&vless.Request{UUID: id, Command: vless.CommandTCP, Address: tunnelAddress, Port: tunnelPort}).MarshalBinary()
+	require.NoError(t, err)
+
+	// VLESS request comes in Sec-WebSocket-Protocol header, the header is echoed.
+	proto := base64.RawURLEncoding.EncodeToString(req)
+	conn, resp, err := websocket.DefaultDialer.Dial("ws://"+addr+"/tun", http.Header{"Sec-WebSocket-Protocol": {proto}})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	require.Equal(t, proto, resp.Header.Get("Sec-WebSocket-Protocol"))
+	require.NoError(t, conn.WriteJSON(clientHello{Version: controlVersion}))
+	require.Equal(t, "10.50.0.2/24", readServerHello(t, conn).Config.Address)
+
+	_, resp, err = websocket.DefaultDialer.Dial("ws://"+addr+"/tun", http.Header{"Sec-WebSocket-Protocol": {"not base64!"}})
+	require.Error(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestGateway_Batch(t *testing.T) {
+	gwDev := newTestDevice()
+	_, addr := startTestGateway(t, GatewayConfig{BatchWindow: Duration(50 * time.Millisecond)}, gwDev)
+
+	// The lower parameters are agreed, both directions are batched.
+	conn := dialTestGateway(t, addr, testUUID, clientHello{
+		Version: controlVersion,
+		Batch:   &batchParams{Window: Duration(100 * time.Millisecond), Size: 1 << 20},
+	})
+	hello := readServerHello(t, conn)
+	require.Equal(t, &batchParams{Window: Duration(50 * time.Millisecond), Size: defaultBatchSize}, hello.Batch)
+	first, second := testPacket("10.50.0.2", "198.51.100.1", "first"), testPacket("10.50.0.2", "198.51.100.1", "second")
+	var batch []byte
+	for _, p := range [][]byte{first, second} {
+		batch = append(binary.BigEndian.AppendUint16(batch, uint16(len(p))), p...)
+	}
+	require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, batch))
+	require.Equal(t, first, receive(t, gwDev.out))
+	require.Equal(t, second, receive(t, gwDev.out))
+	first, second = testPacket("198.51.100.1", "10.50.0.2", "first"), testPacket("198.51.100.1", "10.50.0.2", "second")
+	gwDev.in <- first
+	gwDev.in <- second
+	_, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	var packets [][]byte
+	require.NoError(t, splitBatch(msg, func(p []byte) error {
+		packets = append(packets, p)
+		return nil
+	}))
+	require.Equal(t, [][]byte{first, second}, packets)
+
+	// Not batched if the client does not ask for it or the gateway refuses it.
+	conn = dialTestGateway(t, addr, otherUUID, clientHello{Version: controlVersion})
+	require.Nil(t, readServerHello(t, conn).Batch)
+	_, addr = startTestGateway(t, GatewayConfig{DisableBatching: true}, newTestDevice())
+	conn = dialTestGateway(t, addr, testUUID, clientHello{Version: controlVersion, Batch: &batchParams{Window: Duration(time.Millisecond), Size: 1500}})
+	require.Nil(t, readServerHello(t, conn).Batch)
+}
+
+func TestGateway_Stream(t *testing.T) {
+	gwDev := newTestDevice()
+	_, _, addr := startTestGatewayStream(t, GatewayConfig{}, gwDev, nil)
+
+	// A plain client frames messages with frame.Conn: VLESS request, hello, then packets and empty pings.
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	conn := frame.NewConn(c)
+	t.Cleanup(func() { _ = conn.Close() })
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	id, err := vless.ParseUUID(testUUID)
+	require.NoError(t, err)
+	req, err := (&vless.Request{UUID: id, Command: vless.CommandTCP, Address: tunnelAddress, Port: tunnelPort}).MarshalBinary()
+	require.NoError(t, err)
+	_, err = conn.Write(req)
+	require.NoError(t, err)
+	_, err = conn.Write([]byte(`{"version": 1, "address": "10.50.0.9/24"}`))
+	require.NoError(t, err)
+
+	buf := make([]byte, 2048)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0, 0}, buf[:n])
+	n, err = conn.Read(buf)
+	require.NoError(t, err)
+	var hello serverHello
+	require.NoError(t, json.Unmarshal(buf[:n], &hello))
+	require.Equal(t, "10.50.0.9/24", hello.Config.Address)
+
+	// Packets keep their boundaries, an empty frame is answered with an empty one.
+	packets := [][]byte{testPacket("10.50.0.9", "198.51.100.1", "first"), testPacket("10.50.0.9", "198.51.100.1", "second")}
+	for _, p := range packets {
+		_, err = conn.Write(p)
+		require.NoError(t, err)
+	}
+	for _, p := range packets {
+		require.Equal(t, p, receive(t, gwDev.out))
+	}
+	_, err = conn.Write(nil)
+	require.NoError(t, err)
+	n, err = conn.Read(buf)
+	require.NoError(t, err)
+	require.Zero(t, n)
+	packet := testPacket("198.51.100.1", "10.50.0.9", "reply")
+	gwDev.in <- packet
+	n, err = conn.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, packet, buf[:n])
+}
+
+func TestGateway_DeadPeer(t *testing.T) {
+	gwDev := newTestDevice()
+	cfg := GatewayConfig{Keepalive: Duration(20 * time.Millisecond), DeadPeerTimeout: Duration(100 * time.Millisecond)}
+	gw, addr := startTestGateway(t, cfg, gwDev)
+
+	// The alive client answers pings while reading, the dead one sends and reads nothing after the handshake.
+	alive := dialTestGateway(t, addr, testUUID, clientHello{Version: controlVersion, Address: "10.50.0.2/24"})
+	require.Equal(t, "10.50.0.2/24", readServerHello(t, alive).Config.Address)
+	dead := dialTestGateway(t, addr, otherUUID, clientHello{Version: controlVersion, Address: "10.50.0.3/24"})
+	require.Equal(t, "10.50.0.3/24", readServerHello(t, dead).Config.Address)
+	received := make(chan []byte, 1)
+	go func() {
+		for {
+			_, msg, err := alive.ReadMessage()
+			if err != nil {
+				return
+			}
+			received <- msg
+		}
+	}()
+	for range 10 {
+		gwDev.in <- testPacket("198.51.100.1", "10.50.0.3", "to the dead client")
+	}
+
+	// The dead session is closed and its queued packets are returned to the pool (routeToClients holds one buffer).
+	require.Eventually(t, func() bool {
+		gw.mu.Lock()
+		defer gw.mu.Unlock()
+		return len(gw.sessions) == 1 && len(gw.pool.free)+len(gw.pool.tokens) == gw.cfg.PacketBuffers-1
+	}, 5*time.Second, 10*time.Millisecond)
+	var err error
+	for err == nil {
+		_, _, err = dead.ReadMessage() // Packets written before the session was closed come first.
+	}
+	require.NotErrorIs(t, err, os.ErrDeadlineExceeded, "dead session is closed")
+	packet := testPacket("198.51.100.1", "10.50.0.2", "to the alive client")
+	gwDev.in <- packet
+	require.Equal(t, packet, receive(t, received))
+}
+
+func TestGatewayConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "l3gateway.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"listen": ":443", "users": ["user"], "wan_interface": "eth0"}`), 0o600))
+	cfg, err := LoadGatewayConfig(path)
+	require.NoError(t, err)
+	gw, err := NewGateway(*cfg)
+	require.NoError(t, err)
+	require.Equal(t, "/tun", gw.cfg.Path)
+	require.Equal(t, "tun-gw", gw.cfg.TUNName)
+	require.Equal(t, 1500, gw.cfg.MTU)
+	require.Equal(t, Duration(2*time.Millisecond), gw.cfg.BatchWindow)
+	require.Equal(t, Duration(15*time.Second), gw.cfg.Keepalive)
+	require.Equal(t, Duration(45*time.Second), gw.cfg.DeadPeerTimeout)
+	require.Equal(t, netip.MustParsePrefix("10.50.0.0/24"), gw.prefix)
+	require.Equal(t, netip.MustParseAddr("10.50.0.1"), gw.gwAddr)
+
+	_, err = ParseGatewayConfig(strings.NewReader(`{"user": ["user"]}`))
+	require.ErrorContains(t, err, `unknown field "user"`)
+
+	for name, tc := range map[string]struct {
+		cfg GatewayConfig
+		err string
+	}{
+		"no users":  {GatewayConfig{}, "no users"},
+		"user":      {GatewayConfig{Users: []string{""}}, `invalid UUID ""`},
+		"listen":    {GatewayConfig{Listen: "443", Users: []string{testUUID}}, `listen address "443"`},
+		"path":      {GatewayConfig{Path: "tun", Users: []string{testUUID}}, `path "tun" must start with /`},
+		"tls":       {GatewayConfig{CertFile: "cert.pem", Users: []string{testUUID}}, "both certificate and key"},
+		"address":   {GatewayConfig{TUNAddress: "10.50.0.1", Users: []string{testUUID}}, "TUN address"},
+		"mtu":       {GatewayConfig{MTU: 70000, Users: []string{testUUID}}, "MTU 70000 is out of range"},
+		"tun name":  {GatewayConfig{TUNName: "tun-with-a-long-name", Users: []string{testUUID}}, "1 to 15 characters"},
+		"dns":       {GatewayConfig{DNS: []string{"dns.google"}, Users: []string{testUUID}}, "DNS server"},
+		"route":     {GatewayConfig{Routes: []string{"10.0.0.0"}, Users: []string{testUUID}}, "route"},
+		"batch":     {GatewayConfig{BatchSize: -1, Users: []string{testUUID}}, "negative batch window 0s or size -1"},
+		"stream":    {GatewayConfig{StreamListen: "443", Users: []string{testUUID}}, `stream listen address "443"`},
+		"frame":     {GatewayConfig{StreamListen: ":443", BatchSize: 1 << 20, Users: []string{testUUID}}, "batch size 1048576 exceeds frame size"},
+		"buffers":   {GatewayConfig{PacketBuffers: 100, Users: []string{testUUID}}, "packet buffers 100 must be at least 256"},
+		"keepalive": {GatewayConfig{Keepalive: Duration(-time.Second), Users: []string{testUUID}}, "negative keepalive -1s"},
+		"dead peer": {GatewayConfig{DeadPeerTimeout: Duration(time.Second), Users: []string{testUUID}}, "dead peer timeout 1s must be longer than keepalive 15s"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewGateway(tc.cfg)
+			require.ErrorContains(t, err, tc.err)
+		})
+	}
+}
+
+// startTestGateway serves the gateway with dev as the TUN device on loopback, returned is its address.
+// Both test users are allowed.
+func startTestGateway(t *testing.T, cfg GatewayConfig, dev *testDevice) (*Gateway, string) {
+	t.Helper()
+
+	gw, addr, _ := startTestGatewayStream(t, cfg, dev, nil)
+
+	return gw, addr
+}
+
+// startTestGatewayStream is startTestGateway with the stream listener, over TLS if tlsCfg is not nil.
+// Returned are the addresses of the WebSocket server and the stream listener.
+func startTestGatewayStream(t *testing.T, cfg GatewayConfig, dev *testDevice, tlsCfg *tls.Config) (*Gateway, string, string) {
+	t.Helper()
+
+	cfg.Users, cfg.Logger = []string{testUUID, otherUUID}, testLogger()
+	gw, err := NewGateway(cfg)
+	require.NoError(t, err)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	streamLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	if tlsCfg != nil {
+		streamLn = tls.NewListener(streamLn, tlsCfg)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = gw.serve(ctx, ln, streamLn, dev)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	return gw, ln.Addr().String(), streamLn.Addr().String()
+}
+
+// dialTestGateway connects to the gateway as the user and sends the tunnel request and hello.
+func dialTestGateway(t *testing.T, addr, user string, hello clientHello) *websocket.Conn {
+	t.Helper()
+
+	id, err := vless.ParseUUID(user)
+	require.NoError(t, err)
+
+	return dialTestGatewayRequest(t, addr, vless.Request{UUID: id, Command: vless.CommandTCP, Address: tunnelAddress, Port: tunnelPort}, hello)
+}
+
+// dialTestGatewayRequest connects to the gateway and sends VLESS request and hello.
+func dialTestGatewayRequest(t *testing.T, addr string, req vless.Request, hello clientHello) *websocket.Conn {
+	t.Helper()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/tun", nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	b, err := req.MarshalBinary()
+	require.NoError(t, err)
+	require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, b))
+	require.NoError(t, conn.WriteJSON(hello))
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+	return conn
+}
+
+// readServerHello reads VLESS response header and serverHello of the gateway.
+func readServerHello(t *testing.T, conn *websocket.Conn) *serverHello {
+	t.Helper()
+
+	_, resp, err := conn.ReadMessage()
+	require.NoError(t, err)
+	require.Equal(t, []byte{0, 0}, resp)
+	var hello serverHello
+	require.NoError(t, conn.ReadJSON(&hello))
+
+	return &hello
+}
+
+// testPacket returns IPv4 packet with the payload, only the header fields used by the tunnel are set.
+func testPacket(src, dst, payload string) []byte {
+	p := make([]byte, 20, 20+len(payload))
+	p[0] = 0x45 // Version 4, header of 5 words.
+	binary.BigEndian.PutUint16(p[2:], uint16(20+len(payload)))
+	copy(p[12:16], net.ParseIP(src).To4())
+	copy(p[16:20], net.ParseIP(dst).To4())
+
+	return append(p, payload...)
+}
+
+// receive returns the next value of ch, the test fails if nothing comes in time.
+func receive[T any](t *testing.T, ch <-chan T) T {
+	t.Helper()
+
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing received")
+		var zero T
+		return zero
+	}
+}
+
+func testLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
@@ -0,0 +1,520 @@
+// Package l3tunnel implements the L3 tunnel: raw IP packets of the TUN device are carried to the gateway server
+// over VLESS and WebSocket (or a framed TCP or TLS stream), so the traffic leaves the device unchanged (QUIC and HTTP/3 are preserved).
+// Gateway is the server end, it writes the packets to its TUN device and routes replies back to the clients.
+//
+// Device specifics (WAN interface, gateway, TUN device and runtime tuning) are selected by profiles,
+// see Config and BuiltinProfiles.
+package l3tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/goxray/tun/pkg/l3tunnel/vless"
+)
+
+const (
+	// handshakeTimeout limits WebSocket handshake with the server.
+	handshakeTimeout = 10 * time.Second
+	// writeTimeout limits writing of a message, ping or pong, the peer not taking it for so long is considered dead.
+	writeTimeout = 10 * time.Second
+	// reconnectMin and reconnectMax limit the delay before the next dial after a failed one or a lost connection.
+	reconnectMin = 500 * time.Millisecond
+	reconnectMax = 30 * time.Second
+	// stableSession is the session duration after which the reconnect delay starts from reconnectMin again.
+	stableSession = time.Minute
+	// userAgent of the WebSocket handshake request if not configured.
+	userAgent = "Mozilla/5.0 (Linux; Android)"
+)
+
+// Destination of the VLESS request, the gateway server carries packets of such requests to its TUN device.
+const (
+	tunnelAddress = "l3tunnel.invalid"
+	tunnelPort    = 1
+)
+
+// Tunnel forwards packets between the TUN device and the gateway server, reconnecting when the connection is lost.
+type Tunnel struct {
+	cfg     Config
+	profile Profile
+	log     *slog.Logger
+	request []byte // Encoded VLESS request header.
+	early   bool   // The request is sent as early data.
+
+	// configure applies the tunnel configuration pushed by the gateway to the device, prev is the one applied before.
+	configure func(cfg, prev *tunnelConfig) error
+	dns       *resolvConf   // DNS servers of the device, restored when Run returns.
+	assigned  *tunnelConfig // Tunnel configuration of the last session.
+	backoff   backoff       // Delays between connection attempts.
+
+	statsMu sync.Mutex
+	stats   LinkStats
+}
+
+// LinkStats describes the quality of the link to the server measured by keepalive pings.
+type LinkStats struct {
+	RTT         time.Duration // Round-trip time of the last ping.
+	SmoothedRTT time.Duration // Moving average of the round-trip time, as TCP SRTT.
+	Samples     uint64        // Number of pongs received since start.
+}
+
+// New validates the config and creates Tunnel, nothing is set up until Run.
+func New(cfg Config) (*Tunnel, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	p, err := cfg.profile()
+	if err != nil {
+		return nil, err
+	}
+	id, _ := vless.ParseUUID(cfg.UUID) // Validated above.
+	req, err := (&vless.Request{UUID: id, Command: vless.CommandTCP, Address: tunnelAddress, Port: tunnelPort}).MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("encode VLESS request: %w", err)
+	}
+
+	dns := &resolvConf{path: p.ResolvConf}
+
+	return &Tunnel{
+		cfg:     cfg,
+		profile: p,
+		log:     cfg.Logger,
+		request: req,
+		early:   cfg.Transport == TransportWebSocket && len(req) <= cfg.EarlyData,
+		configure: func(cfg, prev *tunnelConfig) error {
+			if err := configureTUN(p, cfg, prev); err != nil {
+				return err
+			}
+			return dns.write(cfg.DNS)
+		},
+		dns:     dns,
+		backoff: backoff{min: reconnectMin, max: reconnectMax},
+	}, nil
+}
+
+// Profile returns the device profile the tunnel runs with.
+func (t *Tunnel) Profile() Profile {
+	return t.profile
+}
+
+// LinkStats returns the round-trip time samples of the keepalive pings.
+func (t *Tunnel) LinkStats() LinkStats {
+	t.statsMu.Lock()
+	defer t.statsMu.Unlock()
+
+	return t.stats
+}
+
+// addRTT records the round-trip time of a ping.
+func (t *Tunnel) addRTT(rtt time.Duration) {
+	t.statsMu.Lock()
+	defer t.statsMu.Unlock()
+	if t.stats.Samples == 0 {
+		t.stats.SmoothedRTT = rtt
+	} else {
+		t.stats.SmoothedRTT += (rtt - t.stats.SmoothedRTT) / 8
+	}
+	t.stats.RTT = rtt
+	t.stats.Samples++
+}
+
+// Run sets up the device (runtime tuning, TUN device and the route to the server) and forwards packets until ctx
+// is done or reading the TUN device fails. Address, MTU, routes and DNS servers of the TUN device are pushed
+// by the gateway when connected. The route to the server is removed, the DNS servers of the device are restored
+// and the TUN device is closed on return.
+func (t *Tunnel) Run(ctx context.Context) error {
+	p := t.profile
+	applyTuning(p.Tuning, t.log)
+	if p.LoadTUNModule {
+		if err := loadTUNModule(); err != nil {
+			t.log.Warn("TUN module setup failed", "err", err)
+		}
+	}
+
+	host, _, _ := net.SplitHostPort(t.cfg.Server)
+	serverIP, err := net.ResolveIPAddr("ip", host)
+	if err != nil {
+		return fmt.Errorf("resolve server: %w", err)
+	}
+
+	dev, err := openTUN(p)
+	if err != nil {
+		return fmt.Errorf("setup TUN device: %w", err)
+	}
+	defer dev.Close()
+
+	cleanup, err := setupServerRoute(p, serverIP.IP)
+	if err != nil {
+		return fmt.Errorf("setup server route: %w", err)
+	}
+	defer cleanup()
+	defer func() {
+		if err := t.dns.restore(); err != nil {
+			t.log.Warn("DNS restore failed", "err", err)
+		}
+	}()
+
+	t.log.Info("L3 tunnel active", "profile", t.cfg.Profile, "tun", p.TUNName, "server", t.cfg.Server)
+
+	return t.forward(ctx, dev)
+}
+
+// forward connects to the server and forwards packets of dev until ctx is done or reading dev fails.
+// The device is read by a single goroutine for all sessions, so no packet is lost to a reader of a closed session.
+func (t *Tunnel) forward(ctx context.Context, dev io.ReadWriter) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	pool := newPacketPool(t.profile.PacketBuffers, t.profile.BufferSize)
+	packets := make(chan []byte, t.profile.PacketBuffers)
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- readTUN(ctx, dev, packets, pool)
+		cancel()
+	}()
+
+	for ctx.Err() == nil {
+		conn, reply, err := t.dial(ctx)
+		if err == nil {
+			// Applied after every reconnect: the configuration may change and the device may have been reset.
+			if err = t.configure(reply.Config, t.assigned); err != nil {
+				_ = conn.Close()
+				err = fmt.Errorf("tunnel configuration: %w", err)
+			}
+		}
+		if err != nil {
+			delay := t.backoff.next()
+			t.log.Warn("connection to server failed", "server", t.cfg.Server, "err", err, "retry", delay)
+			sleep(ctx, delay)
+			continue
+		}
+		tc := reply.Config
+		t.assigned = tc
+		t.log.Info("connected to server", "server", t.cfg.Server, "address", tc.Address, "mtu", tc.MTU,
+			"dns", tc.DNS, "routes", tc.Routes, "batch", reply.Batch != nil)
+
+		start := time.Now()
+		t.forwardSession(ctx, conn, reply.Batch, dev, packets, pool)
+		if time.Since(start) >= stableSession {
+			t.backoff.reset()
+		}
+		if ctx.Err() == nil {
+			delay := t.backoff.next()
+			t.log.Info("connection lost, reconnecting", "delay", delay)
+			sleep(ctx, delay)
+		}
+	}
+
+	select {
+	case err := <-readErr:
+		if err != nil {
+			return fmt.Errorf("read TUN device: %w", err)
+		}
+	default:
+	}
+
+	return nil
+}
+
+// dial connects to the server and makes the session handshake, returned is serverHello with the tunnel
+// configuration pushed by the gateway.
+func (t *Tunnel) dial(ctx context.Context) (msgConn, *serverHello, error) {
+	dial := t.dialWebSocket
+	if t.cfg.Transport == TransportStream {
+		dial = t.dialStream
+	}
+	conn, err := dial(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	reply, err := t.handshake(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+
+	return conn, reply, nil
+}
+
+// dialWebSocket connects to the WebSocket endpoint of the server.
+func (t *Tunnel) dialWebSocket(ctx context.Context) (msgConn, error) {
+	scheme := "ws"
+	if t.cfg.TLS {
+		scheme = "wss"
+	}
+	// Path may carry a query, so it is not escaped.
+	u := scheme + "://" + t.cfg.Server + t.cfg.Path
+	headers := http.Header{}
+	headers.Set("User-Agent", userAgent)
+	for name, value := range t.cfg.Headers {
+		headers.Set(name, value)
+	}
+	if t.cfg.Host != "" {
+		headers.Set("Host", t.cfg.Host)
+	}
+	if t.early {
+		headers.Set("Sec-WebSocket-Protocol", base64.RawURLEncoding.EncodeToString(t.request))
+	}
+
+	conn, err := dialWS(ctx, u, headers, &tls.Config{ServerName: t.cfg.SNI, InsecureSkipVerify: t.cfg.Insecure})
+	if err != nil {
+		return nil, fmt.Errorf("dial %s: %w", u, err)
+	}
+
+	return conn, nil
+}
+
+// dialStream connects to the stream listener of the server, over TLS if enabled.
+func (t *Tunnel) dialStream(ctx context.Context) (msgConn, error) {
+	ctx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", t.cfg.Server)
+	if err != nil {
+		return nil, fmt.Errorf("dial %s: %w", t.cfg.Server, err)
+	}
+	if t.cfg.TLS {
+		tc := tls.Client(conn, &tls.Config{ServerName: t.cfg.SNI, InsecureSkipVerify: t.cfg.Insecure})
+		if err = tc.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("TLS handshake with %s: %w", t.cfg.Server, err)
+		}
+		conn = tc
+	}
+
+	return newStreamConn(conn, true), nil
+}
+
+// handshake sends VLESS request header (unless sent as early data) and clientHello, and reads VLESS response
+// header and serverHello. The returned serverHello carries valid tunnel configuration.
+func (t *Tunnel) handshake(conn msgConn) (*serverHello, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	if !t.early {
+		if err := conn.WriteMessage(t.request); err != nil {
+			return nil, fmt.Errorf("send VLESS request: %w", err)
+		}
+	}
+	// The client asks for its previous address, so it is kept over reconnects.
+	hello := clientHello{Version: controlVersion, Address: t.cfg.TUNAddress}
+	if t.assigned != nil {
+		hello.Address = t.assigned.Address
+	}
+	if t.cfg.BatchWindow > 0 {
+		hello.Batch = &batchParams{Window: t.cfg.BatchWindow, Size: t.cfg.BatchSize}
+	}
+	if err := writeControl(conn, hello); err != nil {
+		return nil, fmt.Errorf("send hello: %w", err)
+	}
+
+	buf := make([]byte, maxControlSize)
+	n, err := conn.ReadMessage(buf)
+	if err != nil {
+		return nil, fmt.Errorf("read VLESS response: %w", err)
+	}
+	r := bytes.NewReader(buf[:n])
+	if _, err = vless.ReadResponse(r); err != nil {
+		return nil, err
+	}
+	// serverHello may come in the same message as the response header.
+	msg := buf[n-r.Len() : n]
+	if len(msg) == 0 {
+		if n, err = conn.ReadMessage(buf); err != nil {
+			return nil, fmt.Errorf("read hello: %w", err)
+		}
+		msg = buf[:n]
+	}
+	var reply serverHello
+	if err = json.Unmarshal(msg, &reply); err != nil {
+		return nil, fmt.Errorf("invalid hello: %w", err)
+	}
+	switch {
+	case reply.Version != controlVersion:
+		return nil, fmt.Errorf("unsupported control version %d", reply.Version)
+	case reply.Error != "":
+		return nil, fmt.Errorf("refused by gateway: %s", reply.Error)
+	case reply.Config == nil:
+		return nil, fmt.Errorf("no tunnel config in hello")
+	case reply.Batch != nil && hello.Batch.agree(reply.Batch) == nil:
+		return nil, fmt.Errorf("invalid batching: %+v", *reply.Batch)
+	}
+	// The gateway agrees on parameters not exceeding the requested ones, the latency bound is kept anyway.
+	reply.Batch = hello.Batch.agree(reply.Batch)
+
+	return &reply, reply.Config.validate()
+}
+
+// readTUN reads packets of the TUN device into buffers of pool and sends them to packets until ctx is done.
+// Reading waits while all buffers are in use. The read error is returned unless ctx is done.
+func readTUN(ctx context.Context, dev io.Reader, packets chan<- []byte, pool *packetPool) error {
+	for {
+		buf := pool.get(ctx.Done())
+		if buf == nil {
+			return nil
+		}
+		n, err := dev.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case packets <- buf[:n]:
+		}
+	}
+}
+
+// forwardSession forwards packets between the TUN device and the server until either direction fails, the server
+// does not respond within DeadPeerTimeout or ctx is done. Packets are batched if batch is not nil. Both directions
+// are stopped and conn is closed on return, so the next session starts alone.
+func (t *Tunnel) forwardSession(ctx context.Context, conn msgConn, batch *batchParams, dev io.Writer,
+	packets <-chan []byte, pool *packetPool,
+) {
+	ctx, cancel := context.WithCancel(ctx)
+	timeout := time.Duration(t.cfg.DeadPeerTimeout)
+	start := time.Now()
+	// Any frame of the server keeps the connection alive: messages, its pings and pongs of the keepalive pings.
+	conn.SetIdleTimeout(timeout)
+	conn.SetWriteTimeout(writeTimeout)
+	conn.SetPongHandler(func(data []byte) {
+		if len(data) == 8 {
+			t.addRTT(time.Since(start) - time.Duration(binary.BigEndian.Uint64(data)))
+		}
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		defer cancel()
+		if batch == nil {
+			forwardTUNToServer(ctx, packets, pool, conn)
+			return
+		}
+		w := newBatchWriter(*batch, conn.WriteMessage)
+		_ = w.run(ctx.Done(), packets, pool.put)
+	}()
+	go func() {
+		defer wg.Done()
+		defer cancel()
+		var netErr net.Error
+		// Messages of the server are read into a buffer of the session, a batch may be larger than a packet.
+		var batchSize int
+		if batch != nil {
+			batchSize = batch.Size
+		}
+		buf := make([]byte, receiveBufferSize(t.profile.BufferSize, batchSize))
+		err := forwardServerToTUN(ctx, conn, dev, buf, batch != nil, t.log)
+		switch {
+		case errors.As(err, &netErr) && netErr.Timeout():
+			t.log.Warn("server is not responding", "timeout", timeout)
+		case errors.Is(err, errBatch):
+			t.log.Warn("invalid batch from server", "err", err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		defer cancel()
+		t.keepalive(ctx, conn, start)
+	}()
+
+	<-ctx.Done()
+	_ = conn.Close() // Unblocks reading and writing of the connection.
+	wg.Wait()
+}
+
+// keepalive pings the server every Keepalive interval until ctx is done or sending fails. A ping carries the time
+// since the session start, so its pong gives the round-trip time.
+func (t *Tunnel) keepalive(ctx context.Context, conn msgConn, start time.Time) {
+	ticker := time.NewTicker(time.Duration(t.cfg.Keepalive))
+	defer ticker.Stop()
+	ping := make([]byte, 8)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		binary.BigEndian.PutUint64(ping, uint64(time.Since(start)))
+		if err := conn.WritePing(ping); err != nil {
+			return
+		}
+	}
+}
+
+// forwardTUNToServer sends every packet read from the TUN device as a message, buffers of sent packets
+// are returned to pool.
+func forwardTUNToServer(ctx context.Context, packets <-chan []byte, pool *packetPool, conn msgConn) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case packet := <-packets:
+			err := conn.WriteMessage(packet)
+			pool.put(packet)
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// forwardServerToTUN writes every message of the server to the TUN device as a packet, or every packet
+// of the message if batched. Messages are read into buf, larger ones are dropped. The error reading the server
+// or writing the device is returned.
+func forwardServerToTUN(ctx context.Context, conn msgConn, dev io.Writer, buf []byte, batched bool,
+	log *slog.Logger,
+) error {
+	write := func(packet []byte) error {
+		_, err := dev.Write(packet)
+		return err
+	}
+	for ctx.Err() == nil {
+		n, err := conn.ReadMessage(buf)
+		if errors.Is(err, errMessageTooLarge) {
+			log.Debug("message dropped", "err", err, "buffer", len(buf))
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if batched {
+			err = splitBatch(buf[:n], write)
+		} else {
+			err = write(buf[:n])
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
+
+// errUnsupported is returned by device setup on platforms other than Linux.
+var errUnsupported = errors.New("l3 tunnel is supported on Linux only")
@@ -0,0 +1,507 @@
+package l3tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+
+	"github.com/goxray/tun/pkg/l3tunnel/vless"
+)
+
+func TestTunnel_Forward(t *testing.T) {
+	requests := make(chan *vless.Request, 1)
+	pushed := &tunnelConfig{Address: "10.50.0.7/24", MTU: 1400, Routes: []string{"0.0.0.0/0"}}
+	addr := startTestEchoServer(t, "/tun", requests, pushed)
+	tun, configs := startTestTunnel(t, Config{Server: addr, UUID: testUUID, TUNAddress: "10.50.0.7/24"})
+
+	select {
+	case req := <-requests:
+		id, err := vless.ParseUUID(testUUID)
+		require.NoError(t, err)
+		require.Equal(t, &vless.Request{UUID: id, Command: vless.CommandTCP, Address: tunnelAddress, Port: tunnelPort}, req)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no VLESS request")
+	}
+	require.Equal(t, pushed, receive(t, configs))
+
+	// Every packet goes in its own message, so packet boundaries are kept.
+	packets := [][]byte{[]byte("first packet"), []byte("second"), make([]byte, 1500)}
+	for _, p := range packets {
+		tun.dev.in <- p
+	}
+	for _, p := range packets {
+		require.Equal(t, p, receive(t, tun.dev.out))
+	}
+}
+
+func TestTunnel_Endpoint(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	pushed := &tunnelConfig{Address: "10.50.0.2/24", MTU: 1500}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+		proto := r.Header.Get("Sec-WebSocket-Protocol")
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, http.Header{"Sec-Websocket-Protocol": {proto}})
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var hello clientHello
+		if err = conn.ReadJSON(&hello); err != nil {
+			return // VLESS request is not expected, it comes as early data.
+		}
+		reply, _ := json.Marshal(serverHello{Version: controlVersion, Config: pushed})
+		_ = conn.WriteMessage(websocket.BinaryMessage, append([]byte{0, 0}, reply...))
+		_, _, _ = conn.ReadMessage()
+	}))
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	tun, configs := startTestTunnel(t, Config{
+		Server:   strings.TrimPrefix(srv.URL, "https://"),
+		UUID:     testUUID,
+		Path:     "/ws?ed=2048&token=secret",
+		Host:     "gw.example.com",
+		TLS:      true,
+		SNI:      "front.example.com",
+		Insecure: true,
+		Headers:  map[string]string{"User-Agent": "okhttp/4.12.0", "X-Client": "modem"},
+	})
+	r := receive(t, requests)
+	require.Equal(t, "/ws?token=secret", r.URL.String())
+	require.Equal(t, "gw.example.com", r.Host)
+	require.Equal(t, "front.example.com", r.TLS.ServerName)
+	require.Equal(t, "okhttp/4.12.0", r.UserAgent())
+	require.Equal(t, "modem", r.Header.Get("X-Client"))
+	early, err := base64.RawURLEncoding.DecodeString(r.Header.Get("Sec-WebSocket-Protocol"))
+	require.NoError(t, err)
+	require.Equal(t, tun.request, early)
+	require.Equal(t, pushed, receive(t, configs))
+}
+
+func TestTunnel_Reconnect(t *testing.T) {
+	gwDev := newTestDevice()
+	gw, addr := startTestGateway(t, GatewayConfig{}, gwDev)
+	tun, configs := startTestTunnel(t, Config{Server: addr, UUID: testUUID})
+
+	// No packet is lost to the previous session after reconnecting, in both directions.
+	for i := range 3 {
+		require.Equal(t, "10.50.0.2/24", receive(t, configs).Address)
+		for j := range 4 {
+			packet := testPacket("10.50.0.2", "198.51.100.1", fmt.Sprintf("request %d.%d", i, j))
+			tun.dev.in <- packet
+			require.Equal(t, packet, receive(t, gwDev.out))
+			packet = testPacket("198.51.100.1", "10.50.0.2", fmt.Sprintf("reply %d.%d", i, j))
+			gwDev.in <- packet
+			require.Equal(t, packet, receive(t, tun.dev.out))
+		}
+		gw.closeSessions()
+	}
+}
+
+func TestTunnel_Keepalive(t *testing.T) {
+	// Pongs of the gateway keep the idle connection alive and give RTT samples.
+	_, addr := startTestGateway(t, GatewayConfig{}, newTestDevice())
+	keepalive := Duration(10 * time.Millisecond)
+	tun, configs := startTestTunnel(t, Config{Server: addr, UUID: testUUID, Keepalive: keepalive, DeadPeerTimeout: 5 * keepalive})
+	receive(t, configs)
+	require.Eventually(t, func() bool { return tun.LinkStats().Samples >= 10 }, 5*time.Second, time.Millisecond)
+	require.Empty(t, configs, "connection is kept")
+	stats := tun.LinkStats()
+	require.Positive(t, stats.RTT)
+	require.Positive(t, stats.SmoothedRTT)
+
+	// The client reconnects to the server not answering pings.
+	pushed := &tunnelConfig{Address: "10.50.0.2/24", MTU: 1500}
+	addr = startTestSilentServer(t, pushed)
+	_, configs = startTestTunnel(t, Config{Server: addr, UUID: testUUID, Keepalive: keepalive, DeadPeerTimeout: 5 * keepalive})
+	for range 3 {
+		require.Equal(t, pushed, receive(t, configs))
+	}
+}
+
+func TestTunnel_Batch(t *testing.T) {
+	gwDev := newTestDevice()
+	_, addr := startTestGateway(t, GatewayConfig{}, gwDev)
+	tun, configs := startTestTunnel(t, Config{Server: addr, UUID: testUUID, BatchWindow: Duration(time.Millisecond)})
+	receive(t, configs)
+
+	// Packets are split back in order.
+	for i := range 10 {
+		tun.dev.in <- testPacket("10.50.0.2", "198.51.100.1", fmt.Sprintf("request %d", i))
+		gwDev.in <- testPacket("198.51.100.1", "10.50.0.2", fmt.Sprintf("reply %d", i))
+	}
+	for i := range 10 {
+		require.Equal(t, testPacket("10.50.0.2", "198.51.100.1", fmt.Sprintf("request %d", i)), receive(t, gwDev.out))
+		require.Equal(t, testPacket("198.51.100.1", "10.50.0.2", fmt.Sprintf("reply %d", i)), receive(t, tun.dev.out))
+	}
+
+	// Full-size packets do not fit in batches of the MTU, each goes alone with its length prefix.
+	gwDev = newTestDevice()
+	_, addr = startTestGateway(t, GatewayConfig{BatchSize: 1500}, gwDev)
+	tun, configs = startTestTunnel(t, Config{Server: addr, UUID: testUUID, BatchWindow: Duration(time.Millisecond), BatchSize: 1500})
+	receive(t, configs)
+	payload := strings.Repeat("x", 1480)
+	for range 3 {
+		tun.dev.in <- testPacket("10.50.0.2", "198.51.100.1", payload)
+		gwDev.in <- testPacket("198.51.100.1", "10.50.0.2", payload)
+	}
+	for range 3 {
+		require.Len(t, receive(t, gwDev.out), 1500)
+		require.Len(t, receive(t, tun.dev.out), 1500)
+	}
+}
+
+func TestTunnel_Stream(t *testing.T) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	t.Cleanup(srv.Close)
+	for name, tlsCfg := range map[string]*tls.Config{"tcp": nil, "tls": {Certificates: srv.TLS.Certificates}} {
+		t.Run(name, func(t *testing.T) {
+			gwDev := newTestDevice()
+			gw, _, addr := startTestGatewayStream(t, GatewayConfig{}, gwDev, tlsCfg)
+			keepalive := Duration(10 * time.Millisecond)
+			tun, configs := startTestTunnel(t, Config{
+				Server:          addr,
+				UUID:            testUUID,
+				Transport:       TransportStream,
+				TLS:             tlsCfg != nil,
+				Insecure:        true,
+				Keepalive:       keepalive,
+				DeadPeerTimeout: 50 * keepalive,
+			})
+
+			// Packets keep their boundaries in both directions, the session is kept over reconnects.
+			for i := range 2 {
+				require.Equal(t, "10.50.0.2/24", receive(t, configs).Address)
+				for j := range 4 {
+					packet := testPacket("10.50.0.2", "198.51.100.1", fmt.Sprintf("request %d.%d", i, j))
+					tun.dev.in <- packet
+					require.Equal(t, packet, receive(t, gwDev.out))
+					packet = testPacket("198.51.100.1", "10.50.0.2", fmt.Sprintf("reply %d.%d", i, j))
+					gwDev.in <- packet
+					require.Equal(t, packet, receive(t, tun.dev.out))
+				}
+				gw.closeSessions()
+			}
+			// Empty frames are pings and pongs.
+			require.Eventually(t, func() bool { return tun.LinkStats().Samples >= 5 }, 5*time.Second, time.Millisecond)
+		})
+	}
+}
+
+func TestTunnel_ReadError(t *testing.T) {
+	tun, err := New(Config{Server: "127.0.0.1:1", UUID: testUUID, Logger: testLogger()})
+	require.NoError(t, err)
+	tun.backoff = backoff{min: time.Millisecond, max: time.Millisecond}
+	dev := &failingDevice{err: errors.New("device removed")}
+	require.ErrorIs(t, tun.forward(context.Background(), dev), dev.err)
+}
+
+func TestTunnel_Handshake(t *testing.T) {
+	for name, tc := range map[string]struct {
+		reply string
+		err   string
+	}{
+		"version":   {`{"version": 2, "config": {"address": "10.50.0.2/24", "mtu": 1500}}`, "unsupported control version 2"},
+		"refused":   {`{"version": 1, "error": "no free address"}`, "refused by gateway: no free address"},
+		"no config": {`{"version": 1}`, "no tunnel config"},
+		"invalid":   {`{"version": 1, "config": {"address": "10.50.0.2/24", "mtu": 100}}`, "MTU 100 is out of range"},
+		"not json":  {`hello`, "invalid hello"},
+		"batch":     {`{"version": 1, "config": {"address": "10.50.0.2/24", "mtu": 1500}, "batch": {"window": "1ms", "size": 1500}}`, "invalid batching"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tun, err := New(Config{Server: "127.0.0.1:1", UUID: testUUID, Logger: testLogger()})
+			require.NoError(t, err)
+			client, server := newTestConnPair(t)
+			go func() {
+				buf := make([]byte, 1024)
+				_, _ = server.ReadMessage(buf) // VLESS request.
+				_, _ = server.ReadMessage(buf) // Hello.
+				_ = server.WriteMessage(append([]byte{0, 0}, tc.reply...))
+			}()
+			_, err = tun.handshake(client)
+			require.ErrorContains(t, err, tc.err)
+		})
+	}
+}
+
+func TestForward_Allocs(t *testing.T) {
+	// Packets are read into the session buffer and written from it, nothing is allocated per packet.
+	client, server := newTestConnPair(t)
+	packet := make([]byte, 1400)
+	batch := append(binary.BigEndian.AppendUint16(nil, uint16(len(packet))), packet...)
+	batch = append(batch, batch...)
+	buf := make([]byte, 4096)
+	dev, log := &countingDevice{}, testLogger()
+	for name, tc := range map[string]struct {
+		msg     []byte
+		batched bool
+		packets int
+	}{
+		"packet": {packet, false, 1},
+		"batch":  {batch, true, 2},
+	} {
+		allocs := testing.AllocsPerRun(100, func() {
+			_ = server.WriteMessage(tc.msg)
+			dev.limit = tc.packets
+			_ = forwardServerToTUN(context.Background(), client, dev, buf, tc.batched, log)
+		})
+		require.Zero(t, allocs, name)
+	}
+}
+
+// BenchmarkForwardServerToTUN measures the downlink of the client per packet.
+func BenchmarkForwardServerToTUN(b *testing.B) {
+	for name, batched := range map[string]bool{"packet": false, "batch": true} {
+		b.Run(name, func(b *testing.B) {
+			client, server := newTestConnPair(b)
+			packet := make([]byte, 1400)
+			msg, perMsg := packet, 1
+			if batched {
+				msg, perMsg = nil, 8
+				for range perMsg {
+					msg = append(binary.BigEndian.AppendUint16(msg, uint16(len(packet))), packet...)
+				}
+			}
+			go func() {
+				for range (b.N + perMsg - 1) / perMsg {
+					if server.WriteMessage(msg) != nil {
+						return
+					}
+				}
+			}()
+			dev := &countingDevice{limit: b.N}
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(packet)))
+			b.ResetTimer()
+			err := forwardServerToTUN(context.Background(), client, dev, make([]byte, len(msg)), batched, testLogger())
+			require.ErrorIs(b, err, errLimit)
+		})
+	}
+}
+
+// BenchmarkForwardTUNToServer measures the uplink of the client per packet.
+func BenchmarkForwardTUNToServer(b *testing.B) {
+	client, server := newTestConnPair(b)
+	pool := newPacketPool(64, 1500)
+	packets := make(chan []byte, 64)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		for range b.N {
+			packets <- pool.get(ctx.Done())[:1400]
+		}
+	}()
+	go func() {
+		defer cancel()
+		buf := make([]byte, 1500)
+		for range b.N {
+			if _, err := server.ReadMessage(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	b.ReportAllocs()
+	b.SetBytes(1400)
+	b.ResetTimer()
+	forwardTUNToServer(ctx, packets, pool, client)
+}
+
+// testTunnel is the tunnel forwarding packets of dev.
+type testTunnel struct {
+	*Tunnel
+	dev *testDevice
+}
+
+// startTestTunnel starts forwarding of the tunnel with the test device, tunnel configurations pushed by
+// the gateway are sent to the returned channel instead of being applied.
+func startTestTunnel(t *testing.T, cfg Config) (*testTunnel, <-chan *tunnelConfig) {
+	t.Helper()
+
+	cfg.Logger = testLogger()
+	tun, err := New(cfg)
+	require.NoError(t, err)
+	configs := make(chan *tunnelConfig, 16)
+	tun.configure = func(cfg, _ *tunnelConfig) error {
+		configs <- cfg
+		return nil
+	}
+	tun.backoff = backoff{min: 10 * time.Millisecond, max: 100 * time.Millisecond}
+	dev := newTestDevice()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go tun.forward(ctx, dev)
+
+	return &testTunnel{Tunnel: tun, dev: dev}, configs
+}
+
+// newTestConnPair returns both ends of WebSocket connection.
+func newTestConnPair(t testing.TB) (client, server *wsConn) {
+	t.Helper()
+
+	accepted := make(chan *wsConn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err == nil {
+			accepted <- newWSConn(conn.NetConn(), nil, false)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	client, err := dialWS(context.Background(), "ws"+strings.TrimPrefix(srv.URL, "http"), http.Header{}, nil)
+	require.NoError(t, err)
+	server = <-accepted
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+
+	return client, server
+}
+
+// testDevice is the TUN device, packets written to in are read by the tunnel, written ones go to out.
+type testDevice struct {
+	in, out chan []byte
+}
+
+func newTestDevice() *testDevice {
+	return &testDevice{in: make(chan []byte, 16), out: make(chan []byte, 16)}
+}
+
+func (d *testDevice) Read(p []byte) (int, error) {
+	return copy(p, <-d.in), nil
+}
+
+func (d *testDevice) Write(p []byte) (int, error) {
+	d.out <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+// failingDevice is the TUN device failing reads with err.
+type failingDevice struct {
+	err error
+}
+
+func (d *failingDevice) Read([]byte) (int, error) {
+	return 0, d.err
+}
+
+func (d *failingDevice) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// errLimit is returned by countingDevice.
+var errLimit = errors.New("limit reached")
+
+// countingDevice is the TUN device failing with errLimit when limit packets are written.
+type countingDevice struct {
+	failingDevice
+	limit int
+}
+
+func (d *countingDevice) Write(p []byte) (int, error) {
+	if d.limit--; d.limit <= 0 {
+		return len(p), errLimit
+	}
+	return len(p), nil
+}
+
+// startTestSilentServer starts WebSocket server pushing cfg at session start and reading nothing after it,
+// so pings of the client are not answered. Returned address is host:port of the server.
+func startTestSilentServer(t *testing.T, cfg *tunnelConfig) string {
+	t.Helper()
+
+	stop := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _, _ = conn.ReadMessage() // VLESS request.
+		_, _, _ = conn.ReadMessage() // Hello.
+		reply, _ := json.Marshal(serverHello{Version: controlVersion, Config: cfg})
+		_ = conn.WriteMessage(websocket.BinaryMessage, append([]byte{0, 0}, reply...))
+		<-stop
+	}))
+	t.Cleanup(func() {
+		close(stop)
+		srv.Close()
+	})
+
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+// startTestEchoServer starts WebSocket server sending messages back. The first message (VLESS request header)
+// is decoded and sent to requests, the second one (clientHello) is answered with VLESS response header and
+// serverHello pushing cfg in a single message. Returned address is host:port of the server.
+func startTestEchoServer(t *testing.T, path string, requests chan<- *vless.Request, cfg *tunnelConfig) string {
+	t.Helper()
+
+	var mu sync.Mutex
+	var conns []*websocket.Conn
+	upgrader := websocket.Upgrader{}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		mu.Lock()
+		conns = append(conns, conn)
+		mu.Unlock()
+
+		_, header, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		req, err := vless.ReadRequest(bytes.NewReader(header))
+		if err != nil {
+			return
+		}
+		requests <- req
+		var hello clientHello
+		if err = conn.ReadJSON(&hello); err != nil || hello.Address != cfg.Address {
+			return
+		}
+		reply, _ := json.Marshal(serverHello{Version: controlVersion, Config: cfg})
+		resp, _ := (&vless.Response{}).MarshalBinary()
+		if err = conn.WriteMessage(websocket.BinaryMessage, append(resp, reply...)); err != nil {
+			return
+		}
+		for {
+			typ, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err = conn.WriteMessage(typ, msg); err != nil {
+				return
+			}
+		}
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(func() {
+		srv.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range conns {
+			_ = c.Close()
+		}
+	})
+
+	return strings.TrimPrefix(srv.URL, "http://")
+}
@@ -0,0 +1,59 @@
+package l3tunnel
+
+// packetPool is a bounded pool of packet buffers. At most n buffers are in use: get blocks until one is put back,
+// so the producer slows down to the pace of the consumers instead of allocating. Buffers are allocated on demand.
+type packetPool struct {
+	size   int
+	free   chan []byte
+	tokens chan struct{} // Buffers which may still be allocated.
+}
+
+func newPacketPool(n, size int) *packetPool {
+	p := &packetPool{size: size, free: make(chan []byte, n), tokens: make(chan struct{}, n)}
+	for range n {
+		p.tokens <- struct{}{}
+	}
+
+	return p
+}
+
+// get returns a buffer of the pool size, nil if done is closed before a buffer is available.
+func (p *packetPool) get(done <-chan struct{}) []byte {
+	select {
+	case b := <-p.free:
+		return b
+	default:
+	}
+	select {
+	case b := <-p.free:
+		return b
+	case <-p.tokens:
+		return make([]byte, p.size)
+	case <-done:
+		return nil
+	}
+}
+
+// put returns buffer b got from the pool, it may be resliced.
+func (p *packetPool) put(b []byte) {
+	p.free <- b[:p.size]
+}
+
+// receiveBufferSize is the size of the buffer messages of a session are read into: a packet of bufferSize
+// or a batch of batchSize (zero if not batching). A packet not fitting in a batch is sent alone
+// with its length prefix, so a batch may be up to bufferSize+2 bytes whatever batchSize is.
+func receiveBufferSize(bufferSize, batchSize int) int {
+	if batchSize == 0 {
+		return bufferSize
+	}
+
+	return max(bufferSize+2, batchSize)
+}
+
+// sessionBuffers is the memory of the buffers of a session in bytes: the receive buffer, the batch being
+// collected, the read and write buffers of the connection and the buffer of the handshake.
+func sessionBuffers(bufferSize, batchSize int) int {
+	receive := receiveBufferSize(bufferSize, batchSize)
+	// The write buffer holds the largest message with its frame header.
+	return receive + batchSize + connReadBuffer + receive + maxFrameHeader + maxControlSize
+}
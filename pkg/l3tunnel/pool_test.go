@@ -0,0 +1,33 @@
+package l3tunnel
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPacketPool(t *testing.T) {
+	pool := newPacketPool(2, 1500)
+	first, second := pool.get(nil), pool.get(nil)
+	require.Len(t, first, 1500)
+	require.Len(t, second, 1500)
+
+	// No more buffers are allocated until one is put back.
+	done := make(chan struct{})
+	got := make(chan []byte)
+	go func() { got <- pool.get(done) }()
+	select {
+	case <-got:
+		t.Fatal("buffer over the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+	pool.put(first[:20])
+	third := receive(t, got)
+	require.Len(t, third, 1500)
+	require.Same(t, &first[0], &third[0], "buffer is reused")
+
+	go func() { got <- pool.get(done) }()
+	close(done)
+	require.Nil(t, receive(t, got))
+}
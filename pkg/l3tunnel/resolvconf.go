@@ -0,0 +1,69 @@
+package l3tunnel
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+)
+
+// resolvConf writes the DNS servers pushed by the gateway to the resolv.conf file of the profile. The contents
+// of the file before the first write are kept, so restore puts them back when the tunnel exits.
+type resolvConf struct {
+	path string
+
+	mu      sync.Mutex
+	saved   bool
+	orig    []byte
+	existed bool // The file existed before the first write.
+}
+
+// write replaces the file with the DNS servers, nothing is written if the path or servers are empty.
+func (r *resolvConf) write(servers []string) error {
+	if r.path == "" || len(servers) == 0 {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.saved {
+		orig, err := os.ReadFile(r.path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("save DNS: %w", err)
+		}
+		r.orig, r.existed, r.saved = orig, err == nil, true
+	}
+	var conf strings.Builder
+	for _, dns := range servers {
+		fmt.Fprintf(&conf, "nameserver %s\n", dns)
+	}
+	if err := os.WriteFile(r.path, []byte(conf.String()), 0o644); err != nil {
+		return fmt.Errorf("set DNS: %w", err)
+	}
+
+	return nil
+}
+
+// restore puts back the contents of the file before the first write, the file is removed if it did not exist.
+func (r *resolvConf) restore() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.saved {
+		return nil
+	}
+
+	var err error
+	if r.existed {
+		err = os.WriteFile(r.path, r.orig, 0o644)
+	} else if err = os.Remove(r.path); errors.Is(err, fs.ErrNotExist) {
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("restore DNS: %w", err)
+	}
+	r.saved = false
+
+	return nil
+}
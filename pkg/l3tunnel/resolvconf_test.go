@@ -0,0 +1,36 @@
+package l3tunnel
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolvConf(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	require.NoError(t, os.WriteFile(path, []byte("nameserver 192.168.1.1\n"), 0o644))
+	r := &resolvConf{path: path}
+
+	require.NoError(t, r.write(nil), "nothing is written without servers")
+	require.NoError(t, r.write([]string{"10.0.0.1", "10.0.0.2"}))
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "nameserver 10.0.0.1\nnameserver 10.0.0.2\n", string(b))
+	require.NoError(t, r.write([]string{"10.0.0.3"}), "the original is kept on later writes")
+	require.NoError(t, r.restore())
+	b, err = os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "nameserver 192.168.1.1\n", string(b))
+
+	// A file created by the tunnel is removed.
+	path = filepath.Join(t.TempDir(), "resolv.conf")
+	r = &resolvConf{path: path}
+	require.NoError(t, r.restore(), "nothing to restore before writing")
+	require.NoError(t, r.write([]string{"10.0.0.1"}))
+	require.NoError(t, r.restore())
+	require.NoFileExists(t, path)
+
+	require.NoError(t, (&resolvConf{}).write([]string{"10.0.0.1"}), "DNS is not changed without a path")
+}
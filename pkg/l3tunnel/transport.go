@@ -0,0 +1,141 @@
+package l3tunnel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/goxray/tun/pkg/l3tunnel/frame"
+)
+
+// connReadBuffer is the size of the read buffer of a session connection (the bufio default, as in package frame).
+const connReadBuffer = 4096
+
+// errMessageTooLarge is returned by msgConn.ReadMessage for a message larger than the buffer.
+var errMessageTooLarge = errors.New("message too large")
+
+// Transports of the tunnel, see Config.Transport.
+const (
+	// TransportWebSocket carries messages as WebSocket binary messages.
+	TransportWebSocket = "ws"
+	// TransportStream carries messages as frames of untyped framing of package frame over TCP or TLS.
+	TransportStream = "tcp"
+)
+
+// msgConn carries the messages of a session: VLESS headers, control messages and packets (or batches of them).
+// Implementations are wsConn and streamConn.
+type msgConn interface {
+	// ReadMessage reads the next message into buf, returned is its length. A message larger than buf is
+	// discarded with errMessageTooLarge, the connection stays usable. Pings of the peer are answered
+	// and pongs are passed to the pong handler while reading.
+	ReadMessage(buf []byte) (int, error)
+	// WriteMessage sends p as a single message, p must not be empty. It must not be called concurrently.
+	WriteMessage(p []byte) error
+	// WritePing sends a ping carrying data, it may be called concurrently with WriteMessage.
+	WritePing(data []byte) error
+	// SetPongHandler sets the handler called with the data of the ping when its pong comes.
+	SetPongHandler(h func(data []byte))
+	// SetIdleTimeout makes reading fail when no frame (message, ping or pong) comes from the peer for d,
+	// it overrides the read deadline. Zero disables it. It must be set before reading.
+	SetIdleTimeout(d time.Duration)
+	// SetWriteTimeout limits writing of every message, ping and pong to d, zero disables it.
+	// It must be set before writing.
+	SetWriteTimeout(d time.Duration)
+	SetReadDeadline(t time.Time) error
+	Close() error
+}
+
+// streamConn is msgConn over a stream (TCP or TLS), messages are frames of untyped framing of package frame,
+// so the stream is that of frame.Conn. Messages are never empty: an empty frame of the client is a ping,
+// the gateway answers it with an empty frame (pong). The pong carries no data, the pong handler is given
+// the data of the last ping. The gateway cannot ping, so it relies on the pings of the client.
+type streamConn struct {
+	net.Conn
+	r            *frame.Reader
+	w            *frame.Writer
+	client       bool
+	idle         time.Duration
+	writeTimeout time.Duration
+
+	mu   sync.Mutex
+	ping []byte // Data of the last ping.
+	pong func(data []byte)
+}
+
+func newStreamConn(conn net.Conn, client bool) *streamConn {
+	return &streamConn{Conn: conn, r: frame.NewReader(conn, false), w: frame.NewWriter(conn, false), client: client}
+}
+
+func (c *streamConn) ReadMessage(buf []byte) (int, error) {
+	for {
+		if c.idle > 0 {
+			_ = c.SetReadDeadline(time.Now().Add(c.idle))
+		}
+		_, n, err := c.r.ReadFrame(buf)
+		switch {
+		case errors.Is(err, frame.ErrTooLarge):
+			return 0, errMessageTooLarge
+		case err != nil:
+			return 0, err
+		case n > 0:
+			return n, nil
+		case !c.client:
+			if err = c.writeFrame(nil); err != nil {
+				return 0, fmt.Errorf("send pong: %w", err)
+			}
+		default:
+			c.mu.Lock()
+			h, data := c.pong, c.ping
+			c.mu.Unlock()
+			if h != nil {
+				h(data)
+			}
+		}
+	}
+}
+
+func (c *streamConn) WriteMessage(p []byte) error {
+	if len(p) == 0 {
+		return errors.New("empty message")
+	}
+
+	return c.writeFrame(p)
+}
+
+// WritePing sends an empty frame, nothing is sent by the gateway: its empty frames are pongs.
+func (c *streamConn) WritePing(data []byte) error {
+	if !c.client {
+		return nil
+	}
+	c.mu.Lock()
+	c.ping = append([]byte(nil), data...) // The slice passed to the handler is not modified.
+	c.mu.Unlock()
+
+	return c.writeFrame(nil)
+}
+
+func (c *streamConn) SetPongHandler(h func(data []byte)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pong = h
+}
+
+func (c *streamConn) SetIdleTimeout(d time.Duration) {
+	c.idle = d
+}
+
+func (c *streamConn) SetWriteTimeout(d time.Duration) {
+	c.writeTimeout = d
+}
+
+// writeFrame writes p as a frame with the write deadline of the timeout from now. Concurrent writers move
+// the deadline of the connection forward only, so no frame is cut before its timeout.
+func (c *streamConn) writeFrame(p []byte) error {
+	if c.writeTimeout > 0 {
+		_ = c.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+
+	return c.w.WriteFrame(frame.TypePacket, p)
+}
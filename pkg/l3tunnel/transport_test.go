@@ -0,0 +1,84 @@
+package l3tunnel
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamConn(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+	c, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	s, err := ln.Accept()
+	require.NoError(t, err)
+	client, server := newStreamConn(c, true), newStreamConn(s, false)
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+
+	// The gateway answers an empty frame with an empty frame, the client takes it for the pong of its last ping.
+	received := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 16)
+		n, _ := server.ReadMessage(buf)
+		received <- string(buf[:n])
+	}()
+	pongs := make(chan string, 1)
+	client.SetPongHandler(func(data []byte) { pongs <- string(data) })
+	require.NoError(t, client.WritePing([]byte("ping")))
+	require.NoError(t, client.WriteMessage([]byte("packet")))
+	require.Equal(t, "packet", receive(t, received))
+	require.NoError(t, server.WriteMessage([]byte("reply")))
+	buf := make([]byte, 4)
+	_, err = client.ReadMessage(buf)
+	require.ErrorIs(t, err, errMessageTooLarge)
+	require.Equal(t, "ping", receive(t, pongs))
+	require.Error(t, client.WriteMessage(nil), "empty messages are pings")
+
+	buf = make([]byte, 2048)
+	packet := bytes.Repeat([]byte{1}, 1400)
+	for _, pair := range [][2]*streamConn{{client, server}, {server, client}} {
+		w, r := pair[0], pair[1]
+		w.SetWriteTimeout(time.Minute)
+		r.SetIdleTimeout(time.Minute)
+		allocs := testing.AllocsPerRun(100, func() {
+			_ = w.WriteMessage(packet)
+			_, _ = r.ReadMessage(buf)
+		})
+		require.Zero(t, allocs, "client %v", w.client)
+	}
+}
+
+func TestMsgConn_Timeouts(t *testing.T) {
+	for name, newConn := range map[string]func(net.Conn) msgConn{
+		"ws":     func(c net.Conn) msgConn { return newWSConn(c, nil, false) },
+		"stream": func(c net.Conn) msgConn { return newStreamConn(c, false) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			// Nothing reads or writes the other end of the pipe: the peer is dead.
+			c, peer := net.Pipe()
+			t.Cleanup(func() {
+				_ = c.Close()
+				_ = peer.Close()
+			})
+			conn := newConn(c)
+			conn.SetWriteTimeout(10 * time.Millisecond)
+			conn.SetIdleTimeout(10 * time.Millisecond)
+
+			var netErr net.Error
+			err := conn.WriteMessage([]byte("packet"))
+			require.ErrorAs(t, err, &netErr)
+			require.True(t, netErr.Timeout())
+			_, err = conn.ReadMessage(make([]byte, 16))
+			require.ErrorAs(t, err, &netErr)
+			require.True(t, netErr.Timeout())
+		})
+	}
+}
@@ -0,0 +1,326 @@
+// Package vless implements VLESS request and response headers (protocol version 0) as XRay encodes them.
+//
+// Request header:
+//
+//	version (1) | UUID (16) | addons length (1) | addons (protobuf) | command (1) | port (2) | address type (1) | address
+//
+// Port and address are omitted for the mux command. Response header:
+//
+//	version (1) | addons length (1) | addons (protobuf)
+package vless
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// Version is the supported protocol version.
+const Version = 0
+
+// maxAddonsLen is the limit of encoded addons, their length is sent in a byte.
+const maxAddonsLen = 255
+
+// ErrVersion is returned by decoders when the header version is not supported.
+var ErrVersion = errors.New("vless: unsupported version")
+
+// Command is the request command.
+type Command byte
+
+const (
+	// CommandTCP requests a stream connection to the destination.
+	CommandTCP Command = 1
+	// CommandUDP requests a packet connection to the destination.
+	CommandUDP Command = 2
+	// CommandMux requests a multiplexed connection, it has no destination.
+	CommandMux Command = 3
+)
+
+func (c Command) String() string {
+	switch c {
+	case CommandTCP:
+		return "tcp"
+	case CommandUDP:
+		return "udp"
+	case CommandMux:
+		return "mux"
+	}
+
+	return fmt.Sprintf("command(%d)", byte(c))
+}
+
+// Address types of the request destination.
+const (
+	addrIPv4   = 1
+	addrDomain = 2
+	addrIPv6   = 3
+)
+
+// UUID is the user ID, the request is authenticated by it.
+type UUID [16]byte
+
+// ParseUUID parses UUID in the canonical (8-4-4-4-12) or plain 32 hex digits form.
+// As in XRay, other strings of 1-30 bytes are mapped to UUIDv5 with zero namespace.
+func ParseUUID(s string) (UUID, error) {
+	var id UUID
+	if l := len(s); l < 32 || l > 36 {
+		if l == 0 || l > 30 {
+			return id, fmt.Errorf("vless: invalid UUID %q", s)
+		}
+		h := sha1.New()
+		h.Write(id[:])
+		h.Write([]byte(s))
+		copy(id[:], h.Sum(nil))
+		id[6] = id[6]&0x0f | 5<<4 // Version 5.
+		id[8] = id[8]&0x3f | 0x80 // RFC 4122 variant.
+
+		return id, nil
+	}
+
+	h := s
+	if len(s) == 36 && s[8] == '-' && s[13] == '-' && s[18] == '-' && s[23] == '-' {
+		h = s[:8] + s[9:13] + s[14:18] + s[19:23] + s[24:]
+	}
+	if len(h) != 32 {
+		return id, fmt.Errorf("vless: invalid UUID %q", s)
+	}
+	if _, err := hex.Decode(id[:], []byte(h)); err != nil {
+		return id, fmt.Errorf("vless: invalid UUID %q", s)
+	}
+
+	return id, nil
+}
+
+func (id UUID) String() string {
+	h := hex.EncodeToString(id[:])
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// Addons are optional header extensions (protobuf message xray.proxy.vless.encoding.Addons).
+type Addons struct {
+	Flow string // Flow control, e.g. xtls-rprx-vision.
+	Seed []byte
+}
+
+// Request is VLESS request header.
+type Request struct {
+	UUID    UUID
+	Addons  Addons
+	Command Command
+	// Address is the destination IP or domain, Address and Port are not used by CommandMux.
+	Address string
+	Port    uint16
+}
+
+// AppendBinary appends encoded request header to b.
+func (r *Request) AppendBinary(b []byte) ([]byte, error) {
+	b = append(b, Version)
+	b = append(b, r.UUID[:]...)
+	b, err := appendAddons(b, &r.Addons)
+	if err != nil {
+		return nil, err
+	}
+	b = append(b, byte(r.Command))
+
+	switch r.Command {
+	case CommandMux:
+		return b, nil
+	case CommandTCP, CommandUDP:
+	default:
+		return nil, fmt.Errorf("vless: unknown command %d", r.Command)
+	}
+
+	b = binary.BigEndian.AppendUint16(b, r.Port)
+	if ip := net.ParseIP(r.Address); ip != nil {
+		if v4 := ip.To4(); v4 != nil {
+			return append(append(b, addrIPv4), v4...), nil
+		}
+		return append(append(b, addrIPv6), ip...), nil
+	}
+	if r.Address == "" || len(r.Address) > 255 {
+		return nil, fmt.Errorf("vless: invalid domain %q", r.Address)
+	}
+
+	return append(append(b, addrDomain, byte(len(r.Address))), r.Address...), nil
+}
+
+// MarshalBinary encodes request header.
+func (r *Request) MarshalBinary() ([]byte, error) {
+	return r.AppendBinary(nil)
+}
+
+// ReadRequest reads request header from r, data of the request follows it.
+func ReadRequest(r io.Reader) (*Request, error) {
+	var head [1 + 16 + 1]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, fmt.Errorf("vless: read request: %w", err)
+	}
+	if head[0] != Version {
+		return nil, fmt.Errorf("%w %d", ErrVersion, head[0])
+	}
+	req := &Request{}
+	copy(req.UUID[:], head[1:17])
+
+	// Addons are followed by the command.
+	rest := make([]byte, int(head[17])+1)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, fmt.Errorf("vless: read request: %w", err)
+	}
+	if err := req.Addons.unmarshal(rest[:len(rest)-1]); err != nil {
+		return nil, err
+	}
+	req.Command = Command(rest[len(rest)-1])
+
+	switch req.Command {
+	case CommandMux:
+		return req, nil
+	case CommandTCP, CommandUDP:
+	default:
+		return nil, fmt.Errorf("vless: unknown command %d", req.Command)
+	}
+
+	var dst [3]byte
+	if _, err := io.ReadFull(r, dst[:]); err != nil {
+		return nil, fmt.Errorf("vless: read destination: %w", err)
+	}
+	req.Port = binary.BigEndian.Uint16(dst[:2])
+	var addr []byte
+	switch dst[2] {
+	case addrIPv4:
+		addr = make([]byte, net.IPv4len)
+	case addrIPv6:
+		addr = make([]byte, net.IPv6len)
+	case addrDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(r, l[:]); err != nil {
+			return nil, fmt.Errorf("vless: read destination: %w", err)
+		}
+		if l[0] == 0 {
+			return nil, fmt.Errorf("vless: empty domain")
+		}
+		addr = make([]byte, l[0])
+	default:
+		return nil, fmt.Errorf("vless: unknown address type %d", dst[2])
+	}
+	if _, err := io.ReadFull(r, addr); err != nil {
+		return nil, fmt.Errorf("vless: read destination: %w", err)
+	}
+	if dst[2] == addrDomain {
+		req.Address = string(addr)
+	} else {
+		req.Address = net.IP(addr).String()
+	}
+
+	return req, nil
+}
+
+// Response is VLESS response header, the server sends it before the first data.
+type Response struct {
+	Addons Addons
+}
+
+// AppendBinary appends encoded response header to b.
+func (r *Response) AppendBinary(b []byte) ([]byte, error) {
+	return appendAddons(append(b, Version), &r.Addons)
+}
+
+// MarshalBinary encodes response header.
+func (r *Response) MarshalBinary() ([]byte, error) {
+	return r.AppendBinary(nil)
+}
+
+// ReadResponse reads response header from r, data of the response follows it.
+func ReadResponse(r io.Reader) (*Response, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, fmt.Errorf("vless: read response: %w", err)
+	}
+	if head[0] != Version {
+		return nil, fmt.Errorf("%w %d", ErrVersion, head[0])
+	}
+	resp := &Response{}
+	if head[1] == 0 {
+		return resp, nil
+	}
+	addons := make([]byte, head[1])
+	if _, err := io.ReadFull(r, addons); err != nil {
+		return nil, fmt.Errorf("vless: read response: %w", err)
+	}
+
+	return resp, resp.Addons.unmarshal(addons)
+}
+
+// appendAddons appends addons length and protobuf encoded addons, empty fields are omitted as by protobuf.
+func appendAddons(b []byte, a *Addons) ([]byte, error) {
+	lenAt := len(b)
+	b = append(b, 0)
+	if a.Flow != "" {
+		b = binary.AppendUvarint(append(b, 1<<3|2), uint64(len(a.Flow)))
+		b = append(b, a.Flow...)
+	}
+	if len(a.Seed) > 0 {
+		b = binary.AppendUvarint(append(b, 2<<3|2), uint64(len(a.Seed)))
+		b = append(b, a.Seed...)
+	}
+	n := len(b) - lenAt - 1
+	if n > maxAddonsLen {
+		return nil, fmt.Errorf("vless: addons are %d bytes, at most %d are allowed", n, maxAddonsLen)
+	}
+	b[lenAt] = byte(n)
+
+	return b, nil
+}
+
+// unmarshal decodes protobuf encoded addons, unknown fields are skipped.
+func (a *Addons) unmarshal(b []byte) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return fmt.Errorf("vless: invalid addons")
+		}
+		b = b[n:]
+
+		var value []byte
+		switch key & 7 {
+		case 0: // Varint.
+			if _, n = binary.Uvarint(b); n <= 0 {
+				return fmt.Errorf("vless: invalid addons")
+			}
+			b = b[n:]
+			continue
+		case 1: // Fixed 64 bits.
+			if len(b) < 8 {
+				return fmt.Errorf("vless: invalid addons")
+			}
+			b = b[8:]
+			continue
+		case 5: // Fixed 32 bits.
+			if len(b) < 4 {
+				return fmt.Errorf("vless: invalid addons")
+			}
+			b = b[4:]
+			continue
+		case 2: // Length delimited.
+			l, n := binary.Uvarint(b)
+			if n <= 0 || l > uint64(len(b)-n) {
+				return fmt.Errorf("vless: invalid addons")
+			}
+			value, b = b[n:n+int(l)], b[n+int(l):]
+		default:
+			return fmt.Errorf("vless: invalid addons wire type %d", key&7)
+		}
+
+		switch key >> 3 {
+		case 1:
+			a.Flow = string(value)
+		case 2:
+			a.Seed = append([]byte(nil), value...)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,290 @@
+package vless
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	xnet "github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/protocol"
+	xuuid "github.com/xtls/xray-core/common/uuid"
+	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/infra/conf"
+	xvless "github.com/xtls/xray-core/proxy/vless"
+	"github.com/xtls/xray-core/proxy/vless/encoding"
+
+	// XRay features of the test server.
+	_ "github.com/xtls/xray-core/app/dispatcher"
+	_ "github.com/xtls/xray-core/app/proxyman/inbound"
+	_ "github.com/xtls/xray-core/app/proxyman/outbound"
+	_ "github.com/xtls/xray-core/proxy/freedom"
+	_ "github.com/xtls/xray-core/proxy/vless/inbound"
+	_ "github.com/xtls/xray-core/transport/internet/tcp"
+)
+
+const testUUID = "27848739-7e62-4138-9fd3-098a63964b6b"
+
+func TestRequest_Vectors(t *testing.T) {
+	id, err := ParseUUID(testUUID)
+	require.NoError(t, err)
+	uid := "278487397e6241389fd3098a63964b6b"
+
+	for name, tc := range map[string]struct {
+		req Request
+		hex string
+	}{
+		"tcp ipv4": {
+			Request{UUID: id, Command: CommandTCP, Address: "127.0.0.1", Port: 443},
+			"00" + uid + "00" + "01" + "01bb" + "01" + "7f000001",
+		},
+		"tcp domain with flow": {
+			Request{UUID: id, Addons: Addons{Flow: "xtls-rprx-vision"}, Command: CommandTCP, Address: "example.com", Port: 80},
+			"00" + uid + "12" + "0a10" + hex.EncodeToString([]byte("xtls-rprx-vision")) + "01" + "0050" + "02" + "0b" + hex.EncodeToString([]byte("example.com")),
+		},
+		"udp ipv6 with seed": {
+			Request{UUID: id, Addons: Addons{Seed: []byte{1, 2, 3}}, Command: CommandUDP, Address: "2001:db8::1", Port: 53},
+			"00" + uid + "05" + "1203010203" + "02" + "0035" + "03" + "20010db8000000000000000000000001",
+		},
+		"mux": {
+			Request{UUID: id, Command: CommandMux},
+			"00" + uid + "00" + "03",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			vector, err := hex.DecodeString(tc.hex)
+			require.NoError(t, err)
+
+			b, err := tc.req.MarshalBinary()
+			require.NoError(t, err)
+			require.Equal(t, vector, b)
+
+			// Data following the header is left in the reader.
+			r := bytes.NewReader(append(vector, "data"...))
+			req, err := ReadRequest(r)
+			require.NoError(t, err)
+			require.Equal(t, &tc.req, req)
+			rest, _ := io.ReadAll(r)
+			require.Equal(t, "data", string(rest))
+
+			// XRay encodes the same bytes (it sends addons with Vision flow only) and decodes ours.
+			xreq, xaddons := toXrayRequest(t, &tc.req)
+			if len(tc.req.Addons.Seed) == 0 {
+				var xb bytes.Buffer
+				require.NoError(t, encoding.EncodeRequestHeader(&xb, xreq, xaddons))
+				require.Equal(t, vector, xb.Bytes())
+			}
+
+			validator := &xvless.MemoryValidator{}
+			require.NoError(t, validator.Add(xreq.User))
+			decoded, addons, _, err := encoding.DecodeRequestHeader(false, nil, bytes.NewReader(vector), validator)
+			require.NoError(t, err)
+			require.Equal(t, xreq.Command, decoded.Command)
+			require.Equal(t, tc.req.Addons.Flow, addons.Flow)
+			require.Equal(t, tc.req.Addons.Seed, addons.Seed)
+			if tc.req.Command != CommandMux {
+				require.Equal(t, xreq.Address, decoded.Address)
+				require.Equal(t, tc.req.Port, uint16(decoded.Port))
+			}
+		})
+	}
+}
+
+func TestResponse(t *testing.T) {
+	b, err := (&Response{}).MarshalBinary()
+	require.NoError(t, err)
+	require.Equal(t, []byte{0, 0}, b)
+
+	resp := &Response{Addons: Addons{Flow: "xtls-rprx-vision"}}
+	b, err = resp.MarshalBinary()
+	require.NoError(t, err)
+
+	// XRay decodes our response and we decode XRay one.
+	xreq, _ := toXrayRequest(t, &Request{Command: CommandTCP, Address: "1.1.1.1"})
+	addons, err := encoding.DecodeResponseHeader(bytes.NewReader(b), xreq)
+	require.NoError(t, err)
+	require.Equal(t, resp.Addons.Flow, addons.Flow)
+
+	var xb bytes.Buffer
+	require.NoError(t, encoding.EncodeResponseHeader(&xb, xreq, &encoding.Addons{Flow: "xtls-rprx-vision"}))
+	require.Equal(t, b, xb.Bytes())
+	got, err := ReadResponse(&xb)
+	require.NoError(t, err)
+	require.Equal(t, resp, got)
+
+	_, err = ReadResponse(bytes.NewReader([]byte{1, 0}))
+	require.ErrorIs(t, err, ErrVersion)
+	_, err = ReadResponse(bytes.NewReader([]byte{0, 5, 0x0a}))
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestReadRequest_Errors(t *testing.T) {
+	id, err := ParseUUID(testUUID)
+	require.NoError(t, err)
+	valid, err := (&Request{UUID: id, Command: CommandTCP, Address: "example.com", Port: 80}).MarshalBinary()
+	require.NoError(t, err)
+
+	for n := range valid {
+		_, err = ReadRequest(bytes.NewReader(valid[:n]))
+		require.Error(t, err, "truncated to %d bytes", n)
+	}
+
+	for name, tc := range map[string]struct {
+		patch func(b []byte)
+		err   string
+	}{
+		"version":      {func(b []byte) { b[0] = 1 }, "unsupported version 1"},
+		"command":      {func(b []byte) { b[18] = 9 }, "unknown command 9"},
+		"address type": {func(b []byte) { b[21] = 4 }, "unknown address type 4"},
+		"empty domain": {func(b []byte) { b[22] = 0 }, "empty domain"},
+		"addons":       {func(b []byte) { b[17] = 1 }, "invalid addons"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			b := bytes.Clone(valid)
+			tc.patch(b)
+			_, err := ReadRequest(bytes.NewReader(b))
+			require.ErrorContains(t, err, tc.err)
+		})
+	}
+
+	_, err = (&Request{Command: 7}).MarshalBinary()
+	require.ErrorContains(t, err, "unknown command 7")
+	_, err = (&Request{Command: CommandTCP}).MarshalBinary()
+	require.ErrorContains(t, err, "invalid domain")
+	_, err = (&Request{Command: CommandMux, Addons: Addons{Seed: make([]byte, 300)}}).MarshalBinary()
+	require.ErrorContains(t, err, "at most 255 are allowed")
+}
+
+func TestParseUUID(t *testing.T) {
+	for _, s := range []string{testUUID, strings.ReplaceAll(testUUID, "-", ""), "my-password"} {
+		id, err := ParseUUID(s)
+		require.NoError(t, err)
+		xid, err := xuuid.ParseString(s)
+		require.NoError(t, err)
+		require.Equal(t, xid.Bytes(), id[:], s)
+	}
+
+	id, _ := ParseUUID(testUUID)
+	require.Equal(t, testUUID, id.String())
+
+	for _, s := range []string{"", strings.Repeat("a", 31), testUUID[:35] + "x", strings.ReplaceAll(testUUID, "-", "+")} {
+		_, err := ParseUUID(s)
+		require.ErrorContains(t, err, "invalid UUID", s)
+	}
+}
+
+func TestXrayInbound(t *testing.T) {
+	echo := startTCPEcho(t)
+	port := startTestXrayInbound(t)
+	id, err := ParseUUID(testUUID)
+	require.NoError(t, err)
+	host, echoPort, _ := net.SplitHostPort(echo)
+	var p int
+	_, _ = fmt.Sscan(echoPort, &p)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	req, err := (&Request{UUID: id, Command: CommandTCP, Address: host, Port: uint16(p)}).MarshalBinary()
+	require.NoError(t, err)
+	_, err = conn.Write(append(req, "hello vless"...))
+	require.NoError(t, err)
+
+	resp, err := ReadResponse(conn)
+	require.NoError(t, err)
+	require.Equal(t, &Response{}, resp)
+	reply := make([]byte, len("hello vless"))
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	require.Equal(t, "hello vless", string(reply))
+
+	// Unknown user is rejected.
+	other, err := ParseUUID("other-user")
+	require.NoError(t, err)
+	conn2, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	require.NoError(t, err)
+	defer conn2.Close()
+	require.NoError(t, conn2.SetDeadline(time.Now().Add(5*time.Second)))
+	req, err = (&Request{UUID: other, Command: CommandTCP, Address: host, Port: uint16(p)}).MarshalBinary()
+	require.NoError(t, err)
+	_, err = conn2.Write(append(req, "hello vless"...))
+	require.NoError(t, err)
+	_, err = ReadResponse(conn2)
+	require.Error(t, err)
+}
+
+func toXrayRequest(t *testing.T, r *Request) (*protocol.RequestHeader, *encoding.Addons) {
+	t.Helper()
+
+	id, err := xuuid.ParseBytes(r.UUID[:])
+	require.NoError(t, err)
+	req := &protocol.RequestHeader{
+		Version: Version,
+		User:    &protocol.MemoryUser{Account: &xvless.MemoryAccount{ID: protocol.NewID(id)}},
+		Command: protocol.RequestCommand(r.Command),
+	}
+	if r.Command != CommandMux {
+		req.Address = xnet.ParseAddress(r.Address)
+		req.Port = xnet.Port(r.Port)
+	}
+
+	return req, &encoding.Addons{Flow: r.Addons.Flow, Seed: r.Addons.Seed}
+}
+
+// startTestXrayInbound starts XRay with VLESS inbound on loopback, returned is its port.
+func startTestXrayInbound(t *testing.T) int {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := ln.Addr().(*net.TCPAddr).Port
+	require.NoError(t, ln.Close())
+
+	var jsonCfg conf.Config
+	require.NoError(t, json.Unmarshal([]byte(fmt.Sprintf(`{
+		"log": {"loglevel": "none"},
+		"inbounds": [{
+			"listen": "127.0.0.1", "port": %d, "protocol": "vless",
+			"settings": {"clients": [{"id": %q}], "decryption": "none"}
+		}],
+		"outbounds": [{"protocol": "freedom"}]
+	}`, port, testUUID)), &jsonCfg))
+	cfg, err := jsonCfg.Build()
+	require.NoError(t, err)
+	srv, err := core.New(cfg)
+	require.NoError(t, err)
+	require.NoError(t, srv.Start())
+	t.Cleanup(func() { _ = srv.Close() })
+
+	return port
+}
+
+func startTCPEcho(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
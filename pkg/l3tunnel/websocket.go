@@ -0,0 +1,367 @@
+package l3tunnel
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	mrand "math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket opcodes (RFC 6455, section 5.2).
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+const (
+	// maxControlPayload is the largest payload of a control frame.
+	maxControlPayload = 125
+	// maxFrameHeader is the largest frame header: 64-bit payload length and masking key.
+	maxFrameHeader = 14
+)
+
+// wsGUID is appended to Sec-WebSocket-Key for Sec-WebSocket-Accept (RFC 6455, section 1.3).
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var (
+	// errWebSocket is returned for frames violating RFC 6455, the connection is not usable after it.
+	errWebSocket = errors.New("websocket protocol error")
+	// errWebSocketClosed is returned when the peer closes the connection with a close frame.
+	errWebSocketClosed = errors.New("websocket closed by peer")
+)
+
+// wsConn is msgConn over WebSocket, messages are binary messages. The handshake is made by dialWS
+// on the client and by websocket.Upgrader on the gateway, frames are read and written here: messages
+// are read into the buffers of the caller, so nothing is allocated per message (gorilla/websocket allocates
+// a reader for every message). Extensions are not negotiated, so frames carry no RSV bits.
+type wsConn struct {
+	net.Conn
+	r      *bufio.Reader
+	client bool // Frames of the client are masked.
+	head   [8]byte
+	ctl    [maxControlPayload]byte // Payload of the control frame being read.
+	pong   func(data []byte)
+	idle   time.Duration
+
+	mu           sync.Mutex // Serializes writing of frames.
+	wbuf         []byte
+	writeTimeout time.Duration
+}
+
+// newWSConn wraps conn after the WebSocket handshake, r is the reader the handshake was read with
+// (it may hold the first frames), nil if nothing was read beyond it.
+func newWSConn(conn net.Conn, r *bufio.Reader, client bool) *wsConn {
+	if r == nil {
+		r = bufio.NewReaderSize(conn, connReadBuffer)
+	}
+
+	return &wsConn{Conn: conn, r: r, client: client}
+}
+
+// ReadMessage reads frames until the last frame of a data message. Pings are answered with pongs,
+// pongs are passed to the pong handler.
+func (c *wsConn) ReadMessage(buf []byte) (int, error) {
+	n, started, tooLarge := 0, false, false
+	for {
+		if c.idle > 0 {
+			_ = c.SetReadDeadline(time.Now().Add(c.idle))
+		}
+		fin, op, key, size, err := c.readHeader()
+		if err != nil {
+			return 0, err
+		}
+		if op >= opClose {
+			if err = c.readControl(op, key, size); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		switch {
+		case op == opContinuation && !started, op != opContinuation && started:
+			return 0, fmt.Errorf("%w: unexpected continuation of message", errWebSocket)
+		case op != opContinuation && op != opText && op != opBinary:
+			return 0, fmt.Errorf("%w: unknown opcode %d", errWebSocket, op)
+		}
+		started = true
+
+		if tooLarge || size > len(buf)-n {
+			tooLarge = true
+			if _, err = c.r.Discard(size); err != nil {
+				return 0, unexpectedEOF(err)
+			}
+		} else {
+			p := buf[n : n+size]
+			if _, err = io.ReadFull(c.r, p); err != nil {
+				return 0, unexpectedEOF(err)
+			}
+			if key != nil {
+				maskBytes(key, p)
+			}
+			n += size
+		}
+		if fin {
+			if tooLarge {
+				return 0, errMessageTooLarge
+			}
+			return n, nil
+		}
+	}
+}
+
+// readHeader reads the frame header, returned are the FIN bit, opcode, masking key (nil if not masked)
+// and payload length.
+func (c *wsConn) readHeader() (bool, byte, []byte, int, error) {
+	h := c.head[:2]
+	if _, err := io.ReadFull(c.r, h); err != nil {
+		return false, 0, nil, 0, err
+	}
+	fin, op, masked := h[0]&0x80 != 0, h[0]&0x0f, h[1]&0x80 != 0
+	if h[0]&0x70 != 0 {
+		return false, 0, nil, 0, fmt.Errorf("%w: reserved bits are set", errWebSocket)
+	}
+	size := uint64(h[1] & 0x7f)
+	switch size {
+	case 126:
+		if _, err := io.ReadFull(c.r, c.head[:2]); err != nil {
+			return false, 0, nil, 0, unexpectedEOF(err)
+		}
+		size = uint64(binary.BigEndian.Uint16(c.head[:2]))
+	case 127:
+		if _, err := io.ReadFull(c.r, c.head[:8]); err != nil {
+			return false, 0, nil, 0, unexpectedEOF(err)
+		}
+		size = binary.BigEndian.Uint64(c.head[:8])
+	}
+	if size > math.MaxInt32 {
+		return false, 0, nil, 0, fmt.Errorf("%w: frame of %d bytes", errWebSocket, size)
+	}
+	var key []byte
+	if masked {
+		key = c.head[4:8]
+		if _, err := io.ReadFull(c.r, key); err != nil {
+			return false, 0, nil, 0, unexpectedEOF(err)
+		}
+	}
+
+	return fin, op, key, int(size), nil
+}
+
+// readControl reads the payload of the control frame and handles it.
+func (c *wsConn) readControl(op byte, key []byte, size int) error {
+	if size > maxControlPayload {
+		return fmt.Errorf("%w: control frame of %d bytes", errWebSocket, size)
+	}
+	p := c.ctl[:size]
+	if _, err := io.ReadFull(c.r, p); err != nil {
+		return unexpectedEOF(err)
+	}
+	if key != nil {
+		maskBytes(key, p)
+	}
+	switch op {
+	case opPing:
+		if err := c.writeFrame(opPong, p); err != nil {
+			return fmt.Errorf("send pong: %w", err)
+		}
+	case opPong:
+		if c.pong != nil {
+			c.pong(p)
+		}
+	case opClose:
+		return errWebSocketClosed
+	default:
+		return fmt.Errorf("%w: unknown opcode %d", errWebSocket, op)
+	}
+
+	return nil
+}
+
+func (c *wsConn) WriteMessage(p []byte) error {
+	return c.writeFrame(opBinary, p)
+}
+
+func (c *wsConn) WritePing(data []byte) error {
+	return c.writeFrame(opPing, data)
+}
+
+// SetPongHandler sets the pong handler, it must be set before reading. The data passed to it is only valid
+// during the call.
+func (c *wsConn) SetPongHandler(h func(data []byte)) {
+	c.pong = h
+}
+
+func (c *wsConn) SetIdleTimeout(d time.Duration) {
+	c.idle = d
+}
+
+func (c *wsConn) SetWriteTimeout(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeTimeout = d
+}
+
+// writeFrame writes p as a single frame with a single Write, masked by the client. The write deadline is set
+// for the frame if the write timeout is set.
+func (c *wsConn) writeFrame(op byte, p []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b := append(c.wbuf[:0], 0x80|op)
+	var mask byte
+	if c.client {
+		mask = 0x80
+	}
+	switch {
+	case len(p) < 126:
+		b = append(b, mask|byte(len(p)))
+	case len(p) <= math.MaxUint16:
+		b = binary.BigEndian.AppendUint16(append(b, mask|126), uint16(len(p)))
+	default:
+		b = binary.BigEndian.AppendUint64(append(b, mask|127), uint64(len(p)))
+	}
+	if c.client {
+		// The key only keeps intermediaries from taking the payload for requests, as in gorilla/websocket
+		// it need not be unpredictable.
+		b = binary.BigEndian.AppendUint32(b, mrand.Uint32())
+		key := b[len(b)-4:]
+		b = append(b, p...)
+		maskBytes(key, b[len(b)-len(p):])
+	} else {
+		b = append(b, p...)
+	}
+	c.wbuf = b
+
+	if c.writeTimeout > 0 {
+		_ = c.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	_, err := c.Write(b)
+
+	return err
+}
+
+// maskBytes masks (or unmasks) the payload of a frame with the masking key.
+func maskBytes(key []byte, p []byte) {
+	for i := range p {
+		p[i] ^= key[i&3]
+	}
+}
+
+// unexpectedEOF converts io.EOF to io.ErrUnexpectedEOF, the connection ended inside a frame.
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// dialWS connects to the WebSocket endpoint u (ws:// or wss://) and makes the client handshake
+// with headers (Host is taken from them if set). TLS of wss:// is configured by tlsCfg.
+func dialWS(ctx context.Context, u string, headers http.Header, tlsCfg *tls.Config) (*wsConn, error) {
+	ctx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+	defer cancel()
+	target, err := url.Parse(u)
+	if err != nil {
+		return nil, err
+	}
+	addr := target.Host
+	if target.Port() == "" {
+		port := "80"
+		if target.Scheme == "wss" {
+			port = "443"
+		}
+		addr = net.JoinHostPort(target.Hostname(), port)
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	// The handshake is stopped when ctx is done.
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Unix(1, 0)) })
+	ws, err := handshakeWebSocket(ctx, conn, target, headers, tlsCfg)
+	if !stop() && err == nil {
+		err = ctx.Err() // The deadline is already set.
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return ws, nil
+}
+
+// handshakeWebSocket makes TLS handshake (for wss://) and WebSocket handshake over conn.
+func handshakeWebSocket(ctx context.Context, conn net.Conn, target *url.URL, headers http.Header,
+	tlsCfg *tls.Config,
+) (*wsConn, error) {
+	if target.Scheme == "wss" {
+		tc := tls.Client(conn, tlsCfg)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			return nil, fmt.Errorf("TLS handshake: %w", err)
+		}
+		conn = tc
+	}
+
+	nonce := make([]byte, 16)
+	_, _ = rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Scheme: "http", Host: target.Host, Path: target.Path, RawQuery: target.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     headers.Clone(),
+		Host:       target.Host,
+	}
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host
+		req.Header.Del("Host")
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err := req.Write(conn); err != nil {
+		return nil, fmt.Errorf("send handshake: %w", err)
+	}
+
+	r := bufio.NewReaderSize(conn, connReadBuffer)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return nil, fmt.Errorf("read handshake: %w", err)
+	}
+	_ = resp.Body.Close()
+	sum := sha1.Sum([]byte(key + wsGUID))
+	switch {
+	case resp.StatusCode != http.StatusSwitchingProtocols:
+		return nil, fmt.Errorf("bad handshake: %s", resp.Status)
+	case !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket"):
+		return nil, fmt.Errorf("bad handshake: upgrade to %q", resp.Header.Get("Upgrade"))
+	case resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(sum[:]):
+		return nil, errors.New("bad handshake: invalid Sec-WebSocket-Accept")
+	case resp.Header.Get("Sec-WebSocket-Extensions") != "":
+		return nil, errors.New("bad handshake: extensions were not asked for")
+	}
+
+	return newWSConn(conn, r, true), nil
+}
@@ -0,0 +1,120 @@
+package l3tunnel
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWSConn(t *testing.T) {
+	// gorilla/websocket is the peer: a small write buffer splits messages into frames.
+	accepted := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{WriteBufferSize: 16}).Upgrade(w, r, nil)
+		if err == nil {
+			accepted <- conn
+		}
+	}))
+	t.Cleanup(srv.Close)
+	client, err := dialWS(context.Background(), "ws"+strings.TrimPrefix(srv.URL, "http")+"/tun?token=1",
+		http.Header{"Host": {"gw.example.com"}}, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = client.Close() })
+	peer := receive(t, accepted)
+	require.NoError(t, peer.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+	large := bytes.Repeat([]byte("fragmented "), 100)
+	for _, msg := range [][]byte{[]byte("short"), {}, []byte("exactly 16 bytes"), []byte("larger than the buffer"), []byte("next"), large} {
+		require.NoError(t, peer.WriteMessage(websocket.BinaryMessage, msg))
+	}
+	buf := make([]byte, 16)
+	for _, want := range []string{"short", "", "exactly 16 bytes"} {
+		n, err := client.ReadMessage(buf)
+		require.NoError(t, err)
+		require.Equal(t, want, string(buf[:n]))
+	}
+	_, err = client.ReadMessage(buf)
+	require.ErrorIs(t, err, errMessageTooLarge)
+	n, err := client.ReadMessage(buf)
+	require.NoError(t, err, "the connection is usable after a large message")
+	require.Equal(t, "next", string(buf[:n]))
+	buf = make([]byte, 2048)
+	n, err = client.ReadMessage(buf)
+	require.NoError(t, err)
+	require.Equal(t, large, buf[:n])
+
+	// Masked messages and pings of the client, pings of the peer are answered while reading.
+	require.NoError(t, client.WriteMessage(large))
+	typ, msg, err := peer.ReadMessage()
+	require.NoError(t, err)
+	require.Equal(t, websocket.BinaryMessage, typ)
+	require.Equal(t, large, msg)
+	pongs := make(chan string, 2)
+	peer.SetPongHandler(func(data string) error {
+		pongs <- data
+		return nil
+	})
+	peer.SetPingHandler(func(data string) error {
+		if err := peer.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second)); err != nil {
+			return err
+		}
+		return peer.WriteMessage(websocket.BinaryMessage, []byte("after ping"))
+	})
+	go func() { _, _, _ = peer.ReadMessage() }()
+	client.SetPongHandler(func(data []byte) { pongs <- string(data) })
+	require.NoError(t, peer.WriteControl(websocket.PingMessage, []byte("peer"), time.Now().Add(time.Second)))
+	require.NoError(t, client.WritePing([]byte("client")))
+	n, err = client.ReadMessage(buf)
+	require.NoError(t, err)
+	require.Equal(t, "after ping", string(buf[:n]))
+	require.ElementsMatch(t, []string{"client", "peer"}, []string{receive(t, pongs), receive(t, pongs)})
+
+	require.NoError(t, peer.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second)))
+	_, err = client.ReadMessage(buf)
+	require.ErrorIs(t, err, errWebSocketClosed)
+}
+
+func TestWSConn_Handshake(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Upgrade", "websocket")
+		w.Header().Set("Connection", "Upgrade")
+		w.Header().Set("Sec-WebSocket-Accept", "invalid")
+		w.WriteHeader(http.StatusSwitchingProtocols)
+	}))
+	t.Cleanup(srv.Close)
+	_, err := dialWS(context.Background(), "ws"+strings.TrimPrefix(srv.URL, "http"), http.Header{}, nil)
+	require.ErrorContains(t, err, "invalid Sec-WebSocket-Accept")
+
+	srv = httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(srv.Close)
+	_, err = dialWS(context.Background(), "ws"+strings.TrimPrefix(srv.URL, "http"), http.Header{}, nil)
+	require.ErrorContains(t, err, "bad handshake: 404 Not Found")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = dialWS(ctx, "ws"+strings.TrimPrefix(srv.URL, "http"), http.Header{}, nil)
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestWSConn_Allocs(t *testing.T) {
+	client, server := newTestConnPair(t)
+	buf := make([]byte, 2048)
+	packet := bytes.Repeat([]byte{1}, 1400)
+	for _, pair := range [][2]*wsConn{{client, server}, {server, client}} {
+		w, r := pair[0], pair[1]
+		w.SetWriteTimeout(time.Minute)
+		r.SetIdleTimeout(time.Minute)
+		allocs := testing.AllocsPerRun(100, func() {
+			_ = w.WriteMessage(packet)
+			_, _ = r.ReadMessage(buf)
+		})
+		require.Zero(t, allocs, "client %v", w.client)
+	}
+}
@@ -0,0 +1,77 @@
+// Package sdnotify implements systemd service notification protocol (sd_notify)
+// used by Type=notify services to report readiness, status and watchdog keep-alive pings.
+//
+// See https://www.freedesktop.org/software/systemd/man/latest/sd_notify.html.
+package sdnotify
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Notification states.
+const (
+	// Ready tells the service manager that service startup is finished.
+	Ready = "READY=1"
+	// Stopping tells the service manager that the service is beginning its shutdown.
+	Stopping = "STOPPING=1"
+	// Watchdog is a keep-alive ping, must be sent regularly if WatchdogSec= is set for the service.
+	Watchdog = "WATCHDOG=1"
+)
+
+// Status returns state with free-form service status shown by "systemctl status".
+func Status(status string) string {
+	return "STATUS=" + strings.ReplaceAll(status, "\n", " ")
+}
+
+// Notify sends states to the service manager over the socket set in NOTIFY_SOCKET.
+// It returns false if the service is not run by systemd (NOTIFY_SOCKET is not set).
+func Notify(states ...string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:] // Abstract namespace socket.
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, fmt.Errorf("dial notify socket: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err = conn.Write([]byte(strings.Join(states, "\n"))); err != nil {
+		return false, fmt.Errorf("write notify socket: %w", err)
+	}
+
+	return true, nil
+}
+
+// WatchdogInterval returns watchdog timeout configured for the service (WatchdogSec=).
+// Zero is returned if the watchdog is disabled or is meant for another process.
+// Watchdog pings should be sent at least twice per interval.
+func WatchdogInterval() (time.Duration, error) {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return 0, nil
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, nil
+	}
+
+	n, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parse WATCHDOG_USEC: %w", err)
+	}
+	if n <= 0 {
+		return 0, errors.New("parse WATCHDOG_USEC: must be positive")
+	}
+
+	return time.Duration(n) * time.Microsecond, nil
+}
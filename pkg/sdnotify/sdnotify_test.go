@@ -0,0 +1,81 @@
+package sdnotify
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	sent, err := Notify(Ready)
+	require.NoError(t, err)
+	require.False(t, sent)
+
+	for name, socket := range map[string]string{
+		"path":     filepath.Join(t.TempDir(), "notify.sock"),
+		"abstract": "@goxray-sdnotify-test-" + strconv.Itoa(os.Getpid()),
+	} {
+		t.Run(name, func(t *testing.T) {
+			addr := socket
+			if addr[0] == '@' {
+				addr = "\x00" + addr[1:]
+			}
+			conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+			require.NoError(t, err)
+			defer conn.Close()
+			t.Setenv("NOTIFY_SOCKET", socket)
+
+			sent, err := Notify(Ready, Status("Connected\nto server"))
+			require.NoError(t, err)
+			require.True(t, sent)
+
+			buf := make([]byte, 1024)
+			require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+			n, err := conn.Read(buf)
+			require.NoError(t, err)
+			require.Equal(t, "READY=1\nSTATUS=Connected to server", string(buf[:n]))
+		})
+	}
+
+	t.Setenv("NOTIFY_SOCKET", filepath.Join(t.TempDir(), "missing.sock"))
+	_, err = Notify(Watchdog)
+	require.Error(t, err)
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	tests := []struct {
+		name string
+		usec string
+		pid  string
+		exp  time.Duration
+		err  bool
+	}{
+		{name: "disabled"},
+		{name: "enabled", usec: "30000000", exp: 30 * time.Second},
+		{name: "own pid", usec: "500", pid: strconv.Itoa(os.Getpid()), exp: 500 * time.Microsecond},
+		{name: "other pid", usec: "500", pid: "1"},
+		{name: "invalid", usec: "abc", err: true},
+		{name: "negative", usec: "-1", err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("WATCHDOG_USEC", test.usec)
+			t.Setenv("WATCHDOG_PID", test.pid)
+
+			interval, err := WatchdogInterval()
+			if test.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.exp, interval)
+		})
+	}
+}
@@ -0,0 +1,54 @@
+#!/bin/bash
+# End-to-end check of the L3 tunnel on one Linux host (run as root). The gateway and the client run in their own
+# network namespaces connected by a veth pair, the client fetches a page served on an "internet" address
+# (198.51.100.1, an address of the gateway namespace) through the tunnel.
+# The tunnel configuration (address, MTU and routes) is pushed to the client by the gateway.
+# NAT is set up if iptables is available, otherwise the gateway runs with it disabled.
+set -euo pipefail
+
+UUID=27848739-7e62-4138-9fd3-098a63964b6b
+GW=l3-gateway
+CL=l3-client
+WORK=$(mktemp -d)
+
+cleanup() {
+	jobs -p | xargs -r kill 2>/dev/null || true
+	wait 2>/dev/null || true
+	ip netns del "$GW" 2>/dev/null || true
+	ip netns del "$CL" 2>/dev/null || true
+	rm -rf "$WORK"
+}
+trap cleanup EXIT
+
+go build -o "$WORK/l3gateway" ./cmd/l3gateway
+go build -o "$WORK/l3tunnel" ./cmd/l3tunnel
+
+ip netns add "$GW"
+ip netns add "$CL"
+ip link add veth-gw netns "$GW" type veth peer name veth-cl netns "$CL"
+ip -n "$GW" addr add 192.0.2.1/24 dev veth-gw
+ip -n "$CL" addr add 192.0.2.2/24 dev veth-cl
+ip -n "$GW" addr add 198.51.100.1/32 dev lo
+for link in lo veth-gw; do ip -n "$GW" link set "$link" up; done
+for link in lo veth-cl; do ip -n "$CL" link set "$link" up; done
+
+DISABLE_NAT=true
+command -v iptables >/dev/null && DISABLE_NAT=false
+cat > "$WORK/gateway.json" <<EOF
+{"listen": "192.0.2.1:8080", "users": ["$UUID"], "wan_interface": "veth-gw", "mtu": 1400, "disable_nat": $DISABLE_NAT}
+EOF
+cat > "$WORK/client.json" <<EOF
+{"server": "192.0.2.1:8080", "uuid": "$UUID", "batch_window": "2ms", "path": "/tun?ed=2048", "device": {"wan_interface": "veth-cl"}}
+EOF
+echo "L3 tunnel works" > "$WORK/index.html"
+
+ip netns exec "$GW" python3 -m http.server --bind 198.51.100.1 --directory "$WORK" 80 >/dev/null 2>&1 &
+ip netns exec "$GW" "$WORK/l3gateway" -config "$WORK/gateway.json" &
+sleep 1
+ip netns exec "$CL" "$WORK/l3tunnel" -config "$WORK/client.json" &
+sleep 2
+
+ip -n "$CL" -o addr show dev tun-l3 | grep "inet 10.50.0.2/24" >/dev/null
+ip -n "$CL" -o link show dev tun-l3 | grep "mtu 1400" >/dev/null
+ip netns exec "$CL" curl -sf --max-time 5 http://198.51.100.1/index.html | grep "L3 tunnel works" >/dev/null
+echo "PASS: client reached 198.51.100.1 through the tunnel"